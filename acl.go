@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// addrFilter decides which remote addresses may connect, by CIDR. Addresses
+// in the denylist never may, and if there's an allowlist, only addresses in
+// it may. Addresses which aren't IPs, e.g. of unix sockets, always may, since
+// file permissions are the way to restrict those.
+type addrFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// parseAddrFilter parses comma-separated lists of CIDRs, or plain IPs. If
+// both are empty, it returns nil, which allows everything.
+func parseAddrFilter(allow, deny string) (*addrFilter, error) {
+	if allow == "" && deny == "" {
+		return nil, nil
+	}
+	var f addrFilter
+	var err error
+	if f.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", field)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// allowed returns true if the address, as host:port, may connect.
+func (f *addrFilter) allowed(addr string) bool {
+	if f == nil {
+		return true
+	}
+	ip := net.ParseIP(clientHost(addr))
+	if ip == nil {
+		return true
+	}
+	for _, n := range f.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// listener returns a listener which closes connections from addresses that
+// aren't allowed, as soon as they're accepted, and calls denied with each of
+// them. If f is nil, it returns ln itself.
+func (f *addrFilter) listener(ln net.Listener, denied func(addr string)) net.Listener {
+	if f == nil {
+		return ln
+	}
+	return &filteredListener{Listener: ln, filter: f, denied: denied}
+}
+
+type filteredListener struct {
+	net.Listener
+	filter *addrFilter
+	denied func(addr string)
+}
+
+func (l *filteredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if addr := conn.RemoteAddr().String(); !l.filter.allowed(addr) {
+			conn.Close()
+			l.denied(addr)
+			continue
+		}
+		return conn, nil
+	}
+}
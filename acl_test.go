@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAddrFilter(t *testing.T) {
+	f, err := parseAddrFilter("10.0.0.0/8, 192.0.2.7, 2001:db8::/32", "10.1.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{
+		"10.0.0.1:1234":        true,
+		"10.1.2.3:1234":        false,
+		"192.0.2.7:1234":       true,
+		"192.0.2.8:1234":       false,
+		"[2001:db8::1]:1234":   true,
+		"[2001:db9::1]:1234":   false,
+		"[::ffff:10.0.0.1]:53": true,
+		"@":                    true, // unix socket
+		"":                     true,
+	} {
+		if have := f.allowed(addr); want != have {
+			t.Errorf("%q: want %v, have %v", addr, want, have)
+		}
+	}
+
+	deny, err := parseAddrFilter("", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deny.allowed("127.0.0.1:1234") || !deny.allowed("127.0.0.2:1234") {
+		t.Errorf("denylist only: want 127.0.0.1 denied, and 127.0.0.2 allowed")
+	}
+
+	var none *addrFilter
+	if !none.allowed("10.1.2.3:1234") {
+		t.Errorf("nil filter: want allowed")
+	}
+	if f, err := parseAddrFilter("", ""); f != nil || err != nil {
+		t.Errorf("empty lists: want nil filter and no error, have %v, %v", f, err)
+	}
+	for _, allow := range []string{"10.0.0.0/33", "10.0.0", "example.com"} {
+		if _, err := parseAddrFilter(allow, ""); err == nil {
+			t.Errorf("%q: want error, have none", allow)
+		}
+	}
+}
+
+func TestFilteredListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := parseAddrFilter("", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	denied := make(chan string, 1)
+	ln = f.listener(ln, func(addr string) { denied <- addr })
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case addr := <-denied:
+		if want, have := conn.LocalAddr().String(), addr; want != have {
+			t.Errorf("denied: want %s, have %s", want, have)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the connection to be denied")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("want EOF, have %v", err)
+	}
+}
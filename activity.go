@@ -0,0 +1,362 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// activity records connected clients, recently received lines, and recently
+// rejected lines, so operators can see what's going on without grepping logs
+// or reaching for tcpdump.
+//
+// Counting lines is on the hot path, so a connection counts its own, and
+// they're added to its host's totals when it disconnects. Packets have no
+// connection, so they're counted in their host's totals, which only takes a
+// read lock, once the host has been seen.
+type activity struct {
+	other clientTotals // first, for alignment; hosts which didn't fit, or went idle
+
+	now func() time.Time
+
+	mtx     sync.Mutex
+	clients map[*clientInfo]struct{}
+	lines   lineRing // all lines, if enabled
+	errors  lineRing // rejected lines only
+
+	tmtx   sync.RWMutex             // after mtx, if both are held
+	totals map[string]*clientTotals // by client host, up to maxClientHosts
+}
+
+// Every client host has series of its own, so UDP senders and pods coming
+// and going would grow the output forever. Only so many hosts are counted
+// separately, and a host which sends nothing for long enough is forgotten;
+// the rest are counted as otherClient.
+const (
+	maxClientHosts = 1000
+	clientHostTTL  = time.Hour
+	otherClient    = "other"
+)
+
+// clientInfo describes a connected client.
+type clientInfo struct {
+	counts clientTotals // first, for alignment; of this connection only
+	host   *clientTotals
+
+	Addr      string    `json:"addr"`
+	Connected time.Time `json:"connected"`
+	Accepted  uint64    `json:"accepted"`
+	Rejected  uint64    `json:"rejected"`
+}
+
+// clientTotals are the totals for a client host, until it's swept into the
+// other totals, or for a connection. The counts are atomic.
+type clientTotals struct {
+	acceptedLines uint64
+	acceptedBytes uint64
+	rejectedLines uint64
+	rejectedBytes uint64
+
+	swept uint64    // lines, as of the last sweep
+	idle  time.Time // since when the lines haven't changed
+}
+
+func (t *clientTotals) accept(n int) {
+	atomic.AddUint64(&t.acceptedLines, 1)
+	atomic.AddUint64(&t.acceptedBytes, uint64(n))
+}
+
+func (t *clientTotals) reject(n int) {
+	atomic.AddUint64(&t.rejectedLines, 1)
+	atomic.AddUint64(&t.rejectedBytes, uint64(n))
+}
+
+// load returns a copy of the counts.
+func (t *clientTotals) load() clientTotals {
+	return clientTotals{
+		acceptedLines: atomic.LoadUint64(&t.acceptedLines),
+		acceptedBytes: atomic.LoadUint64(&t.acceptedBytes),
+		rejectedLines: atomic.LoadUint64(&t.rejectedLines),
+		rejectedBytes: atomic.LoadUint64(&t.rejectedBytes),
+	}
+}
+
+// add adds the counts of u to t.
+func (t *clientTotals) add(u clientTotals) {
+	atomic.AddUint64(&t.acceptedLines, u.acceptedLines)
+	atomic.AddUint64(&t.acceptedBytes, u.acceptedBytes)
+	atomic.AddUint64(&t.rejectedLines, u.rejectedLines)
+	atomic.AddUint64(&t.rejectedBytes, u.rejectedBytes)
+}
+
+// lineRecord is a received line, and the reason it was rejected, if any.
+type lineRecord struct {
+	Time     time.Time `json:"time"`
+	Addr     string    `json:"addr"`
+	Line     string    `json:"line"`
+	Accepted bool      `json:"accepted"`
+	Err      string    `json:"err,omitempty"`
+}
+
+// maxRecentErrors is the number of rejected lines kept by activity.
+const maxRecentErrors = 100
+
+// newActivity returns an activity which keeps the most recent n lines,
+// in addition to the most recent rejected lines. If n is zero, lines are
+// only kept when they're rejected.
+func newActivity(n int) *activity {
+	return &activity{
+		now:     time.Now,
+		clients: map[*clientInfo]struct{}{},
+		totals:  map[string]*clientTotals{},
+		lines:   newLineRing(n),
+		errors:  newLineRing(maxRecentErrors),
+	}
+}
+
+// connect records a connected client, and returns it, to count its lines.
+func (a *activity) connect(addr string) *clientInfo {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.tmtx.Lock()
+	defer a.tmtx.Unlock()
+	c := &clientInfo{host: a.clientTotals(addr), Addr: addr, Connected: a.now()}
+	a.clients[c] = struct{}{}
+	return c
+}
+
+// disconnect forgets the client, and adds its counts to its host's.
+func (a *activity) disconnect(c *clientInfo) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	delete(a.clients, c)
+	a.tmtx.RLock()
+	defer a.tmtx.RUnlock()
+	c.host.add(c.counts.load())
+}
+
+// accept records an accepted line from the client at addr, which is
+// connected, or nil, for packets.
+func (a *activity) accept(addr string, c *clientInfo, line []byte) {
+	if c != nil {
+		c.counts.accept(len(line))
+	} else {
+		a.count(addr, true, len(line))
+	}
+	if a.lines.enabled() {
+		a.mtx.Lock()
+		defer a.mtx.Unlock()
+		a.lines.add(lineRecord{Time: a.now(), Addr: addr, Line: string(line), Accepted: true})
+	}
+}
+
+// reject records a rejected line from the client at addr, which is
+// connected, or nil, for packets.
+func (a *activity) reject(addr string, c *clientInfo, line []byte, err error) {
+	if c != nil {
+		c.counts.reject(len(line))
+	} else {
+		a.count(addr, false, len(line))
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	r := lineRecord{Time: a.now(), Addr: addr, Line: string(line), Err: err.Error()}
+	a.errors.add(r)
+	if a.lines.enabled() {
+		a.lines.add(r)
+	}
+}
+
+// count counts a line of n bytes in the totals of the host of addr. The
+// read lock is held while counting, so a sweep can't forget the totals in
+// between.
+func (a *activity) count(addr string, accepted bool, n int) {
+	a.tmtx.RLock()
+	t, ok := a.totals[clientHost(addr)]
+	if !ok {
+		a.tmtx.RUnlock()
+		a.tmtx.Lock()
+		defer a.tmtx.Unlock()
+		t = a.clientTotals(addr)
+	} else {
+		defer a.tmtx.RUnlock()
+	}
+	if accepted {
+		t.accept(n)
+	} else {
+		t.reject(n)
+	}
+}
+
+// clientTotals returns the totals for the host of addr, creating them if
+// necessary, or the other totals, if there are too many hosts already. Ports
+// are ignored, so that clients which reconnect, or which send from ephemeral
+// ports, are tracked as one. The caller must hold tmtx.
+func (a *activity) clientTotals(addr string) *clientTotals {
+	client := clientHost(addr)
+	t, ok := a.totals[client]
+	if !ok {
+		if len(a.totals) >= maxClientHosts {
+			return &a.other
+		}
+		t = &clientTotals{idle: a.now()}
+		a.totals[client] = t
+	}
+	return t
+}
+
+// clientHost returns the host part of a remote address, or the entire
+// address if it has no port, e.g. for unix sockets.
+func clientHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// sweep moves the totals of hosts which haven't sent anything for
+// clientHostTTL, and aren't connected, to the other totals, so their series
+// go away, and the other series carries on counting them. The caller must
+// hold mtx, and tmtx.
+func (a *activity) sweep() {
+	now := a.now()
+	connected := map[*clientTotals]bool{}
+	for c := range a.clients {
+		connected[c.host] = true
+	}
+	for client, t := range a.totals {
+		counts := t.load()
+		if lines := counts.acceptedLines + counts.rejectedLines; lines != t.swept {
+			t.swept, t.idle = lines, now
+			continue
+		}
+		if now.Sub(t.idle) >= clientHostTTL && !connected[t] {
+			a.other.add(counts)
+			delete(a.totals, client)
+		}
+	}
+}
+
+// renderTelemetry writes the per-client totals in the Prometheus text format,
+// including the counts of connected clients, after sweeping away the idle
+// ones.
+func (a *activity) renderTelemetry(w io.Writer) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.tmtx.Lock()
+	defer a.tmtx.Unlock()
+	a.sweep()
+	totals := make(map[string]clientTotals, len(a.totals)+1)
+	for client, t := range a.totals {
+		totals[client] = t.load()
+	}
+	add := func(client string, counts clientTotals) {
+		t := totals[client]
+		t.add(counts)
+		totals[client] = t
+	}
+	if other := a.other.load(); other != (clientTotals{}) {
+		add(otherClient, other)
+	}
+	for c := range a.clients {
+		client := clientHost(c.Addr)
+		if c.host == &a.other {
+			client = otherClient
+		}
+		add(client, c.counts.load())
+	}
+	clients := make([]string, 0, len(totals))
+	for client := range totals {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+	if len(clients) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "# HELP prometheus_aggregator_client_lines_total Lines received, by client host and result.\n")
+	fmt.Fprintf(w, "# TYPE prometheus_aggregator_client_lines_total counter\n")
+	for _, client := range clients {
+		t := totals[client]
+		fmt.Fprintf(w, "prometheus_aggregator_client_lines_total%s %d\n", renderLabels(map[string]string{"client": client, "result": "accepted"}), t.acceptedLines)
+		fmt.Fprintf(w, "prometheus_aggregator_client_lines_total%s %d\n", renderLabels(map[string]string{"client": client, "result": "rejected"}), t.rejectedLines)
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintf(w, "# HELP prometheus_aggregator_client_bytes_total Bytes received, by client host and result.\n")
+	fmt.Fprintf(w, "# TYPE prometheus_aggregator_client_bytes_total counter\n")
+	for _, client := range clients {
+		t := totals[client]
+		fmt.Fprintf(w, "prometheus_aggregator_client_bytes_total%s %d\n", renderLabels(map[string]string{"client": client, "result": "accepted"}), t.acceptedBytes)
+		fmt.Fprintf(w, "prometheus_aggregator_client_bytes_total%s %d\n", renderLabels(map[string]string{"client": client, "result": "rejected"}), t.rejectedBytes)
+	}
+	fmt.Fprintln(w)
+}
+
+// connectedClients returns the connected clients, ordered by address.
+func (a *activity) connectedClients() []clientInfo {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	clients := make([]clientInfo, 0, len(a.clients))
+	for c := range a.clients {
+		counts := c.counts.load()
+		clients = append(clients, clientInfo{Addr: c.Addr, Connected: c.Connected, Accepted: counts.acceptedLines, Rejected: counts.rejectedLines})
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Addr < clients[j].Addr })
+	return clients
+}
+
+// recentErrors returns the most recently rejected lines, newest first.
+func (a *activity) recentErrors() []lineRecord {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.errors.newestFirst()
+}
+
+// recentLines returns the most recently received lines, newest first.
+func (a *activity) recentLines() []lineRecord {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.lines.newestFirst()
+}
+
+// recentHandler serves the most recently received lines as JSON.
+func recentHandler(a *activity) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondJSON(w, http.StatusOK, a.recentLines())
+	})
+}
+
+// lineRing is a fixed-size ring buffer of line records.
+type lineRing struct {
+	records []lineRecord
+	next    int // index of the next write
+}
+
+func newLineRing(n int) lineRing {
+	return lineRing{records: make([]lineRecord, 0, n)}
+}
+
+func (r *lineRing) enabled() bool { return cap(r.records) > 0 }
+
+func (r *lineRing) add(rec lineRecord) {
+	if len(r.records) < cap(r.records) {
+		r.records = append(r.records, rec)
+	} else {
+		r.records[r.next] = rec
+	}
+	r.next = (r.next + 1) % cap(r.records)
+}
+
+func (r *lineRing) newestFirst() []lineRecord {
+	records := make([]lineRecord, 0, len(r.records))
+	for i := 1; i <= len(r.records); i++ {
+		records = append(records, r.records[(r.next-i+cap(r.records))%cap(r.records)])
+	}
+	return records
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestActivityRecentErrors(t *testing.T) {
+	a := newActivity(0)
+	for i := 0; i < maxRecentErrors+5; i++ {
+		a.reject("1.2.3.4:5", nil, []byte("bad"), fmt.Errorf("error %d", i))
+	}
+	errs := a.recentErrors()
+	if want, have := maxRecentErrors, len(errs); want != have {
+		t.Fatalf("want %d errors, have %d", want, have)
+	}
+	if want, have := fmt.Sprintf("error %d", maxRecentErrors+4), errs[0].Err; want != have {
+		t.Errorf("newest: want %q, have %q", want, have)
+	}
+	if want, have := "error 5", errs[len(errs)-1].Err; want != have {
+		t.Errorf("oldest: want %q, have %q", want, have)
+	}
+	if want, have := 0, len(a.recentLines()); want != have {
+		t.Errorf("recent lines disabled: want %d, have %d", want, have)
+	}
+}
+
+func TestActivityRecentLines(t *testing.T) {
+	a := newActivity(3)
+	a.accept("a", nil, []byte(`foo{} 1`))
+	a.reject("b", nil, []byte(`foo 2`), errors.New("no braces"))
+	a.accept("a", nil, []byte(`foo{} 3`))
+	a.accept("a", nil, []byte(`foo{} 4`))
+
+	var have []lineRecord
+	for _, r := range a.recentLines() {
+		have = append(have, lineRecord{Addr: r.Addr, Line: r.Line, Accepted: r.Accepted, Err: r.Err})
+	}
+	if want := []lineRecord{
+		{Addr: "a", Line: `foo{} 4`, Accepted: true},
+		{Addr: "a", Line: `foo{} 3`, Accepted: true},
+		{Addr: "b", Line: `foo 2`, Err: "no braces"},
+	}; !cmp.Equal(want, have) {
+		t.Fatal(cmp.Diff(want, have))
+	}
+}
+
+func TestActivityTelemetry(t *testing.T) {
+	a := newActivity(0)
+	a.accept("10.0.0.1:1234", nil, []byte(`foo{} 1`))
+	a.accept("10.0.0.1:5678", nil, []byte(`foo{} 12`))
+	a.reject("10.0.0.2:1234", nil, []byte(`foo 1`), errors.New("no braces"))
+	a.accept("test", nil, []byte(`foo{} 1`))
+
+	var buf bytes.Buffer
+	a.renderTelemetry(&buf)
+	if want, have := normalizeResponse(`
+		# HELP prometheus_aggregator_client_lines_total Lines received, by client host and result.
+		# TYPE prometheus_aggregator_client_lines_total counter
+		prometheus_aggregator_client_lines_total{client="10.0.0.1",result="accepted"} 2
+		prometheus_aggregator_client_lines_total{client="10.0.0.1",result="rejected"} 0
+		prometheus_aggregator_client_lines_total{client="10.0.0.2",result="accepted"} 0
+		prometheus_aggregator_client_lines_total{client="10.0.0.2",result="rejected"} 1
+		prometheus_aggregator_client_lines_total{client="test",result="accepted"} 1
+		prometheus_aggregator_client_lines_total{client="test",result="rejected"} 0
+
+		# HELP prometheus_aggregator_client_bytes_total Bytes received, by client host and result.
+		# TYPE prometheus_aggregator_client_bytes_total counter
+		prometheus_aggregator_client_bytes_total{client="10.0.0.1",result="accepted"} 15
+		prometheus_aggregator_client_bytes_total{client="10.0.0.1",result="rejected"} 0
+		prometheus_aggregator_client_bytes_total{client="10.0.0.2",result="accepted"} 0
+		prometheus_aggregator_client_bytes_total{client="10.0.0.2",result="rejected"} 5
+		prometheus_aggregator_client_bytes_total{client="test",result="accepted"} 7
+		prometheus_aggregator_client_bytes_total{client="test",result="rejected"} 0
+	`), normalizeResponse(buf.String()); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestActivityClientHostLimits(t *testing.T) {
+	a := newActivity(0)
+	now := time.Unix(1000, 0)
+	a.now = func() time.Time { return now }
+	for i := 0; i < maxClientHosts+2; i++ {
+		a.accept(fmt.Sprintf("10.0.%d.%d:1234", i/256, i%256), nil, []byte(`foo{} 1`))
+	}
+	a.connect("10.0.0.1:1234")
+	series := func() (n int, other string) {
+		var buf bytes.Buffer
+		a.renderTelemetry(&buf)
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if strings.HasPrefix(line, "prometheus_aggregator_client_lines_total{") && strings.Contains(line, `result="accepted"`) {
+				n++
+				if strings.Contains(line, `client="other"`) {
+					other = line[strings.LastIndexByte(line, ' ')+1:]
+				}
+			}
+		}
+		return n, other
+	}
+
+	// Hosts beyond the limit are counted as other.
+	if n, other := series(); n != maxClientHosts+1 || other != "2" {
+		t.Errorf("over the limit: want %d series, other 2, have %d, other %s", maxClientHosts+1, n, other)
+	}
+
+	// Idle hosts are forgotten, and counted as other, unless they're
+	// connected.
+	now = now.Add(clientHostTTL)
+	a.accept("10.0.0.0:1234", nil, []byte(`foo{} 1`))
+	if n, other := series(); n != 3 || other != fmt.Sprint(maxClientHosts) {
+		t.Errorf("after the TTL: want 3 series, other %d, have %d, other %s", maxClientHosts, n, other)
+	}
+}
+
+func TestActivityConnectionCounts(t *testing.T) {
+	a := newActivity(0)
+	lines := func() string {
+		var buf bytes.Buffer
+		a.renderTelemetry(&buf)
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if strings.HasPrefix(line, `prometheus_aggregator_client_lines_total{client="10.0.0.1",result="accepted"}`) {
+				return line[strings.LastIndexByte(line, ' ')+1:]
+			}
+		}
+		return ""
+	}
+
+	// A connection's lines are counted while it's connected, and after.
+	c := a.connect("10.0.0.1:1234")
+	a.accept("10.0.0.1:1234", c, []byte(`foo{} 1`))
+	a.accept("10.0.0.1:5678", nil, []byte(`foo{} 1`))
+	if want, have := "2", lines(); want != have {
+		t.Errorf("connected: want %s, have %s", want, have)
+	}
+	if want, have := uint64(1), a.connectedClients()[0].Accepted; want != have {
+		t.Errorf("connection: want %d accepted, have %d", want, have)
+	}
+	a.accept("10.0.0.1:1234", c, []byte(`foo{} 1`))
+	a.disconnect(c)
+	if want, have := "3", lines(); want != have {
+		t.Errorf("disconnected: want %s, have %s", want, have)
+	}
+}
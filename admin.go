@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// declarations returns the declaration of every metric in the universe,
+// ordered by name.
+func (u *universe) declarations() []observation {
+	names, collections := u.sortedCollections()
+	decls := make([]observation, 0, len(names))
+	for i, n := range names {
+		decls = append(decls, collections[i].declaration(n))
+	}
+	return decls
+}
+
+// declarationResult reports what happened to a single runtime declaration.
+type declarationResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"` // "created", "exists", or "rebucketed"
+}
+
+// declarationsHandler lists every declared metric on GET, and registers new
+// declarations on a POST with admin credentials. The POST body may be a
+// single JSON declaration, or an array of them, in the same format as the
+// declfile.
+func declarationsHandler(u *universe, admin *httpAuth, audit *auditLog, logger log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			respondJSON(w, http.StatusOK, u.declarations())
+
+		case "POST":
+			if !admin.allow(r, roleAdmin) {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			decls, err := readDeclarations(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			results := make([]declarationResult, 0, len(decls))
+			for _, o := range decls {
+				status, err := u.declare(o)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				switch status {
+				case declCreated:
+					level.Info(logger).Log("declaration", "created", "name", o.Name, "type", o.Type)
+					if err := audit.record(requester(r, admin), "declare", map[string]string{"name": o.Name, "type": o.Type, "help": o.Help}); err != nil {
+						level.Error(logger).Log("during", "audit", "err", err)
+					}
+				case declRebucketed:
+					level.Warn(logger).Log("declaration", "rebucketed", "name", o.Name, "buckets", fmt.Sprint(o.Buckets), "msg", "all series reset")
+					if err := audit.record(requester(r, admin), "rebucket", map[string]string{"name": o.Name, "buckets": fmt.Sprint(o.Buckets)}); err != nil {
+						level.Error(logger).Log("during", "audit", "err", err)
+					}
+				}
+				results = append(results, declarationResult{Name: o.Name, Status: status})
+			}
+			respondJSON(w, http.StatusOK, results)
+
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func readDeclarations(r *http.Request) ([]observation, error) {
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	buf = bytes.TrimSpace(buf)
+	if len(buf) > 0 && buf[0] == '{' {
+		var o observation
+		err = json.Unmarshal(buf, &o)
+		return []observation{o}, err
+	}
+	var decls []observation
+	err = json.Unmarshal(buf, &decls)
+	return decls, err
+}
+
+func respondJSON(w http.ResponseWriter, code int, v interface{}) {
+	buf, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(buf)
+}
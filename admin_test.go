@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDeclarationsHandler(t *testing.T) {
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+	})...)
+	admin := &httpAuth{}
+	admin.addToken("s3cr3t", roleAdmin)
+	admin.addToken("prometheus", roleScrape)
+	h := declarationsHandler(u, admin, nil, log.NewNopLogger())
+
+	post := func(auth, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/admin/declarations", strings.NewReader(body))
+		req.Header.Set("Authorization", auth)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if want, have := http.StatusUnauthorized, post("Bearer nope", `{}`).Code; want != have {
+		t.Fatalf("unauthenticated POST: want %d, have %d", want, have)
+	}
+	if want, have := http.StatusUnauthorized, post("Bearer prometheus", `{}`).Code; want != have {
+		t.Fatalf("POST with scrape credentials: want %d, have %d", want, have)
+	}
+	if want, have := http.StatusBadRequest, post("Bearer s3cr3t", `{"name":"bad","type":"untyped","help":"x"}`).Code; want != have {
+		t.Fatalf("invalid type: want %d, have %d", want, have)
+	}
+
+	rec := post("Bearer s3cr3t", `[
+		{"name":"foo_total","type":"counter","help":"Total number of foos."},
+		{"name":"bar_seconds","type":"histogram","help":"Bar duration.","buckets":[0.1,1]}
+	]`)
+	if want, have := http.StatusOK, rec.Code; want != have {
+		t.Fatalf("POST: want %d, have %d (%s)", want, have, rec.Body.String())
+	}
+	var results []declarationResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []declarationResult{
+		{Name: "foo_total", Status: "exists"},
+		{Name: "bar_seconds", Status: "created"},
+	}, results; !cmp.Equal(want, have) {
+		t.Fatal(cmp.Diff(want, have))
+	}
+
+	loadObservations(t, u, makeObservations(t, []string{
+		`bar_seconds{} 0.5`,
+	}))
+	if want, have := normalizeResponse(`
+		# HELP bar_seconds Bar duration.
+		# TYPE bar_seconds histogram
+		bar_seconds_bucket{le="0.1"} 0
+		bar_seconds_bucket{le="1"} 1
+		bar_seconds_bucket{le="+Inf"} 1
+		bar_seconds_sum{} 0.5
+		bar_seconds_count{} 1
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/declarations", nil))
+	var decls []observation
+	if err := json.Unmarshal(rec.Body.Bytes(), &decls); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []observation{
+		{Name: "bar_seconds", Type: "histogram", Help: "Bar duration.", Buckets: []float64{0.1, 1}},
+		{Name: "foo_total", Type: "counter", Help: "Total number of foos."},
+	}, decls; !cmp.Equal(want, have) {
+		t.Fatal(cmp.Diff(want, have))
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// auditLog records runtime changes to the aggregator: declarations, series
+// deletions, and reloads. Entries are appended as JSON lines to a writer,
+// typically a file, and the most recent entries are kept in memory. A nil
+// auditLog records nothing.
+type auditLog struct {
+	mtx     sync.Mutex
+	w       io.Writer
+	now     func() time.Time
+	entries []auditEntry // most recent, oldest first
+}
+
+// auditEntry is a single runtime change: who did what, and when.
+type auditEntry struct {
+	Time   time.Time         `json:"time"`
+	Who    string            `json:"who"`
+	Action string            `json:"action"`
+	What   map[string]string `json:"what,omitempty"`
+}
+
+// maxAuditEntries is the number of entries kept in memory.
+const maxAuditEntries = 1000
+
+func newAuditLog(w io.Writer) *auditLog {
+	return &auditLog{w: w, now: time.Now}
+}
+
+// record appends an entry to the log. Errors writing the entry are returned,
+// but the entry is kept in memory regardless.
+func (a *auditLog) record(who, action string, what map[string]string) error {
+	if a == nil {
+		return nil
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	e := auditEntry{Time: a.now(), Who: who, Action: action, What: what}
+	a.entries = append(a.entries, e)
+	if len(a.entries) > maxAuditEntries {
+		a.entries = append(a.entries[:0], a.entries[len(a.entries)-maxAuditEntries:]...)
+	}
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = a.w.Write(append(buf, '\n'))
+	return err
+}
+
+func (a *auditLog) recent() []auditEntry {
+	if a == nil {
+		return []auditEntry{}
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	entries := make([]auditEntry, len(a.entries))
+	copy(entries, a.entries)
+	return entries
+}
+
+// auditHandler serves the most recent audit entries as JSON, oldest first.
+func auditHandler(a *auditLog) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondJSON(w, http.StatusOK, a.recent())
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	audit := newAuditLog(&buf)
+
+	u, _ := newUniverse()
+	i := &ingester{observer: u, activity: newActivity(0), audit: audit, logger: log.NewNopLogger()}
+	for _, line := range []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`foo_total{code="200"} 1`,
+		`{"name":"foo_total","labels":{"code":"200"},"op":"delete"}`,
+		`{"name":"foo_total","op":"delete"}`,
+	} {
+		if _, err := i.handleLine([]byte(line), "10.0.0.1:1234"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := audit.record("SIGHUP", "reload", map[string]string{"added": "0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []auditEntry{
+		{Who: "10.0.0.1:1234", Action: "delete", What: map[string]string{"name": "foo_total", "labels": `{code="200"}`}},
+		{Who: "10.0.0.1:1234", Action: "delete", What: map[string]string{"name": "foo_total"}},
+		{Who: "SIGHUP", Action: "reload", What: map[string]string{"added": "0"}},
+	}
+	ignoreTime := cmpopts.IgnoreFields(auditEntry{}, "Time")
+	if have := audit.recent(); !cmp.Equal(want, have, ignoreTime) {
+		t.Fatal(cmp.Diff(want, have, ignoreTime))
+	}
+
+	var fromFile []auditEntry
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e auditEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		fromFile = append(fromFile, e)
+	}
+	if !cmp.Equal(want, fromFile, ignoreTime) {
+		t.Fatal(cmp.Diff(want, fromFile, ignoreTime))
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Roles of HTTP credentials. Scrape credentials can read /metrics and the
+// UI; admin credentials can do all of that, and use /admin, /debug, and
+// /-/reload, whatever the method, since they serve raw lines, every series,
+// and profiles, or change state.
+const (
+	roleScrape = "scrape"
+	roleAdmin  = "admin"
+)
+
+func validRole(role string) bool {
+	return role == roleScrape || role == roleAdmin
+}
+
+// httpAuth holds the credentials accepted by the HTTP listener, bearer
+// tokens, and basic auth users and their passwords, each with a role.
+// Credentials read from a file are reloaded when it changes.
+type httpAuth struct {
+	added []credential  // with addToken, kept across reloads
+	files *watchedFiles // nil without a file
+
+	mtx    sync.Mutex
+	tokens []credential
+	users  map[string]credential
+}
+
+type credential struct {
+	secret string
+	role   string
+}
+
+// readHTTPAuth reads credentials from a file, and watches it for changes.
+func readHTTPAuth(filename string) (*httpAuth, error) {
+	a := &httpAuth{}
+	files, err := watchFiles(func() error {
+		tokens, users, err := parseHTTPAuth(filename)
+		if err != nil {
+			return err
+		}
+		a.mtx.Lock()
+		defer a.mtx.Unlock()
+		a.tokens, a.users = tokens, users
+		return nil
+	}, filename)
+	if err != nil {
+		return nil, err
+	}
+	a.files = files
+	return a, nil
+}
+
+// parseHTTPAuth reads credentials from a file, one per line, as either
+// `bearer <token> [role]` or `basic <user>:<password> [role]`. The role
+// defaults to scrape. Blank lines, and lines starting with #, are ignored.
+func parseHTTPAuth(filename string) ([]credential, map[string]credential, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	var tokens []credential
+	users := map[string]credential{}
+	s := bufio.NewScanner(bytes.NewReader(buf))
+	for lineno := 1; s.Scan(); lineno++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, nil, fmt.Errorf("%s:%d: want `bearer <token> [role]` or `basic <user>:<password> [role]`", filename, lineno)
+		}
+		role := roleScrape
+		if len(fields) == 3 {
+			if role = strings.ToLower(fields[2]); !validRole(role) {
+				return nil, nil, fmt.Errorf("%s:%d: unknown role %q", filename, lineno, fields[2])
+			}
+		}
+		switch scheme, secret := strings.ToLower(fields[0]), fields[1]; scheme {
+		case "bearer":
+			tokens = append(tokens, credential{secret: secret, role: role})
+		case "basic":
+			x := strings.IndexByte(secret, ':')
+			if x < 1 {
+				return nil, nil, fmt.Errorf("%s:%d: want `basic <user>:<password> [role]`", filename, lineno)
+			}
+			users[secret[:x]] = credential{secret: secret[x+1:], role: role}
+		default:
+			return nil, nil, fmt.Errorf("%s:%d: unknown scheme %q", filename, lineno, fields[0])
+		}
+	}
+	return tokens, users, s.Err()
+}
+
+// addToken adds a token which isn't in the file, e.g. from a flag. It's not
+// safe to call once requests are being served.
+func (a *httpAuth) addToken(token, role string) {
+	if token != "" {
+		a.added = append(a.added, credential{secret: token, role: role})
+	}
+}
+
+// reload reads the credentials file again, if there is one.
+func (a *httpAuth) reload() error {
+	return a.files.reload()
+}
+
+// role returns the role of the request's credentials, or an empty string if
+// it doesn't have any valid ones.
+func (a *httpAuth) role(r *http.Request) string {
+	role, _ := a.identify(r)
+	return role
+}
+
+// identify returns the role of the request's credentials, and who they
+// identify: the basic auth user, or for a bearer token, which has no name,
+// a fingerprint of it, which tells tokens apart without revealing them. Both
+// are empty if it doesn't have any valid ones. Every token is compared, in
+// constant time, so as not to leak which matched, or how much.
+func (a *httpAuth) identify(r *http.Request) (role, who string) {
+	a.files.check()
+	a.mtx.Lock()
+	tokens, users := a.tokens, a.users
+	a.mtx.Unlock()
+
+	if user, password, ok := r.BasicAuth(); ok {
+		c, ok := users[user]
+		if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(c.secret)) != 1 {
+			return "", ""
+		}
+		return c.role, "user:" + user
+	}
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return "", ""
+	}
+	token := strings.TrimPrefix(header, prefix)
+	for _, list := range [][]credential{tokens, a.added} {
+		for _, c := range list {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(c.secret)) == 1 {
+				role = c.role
+			}
+		}
+	}
+	if role == "" {
+		return "", ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return role, "token:" + hex.EncodeToString(sum[:4])
+}
+
+// requester returns who made the request, for the audit log: who its admin
+// credentials identify, or else the identity in its verified client
+// certificate, or failing both, its address.
+func requester(r *http.Request, admin *httpAuth) string {
+	if admin != nil {
+		if _, who := admin.identify(r); who != "" {
+			return who
+		}
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		if id, err := certIdentity(r.TLS.PeerCertificates); err == nil {
+			return "cert:" + id
+		}
+	}
+	return r.RemoteAddr
+}
+
+// allow returns true if the request has credentials with the role, or with
+// the admin role, which can do anything. A nil httpAuth allows nothing.
+func (a *httpAuth) allow(r *http.Request, role string) bool {
+	if a == nil {
+		return false
+	}
+	have := a.role(r)
+	return have != "" && (have == role || have == roleAdmin)
+}
+
+// wrap returns a handler which requires credentials with the role for every
+// request, or, if a is nil, next itself.
+func (a *httpAuth) wrap(next http.Handler, role string) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case a.allow(r, role):
+			next.ServeHTTP(w, r)
+		case a.role(r) != "":
+			http.Error(w, "forbidden", http.StatusForbidden)
+		default:
+			w.Header().Set("WWW-Authenticate", `Basic realm="prometheus-aggregator"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		}
+	})
+}
+
+// authorize returns the handler of the Prometheus listener. /-/ready needs no
+// credentials, since probes can't authenticate; /admin/, /debug/, and
+// /-/reload need admin ones, from admin, and everything else needs scrape
+// ones, from auth.
+// If auth or admin is nil, its paths are open.
+func authorize(next, ready http.Handler, auth, admin *httpAuth) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/-/ready", ready)
+	mux.Handle("/-/reload", admin.wrap(next, roleAdmin))
+	mux.Handle("/admin/", admin.wrap(next, roleAdmin))
+	mux.Handle("/debug/", admin.wrap(next, roleAdmin))
+	mux.Handle("/", auth.wrap(next, roleScrape))
+	return mux
+}
+
+// socketTokens are the tokens stream clients may authenticate with. Tokens
+// read from a file are reloaded when it changes, so they can be rotated.
+type socketTokens struct {
+	added []string      // from a flag, kept across reloads
+	files *watchedFiles // nil without a file
+
+	mtx    sync.Mutex
+	tokens []string
+}
+
+// newSocketTokens reads tokens from a file, if filename isn't empty, and
+// watches it for changes, and adds token, if it isn't empty. If both are
+// empty, it returns nil, and clients don't need to authenticate.
+func newSocketTokens(filename, token string) (*socketTokens, error) {
+	if filename == "" && token == "" {
+		return nil, nil
+	}
+	t := &socketTokens{}
+	if token != "" {
+		t.added = []string{token}
+	}
+	if filename != "" {
+		files, err := watchFiles(func() error {
+			tokens, err := readTokens(filename)
+			if err != nil {
+				return err
+			}
+			t.mtx.Lock()
+			defer t.mtx.Unlock()
+			t.tokens = tokens
+			return nil
+		}, filename)
+		if err != nil {
+			return nil, err
+		}
+		t.files = files
+	}
+	return t, nil
+}
+
+// valid returns true if token is one of the tokens.
+func (t *socketTokens) valid(token string) bool {
+	t.files.check()
+	t.mtx.Lock()
+	tokens := t.tokens
+	t.mtx.Unlock()
+	inFile, added := validToken(tokens, token), validToken(t.added, token)
+	return inFile || added
+}
+
+// reload reads the tokens file again, if there is one.
+func (t *socketTokens) reload() error {
+	if t == nil {
+		return nil
+	}
+	return t.files.reload()
+}
+
+// readTokens reads tokens from a file, one per line. Blank lines, and lines
+// starting with #, are ignored.
+func readTokens(filename string) ([]string, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []string
+	s := bufio.NewScanner(bytes.NewReader(buf))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, line)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%s: no tokens", filename)
+	}
+	return tokens, s.Err()
+}
+
+// validToken returns true if token is one of tokens. Every one of them is
+// compared, in constant time, so as not to leak which matched, or how much.
+func validToken(tokens []string, token string) bool {
+	valid := false
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// authenticate reads the first line of a connection, which must be
+// `AUTH <token>`, with one of the tokens.
+func authenticate(br *bufio.Reader, tokens *socketTokens) error {
+	const prefix = "AUTH "
+	line, err := readLine(br)
+	switch {
+	case err != nil || !bytes.HasPrefix(line, []byte(prefix)):
+		return fmt.Errorf("first line must be %s<token>", prefix)
+	case !tokens.valid(string(line[len(prefix):])):
+		return fmt.Errorf("invalid token")
+	}
+	return nil
+}
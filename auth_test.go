@@ -0,0 +1,279 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestHTTPAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "auth")
+	writeFile(t, filename, `
+		# The scraper.
+		basic prometheus:hunter2
+		Bearer t0k3n
+		basic ops:sw0rdf1sh admin
+	`)
+	auth, err := readHTTPAuth(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.addToken("s3cr3t", roleAdmin)
+	scrape := auth.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), roleScrape)
+	admin := auth.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), roleAdmin)
+
+	for _, testcase := range []struct {
+		name   string
+		set    func(r *http.Request)
+		scrape int
+		admin  int
+	}{
+		{"none", func(r *http.Request) {}, http.StatusUnauthorized, http.StatusUnauthorized},
+		{"basic", func(r *http.Request) { r.SetBasicAuth("prometheus", "hunter2") }, http.StatusOK, http.StatusForbidden},
+		{"basic admin", func(r *http.Request) { r.SetBasicAuth("ops", "sw0rdf1sh") }, http.StatusOK, http.StatusOK},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("prometheus", "hunter3") }, http.StatusUnauthorized, http.StatusUnauthorized},
+		{"unknown user", func(r *http.Request) { r.SetBasicAuth("mallory", "hunter2") }, http.StatusUnauthorized, http.StatusUnauthorized},
+		{"token from file", func(r *http.Request) { r.Header.Set("Authorization", "Bearer t0k3n") }, http.StatusOK, http.StatusForbidden},
+		{"added admin token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cr3t") }, http.StatusOK, http.StatusOK},
+		{"wrong token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, http.StatusUnauthorized, http.StatusUnauthorized},
+		{"empty token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer ") }, http.StatusUnauthorized, http.StatusUnauthorized},
+	} {
+		for _, h := range []struct {
+			role    string
+			handler http.Handler
+			code    int
+		}{
+			{roleScrape, scrape, testcase.scrape},
+			{roleAdmin, admin, testcase.admin},
+		} {
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			testcase.set(req)
+			rec := httptest.NewRecorder()
+			h.handler.ServeHTTP(rec, req)
+			if want, have := h.code, rec.Code; want != have {
+				t.Errorf("%s, %s role: want %d, have %d", testcase.name, h.role, want, have)
+			}
+		}
+	}
+
+	var none *httpAuth
+	rec := httptest.NewRecorder()
+	none.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), roleAdmin).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if want, have := http.StatusOK, rec.Code; want != have {
+		t.Errorf("without auth: want %d, have %d", want, have)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	admin := &httpAuth{}
+	admin.addToken("s3cr3t", roleAdmin)
+	h := authorize(ok, ok, nil, admin) // only -admin-token
+
+	for _, testcase := range []struct {
+		method, path, token string
+		code                int
+	}{
+		{"GET", "/metrics", "", http.StatusOK},
+		{"GET", "/-/ready", "", http.StatusOK},
+		{"GET", "/admin/dump", "", http.StatusUnauthorized},
+		{"GET", "/admin/stats", "", http.StatusUnauthorized},
+		{"GET", "/admin/dump", "s3cr3t", http.StatusOK},
+		{"GET", "/debug/recent", "", http.StatusUnauthorized},
+		{"GET", "/debug/pprof/", "s3cr3t", http.StatusOK},
+		{"POST", "/-/reload", "", http.StatusUnauthorized},
+		{"POST", "/-/reload", "s3cr3t", http.StatusOK},
+	} {
+		req := httptest.NewRequest(testcase.method, testcase.path, nil)
+		if testcase.token != "" {
+			req.Header.Set("Authorization", "Bearer "+testcase.token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if want, have := testcase.code, rec.Code; want != have {
+			t.Errorf("%s %s with %q: want %d, have %d", testcase.method, testcase.path, testcase.token, want, have)
+		}
+	}
+}
+
+func TestAuthorizeRoles(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	auth := &httpAuth{}
+	auth.addToken("t0k3n", roleScrape)
+	auth.addToken("s3cr3t", roleAdmin)
+	h := authorize(ok, ok, auth, auth)
+
+	// Scrape credentials can't read admin data, whatever the method.
+	for _, path := range []string{"/admin/dump", "/admin/declarations", "/admin/audit", "/admin/stats", "/admin/churn", "/debug/recent", "/debug/pprof/"} {
+		for token, code := range map[string]int{"t0k3n": http.StatusForbidden, "s3cr3t": http.StatusOK} {
+			req := httptest.NewRequest("GET", path, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if want, have := code, rec.Code; want != have {
+				t.Errorf("GET %s with %s: want %d, have %d", path, token, want, have)
+			}
+		}
+	}
+}
+
+func TestRequester(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "auth")
+	writeFile(t, filename, "basic alice:pa55 admin\n")
+	admin, err := readHTTPAuth(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin.addToken("s3cr3t", roleAdmin)
+
+	for _, testcase := range []struct {
+		user, password, token string
+		want                  string
+	}{
+		{user: "alice", password: "pa55", want: "user:alice"},
+		{token: "s3cr3t", want: "token:4e738ca5"},
+		{token: "nope", want: "192.0.2.1:1234"},
+		{want: "192.0.2.1:1234"},
+	} {
+		req := httptest.NewRequest("POST", "/-/reload", nil)
+		if testcase.user != "" {
+			req.SetBasicAuth(testcase.user, testcase.password)
+		}
+		if testcase.token != "" {
+			req.Header.Set("Authorization", "Bearer "+testcase.token)
+		}
+		if want, have := testcase.want, requester(req, admin); want != have {
+			t.Errorf("want %q, have %q", want, have)
+		}
+	}
+}
+
+func TestReadHTTPAuthErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "auth")
+	for _, contents := range []string{
+		`t0k3n`,
+		`basic prometheus`,
+		`basic :hunter2`,
+		`digest prometheus:hunter2`,
+		`bearer t0k3n superuser`,
+		`bearer three tokens here`,
+	} {
+		writeFile(t, filename, contents)
+		if _, err := readHTTPAuth(filename); err == nil {
+			t.Errorf("%q: want error, have none", contents)
+		}
+	}
+}
+
+func TestSocketAuth(t *testing.T) {
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Foo."}`,
+	})...)
+	i := &ingester{observer: u, activity: newActivity(0), logger: log.NewNopLogger(), tokens: &socketTokens{added: []string{"t0k3n", "s3cr3t"}}}
+	for _, conn := range []string{
+		"AUTH s3cr3t\nfoo_total{} 1\nfoo_total{} 2\n",
+		"AUTH nope\nfoo_total{} 10\n",
+		"auth s3cr3t\nfoo_total{} 20\n",
+		"foo_total{} 30\n",
+		"AUTH t0k3n\r\nfoo_total{} 4",
+	} {
+		i.handleConn(ioutil.NopCloser(strings.NewReader(conn)), "test")
+	}
+	if want, have := normalizeResponse(`
+		# HELP foo_total Foo.
+		# TYPE foo_total counter
+		foo_total{} 7
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestSecretFilesReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Rotations are given distinct modification times, since they happen
+	// faster than some filesystems can tell apart.
+	modTime := time.Now()
+	rotate := func(filename, contents string) {
+		modTime = modTime.Add(time.Minute)
+		writeFile(t, filename, contents)
+		if err := os.Chtimes(filename, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tokensFile := filepath.Join(dir, "tokens")
+	rotate(tokensFile, "0ld\n")
+	tokens, err := newSocketTokens(tokensFile, "fl4g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authFile := filepath.Join(dir, "auth")
+	rotate(authFile, "bearer 0ld\n")
+	auth, err := readHTTPAuth(authFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.addToken("fl4g", roleAdmin)
+	valid := func(token string) (socket, http bool) {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return tokens.valid(token), auth.allow(req, roleScrape)
+	}
+
+	for _, step := range []struct {
+		name     string
+		tokens   string // new contents, if not empty
+		auth     string
+		reloadOK bool
+		want     map[string]bool
+	}{
+		{"initial", "", "", true, map[string]bool{"0ld": true, "n3w": false, "fl4g": true}},
+		{"rotated", "n3w\n", "bearer n3w\n", true, map[string]bool{"0ld": false, "n3w": true, "fl4g": true}},
+		{"broken", "# none\n", "bearer\n", false, map[string]bool{"0ld": false, "n3w": true, "fl4g": true}},
+	} {
+		if step.tokens != "" {
+			rotate(tokensFile, step.tokens)
+			rotate(authFile, step.auth)
+		}
+		for token, want := range step.want {
+			if socket, http := valid(token); want != socket || want != http {
+				t.Errorf("%s: %s: want %v, have %v (socket), %v (HTTP)", step.name, token, want, socket, http)
+			}
+		}
+		if err := tokens.reload(); (err == nil) != step.reloadOK {
+			t.Errorf("%s: tokens reload: want ok %v, have %v", step.name, step.reloadOK, err)
+		}
+		if err := auth.reload(); (err == nil) != step.reloadOK {
+			t.Errorf("%s: auth reload: want ok %v, have %v", step.name, step.reloadOK, err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// backupTimeout is how long a backup, or fetching the latest one at
+// startup, may take.
+const backupTimeout = time.Minute
+
+// backup uploads a snapshot of the state, in the format of the state file,
+// to an object store every interval, and removes all but the most recent,
+// so an aggregator on a new host, which has no state file, can start from
+// where the old one left off, instead of from zero.
+type backup struct {
+	uploads  uint64 // atomic; first, for alignment
+	failures uint64 // atomic
+
+	store     objectStore
+	prefix    string
+	retention int // snapshots kept
+	snapshot  func() savedState
+	logger    log.Logger
+	now       func() time.Time
+}
+
+func newBackup(store objectStore, prefix string, retention int, snapshot func() savedState, logger log.Logger) *backup {
+	return &backup{
+		store:     store,
+		prefix:    prefix,
+		retention: retention,
+		snapshot:  snapshot,
+		logger:    log.With(logger, "backup", prefix),
+		now:       time.Now,
+	}
+}
+
+// run uploads a snapshot every interval until the context is canceled, and
+// then uploads one last one.
+func (b *backup) run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.uploadLogged()
+		case <-ctx.Done():
+			b.uploadLogged()
+			return ctx.Err()
+		}
+	}
+}
+
+func (b *backup) uploadLogged() {
+	ctx, cancel := context.WithTimeout(context.Background(), backupTimeout)
+	defer cancel()
+	if err := b.upload(ctx); err != nil {
+		atomic.AddUint64(&b.failures, 1)
+		level.Warn(b.logger).Log("during", "backup", "err", err)
+	}
+}
+
+// upload uploads a snapshot, named for the time, so they sort in order, and
+// then removes the oldest, beyond the retention.
+func (b *backup) upload(ctx context.Context) error {
+	buf, err := json.Marshal(b.snapshot())
+	if err != nil {
+		return err
+	}
+	key := b.prefix + "state-" + b.now().UTC().Format("20060102T150405.000Z") + ".json"
+	if err := b.store.put(ctx, key, buf); err != nil {
+		return err
+	}
+	atomic.AddUint64(&b.uploads, 1)
+	keys, err := b.snapshots(ctx)
+	if err != nil {
+		return err
+	}
+	for len(keys) > b.retention {
+		if err := b.store.delete(ctx, keys[0]); err != nil {
+			return err
+		}
+		keys = keys[1:]
+	}
+	return nil
+}
+
+// snapshots returns the keys of the snapshots, oldest first.
+func (b *backup) snapshots(ctx context.Context) ([]string, error) {
+	all, err := b.store.list(ctx, b.prefix)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, key := range all {
+		name := strings.TrimPrefix(key, b.prefix)
+		if strings.HasPrefix(name, "state-") && strings.HasSuffix(name, ".json") && !strings.Contains(name, "/") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// latest returns the most recent snapshot, and its key, or an empty key, if
+// there aren't any.
+func (b *backup) latest(ctx context.Context) (savedState, string, error) {
+	var st savedState
+	keys, err := b.snapshots(ctx)
+	if err != nil || len(keys) == 0 {
+		return st, "", err
+	}
+	key := keys[len(keys)-1]
+	buf, err := b.store.get(ctx, key)
+	if err != nil {
+		return st, "", err
+	}
+	if err := json.Unmarshal(buf, &st); err != nil {
+		return st, "", fmt.Errorf("error parsing %s: %v", key, err)
+	}
+	return st, key, nil
+}
+
+// renderTelemetry writes the backup's counters, in the Prometheus text
+// format.
+func (b *backup) renderTelemetry(w io.Writer) {
+	if b == nil {
+		return
+	}
+	fmt.Fprintf(w, "# HELP prometheus_aggregator_backup_uploads_total Snapshots of the state uploaded to the object store.\n")
+	fmt.Fprintf(w, "# TYPE prometheus_aggregator_backup_uploads_total counter\n")
+	fmt.Fprintf(w, "prometheus_aggregator_backup_uploads_total %d\n\n", atomic.LoadUint64(&b.uploads))
+	fmt.Fprintf(w, "# HELP prometheus_aggregator_backup_failures_total Backups which failed, to upload, or to remove old snapshots.\n")
+	fmt.Fprintf(w, "# TYPE prometheus_aggregator_backup_failures_total counter\n")
+	fmt.Fprintf(w, "prometheus_aggregator_backup_failures_total %d\n\n", atomic.LoadUint64(&b.failures))
+}
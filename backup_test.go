@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// fakeBucket is an object store, behind either S3's API or Azure's, as much
+// as backups use them.
+type fakeBucket struct {
+	azure   bool
+	mtx     sync.Mutex
+	objects map[string][]byte
+}
+
+func (b *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.azure && r.URL.Query().Get("sig") == "" || !b.azure && !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/bucket"), "/")
+	switch {
+	case r.Method == "GET" && key == "":
+		var keys []string
+		for k := range b.objects {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Sort(sort.Reverse(sort.StringSlice(keys))) // in any order
+		type object struct {
+			Key  string `xml:",omitempty"`
+			Name string `xml:",omitempty"`
+		}
+		var objects []object
+		for _, k := range keys {
+			if b.azure {
+				objects = append(objects, object{Name: k})
+			} else {
+				objects = append(objects, object{Key: k})
+			}
+		}
+		if b.azure {
+			xml.NewEncoder(w).Encode(struct {
+				XMLName xml.Name `xml:"EnumerationResults"`
+				Blob    []object `xml:"Blobs>Blob"`
+			}{Blob: objects})
+		} else {
+			xml.NewEncoder(w).Encode(struct {
+				XMLName  xml.Name `xml:"ListBucketResult"`
+				Contents []object
+			}{Contents: objects})
+		}
+	case r.Method == "PUT":
+		b.objects[key], _ = ioutil.ReadAll(r.Body)
+	case r.Method == "GET":
+		buf, ok := b.objects[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(buf)
+	case r.Method == "DELETE":
+		delete(b.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	env := map[string]string{
+		"AWS_ACCESS_KEY_ID":       "AKID",
+		"AWS_SECRET_ACCESS_KEY":   "secret",
+		"AZURE_STORAGE_SAS_TOKEN": "sv=2020-04-08&sig=abc",
+	}
+	for _, azure := range []bool{false, true} {
+		bucket := &fakeBucket{azure: azure, objects: map[string][]byte{"backups/unrelated.txt": nil}}
+		server := httptest.NewServer(bucket)
+		raw := "s3://bucket/backups?endpoint=" + server.URL
+		if azure {
+			raw = "azblob://account/bucket/backups?endpoint=" + server.URL
+		}
+		store, prefix, err := parseObjectStore(raw, func(name string) string { return env[name] })
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		u, _ := newUniverse(makeObservations(t, []string{`{"name":"foo_total","type":"counter","help":"Foo."}`})...)
+		b := newBackup(store, prefix, 2, (&stateFile{u: u}).snapshot, log.NewNopLogger())
+		now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		b.now = func() time.Time { return now }
+		ctx := context.Background()
+		if _, key, err := b.latest(ctx); err != nil || key != "" {
+			t.Fatalf("%s: before any backups, want no snapshot, have %q, %v", raw, key, err)
+		}
+		for i := 0; i < 3; i++ {
+			o, _ := parseLine([]byte(`foo_total{} 1`))
+			u.observe(o)
+			if err := b.upload(ctx); err != nil {
+				t.Fatalf("%s: %v", raw, err)
+			}
+			now = now.Add(time.Hour)
+		}
+
+		// Only the most recent are kept, and other objects are left alone.
+		bucket.mtx.Lock()
+		var keys []string
+		for k := range bucket.objects {
+			keys = append(keys, k)
+		}
+		bucket.mtx.Unlock()
+		sort.Strings(keys)
+		if want, have := "backups/state-20200101T010000.000Z.json backups/state-20200101T020000.000Z.json backups/unrelated.txt", strings.Join(keys, " "); want != have {
+			t.Errorf("%s: want %s, have %s", raw, want, have)
+		}
+
+		// A new aggregator starts from the latest.
+		st, key, err := b.latest(ctx)
+		if err != nil {
+			t.Fatalf("%s: %v", raw, err)
+		}
+		if want, have := "backups/state-20200101T020000.000Z.json", key; want != have {
+			t.Errorf("%s: want %s, have %s", raw, want, have)
+		}
+		u2, _ := newUniverse()
+		if _, _, err := (&stateFile{u: u2, logger: log.NewNopLogger()}).restoreState(st); err != nil {
+			t.Fatal(err)
+		}
+		if want, have := `foo_total{} 3`, scrape(t, u2); !strings.Contains(have, want) {
+			t.Errorf("%s: want %s, have\n%s", raw, want, have)
+		}
+		server.Close()
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strings"
+)
+
+// runCheck is the check subcommand, which validates declfiles without
+// running an aggregator, for the CI of the repos which own them, e.g.
+//
+//	prometheus-aggregator check -declfile decls.json
+//
+// It writes each problem with the file and line of the declaration it's in,
+// and returns an error if there were any.
+func runCheck(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("prometheus-aggregator check", flag.ExitOnError)
+	declfile := fs.String("declfile", "", "declfile to check")
+	fs.Usage = usageFor(fs, "prometheus-aggregator check -declfile <file> [file ...]")
+	fs.Parse(args)
+	files := fs.Args()
+	if *declfile != "" {
+		files = append([]string{*declfile}, files...)
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("-declfile is required")
+	}
+
+	var problems int
+	for _, file := range files {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		for _, p := range checkDeclfile(buf) {
+			fmt.Fprintf(stdout, "%s:%d: %s\n", file, p.line, p.msg)
+			problems++
+		}
+	}
+	if problems > 0 {
+		return fmt.Errorf("%d problem(s) in %d declfile(s)", problems, len(files))
+	}
+	return nil
+}
+
+// declProblem is a problem with a declfile, on a line of it.
+type declProblem struct {
+	line int
+	msg  string
+}
+
+// checkDeclfile returns the problems with a declfile: JSON that isn't an
+// array of declarations, unknown keys, invalid names, types, and help,
+// buckets out of order, names declared twice, or observed before they're
+// declared, and anything else an aggregator would refuse to start with.
+func checkDeclfile(buf []byte) []declProblem {
+	var (
+		problems []declProblem
+		declared = map[string]int{} // line
+		linted   []observation      // declarations which don't break the exposition
+		dec      = json.NewDecoder(bytes.NewReader(buf))
+	)
+	dec.DisallowUnknownFields()
+	scratch, _ := newUniverse() // for everything else an aggregator checks
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return []declProblem{{lineAt(buf, 0), "want a JSON array of declarations"}}
+	}
+	for dec.More() {
+		line := lineAt(buf, dec.InputOffset())
+		var o observation
+		if err := dec.Decode(&o); err != nil {
+			if _, ok := err.(*json.UnmarshalTypeError); !ok && !isUnknownField(err) {
+				return append(problems, declProblem{line, err.Error()}) // can't go on
+			}
+			problems = append(problems, declProblem{line, err.Error()})
+			continue
+		}
+		before := len(problems)
+		problemf := func(format string, args ...interface{}) {
+			problems = append(problems, declProblem{line, fmt.Sprintf(format, args...)})
+		}
+		if o.Name == "" {
+			problemf("a declaration requires a name")
+			continue
+		}
+		if err := validateNames(&o); err != nil {
+			problemf("%v", err)
+		}
+		if o.Type == "" && o.Help == "" && o.Buckets == nil {
+			// An observation of a metric declared before it.
+			first, ok := declared[o.Name]
+			switch {
+			case !ok:
+				problemf("%s is observed before it's declared", o.Name)
+			case scratch.collection(o.metricName()) == nil:
+				// Its declaration was bad, and has been reported.
+			case len(problems) == before:
+				if err := scratch.observe(o); err != nil {
+					problemf("%v, as declared on line %d", err, first)
+				}
+			}
+			continue
+		}
+
+		if first, ok := declared[o.Name]; ok {
+			problemf("%s is declared again, after line %d", o.Name, first)
+			continue
+		}
+		declared[o.Name] = line
+		switch o.Type {
+		case "counter", "gauge", "histogram", "summary":
+		case "":
+			problemf("%s has no type", o.Name)
+		default:
+			problemf("%s has invalid type %q, not counter, gauge, histogram, or summary", o.Name, o.Type)
+		}
+		if o.Help == "" {
+			problemf("%s has no help", o.Name)
+		}
+		if o.Buckets != nil && o.Type != "histogram" && o.Type != "" {
+			problemf("%s has buckets, which only histograms have", o.Name)
+		}
+		for i, b := range o.Buckets {
+			switch {
+			case math.IsNaN(b):
+				problemf("%s has a NaN bucket", o.Name)
+			case i > 0 && b == o.Buckets[i-1]:
+				problemf("%s has bucket %s twice", o.Name, appendLE(nil, b))
+			case i > 0 && b < o.Buckets[i-1]:
+				problemf("%s has bucket %s after %s, out of order", o.Name, appendLE(nil, b), appendLE(nil, o.Buckets[i-1]))
+			}
+		}
+		if err := scratch.observe(o); err != nil && len(problems) == before {
+			problemf("%v", err)
+		}
+		if len(problems) == before {
+			// Breaking the exposition is only up to the declarations
+			// before it, which are fine, or they'd have been reported.
+			for _, err := range lintDeclarations(append(linted, o)) {
+				msg := err.Error()
+				if i := strings.Index(msg, ": "); strings.HasPrefix(msg, "line ") && i > 0 {
+					msg = msg[i+2:] // the line of the exposition means nothing here
+				}
+				problemf("%s breaks the exposition: %s", o.Name, msg)
+			}
+			if len(problems) == before {
+				linted = append(linted, o)
+			}
+		}
+	}
+	return problems
+}
+
+// isUnknownField returns true for the error of a decoder which disallows
+// unknown fields, which doesn't have a type of its own.
+func isUnknownField(err error) bool {
+	return strings.HasPrefix(err.Error(), "json: unknown field ")
+}
+
+// lineAt returns the line of the first thing at or after the offset which
+// isn't whitespace, or the comma between array elements.
+func lineAt(buf []byte, offset int64) int {
+	for offset < int64(len(buf)) && strings.IndexByte(" \t\r\n,", buf[offset]) >= 0 {
+		offset++
+	}
+	return 1 + bytes.Count(buf[:offset], []byte("\n"))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCheckDeclfile(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+		want []string
+	}{
+		{
+			name: "ok",
+			in: `[
+				{"name": "foo_total", "type": "counter", "help": "Foo."},
+				{"name": "bar_seconds", "type": "histogram", "help": "Bar.", "buckets": [0.1, 1]},
+				{"name": "foo_total", "labels": {"code": "200"}, "value": 3}
+			]`,
+		},
+		{
+			name: "everything",
+			in: `[
+				{"name": "foo_total", "type": "counter", "help": "Foo."},
+				{"name": "foo_total", "type": "counter", "help": "Foo again."},
+				{"name": "bar", "type": "untyped", "help": "Bar."},
+				{"name": "baz", "type": "gauge"},
+				{"name": "qux_seconds", "type": "histogram", "help": "Qux.", "buckets": [1, 0.1, 0.1]},
+				{"name": "quux", "type": "gauge", "help": "Quux.", "buckets": [1]},
+				{"name": "9lives", "type": "gauge", "help": "Lives."},
+				{"name": "corge_total", "hlep": "Corge."},
+				{"name": "grault_total", "value": 1},
+				{"name": "foo_total", "labels": {"le": "1"}, "value": 1},
+				{"name": "foo_total", "value": -1},
+				{"name": "qux_seconds", "value": 1},
+				{"type": "counter"}
+			]`,
+			want: []string{
+				`3: foo_total is declared again, after line 2`,
+				`4: bar has invalid type "untyped", not counter, gauge, histogram, or summary`,
+				`5: baz has no help`,
+				`6: qux_seconds has bucket 0.1 after 1, out of order`,
+				`6: qux_seconds has bucket 0.1 twice`,
+				`7: quux has buckets, which only histograms have`,
+				`8: invalid metric name "9lives"`,
+				`9: json: unknown field "hlep"`,
+				`10: grault_total is observed before it's declared`,
+				`11: reserved label name "le"`,
+				`12: negative value -1 for counter foo_total, as declared on line 2`,
+				`14: a declaration requires a name`,
+			},
+		},
+		{
+			name: "exposition",
+			in: `[
+				{"name": "foo_seconds", "type": "histogram", "help": "Foo.", "buckets": [1]},
+				{"name": "foo_seconds_count", "type": "counter", "help": "Foo count."},
+				{"name": "bar_total", "type": "counter", "help": "Bar."}
+			]`,
+			want: []string{`3: foo_seconds_count breaks the exposition: second HELP line for metric name "foo_seconds": "# HELP foo_seconds_count Foo count."`},
+		},
+		{
+			name: "not an array",
+			in:   "\n{\"name\": \"foo_total\"}",
+			want: []string{`2: want a JSON array of declarations`},
+		},
+		{
+			name: "syntax",
+			in:   "[\n{\"name\": \"foo_total\", \"type\": \"counter\", \"help\": \"Foo.\"},\n{\"name\": }\n]",
+			want: []string{`3: invalid character '}' after array element`},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var have []string
+			for _, p := range checkDeclfile([]byte(tc.in)) {
+				have = append(have, fmt.Sprintf("%d: %s", p.line, p.msg))
+			}
+			if !cmp.Equal(tc.want, have) {
+				t.Error(cmp.Diff(tc.want, have))
+			}
+		})
+	}
+}
+
+func TestRunCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	good, bad := filepath.Join(dir, "good.json"), filepath.Join(dir, "bad.json")
+	buf, _ := json.MarshalIndent(exampleDecls, "", "    ")
+	if err := ioutil.WriteFile(good, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(bad, []byte(`[{"name": "foo"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout bytes.Buffer
+	if err := runCheck([]string{"-declfile", good}, &stdout); err != nil {
+		t.Errorf("%s: %v", good, err)
+	}
+	if err := runCheck([]string{"-declfile", good, bad}, &stdout); err == nil {
+		t.Errorf("%s: want error, have none", bad)
+	}
+	if want, have := bad+":1: foo is observed before it's declared\n", stdout.String(); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+}
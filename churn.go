@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// churnCount is a point-in-time view of the series in one collection.
+type churnCount struct {
+	series  int
+	created uint64
+}
+
+// churnCounts returns the current series count and total number of
+// series ever created for every metric in the universe.
+func (u *universe) churnCounts() map[metricName]churnCount {
+	names, collections := u.sortedCollections()
+	counts := make(map[metricName]churnCount, len(names))
+	for i, n := range names {
+		c := collections[i]
+		c.mtx.RLock()
+		counts[n] = churnCount{series: len(c.values), created: c.created}
+		c.mtx.RUnlock()
+	}
+	return counts
+}
+
+// churnStat describes the series creation activity of a single metric
+// over the most recent churn interval.
+type churnStat struct {
+	Name    string  `json:"name"`
+	Series  int     `json:"series"`
+	Created uint64  `json:"created_total"`
+	Recent  uint64  `json:"created_recent"`
+	Rate    float64 `json:"created_per_second"`
+}
+
+// churnTracker periodically samples the universe to compute the rate at
+// which each metric creates new series. Metrics that create more than
+// threshold new series in a single interval are logged as warnings, which
+// is usually a sign that some client is emitting unbounded label values.
+type churnTracker struct {
+	src       *universe
+	threshold uint64 // 0 disables warnings
+	logger    log.Logger
+
+	mtx   sync.Mutex
+	prev  map[metricName]uint64
+	last  time.Time
+	stats []churnStat
+}
+
+func newChurnTracker(src *universe, threshold uint64, logger log.Logger) *churnTracker {
+	return &churnTracker{
+		src:       src,
+		threshold: threshold,
+		logger:    logger,
+		prev:      map[metricName]uint64{},
+		last:      time.Now(),
+	}
+}
+
+// run samples the universe every interval until the context is canceled.
+func (t *churnTracker) run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			t.update(now)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (t *churnTracker) update(now time.Time) {
+	counts := t.src.churnCounts()
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	elapsed := now.Sub(t.last).Seconds()
+	stats := make([]churnStat, 0, len(counts))
+	for n, c := range counts {
+		recent := c.created - t.prev[n] // new metrics start from zero
+		s := churnStat{
+			Name:    string(n),
+			Series:  c.series,
+			Created: c.created,
+			Recent:  recent,
+		}
+		if elapsed > 0 {
+			s.Rate = float64(recent) / elapsed
+		}
+		if t.threshold > 0 && recent > t.threshold {
+			level.Warn(t.logger).Log("metric", n, "churn", "high", "created_recent", recent, "threshold", t.threshold, "series", c.series)
+		}
+		stats = append(stats, s)
+		t.prev[n] = c.created
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Recent != stats[j].Recent {
+			return stats[i].Recent > stats[j].Recent
+		}
+		return stats[i].Name < stats[j].Name
+	})
+	for n := range t.prev {
+		if _, ok := counts[n]; !ok {
+			delete(t.prev, n)
+		}
+	}
+	t.stats = stats
+	t.last = now
+}
+
+// ServeHTTP renders the most recently computed churn statistics as JSON,
+// ordered by recent series creations, highest first.
+func (t *churnTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.mtx.Lock()
+	stats := t.stats
+	t.mtx.Unlock()
+	if stats == nil {
+		stats = []churnStat{}
+	}
+	respondJSON(w, http.StatusOK, stats)
+}
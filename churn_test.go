@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestChurnTracker(t *testing.T) {
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`{"name":"bar_size","type":"gauge","help":"Current bar size."}`,
+	})...)
+
+	var buf bytes.Buffer
+	var (
+		start   = time.Now()
+		tracker = newChurnTracker(u, 2, log.NewLogfmtLogger(&buf))
+	)
+	tracker.last = start
+
+	loadObservations(t, u, makeObservations(t, []string{
+		`foo_total{id="1"} 1`,
+		`foo_total{id="2"} 1`,
+		`foo_total{id="3"} 1`,
+		`bar_size{} 1`,
+	}))
+	tracker.update(start.Add(10 * time.Second))
+
+	if want, have := []churnStat{
+		{Name: "foo_total", Series: 4, Created: 4, Recent: 4, Rate: 0.4},
+		{Name: "bar_size", Series: 1, Created: 1, Recent: 1, Rate: 0.1},
+	}, serveChurn(t, tracker); !cmp.Equal(want, have) {
+		t.Fatal(cmp.Diff(want, have))
+	}
+	if want, have := `metric=foo_total`, buf.String(); !strings.Contains(have, want) {
+		t.Errorf("want log line containing %q, have %q", want, have)
+	}
+	if strings.Contains(buf.String(), `metric=bar_size`) {
+		t.Errorf("bar_size should not exceed the churn threshold: %q", buf.String())
+	}
+
+	buf.Reset()
+	loadObservations(t, u, makeObservations(t, []string{
+		`foo_total{id="1"} 1`,
+		`foo_total{id="4"} 1`,
+	}))
+	tracker.update(start.Add(20 * time.Second))
+
+	if want, have := []churnStat{
+		{Name: "foo_total", Series: 5, Created: 5, Recent: 1, Rate: 0.1},
+		{Name: "bar_size", Series: 1, Created: 1, Recent: 0, Rate: 0},
+	}, serveChurn(t, tracker); !cmp.Equal(want, have) {
+		t.Fatal(cmp.Diff(want, have))
+	}
+	if buf.Len() > 0 {
+		t.Errorf("unexpected warnings: %q", buf.String())
+	}
+}
+
+func serveChurn(t *testing.T, tracker *churnTracker) []churnStat {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	tracker.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/churn", nil))
+	var stats []churnStat
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-kit/kit/log"
+)
+
+// clusterVirtualNodes is the number of points each node has on the hash
+// ring. More points spread series more evenly.
+const clusterVirtualNodes = 128
+
+// hashRing assigns keys to nodes by consistent hashing, so adding or
+// removing a node only moves the keys it gains or loses.
+type hashRing struct {
+	points []uint64 // sorted
+	nodes  []string // of each point
+}
+
+func newHashRing(nodes []string) *hashRing {
+	type point struct {
+		hash uint64
+		node string
+	}
+	var points []point
+	for _, node := range nodes {
+		for i := 0; i < clusterVirtualNodes; i++ {
+			points = append(points, point{hashKey(node + "#" + strconv.Itoa(i)), node})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+	r := &hashRing{points: make([]uint64, len(points)), nodes: make([]string, len(points))}
+	for i, p := range points {
+		r.points[i], r.nodes[i] = p.hash, p.node
+	}
+	return r
+}
+
+// owner returns the node which owns the key: the one with the first point
+// at or after its hash, wrapping around.
+func (r *hashRing) owner(key string) string {
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.nodes[i]
+}
+
+// hashKey hashes the key with FNV-1a, whose high bits barely change between
+// similar keys, like a node's points, and finishes it off with the
+// splitmix64 finalizer, which spreads them around the ring.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// cluster is an observer which shares the series among a cluster of
+// aggregators, by consistent hashing of the tenant, metric name, and labels
+// of each series. Observations of the series this node owns are observed
+// with the next observer, and the rest are streamed to their owners, whose
+// peerListeners observe them with theirs. So clients can write to any node,
+// every series lives on exactly one, and Prometheus scrapes all of them.
+type cluster struct {
+	local uint64 // atomic; first, for alignment; observations of this node's series
+
+	self     string
+	next     observer
+	ring     *hashRing
+	nodes    []string               // every node, including self, in order
+	streams  map[string]*peerStream // by node, except self
+	listener *peerListener
+}
+
+// newCluster returns a cluster of the nodes, which are host:port addresses
+// of their peer listeners, one of which is self.
+func newCluster(self string, nodes []string, network, token string, buffer int, next observer, logger log.Logger) (*cluster, error) {
+	c := &cluster{
+		self:     self,
+		next:     next,
+		ring:     newHashRing(nodes),
+		streams:  map[string]*peerStream{},
+		listener: newPeerListener(token, next, logger),
+	}
+	for _, node := range nodes {
+		if contains(c.nodes, node) {
+			return nil, fmt.Errorf("%s is in the cluster more than once", node)
+		}
+		c.nodes = append(c.nodes, node)
+		if node != self {
+			c.streams[node] = newPeerStream(network, node, token, buffer, logger)
+		}
+	}
+	if !contains(c.nodes, self) {
+		return nil, fmt.Errorf("%s isn't in the cluster", self)
+	}
+	return c, nil
+}
+
+func contains(a []string, s string) bool {
+	for _, x := range a {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ownerOf returns the node which owns the observation's series, or "" if it
+// belongs to every node, as a delete of every series of a metric does, or of
+// every series with some labels, and so does a declaration without a value,
+// so every node knows the metric.
+func (c *cluster) ownerOf(o observation) string {
+	if o.Op == "delete" && (o.Labels == nil || o.Match) || o.Op == "" && o.Value == nil {
+		return ""
+	}
+	return c.ring.owner(o.Tenant + "\xff" + string(o.timeseriesKey()))
+}
+
+func (c *cluster) observe(o observation) error {
+	return c.observeBatch([]observation{o})
+}
+
+// observeBatch observes the observations this node owns, and streams the
+// rest to their owners. Only the local observations can fail; the others
+// are checked by their owners, which log any they reject.
+func (c *cluster) observeBatch(obs []observation) error {
+	var (
+		local   = make([]observation, 0, len(obs))
+		indexes = make([]int, 0, len(obs))
+		remote  = map[string][]observation{}
+	)
+	for j, o := range obs {
+		owner := c.ownerOf(o)
+		if owner == "" || owner == c.self {
+			local, indexes = append(local, o), append(indexes, j)
+		}
+		for node := range c.streams {
+			if owner == "" || owner == node {
+				remote[node] = append(remote[node], o)
+			}
+		}
+	}
+	for node, batch := range remote {
+		c.streams[node].send(batch, nil)
+	}
+	if len(local) == 0 {
+		return nil
+	}
+	atomic.AddUint64(&c.local, uint64(len(local)))
+	err := c.next.observeBatch(local)
+	if err == nil || len(local) == len(obs) {
+		return err
+	}
+	errs := make(batchError, len(obs))
+	for j, n := range indexes {
+		errs[n] = errorAt(err, j)
+	}
+	return errs
+}
+
+// renderTelemetry writes the cluster's counters, by node, in the Prometheus
+// text format.
+func (c *cluster) renderTelemetry(w io.Writer) {
+	if c == nil {
+		return
+	}
+	fmt.Fprintf(w, "# HELP prometheus_aggregator_cluster_connected Whether observations are being streamed to each node.\n")
+	fmt.Fprintf(w, "# TYPE prometheus_aggregator_cluster_connected gauge\n")
+	for _, node := range c.nodes {
+		if s, ok := c.streams[node]; ok {
+			fmt.Fprintf(w, "prometheus_aggregator_cluster_connected{node=%s} %d\n", strconv.Quote(node), atomic.LoadInt32(&s.connected))
+		}
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "# HELP prometheus_aggregator_cluster_forwarded_observations_total Observations streamed to the node which owns their series.\n")
+	fmt.Fprintf(w, "# TYPE prometheus_aggregator_cluster_forwarded_observations_total counter\n")
+	for _, node := range c.nodes {
+		if s, ok := c.streams[node]; ok {
+			fmt.Fprintf(w, "prometheus_aggregator_cluster_forwarded_observations_total{node=%s} %d\n", strconv.Quote(node), atomic.LoadUint64(&s.sent))
+		}
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "# HELP prometheus_aggregator_cluster_dropped_observations_total Observations which never made it to the node which owns their series.\n")
+	fmt.Fprintf(w, "# TYPE prometheus_aggregator_cluster_dropped_observations_total counter\n")
+	for _, node := range c.nodes {
+		if s, ok := c.streams[node]; ok {
+			fmt.Fprintf(w, "prometheus_aggregator_cluster_dropped_observations_total{node=%s} %d\n", strconv.Quote(node), atomic.LoadUint64(&s.dropped))
+		}
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "# HELP prometheus_aggregator_cluster_local_observations_total Observations of series this node owns, from its own clients.\n")
+	fmt.Fprintf(w, "# TYPE prometheus_aggregator_cluster_local_observations_total counter\n")
+	fmt.Fprintf(w, "prometheus_aggregator_cluster_local_observations_total %d\n\n", atomic.LoadUint64(&c.local))
+	fmt.Fprintf(w, "# HELP prometheus_aggregator_cluster_received_observations_total Observations of series this node owns, from other nodes.\n")
+	fmt.Fprintf(w, "# TYPE prometheus_aggregator_cluster_received_observations_total counter\n")
+	fmt.Fprintf(w, "prometheus_aggregator_cluster_received_observations_total %d\n\n", atomic.LoadUint64(&c.listener.received))
+}
+
+// parseClusterNodes parses a comma-separated list of node addresses, like
+// tcp://10.0.0.1:8195, into their network, and host:port addresses, which
+// must all be on the same network.
+func parseClusterNodes(s string) (network string, nodes []string, err error) {
+	for _, addr := range strings.Split(s, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		i := strings.Index(addr, "://")
+		if i < 0 || addr[i+3:] == "" {
+			return "", nil, fmt.Errorf("%s must be an address like tcp://host:port", addr)
+		}
+		if network != "" && addr[:i] != network {
+			return "", nil, fmt.Errorf("every node must be on the same network, not %s and %s", network, addr[:i])
+		}
+		network = addr[:i]
+		nodes = append(nodes, addr[i+3:])
+	}
+	if len(nodes) == 0 {
+		return "", nil, fmt.Errorf("no nodes")
+	}
+	return network, nodes, nil
+}
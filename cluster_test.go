@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestHashRing(t *testing.T) {
+	nodes := []string{"10.0.0.1:8195", "10.0.0.2:8195", "10.0.0.3:8195"}
+	r := newHashRing(nodes)
+	owned := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		owned[r.owner(fmt.Sprintf("foo_total{id=%q}", i))]++
+	}
+	for _, node := range nodes {
+		if have := owned[node]; have < 700 || have > 1300 {
+			t.Errorf("%s: want about 1000 of 3000 keys, have %d", node, have)
+		}
+	}
+
+	// A new node only takes keys, it doesn't shuffle the rest.
+	r4 := newHashRing(append(nodes, "10.0.0.4:8195"))
+	var moved int
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("foo_total{id=%q}", i)
+		if before, after := r.owner(key), r4.owner(key); before != after {
+			if after != "10.0.0.4:8195" {
+				t.Fatalf("%s: moved from %s to %s, not the new node", key, before, after)
+			}
+			moved++
+		}
+	}
+	if moved < 450 || moved > 1050 {
+		t.Errorf("want about 750 of 3000 keys moved, have %d", moved)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	var (
+		lns   []net.Listener
+		nodes []string
+	)
+	for n := 0; n < 3; n++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		lns, nodes = append(lns, ln), append(nodes, ln.Addr().String())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var (
+		us       []*universe
+		clusters []*cluster
+	)
+	for n, self := range nodes {
+		u, _ := newUniverse(makeObservations(t, []string{
+			`{"name":"foo_total","type":"counter","help":"Foo."}`,
+		})...)
+		c, err := newCluster(self, nodes, "tcp", "s3cr3t", 16, u, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		go c.listener.serve(lns[n])
+		for _, s := range c.streams {
+			go s.run(ctx)
+		}
+		us, clusters = append(us, u), append(clusters, c)
+	}
+
+	// Clients write to any node, and every series ends up on its owner.
+	var obs []observation
+	for i := 0; i < 30; i++ {
+		o, _ := parseLine([]byte(fmt.Sprintf(`foo_total{id="%d"} 1`, i)))
+		obs = append(obs, o)
+	}
+	for _, c := range clusters {
+		if err := c.observeBatch(obs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	total := func() (series int, scrapes []string) {
+		for _, u := range us {
+			s := scrape(t, u)
+			series += strings.Count(s, "foo_total{id=")
+			scrapes = append(scrapes, s)
+		}
+		return series, scrapes
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, scrapes := total(); strings.Count(strings.Join(scrapes, ""), "} 3\n") == 30 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	series, scrapes := total()
+	if want, have := 30, series; want != have {
+		t.Errorf("series: want %d, have %d", want, have)
+	}
+	for n, s := range scrapes {
+		if strings.Count(s, "foo_total{id=") == 0 {
+			t.Errorf("%s: want some series, have none", nodes[n])
+		}
+	}
+	if want, have := 30, strings.Count(strings.Join(scrapes, ""), "} 3\n"); want != have {
+		t.Errorf("want %d series of 3, have %d:\n%s", want, have, strings.Join(scrapes, "\n"))
+	}
+
+	// A declaration without a value declares the metric on every node.
+	if err := clusters[0].observe(makeObservations(t, []string{`{"name":"bar","type":"gauge","help":"Bar.","labels":{"id":"1"}}`})[0]); err != nil {
+		t.Fatal(err)
+	}
+	declared := func() (n int) {
+		for _, u := range us {
+			if u.collection("bar") != nil {
+				n++
+			}
+		}
+		return n
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && declared() < len(us) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if want, have := len(us), declared(); want != have {
+		t.Errorf("declared on %d nodes, want %d", have, want)
+	}
+
+	// Deleting every series of a metric deletes them on every node.
+	if err := clusters[0].observe(observation{Name: "foo_total", Op: "delete"}); err != nil {
+		t.Fatal(err)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if series, _ := total(); series == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if series, _ := total(); series != 0 {
+		t.Errorf("after a delete, want no series, have %d", series)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// coarseSuffix is appended to the name of a histogram declared with coarse
+// buckets, to name the histogram of them.
+const coarseSuffix = "_coarse"
+
+// normalizeCoarse returns the coarse buckets of a declaration, normalized,
+// and the indexes of them in its normalized buckets, of which they must be a
+// subset, so the coarse histogram can be rendered from the counts of the
+// fine one, and every observation is in both.
+func normalizeCoarse(typ string, buckets, coarse []float64) ([]float64, []int, error) {
+	if coarse == nil {
+		return nil, nil, nil
+	}
+	if typ != "histogram" {
+		return nil, nil, fmt.Errorf("coarse buckets are only for histograms, not %ss", typ)
+	}
+	coarse, err := normalizeBuckets(coarse)
+	if err != nil {
+		return nil, nil, err
+	}
+	indexes := make([]int, len(coarse))
+	j := 0
+	for i, b := range coarse {
+		for j < len(buckets) && buckets[j] < b {
+			j++
+		}
+		if j == len(buckets) || buckets[j] != b {
+			return nil, nil, fmt.Errorf("coarse bucket %s isn't one of the buckets", appendLE(nil, b))
+		}
+		indexes[i] = j
+	}
+	return coarse, indexes, nil
+}
+
+// sameCoarse returns true if the coarse buckets, once normalized, are the
+// collection's coarse buckets.
+func (c *timeseriesCollection) sameCoarse(coarse []float64) bool {
+	normalized, _, err := normalizeCoarse(c.typ, c.buckets, coarse)
+	if err != nil || len(normalized) != len(c.coarse) {
+		return false
+	}
+	for i := range normalized {
+		if normalized[i] != c.coarse[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// coarseRenderer is a histogram which can render only some of its buckets,
+// as another histogram.
+type coarseRenderer interface {
+	renderCoarse(name string, indexes []int, precision int) string
+}
+
+// writeCoarse writes the coarse histogram of a collection of histograms,
+// and returns the number of series written.
+func writeCoarse(buf *bytes.Buffer, n metricName, help string, indexes []int, values []timeseriesValue, precision int) (series int) {
+	name := string(n) + coarseSuffix
+	writeHeader(buf, name, help+" (coarse buckets)", "histogram")
+	for _, v := range values {
+		h, ok := v.(coarseRenderer)
+		if !ok || !v.touched() {
+			continue
+		}
+		buf.WriteString(h.renderCoarse(name, indexes, precision))
+		series++
+	}
+	buf.WriteByte('\n')
+	return series
+}
+
+func (h *histogram) renderCoarse(name string, indexes []int, precision int) string {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	b := make([]byte, 0, (len(indexes)+3)*(len(name)+len(h.k)+24))
+	var le [32]byte
+	counts := h.cumulativeCounts()
+	for _, i := range indexes {
+		b = appendBucket(b, name, h.labels, appendLE(le[:0], h.buckets[i].max), counts[i])
+	}
+	b = appendBucket(b, name, h.labels, infLE, h.count)
+	b = appendSample(b, name, "_sum", h.labels, h.sum, precision)
+	b = appendCount(b, name, "_count", h.labels, h.count)
+	return string(b)
+}
+
+func (w *windowedHistogram) renderCoarse(name string, indexes []int, precision int) string {
+	_, last := w.histograms()
+	return last.renderCoarse(name, indexes, precision)
+}
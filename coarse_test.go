@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCoarseBuckets(t *testing.T) {
+	u, err := newUniverse(makeObservations(t, []string{
+		`{"name":"lat_seconds","type":"histogram","help":"Latency.","buckets":[0.1,0.25,0.5,1,2.5],"coarse":[0.5,2.5]}`,
+	})...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadObservations(t, u, makeObservations(t, []string{
+		`lat_seconds{route="/a"} 0.2`,
+		`lat_seconds{route="/a"} 0.4`,
+		`lat_seconds{route="/a"} 2`,
+		`lat_seconds{route="/a"} 3`,
+	}))
+	have := scrape(t, u)
+	for _, want := range []string{
+		"# HELP lat_seconds_coarse Latency. (coarse buckets)\n# TYPE lat_seconds_coarse histogram\n",
+		"lat_seconds_bucket{le=\"0.25\",route=\"/a\"} 1\n",
+		"lat_seconds_coarse_bucket{le=\"0.5\",route=\"/a\"} 2\n",
+		"lat_seconds_coarse_bucket{le=\"2.5\",route=\"/a\"} 3\n",
+		"lat_seconds_coarse_bucket{le=\"+Inf\",route=\"/a\"} 4\n",
+		"lat_seconds_coarse_sum{route=\"/a\"} 5.6\n",
+		"lat_seconds_coarse_count{route=\"/a\"} 4\n",
+	} {
+		if !strings.Contains(have, want) {
+			t.Errorf("want %q, have\n%s", strings.TrimSpace(want), have)
+		}
+	}
+	if strings.Contains(have, "lat_seconds_coarse_bucket{le=\"0.25\",route=\"/a\"}") {
+		t.Errorf("coarse histogram has a fine bucket\n%s", have)
+	}
+
+	if err := u.observe(observation{Name: "lat_seconds", Type: "histogram", Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5}, Coarse: []float64{1}}); err == nil {
+		t.Errorf("other coarse buckets: want error, have none")
+	}
+	if want, have := []float64{0.5, 2.5}, u.declarations()[0].Coarse; len(want) != len(have) || want[0] != have[0] || want[1] != have[1] {
+		t.Errorf("declaration: want %v, have %v", want, have)
+	}
+}
+
+func TestNormalizeCoarse(t *testing.T) {
+	buckets := []float64{0.1, 0.5, 1}
+	for _, testcase := range []struct {
+		typ    string
+		coarse []float64
+		want   []int
+		valid  bool
+	}{
+		{"histogram", nil, nil, true},
+		{"histogram", []float64{1, 0.1}, []int{0, 2}, true},
+		{"histogram", []float64{0.25}, nil, false},
+		{"histogram", []float64{2}, nil, false},
+		{"gauge", []float64{1}, nil, false},
+	} {
+		_, have, err := normalizeCoarse(testcase.typ, buckets, testcase.coarse)
+		if want, have := testcase.valid, err == nil; want != have {
+			t.Errorf("%s %v: want valid %v, have %v (%v)", testcase.typ, testcase.coarse, want, have, err)
+		}
+		if want := testcase.want; len(want) != len(have) || (len(want) > 0 && (want[0] != have[0] || want[len(want)-1] != have[len(have)-1])) {
+			t.Errorf("%s %v: want %v, have %v", testcase.typ, testcase.coarse, want, have)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// config is the contents of a YAML (or JSON) -config file. The declarations
+// key holds metric declarations, in the same format as the declfile, the
+// rename key maps incoming metric names to new ones, the relabel and topk
+// keys hold relabel and top-k rules, and the derived and rollups keys hold
+// derived metrics and rollups. Every other key names a flag, and its value is
+// used as if it were passed on the command line.
+type config struct {
+	Declarations []observation          `yaml:"declarations"`
+	Rename       map[string]string      `yaml:"rename"`
+	Relabel      []relabelRule          `yaml:"relabel"`
+	Derived      []derivedRule          `yaml:"derived"`
+	Rollups      []rollupRule           `yaml:"rollups"`
+	TopK         []topKRule             `yaml:"topk"`
+	Settings     map[string]interface{} `yaml:",inline"`
+}
+
+func readConfig(filename string) (config, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return config{}, err
+	}
+	var c config
+	if err := yaml.UnmarshalStrict(buf, &c); err != nil {
+		return config{}, errors.Wrapf(err, "error parsing %s", filename)
+	}
+	for from, to := range c.Rename {
+		if from == "" || !validMetricName(to) {
+			return config{}, fmt.Errorf("%s: can't rename %q to %q", filename, from, to)
+		}
+	}
+	for i := range c.Relabel {
+		if err := c.Relabel[i].compile(); err != nil {
+			return config{}, errors.Wrapf(err, "%s: relabel rule %d", filename, i+1)
+		}
+	}
+	for i, r := range c.Derived {
+		if err := r.check(); err != nil {
+			return config{}, errors.Wrapf(err, "%s: derived metric %d", filename, i+1)
+		}
+	}
+	for i, r := range c.Rollups {
+		if err := r.check(); err != nil {
+			return config{}, errors.Wrapf(err, "%s: rollup %d", filename, i+1)
+		}
+	}
+	for i, r := range c.TopK {
+		if err := r.check(); err != nil {
+			return config{}, errors.Wrapf(err, "%s: topk rule %d", filename, i+1)
+		}
+	}
+	return c, nil
+}
+
+// apply sets the flags named by the config settings. Flags that were
+// explicitly passed on the command line take precedence, and are skipped.
+// Lists set flags that may be repeated once per element.
+// Unknown settings, and values that the flag rejects, are errors.
+func (c config) apply(fs *flag.FlagSet) error {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	keys := make([]string, 0, len(c.Settings))
+	for k := range c.Settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var problems []string
+	for _, k := range keys {
+		if k == "config" || fs.Lookup(k) == nil {
+			problems = append(problems, fmt.Sprintf("unknown setting %q", k))
+			continue
+		}
+		if explicit[k] {
+			continue
+		}
+		var values []string
+		switch v := c.Settings[k].(type) {
+		case string, bool, int, float64:
+			values = []string{fmt.Sprint(v)}
+		case []interface{}:
+			if _, ok := fs.Lookup(k).Value.(repeatable); !ok {
+				problems = append(problems, fmt.Sprintf("%s: invalid value %v", k, v))
+				continue
+			}
+			for _, e := range v {
+				values = append(values, fmt.Sprint(e))
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("%s: invalid value %v", k, v))
+			continue
+		}
+		for _, value := range values {
+			if err := fs.Set(k, value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", k, err))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// repeatable is implemented by flags which may be repeated on the command
+// line, each time adding to their value.
+type repeatable interface {
+	repeatable()
+}
+
+// envPrefix is prepended to the environment variable name for each flag.
+const envPrefix = "PROMAGG_"
+
+// envName returns the environment variable corresponding to a flag name,
+// e.g. churn-warn becomes PROMAGG_CHURN_WARN.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// applyEnv sets flags from their corresponding environment variables.
+// Flags that were explicitly passed on the command line take precedence,
+// and are skipped.
+func applyEnv(fs *flag.FlagSet, lookup func(string) (string, bool)) error {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	var problems []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if explicit[f.Name] {
+			return
+		}
+		value, ok := lookup(envName(f.Name))
+		if !ok {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", envName(f.Name), err))
+		}
+	})
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "config.yaml")
+	writeFile(t, filename, `
+socket: udp://127.0.0.1:9999
+strict: true
+churn-interval: 30s
+churn-warn: 100
+label: [region=eu-west-1, cluster=blue]
+declarations:
+  - name: foo_total
+    type: counter
+    help: Total number of foos.
+  - name: bar_seconds
+    type: histogram
+    help: Bar duration.
+    buckets: [0.1, 1]
+`)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var (
+		socket   = fs.String("socket", "tcp://127.0.0.1:8191", "")
+		strict   = fs.Bool("strict", false, "")
+		churnInt = fs.Duration("churn-interval", time.Minute, "")
+		churnMax = fs.Uint64("churn-warn", 0, "")
+		labels   = constLabels{}
+	)
+	fs.Var(labels, "label", "")
+	fs.String("config", "", "")
+	if err := fs.Parse([]string{"-churn-warn", "5"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := readConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.apply(fs); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "udp://127.0.0.1:9999", *socket; want != have {
+		t.Errorf("socket: want %q, have %q", want, have)
+	}
+	if want, have := true, *strict; want != have {
+		t.Errorf("strict: want %v, have %v", want, have)
+	}
+	if want, have := 30*time.Second, *churnInt; want != have {
+		t.Errorf("churn-interval: want %v, have %v", want, have)
+	}
+	if want, have := uint64(5), *churnMax; want != have {
+		t.Errorf("churn-warn: command line should win, want %d, have %d", want, have)
+	}
+	if want, have := "cluster=blue,region=eu-west-1", labels.String(); want != have {
+		t.Errorf("label: want %q, have %q", want, have)
+	}
+	if want, have := []observation{
+		{Name: "foo_total", Type: "counter", Help: "Total number of foos."},
+		{Name: "bar_seconds", Type: "histogram", Help: "Bar duration.", Buckets: []float64{0.1, 1}},
+	}, c.Declarations; !cmp.Equal(want, have) {
+		t.Error(cmp.Diff(want, have))
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Bool("strict", false, "")
+	fs.Var(constLabels{}, "label", "")
+	fs.String("config", "", "")
+	for name, settings := range map[string]map[string]interface{}{
+		"unknown setting": {"nope": "x"},
+		"recursive":       {"config": "other.yaml"},
+		"bad value":       {"strict": "maybe"},
+		"list value":      {"strict": []interface{}{true}},
+		"bad list value":  {"label": []interface{}{"region=eu", "nope"}},
+	} {
+		if err := (config{Settings: settings}).apply(fs); err == nil {
+			t.Errorf("%s: want error, have none", name)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var (
+		socket   = fs.String("socket", "tcp://127.0.0.1:8191", "")
+		strict   = fs.Bool("strict", false, "")
+		churnMax = fs.Uint64("churn-warn", 0, "")
+		labels   = constLabels{}
+	)
+	fs.Var(labels, "label", "")
+	if err := fs.Parse([]string{"-strict=false"}); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"PROMAGG_SOCKET":     "unix:///tmp/promagg.sock",
+		"PROMAGG_STRICT":     "true",
+		"PROMAGG_CHURN_WARN": "10",
+	}
+	lookup := func(k string) (string, bool) { v, ok := env[k]; return v, ok }
+	if err := applyEnv(fs, lookup); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "unix:///tmp/promagg.sock", *socket; want != have {
+		t.Errorf("socket: want %q, have %q", want, have)
+	}
+	if want, have := false, *strict; want != have {
+		t.Errorf("strict: command line should win, want %v, have %v", want, have)
+	}
+	if want, have := uint64(10), *churnMax; want != have {
+		t.Errorf("churn-warn: want %d, have %d", want, have)
+	}
+
+	env["PROMAGG_CHURN_WARN"] = "lots"
+	if err := applyEnv(flag.NewFlagSet("test", flag.ContinueOnError), lookup); err != nil {
+		t.Errorf("unrelated flag set: want no error, have %v", err)
+	}
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Uint64("churn-warn", 0, "")
+	if err := applyEnv(fs, lookup); err == nil {
+		t.Errorf("bad value: want error, have none")
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// derivedRule is one of the derived metrics in the config file, which are
+// computed from the counters and gauges in the universe at scrape time, and
+// rendered as gauges after them, for consumers which can't run PromQL. A
+// rule either sums a metric, or divides the sum of one metric by the sum of
+// another, e.g. errors by requests. Either way, the sum is by the labels in
+// by, if any, like PromQL's sum by, and is over everything otherwise.
+type derivedRule struct {
+	Name  string   `yaml:"name"`
+	Help  string   `yaml:"help"`
+	Sum   string   `yaml:"sum"`
+	Ratio []string `yaml:"ratio"` // numerator and denominator
+	By    []string `yaml:"by"`
+}
+
+// check returns an error if the rule isn't valid.
+func (r derivedRule) check() error {
+	switch {
+	case !validMetricName(r.Name):
+		return fmt.Errorf("invalid name %q", r.Name)
+	case r.Help == "":
+		return fmt.Errorf("%s requires help", r.Name)
+	case (r.Sum == "") == (r.Ratio == nil):
+		return fmt.Errorf("%s requires either sum or ratio, not both", r.Name)
+	case r.Ratio != nil && len(r.Ratio) != 2:
+		return fmt.Errorf("%s ratio requires a numerator and a denominator", r.Name)
+	}
+	for _, l := range r.By {
+		if !validLabelName(l) {
+			return fmt.Errorf("%s has invalid by label %q", r.Name, l)
+		}
+	}
+	return nil
+}
+
+// derivedGroup is the sum of the series with the same by labels.
+type derivedGroup struct {
+	labels labelPairs
+	value  float64
+}
+
+// sum returns the sum of the metric's series by the rule's by labels, keyed
+// by the rendered labels. Metrics which aren't counters or gauges have none.
+func (r derivedRule) sum(u *universe, n string) map[string]*derivedGroup {
+	groups := map[string]*derivedGroup{}
+	c := u.collection(metricName(n))
+	if c == nil || (c.typ != "counter" && c.typ != "gauge") {
+		return groups
+	}
+	for _, v := range c.series() {
+		value, ok := seriesValue(v)
+		if !ok || !v.touched() {
+			continue
+		}
+		by := make(map[string]string, len(r.By))
+		for _, p := range v.labelSet() {
+			for _, l := range r.By {
+				if p.name == l && p.value != "" {
+					by[l] = p.value
+				}
+			}
+		}
+		k := renderLabels(by)
+		g, ok := groups[k]
+		if !ok {
+			g = &derivedGroup{labels: makeLabelPairs(by)}
+			groups[k] = g
+		}
+		g.value += value
+	}
+	return groups
+}
+
+// seriesValue returns the value of a counter or gauge, and false for
+// anything else.
+func seriesValue(v timeseriesValue) (float64, bool) {
+	switch v := v.(type) {
+	case *counter:
+		return v.value.load(), true
+	case *perSecondCounter:
+		return v.value.load(), true
+	case *gauge:
+		return v.value.load(), true
+	case *minMaxGauge:
+		return v.value.load(), true
+	case *ewmaGauge:
+		return v.value.load(), true
+	default:
+		return 0, false
+	}
+}
+
+// eval returns the groups of the derived metric. Ratios of groups whose
+// denominator is zero are left out, rather than rendered as NaN or Inf.
+func (r derivedRule) eval(u *universe) map[string]*derivedGroup {
+	if r.Sum != "" {
+		return r.sum(u, r.Sum)
+	}
+	num, den := r.sum(u, r.Ratio[0]), r.sum(u, r.Ratio[1])
+	for k, g := range den {
+		if g.value == 0 {
+			delete(den, k)
+			continue
+		}
+		var n float64
+		if ng, ok := num[k]; ok {
+			n = ng.value
+		}
+		g.value = n / g.value
+	}
+	return den
+}
+
+// deriver renders the derived metrics in the config file, and reads them
+// again on reload. A nil deriver renders nothing.
+type deriver struct {
+	u      *universe
+	config string
+
+	mtx   sync.RWMutex
+	rules []derivedRule
+}
+
+// newDeriver reads the derived metrics in the config file. If there's no
+// config file, it returns nil.
+func newDeriver(u *universe, config string) (*deriver, error) {
+	if config == "" {
+		return nil, nil
+	}
+	d := &deriver{u: u, config: config}
+	if err := d.reload(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// reload reads the derived metrics again. If that fails, the previous ones
+// are kept.
+func (d *deriver) reload() error {
+	if d == nil {
+		return nil
+	}
+	c, err := readConfig(d.config)
+	if err != nil {
+		return err
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.rules = c.Derived
+	return nil
+}
+
+// renderTelemetry writes the derived metrics, in the Prometheus text format.
+// Derived metrics with the name of a metric in the universe are skipped, as
+// are those without any groups.
+func (d *deriver) renderTelemetry(w io.Writer) {
+	if d == nil {
+		return
+	}
+	d.mtx.RLock()
+	rules := d.rules
+	d.mtx.RUnlock()
+	var b []byte
+	for _, r := range rules {
+		if d.u.collection(metricName(r.Name)) != nil {
+			continue
+		}
+		groups := r.eval(d.u)
+		if len(groups) == 0 {
+			continue
+		}
+		keys := make([]string, 0, len(groups))
+		for k := range groups {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		help := r.Help
+		if needsEscaping(help, false) {
+			help = string(appendEscaped(nil, help, false))
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", r.Name, help, r.Name)
+		for _, k := range keys {
+			b = appendSample(b[:0], r.Name, "", groups[k].labels, groups[k].value, d.u.precision)
+			w.Write(b)
+		}
+		fmt.Fprintln(w)
+	}
+}
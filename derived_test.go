@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDerived(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"req_total","type":"counter","help":"Requests."}`,
+		`{"name":"err_total","type":"counter","help":"Errors."}`,
+		`{"name":"lat_seconds","type":"histogram","help":"Latency.","buckets":[1]}`,
+		`req_total{route="/a",instance="1"} 6`,
+		`req_total{route="/a",instance="2"} 4`,
+		`req_total{route="/b",instance="1"} 5`,
+		`req_total{instance="3"} 1`,
+		`err_total{route="/a",instance="1"} 1`,
+		`err_total{route="/b",instance="2"} 5`,
+		`lat_seconds{} 0.5`,
+	})...)
+	filename := filepath.Join(dir, "config.yaml")
+	writeFile(t, filename, `derived:
+  - {name: req_by_route, help: "Requests, by route.", sum: req_total, by: [route]}
+  - {name: err_ratio, help: "Errors per request.", ratio: [err_total, req_total]}
+  - {name: err_ratio_by_route, help: "Errors per request, by route.", ratio: [err_total, req_total], by: [route]}
+  - {name: lat_total, help: "Not a counter or gauge.", sum: lat_seconds}
+  - {name: req_total, help: "Already a metric.", sum: err_total}
+`)
+	d, err := newDeriver(u, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	d.renderTelemetry(&buf)
+	if want, have := normalizeResponse(`
+		# HELP req_by_route Requests, by route.
+		# TYPE req_by_route gauge
+		req_by_route{route="/a"} 10
+		req_by_route{route="/b"} 5
+		req_by_route{} 1
+
+		# HELP err_ratio Errors per request.
+		# TYPE err_ratio gauge
+		err_ratio{} 0.375
+
+		# HELP err_ratio_by_route Errors per request, by route.
+		# TYPE err_ratio_by_route gauge
+		err_ratio_by_route{route="/a"} 0.1
+		err_ratio_by_route{route="/b"} 1
+		err_ratio_by_route{} 0
+	`), normalizeResponse(buf.String()); want != have {
+		t.Errorf("want\n%s\nhave\n%s", want, have)
+	}
+	if errs := validateExposition(buf.Bytes()); len(errs) > 0 {
+		t.Errorf("invalid exposition: %v", errs)
+	}
+
+	// Bad rules are errors, and the previous rules are kept.
+	for _, bad := range []string{
+		"derived:\n  - {name: x, sum: req_total}\n",
+		"derived:\n  - {name: 1x, help: X., sum: req_total}\n",
+		"derived:\n  - {name: x, help: X., sum: req_total, ratio: [a, b]}\n",
+		"derived:\n  - {name: x, help: X., ratio: [a]}\n",
+		"derived:\n  - {name: x, help: X., sum: req_total, by: [1a]}\n",
+	} {
+		writeFile(t, filename, bad)
+		if err := d.reload(); err == nil {
+			t.Errorf("%q: want error, have none", bad)
+		}
+	}
+	if want, have := 5, len(d.rules); want != have {
+		t.Errorf("after bad reloads: want %d rules, have %d", want, have)
+	}
+}
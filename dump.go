@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync/atomic"
+)
+
+// universeDump is a complete, JSON-friendly copy of the universe state.
+type universeDump struct {
+	Metrics []collectionDump `json:"metrics"`
+}
+
+// collectionDump is the declaration and state of a single metric.
+type collectionDump struct {
+	Name    string       `json:"name"`
+	Type    string       `json:"type"`
+	Help    string       `json:"help"`
+	Buckets []float64    `json:"buckets,omitempty"`
+	Coarse  []float64    `json:"coarse,omitempty"`
+	Mode    string       `json:"mode,omitempty"`
+	Alpha   float64      `json:"alpha,omitempty"`
+	Window  string       `json:"window,omitempty"`
+	Series  []seriesDump `json:"series"`
+
+	Quantiles  []float64 `json:"quantiles,omitempty"`
+	AgeBuckets int       `json:"age_buckets,omitempty"`
+}
+
+// declaration returns the declaration of the dumped metric.
+func (cd collectionDump) declaration() observation {
+	return observation{Name: cd.Name, Type: cd.Type, Help: cd.Help, Buckets: cd.Buckets, Coarse: cd.Coarse, Mode: cd.Mode, Alpha: cd.Alpha, Window: cd.Window, Quantiles: cd.Quantiles, AgeBuckets: cd.AgeBuckets}
+}
+
+// seriesDump is the state of a single timeseries. Counters and gauges have
+// a value; histograms have a sum, count, and cumulative bucket counts, in
+// the same order as the buckets of the collection; and summaries have a sum
+// and count.
+type seriesDump struct {
+	Labels       map[string]string `json:"labels,omitempty"`
+	Value        *float64          `json:"value,omitempty"`
+	Sum          *float64          `json:"sum,omitempty"`
+	Count        *uint64           `json:"count,omitempty"`
+	BucketCounts []uint64          `json:"bucket_counts,omitempty"`
+}
+
+// dump copies the state of every touched timeseries in the universe.
+func (u *universe) dump() universeDump {
+	names, collections := u.sortedCollections()
+	d := universeDump{Metrics: make([]collectionDump, 0, len(names))}
+	for i, n := range names {
+		d.Metrics = append(d.Metrics, collections[i].dump(n))
+	}
+	return d
+}
+
+func (c *timeseriesCollection) dump(n metricName) collectionDump {
+	d := c.declaration(n)
+	cd := collectionDump{
+		Name:    d.Name,
+		Type:    d.Type,
+		Help:    d.Help,
+		Buckets: d.Buckets,
+		Coarse:  d.Coarse,
+		Mode:    d.Mode,
+		Alpha:   d.Alpha,
+		Window:  d.Window,
+		Series:  []seriesDump{},
+
+		Quantiles:  d.Quantiles,
+		AgeBuckets: d.AgeBuckets,
+	}
+	for _, v := range c.series() {
+		if v.touched() {
+			cd.Series = append(cd.Series, v.dump())
+		}
+	}
+	return cd
+}
+
+func (c *counter) dump() seriesDump {
+	value := c.value.load()
+	return seriesDump{Labels: c.labels.toMap(), Value: &value}
+}
+
+func (g *gauge) dump() seriesDump {
+	value := g.value.load()
+	return seriesDump{Labels: g.labels.toMap(), Value: &value}
+}
+
+func (h *histogram) dump() seriesDump {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	sum, count := h.sum, h.count
+	return seriesDump{Labels: h.labels.toMap(), Sum: &sum, Count: &count, BucketCounts: h.cumulativeCounts()}
+}
+
+// restore sets the counter to the dumped value.
+func (c *counter) restore(sd seriesDump) error {
+	if sd.Value == nil {
+		return fmt.Errorf("counter has no value")
+	}
+	c.value.store(*sd.Value)
+	atomic.StoreUint32(&c.touch, 1)
+	return nil
+}
+
+// restore sets the gauge to the dumped value.
+func (g *gauge) restore(sd seriesDump) error {
+	if sd.Value == nil {
+		return fmt.Errorf("gauge has no value")
+	}
+	g.value.store(*sd.Value)
+	atomic.StoreUint32(&g.touch, 1)
+	return nil
+}
+
+// restore sets the histogram to the dumped sum, count, and bucket counts,
+// which must be for the same buckets.
+func (h *histogram) restore(sd seriesDump) error {
+	if sd.Sum == nil || sd.Count == nil || len(sd.BucketCounts) != len(h.buckets) {
+		return fmt.Errorf("histogram has no sum or count, or the wrong number of buckets")
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	var previous uint64
+	for _, cumulative := range sd.BucketCounts {
+		if cumulative < previous || cumulative > *sd.Count {
+			return fmt.Errorf("histogram bucket counts aren't cumulative")
+		}
+		previous = cumulative
+	}
+	previous = 0
+	for i, cumulative := range sd.BucketCounts {
+		h.buckets[i].count = cumulative - previous
+		previous = cumulative
+	}
+	h.sum, h.count = *sd.Sum, *sd.Count
+	h.version++
+	return nil
+}
+
+// declfile converts the dump to declarations, in the format of a declfile,
+// which seed another aggregator with the same totals: each metric is
+// declared, and followed by an observation of each of its series, which
+// sets a gauge, adds to a counter, and merges into a histogram. Series with
+// values JSON can't represent, i.e. NaN and infinities, are skipped, and so
+// are the series of summaries, which can't be merged into.
+func (d universeDump) declfile() []observation {
+	decls := []observation{}
+	for _, cd := range d.Metrics {
+		decls = append(decls, cd.declaration())
+		for _, sd := range cd.Series {
+			o := observation{Name: cd.Name, Labels: sd.Labels}
+			switch cd.Type {
+			case "counter", "gauge":
+				if sd.Value == nil || math.IsNaN(*sd.Value) || math.IsInf(*sd.Value, 0) {
+					continue
+				}
+				o.Value = sd.Value
+			case "histogram":
+				if sd.Sum == nil || sd.Count == nil || math.IsNaN(*sd.Sum) || math.IsInf(*sd.Sum, 0) {
+					continue
+				}
+				o.Op, o.Value, o.Counts = "merge", sd.Sum, make([]uint64, len(sd.BucketCounts)+1)
+				var below uint64
+				for i, c := range sd.BucketCounts {
+					o.Counts[i], below = c-below, c
+				}
+				o.Counts[len(sd.BucketCounts)] = *sd.Count - below
+			default:
+				continue
+			}
+			decls = append(decls, o)
+		}
+	}
+	return decls
+}
+
+// dumpHandler serves the complete universe state as JSON, or with
+// ?format=declfile, as a declfile which seeds another aggregator with it.
+func dumpHandler(u *universe) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch format := r.URL.Query().Get("format"); format {
+		case "", "dump":
+			respondJSON(w, http.StatusOK, u.dump())
+		case "declfile":
+			respondJSON(w, http.StatusOK, u.dump().declfile())
+		default:
+			http.Error(w, fmt.Sprintf("invalid format %q", format), http.StatusBadRequest)
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDump(t *testing.T) {
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`{"name":"bar_seconds","type":"histogram","help":"Bar duration.","buckets":[0.1,1]}`,
+		`{"name":"baz_size","type":"gauge","help":"Current size of baz."}`,
+	})...)
+	loadObservations(t, u, makeObservations(t, []string{
+		`foo_total{code="200"} 1`,
+		`foo_total{code="200"} 2`,
+		`bar_seconds{} 0.05`,
+		`bar_seconds{} 0.5`,
+		`bar_seconds{} 5`,
+	}))
+
+	rec := httptest.NewRecorder()
+	dumpHandler(u).ServeHTTP(rec, httptest.NewRequest("GET", "/admin/dump", nil))
+	var have universeDump
+	if err := json.Unmarshal(rec.Body.Bytes(), &have); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		three = 3.0
+		sum   = 5.55
+		count = uint64(3)
+	)
+	want := universeDump{Metrics: []collectionDump{
+		{
+			Name:    "bar_seconds",
+			Type:    "histogram",
+			Help:    "Bar duration.",
+			Buckets: []float64{0.1, 1},
+			Series:  []seriesDump{{Sum: &sum, Count: &count, BucketCounts: []uint64{1, 2}}},
+		},
+		{
+			Name:   "baz_size",
+			Type:   "gauge",
+			Help:   "Current size of baz.",
+			Series: []seriesDump{},
+		},
+		{
+			Name:   "foo_total",
+			Type:   "counter",
+			Help:   "Total number of foos.",
+			Series: []seriesDump{{Labels: map[string]string{"code": "200"}, Value: &three}},
+		},
+	}}
+	if !cmp.Equal(want, have) {
+		t.Fatal(cmp.Diff(want, have))
+	}
+}
+
+func TestDumpDeclfile(t *testing.T) {
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`{"name":"bar_seconds","type":"histogram","help":"Bar duration.","buckets":[0.1,1]}`,
+		`{"name":"baz_size","type":"gauge","help":"Current size of baz."}`,
+		`{"name":"qux_size","type":"gauge","help":"Current size of qux."}`,
+	})...)
+	loadObservations(t, u, makeObservations(t, []string{
+		`foo_total{code="200"} 1`,
+		`foo_total{code="500"} 2`,
+		`bar_seconds{} 0.05`,
+		`bar_seconds{} 0.5`,
+		`bar_seconds{} 5`,
+		`baz_size{} 7`,
+		`qux_size{} NaN`,
+	}))
+
+	rec := httptest.NewRecorder()
+	dumpHandler(u).ServeHTTP(rec, httptest.NewRequest("GET", "/admin/dump?format=declfile", nil))
+	var decls []observation
+	if err := json.Unmarshal(rec.Body.Bytes(), &decls); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body.String())
+	}
+	seeded, err := newUniverse(decls...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, have := u.dump(), seeded.dump()
+	want.Metrics[3].Series = []seriesDump{} // NaN can't be in JSON
+	if !cmp.Equal(want, have) {
+		t.Fatal(cmp.Diff(want, have))
+	}
+
+	rec = httptest.NewRecorder()
+	dumpHandler(u).ServeHTTP(rec, httptest.NewRequest("GET", "/admin/dump?format=xml", nil))
+	if want, have := 400, rec.Code; want != have {
+		t.Errorf("invalid format: want %d, have %d", want, have)
+	}
+}
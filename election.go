@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// consulSessionTTL is how long the leader's Consul session lives without
+// being renewed. It's renewed every third of that, so a leader which goes
+// away is replaced within about that long.
+const consulSessionTTL = 15 * time.Second
+
+// election decides which of a pair of aggregators is the leader, which
+// serves scrapes, and which is the standby, which doesn't, but is kept up
+// to date by replication, so it's ready to take over. The leader holds a
+// lock in Consul, with a session which it renews, and releases when it
+// shuts down; if it doesn't, the session expires. A nil election always
+// leads.
+type election struct {
+	leading int32 // atomic; 1 while holding the lock
+
+	consulAPI
+	key    string
+	id     string // of this aggregator, stored in the key while it leads
+	logger log.Logger
+
+	session string // only used by run
+
+	mtx    sync.Mutex
+	holder string // id of the leader, as last seen
+}
+
+func newElection(api, key, id, token string, logger log.Logger) *election {
+	return &election{
+		consulAPI: newConsulAPI(api, token),
+		key:       strings.Trim(key, "/"),
+		id:        id,
+		logger:    logger,
+	}
+}
+
+// leader returns true if this aggregator is the leader.
+func (e *election) leader() bool {
+	return e == nil || atomic.LoadInt32(&e.leading) == 1
+}
+
+// run campaigns for the lock, and keeps it once it has it, until the
+// context is canceled, and then resigns.
+func (e *election) run(ctx context.Context) error {
+	ticker := time.NewTicker(consulSessionTTL / 3)
+	defer ticker.Stop()
+	defer e.resign()
+	for {
+		if err := e.campaign(ctx); err != nil && ctx.Err() == nil {
+			level.Warn(e.logger).Log("during", "election", "err", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// campaign renews the session, or creates one, and tries to acquire the
+// lock with it. Acquiring a lock the session already holds succeeds, so a
+// leader which still leads does, too. If anything fails, it steps down,
+// since it can't be sure it still leads.
+func (e *election) campaign(ctx context.Context) error {
+	if e.session != "" {
+		if err := e.do(ctx, "PUT", "/v1/session/renew/"+e.session, nil, nil); err != nil {
+			e.setLeading(false)
+			e.session = "" // expired, most likely
+			return err
+		}
+	}
+	if e.session == "" {
+		body, _ := json.Marshal(map[string]string{
+			"Name":      "prometheus-aggregator " + e.id,
+			"TTL":       consulSessionTTL.String(),
+			"LockDelay": "1s",
+			"Behavior":  "release",
+		})
+		var created struct{ ID string }
+		if err := e.do(ctx, "PUT", "/v1/session/create", body, &created); err != nil {
+			e.setLeading(false)
+			return err
+		}
+		e.session = created.ID
+	}
+	var acquired bool
+	if err := e.do(ctx, "PUT", "/v1/kv/"+e.key+"?acquire="+url.QueryEscape(e.session), []byte(e.id), &acquired); err != nil {
+		e.setLeading(false)
+		return err
+	}
+	e.setLeading(acquired)
+	holder := e.id
+	if !acquired {
+		var kvs []struct{ Value []byte } // base64, which encoding/json decodes
+		if err := e.do(ctx, "GET", "/v1/kv/"+e.key, nil, &kvs); err != nil && err != errConsulNotFound {
+			return err
+		}
+		holder = ""
+		if len(kvs) > 0 {
+			holder = string(kvs[0].Value)
+		}
+	}
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.holder = holder
+	return nil
+}
+
+func (e *election) setLeading(leading bool) {
+	var v int32
+	if leading {
+		v = 1
+	}
+	if atomic.SwapInt32(&e.leading, v) != v {
+		level.Info(e.logger).Log("leader", leading, "id", e.id)
+	}
+}
+
+// resign releases the lock, if it's held, and destroys the session, so the
+// standby takes over without waiting for it to expire.
+func (e *election) resign() {
+	if e.session == "" {
+		return
+	}
+	e.setLeading(false)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := e.do(ctx, "PUT", "/v1/kv/"+e.key+"?release="+url.QueryEscape(e.session), nil, nil); err != nil {
+		level.Warn(e.logger).Log("during", "resign", "err", err)
+	}
+	if err := e.do(ctx, "PUT", "/v1/session/destroy/"+e.session, nil, nil); err != nil {
+		level.Warn(e.logger).Log("during", "resign", "err", err)
+	}
+	e.session = ""
+}
+
+// errConsulNotFound is returned for keys which don't exist, and sessions
+// which have expired.
+var errConsulNotFound = errors.New("Consul: not found")
+
+// consulAPI makes requests of the Consul HTTP API.
+type consulAPI struct {
+	api    string // e.g. http://127.0.0.1:8500
+	token  string // Consul ACL token; may be empty
+	client *http.Client
+}
+
+func newConsulAPI(api, token string) consulAPI {
+	return consulAPI{
+		api:    strings.TrimSuffix(api, "/"),
+		token:  token,
+		client: &http.Client{Timeout: consulSessionTTL / 3},
+	}
+}
+
+// do makes a request of the Consul API, and decodes the JSON response into
+// out, if it isn't nil.
+func (c consulAPI) do(ctx context.Context, method, path string, body []byte, out interface{}) error {
+	req, err := http.NewRequest(method, c.api+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errConsulNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Consul: %s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// wrapLeader serves scrapes with next, if this aggregator is the leader, and
+// otherwise says it's the standby.
+func (e *election) wrapLeader(next http.Handler) http.Handler {
+	if e == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if e.leader() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		e.mtx.Lock()
+		holder := e.holder
+		e.mtx.Unlock()
+		if holder == "" {
+			holder = "unknown"
+		}
+		http.Error(w, fmt.Sprintf("standby; the leader is %s", holder), http.StatusServiceUnavailable)
+	})
+}
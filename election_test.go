@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+// fakeConsul implements just enough of the Consul API for an election: a
+// key, and its lock.
+type fakeConsul struct {
+	mtx      sync.Mutex
+	sessions map[string]bool
+	next     int
+	holder   string // session
+	value    []byte
+}
+
+func (c *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	switch path := r.URL.Path; {
+	case path == "/v1/session/create":
+		c.next++
+		id := fmt.Sprintf("session-%d", c.next)
+		c.sessions[id] = true
+		json.NewEncoder(w).Encode(map[string]string{"ID": id})
+	case strings.HasPrefix(path, "/v1/session/renew/"):
+		if !c.sessions[strings.TrimPrefix(path, "/v1/session/renew/")] {
+			http.NotFound(w, r)
+		}
+	case strings.HasPrefix(path, "/v1/session/destroy/"):
+		c.expire(strings.TrimPrefix(path, "/v1/session/destroy/"))
+	case path == "/v1/kv/prometheus-aggregator/leader" && r.Method == "GET":
+		if c.value == nil {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode([]map[string][]byte{{"Value": c.value}})
+	case path == "/v1/kv/prometheus-aggregator/leader" && r.URL.Query().Get("acquire") != "":
+		session := r.URL.Query().Get("acquire")
+		if !c.sessions[session] || c.holder != "" && c.holder != session {
+			fmt.Fprint(w, "false")
+			return
+		}
+		c.holder = session
+		c.value, _ = ioutil.ReadAll(r.Body)
+		fmt.Fprint(w, "true")
+	case path == "/v1/kv/prometheus-aggregator/leader" && r.URL.Query().Get("release") != "":
+		if c.holder == r.URL.Query().Get("release") {
+			c.holder = ""
+		}
+		fmt.Fprint(w, "true")
+	default:
+		http.Error(w, "unexpected "+r.Method+" "+r.URL.String(), http.StatusBadRequest)
+	}
+}
+
+// expire ends the session, releasing its lock. It's called with the mutex
+// held.
+func (c *fakeConsul) expire(session string) {
+	delete(c.sessions, session)
+	if c.holder == session {
+		c.holder = ""
+	}
+}
+
+func TestElection(t *testing.T) {
+	consul := &fakeConsul{sessions: map[string]bool{}}
+	server := httptest.NewServer(consul)
+	defer server.Close()
+	ctx := context.Background()
+
+	a := newElection(server.URL, "/prometheus-aggregator/leader/", "agg-a", "", log.NewNopLogger())
+	b := newElection(server.URL, "prometheus-aggregator/leader", "agg-b", "", log.NewNopLogger())
+	campaign := func(e *election) {
+		t.Helper()
+		if err := e.campaign(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scrapeStatus := func(e *election) (int, string) {
+		rec := httptest.NewRecorder()
+		e.wrapLeader(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, "foo_total{} 1")
+		})).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	campaign(a)
+	campaign(b)
+	campaign(a) // still leads
+	if !a.leader() || b.leader() {
+		t.Fatalf("want a leading, have a %v, b %v", a.leader(), b.leader())
+	}
+	if code, _ := scrapeStatus(a); code != http.StatusOK {
+		t.Errorf("leader: want %d, have %d", http.StatusOK, code)
+	}
+	if code, body := scrapeStatus(b); code != http.StatusServiceUnavailable || !strings.Contains(body, "the leader is agg-a") {
+		t.Errorf("standby: want %d, the leader is agg-a, have %d, %s", http.StatusServiceUnavailable, code, body)
+	}
+
+	// When the leader resigns, the standby takes over.
+	a.resign()
+	if a.leader() {
+		t.Errorf("after resigning, want a not leading, but it is")
+	}
+	campaign(b)
+	campaign(a)
+	if !b.leader() || a.leader() {
+		t.Fatalf("after a resigned, want b leading, have a %v, b %v", a.leader(), b.leader())
+	}
+
+	// A leader whose session expired, e.g. because it was partitioned from
+	// Consul, steps down.
+	consul.mtx.Lock()
+	consul.expire(b.session)
+	consul.mtx.Unlock()
+	if err := b.campaign(ctx); err == nil {
+		t.Errorf("with an expired session, want an error, have none")
+	}
+	if b.leader() {
+		t.Errorf("with an expired session, want b not leading, but it is")
+	}
+	campaign(a)
+	campaign(b)
+	if !a.leader() || b.leader() {
+		t.Errorf("after b's session expired, want a leading, have a %v, b %v", a.leader(), b.leader())
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+)
+
+// modeEWMA is the mode of a gauge which is set to an exponentially weighted
+// moving average of the values observed, rather than the last of them, to
+// smooth out noisy measurements, like a queue depth sampled by a lot of
+// workers which don't agree. Each value moves the average by alpha of the
+// way towards it.
+const modeEWMA = "ewma"
+
+// defaultAlpha is the alpha of an EWMA gauge declared without one.
+const defaultAlpha = 0.2
+
+// parseAlpha returns the alpha of a declaration, which only EWMA gauges
+// can have.
+func parseAlpha(mode string, alpha float64) (float64, error) {
+	switch {
+	case mode != modeEWMA && alpha != 0:
+		return 0, fmt.Errorf("alpha is only for gauges with mode %s", modeEWMA)
+	case mode != modeEWMA:
+		return 0, nil
+	case alpha == 0:
+		return defaultAlpha, nil
+	case !(alpha > 0 && alpha <= 1):
+		return 0, fmt.Errorf("alpha %v isn't greater than 0, and at most 1", alpha)
+	default:
+		return alpha, nil
+	}
+}
+
+// ewmaGauge is a gauge whose value is the EWMA of the values observed. The
+// first value observed is the average, as is a value restored. Like any
+// gauge, it's lock-free.
+type ewmaGauge struct {
+	*gauge
+	alpha float64
+}
+
+func newEWMAGauge(o observation, alpha float64) (*ewmaGauge, error) {
+	g, err := newGauge(o)
+	if err != nil {
+		return nil, err
+	}
+	return &ewmaGauge{gauge: g, alpha: alpha}, nil
+}
+
+// observe moves the average towards the value. Values can't be added to
+// an average, which is checked by the universe.
+func (g *ewmaGauge) observe(o observation) error {
+	if o.Value == nil {
+		return nil // declaration
+	}
+	for {
+		old := g.value.loadBits()
+		next := *o.Value
+		if g.touched() {
+			next = g.alpha*next + (1-g.alpha)*math.Float64frombits(old)
+		}
+		if atomic.CompareAndSwapUint64(&g.value.bits, old, math.Float64bits(next)) {
+			break
+		}
+	}
+	atomic.StoreUint32(&g.touch, 1)
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEWMAGauge(t *testing.T) {
+	u, err := newUniverse(makeObservations(t, []string{
+		`{"name":"queue_depth","type":"gauge","help":"Depth of the queue.","mode":"ewma","alpha":0.5}`,
+		`{"name":"smooth","type":"gauge","help":"Default alpha.","mode":"ewma"}`,
+	})...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadObservations(t, u, makeObservations(t, []string{
+		`queue_depth{} 10`,
+		`queue_depth{} 20`,
+		`queue_depth{} 0`,
+		`smooth{} 10`,
+		`smooth{} 20`,
+	}))
+	have := scrape(t, u)
+	for _, want := range []string{"\nqueue_depth{} 7.5\n", "\nsmooth{} 12\n"} {
+		if !strings.Contains(have, want) {
+			t.Errorf("want %q, have\n%s", strings.TrimSpace(want), have)
+		}
+	}
+
+	if err := u.observe(makeObservations(t, []string{`{"name":"queue_depth","op":"add","value":1}`})[0]); err == nil {
+		t.Errorf("add: want error, have none")
+	}
+	if err := u.observe(observation{Name: "queue_depth", Type: "gauge", Help: "Depth of the queue.", Mode: "ewma", Alpha: 0.1}); err == nil {
+		t.Errorf("another alpha: want error, have none")
+	}
+	if want, have := 0.2, u.declarations()[1].Alpha; want != have {
+		t.Errorf("default alpha: want %v, have %v", want, have)
+	}
+}
+
+func TestParseAlpha(t *testing.T) {
+	for _, testcase := range []struct {
+		mode  string
+		alpha float64
+		want  float64
+		valid bool
+	}{
+		{"", 0, 0, true},
+		{"", 0.5, 0, false},
+		{"minmax", 0.5, 0, false},
+		{"ewma", 0, defaultAlpha, true},
+		{"ewma", 1, 1, true},
+		{"ewma", 1.5, 0, false},
+		{"ewma", -0.5, 0, false},
+	} {
+		have, err := parseAlpha(testcase.mode, testcase.alpha)
+		if want, have := testcase.valid, err == nil; want != have {
+			t.Errorf("%q %v: want valid %v, have %v (%v)", testcase.mode, testcase.alpha, want, have, err)
+		}
+		if want := testcase.want; want != have {
+			t.Errorf("%q %v: want %v, have %v", testcase.mode, testcase.alpha, want, have)
+		}
+	}
+}
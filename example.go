@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+)
+
+// exampleFormats are the wire formats the example subcommand has examples
+// of, in order.
+var exampleFormats = []string{"json", "prometheus", "declfile"}
+
+// exampleLines are example lines of each metric type, after its declaration
+// from exampleDecls, in each line-oriented wire format. Ops, like delete,
+// are only in JSON, as are declarations.
+var exampleLines = map[string]map[string][]string{
+	"json": {
+		"counter": {
+			`{"name":"myservice_jobs_processed_total","labels":{"queue":"default"},"value":1}`,
+			`{"name":"myservice_jobs_processed_total","labels":{"queue":"default"},"op":"delete"}`,
+		},
+		"gauge": {
+			`{"name":"myservice_cache_size_bytes","value":1048576}`,
+			`{"name":"myservice_cache_size_bytes","op":"add","value":-4096}`,
+		},
+		"histogram": {
+			`{"name":"myservice_http_request_duration_seconds","labels":{"method":"GET","route":"/users"},"value":0.042}`,
+			`{"name":"myservice_http_request_duration_seconds","labels":{"method":"GET","route":"/users"},"op":"merge","value":0.3,"counts":[0,0,1,2,3,0,0,0,0,0,0,0]}`,
+		},
+		"summary": {
+			`{"name":"myservice_db_query_duration_seconds","labels":{"table":"users"},"value":0.0031}`,
+		},
+	},
+	"prometheus": {
+		"counter": {
+			`myservice_jobs_processed_total{queue="default"} 1`,
+		},
+		"gauge": {
+			`myservice_cache_size_bytes{} 1048576`,
+		},
+		"histogram": {
+			`myservice_http_request_duration_seconds{method="GET",route="/users"} 0.042`,
+		},
+		"summary": {
+			`myservice_db_query_duration_seconds{table="users"} 0.0031`,
+		},
+	},
+}
+
+// runExample is the example subcommand, which prints examples of every
+// metric type in every wire format, or only those of the -type and
+// -format, for client authors to copy and paste. With both, it prints only
+// lines, which can be piped to send.
+func runExample(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("prometheus-aggregator example", flag.ExitOnError)
+	var (
+		format = fs.String("format", "", "only this wire format: json, prometheus, or declfile")
+		typ    = fs.String("type", "", "only this metric type: counter, gauge, histogram, or summary")
+	)
+	fs.Usage = usageFor(fs, "prometheus-aggregator example [flags]")
+	fs.Parse(args)
+
+	formats := exampleFormats
+	if *format != "" {
+		formats = []string{*format}
+	}
+	var decls []observation
+	for _, o := range exampleDecls {
+		if *typ == "" || o.Type == *typ {
+			decls = append(decls, o)
+		}
+	}
+	switch {
+	case len(decls) == 0:
+		return fmt.Errorf("invalid -type %q: want counter, gauge, histogram, or summary", *typ)
+	case *format != "" && *format != "declfile" && exampleLines[*format] == nil:
+		return fmt.Errorf("invalid -format %q: want json, prometheus, or declfile", *format)
+	}
+
+	sections := 0
+	section := func(header string) {
+		if len(formats) == 1 && len(decls) == 1 {
+			return // just lines
+		}
+		if sections > 0 {
+			fmt.Fprintln(stdout)
+		}
+		fmt.Fprintf(stdout, "# %s\n", header)
+		sections++
+	}
+	for _, format := range formats {
+		if format == "declfile" {
+			section("declfile")
+			buf, _ := json.MarshalIndent(decls, "", "    ")
+			fmt.Fprintf(stdout, "%s\n", buf)
+			continue
+		}
+		for _, o := range decls {
+			section(o.Type + ", as " + format)
+			decl, _ := json.Marshal(o)
+			fmt.Fprintf(stdout, "%s\n", decl)
+			for _, line := range exampleLines[format][o.Type] {
+				fmt.Fprintf(stdout, "%s\n", line)
+			}
+		}
+	}
+	return nil
+}
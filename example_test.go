@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExampleLines(t *testing.T) {
+	for _, format := range exampleFormats {
+		for _, typ := range []string{"counter", "gauge", "histogram", "summary"} {
+			var stdout bytes.Buffer
+			if err := runExample([]string{"-format", format, "-type", typ}, &stdout); err != nil {
+				t.Fatalf("%s %s: %v", format, typ, err)
+			}
+			if format == "declfile" {
+				if problems := checkDeclfile(stdout.Bytes()); len(problems) > 0 {
+					t.Errorf("%s %s: %v", format, typ, problems)
+				}
+				continue
+			}
+			u, _ := newUniverse()
+			for _, line := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+				o, err := parseLine([]byte(line))
+				if err != nil {
+					t.Errorf("%s %s: %s: %v", format, typ, line, err)
+					continue
+				}
+				if err := u.observe(o); err != nil {
+					t.Errorf("%s %s: %s: %v", format, typ, line, err)
+				}
+			}
+		}
+	}
+}
+
+func TestExampleSections(t *testing.T) {
+	var stdout bytes.Buffer
+	if err := runExample(nil, &stdout); err != nil {
+		t.Fatal(err)
+	}
+	var headers []string
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if strings.HasPrefix(line, "# ") {
+			headers = append(headers, line)
+		}
+	}
+	if want, have := 4*(len(exampleFormats)-1)+1, len(headers); want != have {
+		t.Errorf("want %d sections, have %d: %v", want, have, headers)
+	}
+
+	for _, args := range [][]string{{"-type", "untyped"}, {"-format", "xml"}} {
+		if err := runExample(args, &stdout); err == nil {
+			t.Errorf("%v: want error, have none", args)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// validateExposition checks that p is valid in the Prometheus text
+// exposition format, with the Prometheus text parser, and returns every
+// problem found. The parser stops at the first syntax error, which is
+// reported with its line. It leaves the checks for duplicates to its
+// callers, so they're made here, on what it parsed, along with the
+// invariants of histograms: bucket counts which don't decrease, and a +Inf
+// bucket which matches the count.
+func validateExposition(p []byte) []error {
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(p))
+	if perr, ok := err.(expfmt.ParseError); ok {
+		lines := bytes.Split(p, []byte("\n"))
+		if n := perr.Line - 1; n >= 0 && n < len(lines) {
+			return []error{fmt.Errorf("line %d: %s: %q", perr.Line, perr.Msg, lines[n])}
+		}
+	}
+	if err != nil {
+		return []error{err}
+	}
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []error
+	for _, name := range names {
+		errs = append(errs, validateFamily(families[name])...)
+	}
+	return errs
+}
+
+// validateFamily checks a parsed metric family for duplicate labels,
+// duplicate series, and broken histograms.
+func validateFamily(mf *dto.MetricFamily) (errs []error) {
+	series := map[string]bool{}
+	for _, m := range mf.GetMetric() {
+		labels := make(map[string]string, len(m.GetLabel()))
+		for _, lp := range m.GetLabel() {
+			if _, ok := labels[lp.GetName()]; ok {
+				errs = append(errs, fmt.Errorf("%s: duplicate label %q", mf.GetName(), lp.GetName()))
+			}
+			labels[lp.GetName()] = lp.GetValue()
+		}
+		key := mf.GetName() + renderSortedLabels(labels)
+		if series[key] {
+			errs = append(errs, fmt.Errorf("duplicate series %s", key))
+		}
+		series[key] = true
+		if h := m.GetHistogram(); h != nil {
+			if err := validateHistogram(key, h); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errs
+}
+
+// validateHistogram checks that the cumulative bucket counts of a parsed
+// histogram don't decrease, and end with a +Inf bucket, which matches the
+// count, if there is one.
+func validateHistogram(key string, h *dto.Histogram) error {
+	buckets := append([]*dto.Bucket(nil), h.GetBucket()...)
+	sort.SliceStable(buckets, func(i, j int) bool { return buckets[i].GetUpperBound() < buckets[j].GetUpperBound() })
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i].GetUpperBound() == buckets[i-1].GetUpperBound() {
+			return fmt.Errorf("%s: duplicate bucket le=%v", key, buckets[i].GetUpperBound())
+		}
+		if buckets[i].GetCumulativeCount() < buckets[i-1].GetCumulativeCount() {
+			return fmt.Errorf("%s: bucket counts decrease at le=%v", key, buckets[i].GetUpperBound())
+		}
+	}
+	if len(buckets) == 0 || !math.IsInf(buckets[len(buckets)-1].GetUpperBound(), +1) {
+		return fmt.Errorf("%s: no +Inf bucket", key)
+	}
+	if last := buckets[len(buckets)-1].GetCumulativeCount(); h.SampleCount != nil && h.GetSampleCount() != last {
+		return fmt.Errorf("%s: +Inf bucket %d doesn't match count %d", key, last, h.GetSampleCount())
+	}
+	return nil
+}
+
+func renderSortedLabels(labels map[string]string) string {
+	parts := make([]string, 0, len(labels))
+	for _, k := range sortLabelKeys(labels) {
+		parts = append(parts, k+"="+strconv.Quote(labels[k]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestValidateExposition(t *testing.T) {
+	for name, testcase := range map[string]struct {
+		input string
+		valid bool
+	}{
+		"empty": {
+			input: ``,
+			valid: true,
+		},
+		"counter": {
+			input: "# HELP foo_total Total foos.\n# TYPE foo_total counter\nfoo_total{code=\"200\"} 1.000000\n",
+			valid: true,
+		},
+		"no labels, timestamp": {
+			input: "foo 1 1600000000000\n",
+			valid: true,
+		},
+		"escaped label value": {
+			input: `foo{path="/a\"b\\c\n"} 1` + "\n",
+			valid: true,
+		},
+		"unescaped quote": {
+			input: `foo{path="/a"b"} 1` + "\n",
+		},
+		"invalid metric name": {
+			input: "1foo{} 1\n",
+		},
+		"invalid label name": {
+			input: `foo{a-b="1"} 1` + "\n",
+		},
+		"duplicate label": {
+			input: `foo{a="1",a="2"} 1` + "\n",
+		},
+		"bad value": {
+			input: "foo{} one\n",
+		},
+		"special values": {
+			input: "foo{a=\"1\"} NaN\nfoo{a=\"2\"} +Inf\nfoo{a=\"3\"} -Inf\n",
+			valid: true,
+		},
+		"duplicate series": {
+			input: "foo{a=\"1\"} 1\nfoo{a=\"1\"} 2\n",
+		},
+		"type after samples": {
+			input: "foo{} 1\n# TYPE foo counter\n",
+		},
+		"invalid type": {
+			input: "# TYPE foo widget\n",
+		},
+		"non-contiguous": {
+			input: "foo{a=\"1\"} 1\nbar{} 1\nfoo{a=\"2\"} 1\n",
+			valid: true, // as far as the Prometheus parser is concerned
+		},
+		"histogram": {
+			input: strings.Join([]string{
+				`# TYPE h histogram`,
+				`h_bucket{le="0.1"} 1`,
+				`h_bucket{le="1"} 2`,
+				`h_bucket{le="+Inf"} 3`,
+				`h_sum{} 5`,
+				`h_count{} 3`,
+			}, "\n") + "\n",
+			valid: true,
+		},
+		"histogram decreasing buckets": {
+			input: strings.Join([]string{
+				`# TYPE h histogram`,
+				`h_bucket{le="0.1"} 2`,
+				`h_bucket{le="1"} 1`,
+				`h_bucket{le="+Inf"} 2`,
+			}, "\n"),
+		},
+		"histogram without +Inf": {
+			input: strings.Join([]string{
+				`# TYPE h histogram`,
+				`h_bucket{le="0.1"} 1`,
+			}, "\n"),
+		},
+		"histogram count mismatch": {
+			input: strings.Join([]string{
+				`# TYPE h histogram`,
+				`h_bucket{le="+Inf"} 3`,
+				`h_count{} 4`,
+			}, "\n"),
+		},
+		"histogram without trailing newline": {
+			input: "# TYPE h histogram\nh_bucket{le=\"+Inf\"} 3\nh_count{} 3",
+		},
+		"histogram duplicate bucket": {
+			input: strings.Join([]string{
+				`# TYPE h histogram`,
+				`h_bucket{le="1"} 1`,
+				`h_bucket{le="1"} 1`,
+				`h_bucket{le="+Inf"} 1`,
+			}, "\n") + "\n",
+		},
+		"histogram bucket without le": {
+			input: strings.Join([]string{
+				`# TYPE h histogram`,
+				`h_bucket{} 3`,
+			}, "\n"),
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			errs := validateExposition([]byte(testcase.input))
+			if want, have := testcase.valid, len(errs) == 0; want != have {
+				t.Fatalf("valid: want %v, have %v (%v)", want, have, errs)
+			}
+		})
+	}
+}
+
+func TestValidateUniverse(t *testing.T) {
+	u, _ := newUniverse()
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`foo_total{code="200"} 1`,
+		`{"name":"bar_seconds","type":"histogram","help":"Bar duration.","buckets":[0.01, 0.1, 1]}`,
+		`{"name":"bar_seconds","labels":{"op":"read"},"value":0.05}`,
+		`{"name":"bar_seconds","labels":{"op":"write"},"value":5}`,
+	}))
+	var buf bytes.Buffer
+	renderMetrics(&buf, u)
+	if errs := validateExposition(buf.Bytes()); len(errs) > 0 {
+		t.Fatalf("%v\n%s", errs, buf.String())
+	}
+}
+
+func TestSelfChecker(t *testing.T) {
+	output := "foo{} 1\n"
+	c := newSelfChecker(func() []byte { return []byte(output) }, log.NewNopLogger())
+	c.check()
+	rec := httptest.NewRecorder()
+	readyHandler(c, nil).ServeHTTP(rec, httptest.NewRequest("GET", "/-/ready", nil))
+	if want, have := 200, rec.Code; want != have {
+		t.Fatalf("want %d, have %d", want, have)
+	}
+
+	output = "foo{} one\n"
+	c.check()
+	rec = httptest.NewRecorder()
+	readyHandler(c, nil).ServeHTTP(rec, httptest.NewRequest("GET", "/-/ready", nil))
+	if want, have := 503, rec.Code; want != have {
+		t.Fatalf("want %d, have %d", want, have)
+	}
+}
+
+func TestLintDeclarations(t *testing.T) {
+	if errs := lintDeclarations(append(exampleDecls, makeObservations(t, []string{
+		`{"name":"myservice_jobs_processed_total","labels":{"queue":"default"},"value":1}`,
+	})...)); len(errs) > 0 {
+		t.Errorf("example: %v", errs)
+	}
+
+	// Each is fine on its own, but a histogram's count is a series of
+	// its own, and so is the counter.
+	errs := lintDeclarations(makeObservations(t, []string{
+		`{"name":"foo_seconds","type":"histogram","help":"Foo duration.","buckets":[1]}`,
+		`{"name":"foo_seconds_count","type":"counter","help":"Total number of foos."}`,
+	}))
+	if want, have := 1, len(errs); want != have {
+		t.Fatalf("want %d error, have %d: %v", want, have, errs)
+	}
+	if want, have := "foo_seconds_count", errs[0].Error(); !strings.Contains(have, want) {
+		t.Errorf("want %q in %q", want, have)
+	}
+}
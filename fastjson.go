@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"unicode/utf8"
+)
+
+// jsonUnmarshal parses a line in the JSON format. Lines which stick to the
+// common subset of JSON, i.e. no escapes, nulls, or unknown or repeated
+// fields, are decoded by hand, and like prometheusUnmarshal, reuse the labels
+// and value of o if they're non-nil. Anything else is left to encoding/json,
+// starting from a zero observation.
+func jsonUnmarshal(p []byte, o *observation) error {
+	if fastJSONUnmarshal(p, o) {
+		return nil
+	}
+	*o = observation{}
+	return json.Unmarshal(p, o)
+}
+
+// fastJSONUnmarshal returns false, without modifying o, if it can't decode p.
+func fastJSONUnmarshal(p []byte, o *observation) bool {
+	var (
+		d    = jsonDecoder{p: p}
+		r    observation
+		seen uint8
+	)
+	if !d.consume('{') {
+		return false
+	}
+	for more := !d.consume('}'); more; more = d.next('}') {
+		key, ok := d.string()
+		if !ok {
+			return false
+		}
+		field := jsonFields[unsafeString(key)]
+		if field == 0 || seen&field != 0 || !d.consume(':') {
+			return false
+		}
+		seen |= field
+		switch field {
+		case jsonName:
+			b, ok := d.string()
+			if !ok {
+				return false
+			}
+			r.Name = labelStrings.lookupBytes(b)
+		case jsonType:
+			b, ok := d.string()
+			if !ok {
+				return false
+			}
+			r.Type = labelStrings.lookupBytes(b)
+		case jsonHelp:
+			b, ok := d.string()
+			if !ok {
+				return false
+			}
+			r.Help = string(b)
+		case jsonOp:
+			b, ok := d.string()
+			if !ok {
+				return false
+			}
+			r.Op = labelStrings.lookupBytes(b)
+		case jsonLabels:
+			labels := o.Labels
+			if labels == nil {
+				labels = map[string]string{}
+			}
+			if !d.labels(labels) {
+				return false
+			}
+			r.Labels = labels
+		case jsonValue:
+			f, ok := d.number()
+			if !ok {
+				return false
+			}
+			r.Value = o.Value
+			if r.Value == nil {
+				r.Value = new(float64)
+			}
+			*r.Value = f
+		case jsonBuckets:
+			buckets, ok := d.buckets()
+			if !ok {
+				return false
+			}
+			r.Buckets = buckets
+		}
+	}
+	d.space()
+	if d.failed || d.i != len(d.p) {
+		return false
+	}
+	*o = r
+	return true
+}
+
+// The fields of an observation, as bits.
+const (
+	jsonName = 1 << iota
+	jsonType
+	jsonHelp
+	jsonOp
+	jsonLabels
+	jsonValue
+	jsonBuckets
+)
+
+var jsonFields = map[string]uint8{
+	"name":    jsonName,
+	"type":    jsonType,
+	"help":    jsonHelp,
+	"op":      jsonOp,
+	"labels":  jsonLabels,
+	"value":   jsonValue,
+	"buckets": jsonBuckets,
+}
+
+type jsonDecoder struct {
+	p      []byte
+	i      int
+	failed bool
+}
+
+// next consumes the separator after an element of an object or array, and
+// returns true if there's another element. If there's neither a separator nor
+// the closing byte, the decoder fails.
+func (d *jsonDecoder) next(closing byte) bool {
+	if d.consume(',') {
+		return true
+	}
+	if !d.consume(closing) {
+		d.failed = true
+	}
+	return false
+}
+
+func (d *jsonDecoder) space() {
+	for d.i < len(d.p) {
+		switch d.p[d.i] {
+		case ' ', '\t', '\n', '\r':
+			d.i++
+		default:
+			return
+		}
+	}
+}
+
+// consume skips whitespace, and the byte c if it's next.
+func (d *jsonDecoder) consume(c byte) bool {
+	d.space()
+	if d.i < len(d.p) && d.p[d.i] == c {
+		d.i++
+		return true
+	}
+	return false
+}
+
+// string returns the contents of a string without escapes.
+func (d *jsonDecoder) string() ([]byte, bool) {
+	if !d.consume('"') {
+		return nil, false
+	}
+	for j := d.i; j < len(d.p); j++ {
+		switch c := d.p[j]; {
+		case c == '"':
+			s := d.p[d.i:j]
+			d.i = j + 1
+			return s, utf8.Valid(s)
+		case c == '\\' || c < 0x20:
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// number returns a number in the JSON grammar.
+func (d *jsonDecoder) number() (float64, bool) {
+	d.space()
+	start := d.i
+	digits := func() bool {
+		n := d.i
+		for d.i < len(d.p) && d.p[d.i] >= '0' && d.p[d.i] <= '9' {
+			d.i++
+		}
+		return d.i > n
+	}
+	if d.i < len(d.p) && d.p[d.i] == '-' {
+		d.i++
+	}
+	if d.i < len(d.p) && d.p[d.i] == '0' {
+		d.i++
+	} else if !digits() {
+		return 0, false
+	}
+	if d.i < len(d.p) && d.p[d.i] == '.' {
+		d.i++
+		if !digits() {
+			return 0, false
+		}
+	}
+	if d.i < len(d.p) && (d.p[d.i] == 'e' || d.p[d.i] == 'E') {
+		d.i++
+		if d.i < len(d.p) && (d.p[d.i] == '+' || d.p[d.i] == '-') {
+			d.i++
+		}
+		if !digits() {
+			return 0, false
+		}
+	}
+	f, err := strconv.ParseFloat(unsafeString(d.p[start:d.i]), 64)
+	return f, err == nil
+}
+
+// labels decodes an object of strings into labels.
+func (d *jsonDecoder) labels(labels map[string]string) bool {
+	if !d.consume('{') {
+		return false
+	}
+	for more := !d.consume('}'); more; more = d.next('}') {
+		k, ok := d.string()
+		if !ok || !d.consume(':') {
+			return false
+		}
+		v, ok := d.string()
+		if !ok {
+			return false
+		}
+		labels[labelStrings.lookupBytes(k)] = labelStrings.lookupBytes(v)
+	}
+	return !d.failed
+}
+
+// buckets decodes an array of numbers. They're only sent with declarations,
+// so they're allocated.
+func (d *jsonDecoder) buckets() ([]float64, bool) {
+	if !d.consume('[') {
+		return nil, false
+	}
+	buckets := []float64{}
+	for more := !d.consume(']'); more; more = d.next(']') {
+		f, ok := d.number()
+		if !ok {
+			return nil, false
+		}
+		buckets = append(buckets, f)
+	}
+	return buckets, !d.failed
+}
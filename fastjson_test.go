@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestJSONUnmarshal(t *testing.T) {
+	for _, input := range []string{
+		`{"name":"foo","type":"counter","help":"Total foos.","value":1}`,
+		`{"name":"foo","labels":{"code":"200","method":"GET"},"value":-1.5e3}`,
+		` { "name" : "foo" , "labels" : { } , "value" : 0 } `,
+		`{"name":"foo","type":"histogram","help":"Foo.","buckets":[0.1,1,10]}`,
+		`{"name":"foo","type":"histogram","help":"Foo.","buckets":[]}`,
+		`{"name":"foo","labels":{"code":"404"},"op":"delete"}`,
+		`{"name":"foo","op":"delete"}`,
+		`{}`,
+		`{"name":"foo","value":1}`,
+		`{"name":"foo","value":null}`,
+		`{"Name":"foo","value":1}`,
+		`{"name":"foo","extra":true,"value":1}`,
+		`{"name":"foo","name":"bar"}`,
+		`{"name":"foo","labels":{"a":"1"},"labels":{"b":"2"}}`,
+		`{"name":"föö","value":1}`,
+		`{"name":"foo","value":01}`,
+		`{"name":"foo","value":1.}`,
+		`{"name":"foo","value":+1}`,
+		`{"name":"foo","value":1e400}`,
+		`{"name":"foo","value":"1"}`,
+		`{"name":"foo",}`,
+		`{"name":"foo","labels":{"a":"1",}}`,
+		`{"name":"foo","buckets":[1,]}`,
+		`{"name":"foo"} x`,
+		`{"name":"foo"`,
+	} {
+		var want observation
+		wantErr := json.Unmarshal([]byte(input), &want)
+
+		var value float64
+		have := observation{Labels: map[string]string{}, Value: &value}
+		haveErr := jsonUnmarshal([]byte(input), &have)
+
+		if (wantErr == nil) != (haveErr == nil) {
+			t.Errorf("%s: want error %v, have %v", input, wantErr, haveErr)
+			continue
+		}
+		if wantErr == nil && !cmp.Equal(want, have) {
+			t.Errorf("%s: %s", input, cmp.Diff(want, have))
+		}
+	}
+}
+
+func TestParseAllocations(t *testing.T) {
+	// The strings of existing series are interned, so they're not allocated.
+	u, _ := newUniverse(makeObservations(t, []string{`{"name":"foo","type":"counter","help":"Foo."}`})...)
+	loadObservations(t, u, makeObservations(t, []string{`foo{code="200",method="GET"} 1`}))
+
+	for _, line := range []string{
+		`foo{code="200",method="GET"} 1`,
+		`{"name":"foo","labels":{"code":"200","method":"GET"},"value":1}`,
+	} {
+		buf, p := []byte(line), getParsed()
+		allocs := testing.AllocsPerRun(100, func() {
+			for k := range p.labels {
+				delete(p.labels, k)
+			}
+			p.obs = observation{Labels: p.labels, Value: &p.value}
+			if err := parseLineInto(buf, &p.obs); err != nil {
+				t.Fatal(err)
+			}
+		})
+		// The timeseries key is the only allocation.
+		if allocs > 1 {
+			t.Errorf("%s: %v allocations per parse", line, allocs)
+		}
+	}
+}
+
+func BenchmarkParsePrometheus(b *testing.B) {
+	benchmarkParse(b, `foo{code="200",method="GET"} 1`)
+}
+
+func BenchmarkParseJSON(b *testing.B) {
+	benchmarkParse(b, `{"name":"foo","labels":{"code":"200","method":"GET"},"value":1}`)
+}
+
+func benchmarkParse(b *testing.B, line string) {
+	buf := []byte(line)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p := getParsed()
+		if err := parseLineInto(buf, &p.obs); err != nil {
+			b.Fatal(err)
+		}
+		putParsed(p)
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -39,17 +41,17 @@ func TestThreeTypes(t *testing.T) {
 		bar_seconds_bucket{le="5"} 3
 		bar_seconds_bucket{le="10"} 4
 		bar_seconds_bucket{le="+Inf"} 4
-		bar_seconds_sum{} 8.858000
+		bar_seconds_sum{} 8.858
 		bar_seconds_count{} 4
 		
 		# HELP baz_size Current size of baz widget.
 		# TYPE baz_size gauge
-		baz_size{} 4.000000
+		baz_size{} 4
 		
 		# HELP foo_total Total number of foos.
 		# TYPE foo_total counter
-		foo_total{code="200"} 5.000000
-		foo_total{code="404"} 10.000000
+		foo_total{code="200"} 5
+		foo_total{code="404"} 10
 	`), normalizeResponse(scrape(t, u)); want != have {
 		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
 	}
@@ -79,21 +81,150 @@ func TestInitialDeclarations(t *testing.T) {
 		bar_seconds_bucket{le="5"} 1
 		bar_seconds_bucket{le="10"} 1
 		bar_seconds_bucket{le="+Inf"} 1
-		bar_seconds_sum{} 0.234000
+		bar_seconds_sum{} 0.234
 		bar_seconds_count{} 1
 		
 		# HELP baz_size Current size of baz widget.
 		# TYPE baz_size gauge
-		baz_size{} 5.000000
+		baz_size{} 5
 		
 		# HELP foo_total Total number of foos.
 		# TYPE foo_total counter
-		foo_total{label="value"} 1.000000
+		foo_total{label="value"} 1
 	`), normalizeResponse(scrape(t, u)); want != have {
 		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
 	}
 }
 
+func TestDelete(t *testing.T) {
+	u, _ := newUniverse()
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`foo_total{code="200"} 1`,
+		`foo_total{code="404"} 2`,
+		`{"name":"bar_size","type":"gauge","help":"Current size of bar."}`,
+		`bar_size{shard="1"} 3`,
+		`bar_size{shard="2"} 4`,
+		`{"name":"foo_total","labels":{"code":"404"},"op":"delete"}`,
+		`{"name":"bar_size","op":"delete"}`,
+		`{"name":"qux_count","op":"delete"}`,
+	}))
+	if want, have := normalizeResponse(`
+		# HELP foo_total Total number of foos.
+		# TYPE foo_total counter
+		foo_total{code="200"} 1
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+
+	// Deleted metrics keep their declarations.
+	loadObservations(t, u, makeObservations(t, []string{
+		`bar_size{shard="3"} 5`,
+	}))
+	if want, have := normalizeResponse(`
+		# HELP bar_size Current size of bar.
+		# TYPE bar_size gauge
+		bar_size{shard="3"} 5
+
+		# HELP foo_total Total number of foos.
+		# TYPE foo_total counter
+		foo_total{code="200"} 1
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	u, _ := newUniverse()
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"foo_seconds","type":"histogram","help":"Foo duration.","buckets":[1,0.1,10]}`,
+		`foo_seconds{} 0.05`,
+		`foo_seconds{} 0.1`,
+		`foo_seconds{} 0.5`,
+		`foo_seconds{} 10`,
+		`foo_seconds{} 20`,
+	}))
+	if want, have := normalizeResponse(`
+		# HELP foo_seconds Foo duration.
+		# TYPE foo_seconds histogram
+		foo_seconds_bucket{le="0.1"} 2
+		foo_seconds_bucket{le="1"} 3
+		foo_seconds_bucket{le="10"} 4
+		foo_seconds_bucket{le="+Inf"} 5
+		foo_seconds_sum{} 30.65
+		foo_seconds_count{} 5
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestRenderCache(t *testing.T) {
+	u, _ := newUniverse()
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total foos.","value":1}`,
+		`{"name":"bar_seconds","type":"histogram","help":"Bar duration.","buckets":[1],"value":0.5}`,
+	}))
+	scrape(t, u)
+	loadObservations(t, u, makeObservations(t, []string{
+		`foo_total{} 1`,
+		`bar_seconds{} 2`,
+	}))
+	if want, have := normalizeResponse(`
+		# HELP bar_seconds Bar duration.
+		# TYPE bar_seconds histogram
+		bar_seconds_bucket{le="1"} 1
+		bar_seconds_bucket{le="+Inf"} 2
+		bar_seconds_sum{} 2.5
+		bar_seconds_count{} 2
+
+		# HELP foo_total Total foos.
+		# TYPE foo_total counter
+		foo_total{} 2
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestConcurrentObserve(t *testing.T) {
+	u, _ := newUniverse()
+	const writers, lines = 8, 100
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < lines; j++ {
+				name := fmt.Sprintf("metric_%d", j%4)
+				o := observation{Name: name, Type: "counter", Help: "Help.", Labels: map[string]string{"writer": fmt.Sprint(i)}, Value: new(float64)}
+				*o.Value = 1
+				if err := u.observe(o); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < lines; j++ {
+			scrape(t, u)
+		}
+	}()
+	wg.Wait()
+
+	if want, have := writers*4, u.stats().Series; want != have {
+		t.Errorf("series: want %d, have %d", want, have)
+	}
+	for _, m := range u.dump().Metrics {
+		for _, s := range m.Series {
+			if want, have := float64(lines/4), *s.Value; want != have {
+				t.Errorf("%s%v: want %v, have %v", m.Name, s.Labels, want, have)
+			}
+		}
+	}
+}
+
 func makeObservations(t *testing.T, lines []string) []observation {
 	t.Helper()
 	observations := make([]observation, len(lines))
@@ -130,3 +261,35 @@ func normalizeResponse(s string) string {
 	}
 	return strings.TrimSpace(strings.Join(lines, "\n"))
 }
+
+func TestObserveBatch(t *testing.T) {
+	u, _ := newUniverse()
+	err := u.observeBatch(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`foo_total{code="200"} 1`,
+		`foo_total{code="200"} 2`,
+		`{"name":"unknown_total","value":1}`,
+		`{"name":"unknown_total","value":2}`,
+		`{"name":"baz_size","type":"gauge","help":"Current size of baz widget."}`,
+		`baz_size{} 4`,
+		`baz_size{} 2`,
+		`foo_total{code="404"} 8`,
+	}))
+	for n, want := range []bool{false, false, false, true, true, false, false, false, false} {
+		if have := errorAt(err, n) != nil; want != have {
+			t.Errorf("observation %d: want error %v, have %v (%v)", n, want, have, errorAt(err, n))
+		}
+	}
+	if want, have := normalizeResponse(`
+		# HELP baz_size Current size of baz widget.
+		# TYPE baz_size gauge
+		baz_size{} 2
+
+		# HELP foo_total Total number of foos.
+		# TYPE foo_total counter
+		foo_total{code="200"} 3
+		foo_total{code="404"} 8
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
@@ -3,11 +3,18 @@ module github.com/peterbourgon/prometheus-aggregator
 go 1.16
 
 require (
+	github.com/beorn7/perks v1.0.1
 	github.com/go-kit/kit v0.6.0
 	github.com/go-logfmt/logfmt v0.3.0 // indirect
 	github.com/go-stack/stack v1.7.0 // indirect
-	github.com/google/go-cmp v0.2.0
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/google/go-cmp v0.5.8
 	github.com/kr/logfmt v0.0.0-20140226030751-b84e30acd515 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
 	github.com/oklog/run v1.0.0
 	github.com/pkg/errors v0.8.0
+	github.com/prometheus/client_model v0.0.0-20170216185247-6f3806018612
+	github.com/prometheus/common v0.0.0-20181126121408-4724e9255275
+	google.golang.org/protobuf v1.27.1 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -3,83 +3,649 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/pkg/errors"
 )
 
-type observer interface{ observe(observation) error }
+type observer interface {
+	observe(observation) error
+	observeBatch([]observation) error // may return a batchError
+}
+
+// ingester reads lines from clients, and observes them.
+type ingester struct {
+	observer observer
+	activity *activity
+	tracer   *tracer        // may be nil
+	errlog   *logLimiter    // may be nil
+	stats    *pipelineStats // may be nil
+	audit    *auditLog      // may be nil
+	recorder *recorder      // of accepted lines; may be nil
+	strict   bool           // disconnect clients when they send bad data
+	reply    bool           // write errors back to clients when they send bad data
+	logger   log.Logger
+	queues   []chan lineJob // one per worker; if nil, lines are handled inline
+	overflow string         // policy for full queues; "" means block
+	maxLine  int            // in bytes; 0 means bufio.MaxScanTokenSize
+	identity string         // label for the certificate identity of TLS clients; "" means none
+	tokens   *socketTokens  // if not nil, connections must start with AUTH and one of them
+	filter   *addrFilter    // of packet senders; may be nil
+	limiter  *rateLimiter   // may be nil
+	tenant   *tenant        // whose socket this is; may be nil
+	tenants  *tenancy       // if not nil, TLS clients are the tenants named by their identities
+	labels   constLabels    // set on every line, replacing the line's own; may be nil
+	rules    *relabeler     // may be nil
+	pods     *podResolver   // if not nil, lines from pods get their pod, namespace, and node
+	quotas   *tenantQuotas  // may be nil
+	drainer  *drainer       // may be nil
+	readers  sync.Pool      // of *bufio.Reader
+}
+
+func (i *ingester) maxLineBytes() int {
+	if i.maxLine <= 0 {
+		return bufio.MaxScanTokenSize
+	}
+	return i.maxLine
+}
 
-func forwardPacketConn(conn net.PacketConn, o observer, logger log.Logger) error {
-	buf := make([]byte, bufio.MaxScanTokenSize)
+// packetBatchSize is the maximum number of datagrams read with one syscall,
+// on platforms which support it.
+const packetBatchSize = 64
+
+func (i *ingester) forwardPacketConn(conn net.PacketConn) error {
+	// Datagrams bigger than the buffer are silently truncated, so don't
+	// make it any smaller than the default, even if lines are limited.
+	size := bufio.MaxScanTokenSize
+	if i.maxLineBytes() > size {
+		size = i.maxLineBytes()
+	}
+	if r, ok := newBatchReader(conn, packetBatchSize, size); ok {
+		batch := make([]lineJob, 0, packetBatchSize)
+		for {
+			n, err := r.read()
+			if err != nil {
+				return err
+			}
+			batch = batch[:0]
+			for j := 0; j < n; j++ {
+				data, from := r.packet(j)
+				if !i.admitPacket(from, data) {
+					continue
+				}
+				batch = append(batch, lineJob{client: i.newClient(nil, from), line: data})
+			}
+			i.dispatch(batch)
+		}
+	}
+
+	buf := make([]byte, size)
+	batch := make([]lineJob, 1)
 	for {
-		n, _, err := conn.ReadFrom(buf)
+		n, addr, err := conn.ReadFrom(buf)
 		if err != nil {
 			return err
 		}
-		name, err := handleLine(buf[:n], o)
-		if err != nil {
-			level.Error(logger).Log("line", "rejected", "err", err)
+		from := addr.String()
+		if !i.admitPacket(from, buf[:n]) {
 			continue
 		}
-		level.Debug(logger).Log("line", "accepted", "name", name)
+		batch[0] = lineJob{client: i.newClient(nil, from), line: buf[:n]}
+		i.dispatch(batch)
+	}
+}
+
+// admitPacket returns true if a datagram from the address is allowed, and
+// within its sender's rate limit. Senders can't be pushed back on, or
+// disconnected, so datagrams over the limit are dropped.
+func (i *ingester) admitPacket(from string, data []byte) bool {
+	if !i.filter.allowed(from) {
+		i.denied(from)
+		return false
+	}
+	if action, _ := i.limiter.limit(clientHost(from), len(data), false); action != "" {
+		return false
+	}
+	if i.tenant != nil {
+		action, _ := i.quotas.limit(i.tenant.name, len(data), false)
+		return action == ""
 	}
+	return true
 }
 
-func forwardListener(ln net.Listener, o observer, strict bool, logger log.Logger) error {
+// denied logs a connection or packet from an address which isn't allowed.
+func (i *ingester) denied(addr string) {
+	if i.errlog.allow(clientHost(addr)) {
+		level.Warn(i.logger).Log("remote_addr", addr, "err", "address not allowed")
+	}
+}
+
+func (i *ingester) forwardListener(ln net.Listener) error {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			return err
 		}
-		go handleConn(conn, o, strict, log.With(logger, "remote_addr", conn.RemoteAddr()))
+		go i.handleConn(conn, conn.RemoteAddr().String())
 	}
 }
 
-func handleConn(rc io.ReadCloser, o observer, strict bool, logger log.Logger) {
+func (i *ingester) handleConn(rc io.ReadCloser, addr string) {
 	defer rc.Close()
-	s := bufio.NewScanner(rc)
-	for s.Scan() {
-		name, err := handleLine(s.Bytes(), o)
+	if !i.drainer.open(rc) {
+		return // shutting down
+	}
+	defer i.drainer.done(rc)
+	c := i.newClient(rc, addr)
+	c.conn = i.activity.connect(addr)
+	defer i.activity.disconnect(c.conn)
+	c.logger = log.With(c.logger, "remote_addr", addr)
+	span := i.tracer.startRoot("conn", spanKindServer)
+	span.set("remote_addr", addr)
+	defer func() {
+		c.pending.Wait()
+		counts := c.conn.counts.load()
+		span.set("accepted", counts.acceptedLines)
+		span.set("rejected", counts.rejectedLines)
+		span.finish(nil)
+	}()
+
+	if conn, ok := rc.(*tls.Conn); ok && (i.identity != "" || i.tenants != nil) {
+		id, err := peerIdentity(conn)
 		if err != nil {
-			level.Error(logger).Log("line", "rejected", "err", err)
-			if strict {
+			level.Debug(c.logger).Log("during", "handshake", "err", err)
+			return
+		}
+		if i.tenants != nil {
+			c.setTenant(i.tenants.tenant(tenantName(id)))
+		}
+		if i.identity != "" {
+			c.setLabel(i.identity, id)
+		}
+		c.key = id
+	}
+
+	// Lines which arrive together, i.e. which are already buffered, are
+	// dispatched together, as a batch. The lines stay valid because the
+	// reader is only refilled when it doesn't hold a complete line.
+	br := i.getReader(rc)
+	defer i.putReader(br)
+	first := 1
+	if i.tokens != nil {
+		if err := authenticate(br, i.tokens); err != nil {
+			if i.errlog.allow(clientHost(addr)) {
+				level.Warn(c.logger).Log("auth", "failed", "err", err)
+			}
+			replyError(rc, first, err)
+			return
+		}
+		first++
+	}
+	line, err := readLine(br)
+directives:
+	for err == nil {
+		switch {
+		case bytes.HasPrefix(line, []byte(labelsDirective)) && c.defaults == nil:
+			if c.defaults, err = parseLabelsDirective(line); err != nil {
+				if i.errlog.allow(clientHost(addr)) {
+					level.Warn(c.logger).Log("directive", "rejected", "err", err)
+				}
+				replyError(rc, first, err)
 				return
 			}
+		case string(bytes.TrimSpace(line)) == echoDirective && !c.echo:
+			c.echo = true
+		default:
+			break directives
+		}
+		first++
+		line, err = readLine(br)
+	}
+	batch := make([]lineJob, 0, i.batchSize())
+	for lineno := first; ; lineno++ {
+		if lineno > first {
+			line, err = readLine(br)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err == errLineTooLong {
+			err = fmt.Errorf("line too long (over %d bytes)", i.maxLineBytes())
+		} else if err != nil {
+			level.Debug(c.logger).Log("during", "read", "err", err)
+			break
+		}
+		action, wait := i.limiter.limit(c.key, len(line), true)
+		if action == "" {
+			action, wait = i.quotas.limit(c.quota, len(line), true)
+		}
+		switch action {
+		case limitThrottle:
+			i.dispatch(batch) // don't hold them up, too
+			batch = batch[:0]
+			time.Sleep(wait)
+		case limitDisconnect:
+			if i.errlog.allow(clientHost(addr)) {
+				level.Warn(c.logger).Log("rate", "limited", "action", action)
+			}
+			i.dispatch(batch)
+			return
+		}
+		if action != limitDrop {
+			batch = append(batch, lineJob{client: c, line: line, lineno: lineno, err: err})
+		}
+		if len(batch) < cap(batch) && completeLineBuffered(br) {
 			continue
 		}
-		level.Debug(logger).Log("line", "accepted", "name", name)
+		i.dispatch(batch)
+		batch = batch[:0]
+		if c.failed() {
+			return
+		}
+	}
+	i.dispatch(batch)
+}
+
+// labelsDirective starts a line, which may be the first of a connection
+// (after AUTH), of labels which every line that follows gets, if it doesn't
+// have them already, e.g. `LABELS instance="web-3",dc="ams1"`.
+const labelsDirective = "LABELS "
+
+// echoDirective is a line, which may be one of the first of a connection,
+// like LABELS, after which the reply to each line is how it was handled: the
+// observation it was parsed into, after relabeling, or why it was rejected.
+// It's for client developers, to see that their lines mean what they think.
+const echoDirective = "ECHO"
+
+func parseLabelsDirective(line []byte) (map[string]string, error) {
+	labels := map[string]string{}
+	if err := parseLabels(bytes.TrimSpace(line[len(labelsDirective):]), labels); err != nil {
+		return nil, errors.Wrap(err, "bad LABELS directive")
+	}
+	for name := range labels {
+		if !validLabelName(name) || reservedLabelName(name) {
+			return nil, fmt.Errorf("bad LABELS directive: invalid label name %q", name)
+		}
+	}
+	return labels, nil
+}
+
+// completeLineBuffered returns true if reading the next line from br won't
+// need to refill its buffer.
+func completeLineBuffered(br *bufio.Reader) bool {
+	buffered, _ := br.Peek(br.Buffered())
+	return bytes.IndexByte(buffered, '\n') >= 0
+}
+
+// maxBatch is the most lines handled at once.
+const maxBatch = 128
+
+// batchSize is the most lines handled at once. In strict mode, it's one,
+// so that nothing after a bad line is observed.
+func (i *ingester) batchSize() int {
+	if i.strict {
+		return 1
+	}
+	return maxBatch
+}
+
+// getReader returns a pooled reader for rc, whose buffer holds the longest
+// line allowed, plus its newline.
+func (i *ingester) getReader(rc io.Reader) *bufio.Reader {
+	size := i.maxLineBytes() + 1
+	if br, ok := i.readers.Get().(*bufio.Reader); ok && br.Size() == size {
+		br.Reset(rc)
+		return br
+	}
+	return bufio.NewReaderSize(rc, size)
+}
+
+func (i *ingester) putReader(br *bufio.Reader) {
+	br.Reset(nil)
+	i.readers.Put(br)
+}
+
+// errLineTooLong is returned by readLine when a line doesn't fit in the
+// reader's buffer.
+var errLineTooLong = errors.New("line too long")
+
+// maxRecordedLine is how much of a line which is too long is returned by
+// readLine, to help identify it.
+const maxRecordedLine = 256
+
+// readLine returns the next line from br, without its line ending, like a
+// bufio.Scanner. Unlike a scanner, if a line doesn't fit in the buffer, it
+// returns errLineTooLong, along with the start of the line, and skips the
+// rest, so that the caller can continue with the next line.
+func readLine(br *bufio.Reader) ([]byte, error) {
+	line, err := br.ReadSlice('\n')
+	switch {
+	case err == bufio.ErrBufferFull:
+		if len(line) > maxRecordedLine {
+			line = line[:maxRecordedLine]
+		}
+		prefix := append([]byte(nil), line...)
+		for err == bufio.ErrBufferFull {
+			_, err = br.ReadSlice('\n')
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return prefix, errLineTooLong
+	case err == io.EOF && len(line) > 0:
+		// The final line may not have a newline.
+	case err != nil:
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line, []byte{'\n'})
+	line = bytes.TrimSuffix(line, []byte{'\r'})
+	return line, nil
+}
+
+// client is the source of a line: a connection, or the sender of a packet.
+// Lines from the same client are always handled in order, by one worker.
+type client struct {
+	rc       io.ReadCloser // nil for packets
+	addr     string
+	tenant   string            // with a universe of its own; "" means none
+	quota    string            // tenant whose quotas the lines count against; "" means none
+	prefix   string            // prepended to the metric name of every line
+	defaults map[string]string // added to every line which doesn't have them
+	echo     bool              // reply to every line with how it was handled
+	labels   map[string]string // added to every line, replacing the line's own
+	key      string            // identifies the client for rate limiting
+	logger   log.Logger
+	conn     *clientInfo    // counts the lines of a connection; nil for packets
+	pending  sync.WaitGroup // lines queued but not yet handled
+	fail     uint32         // atomic; set when a strict client sends bad data
+}
+
+func (c *client) failed() bool { return atomic.LoadUint32(&c.fail) == 1 }
+
+// newClient returns a client of the ingester, whose lines get the prefix and
+// labels of its tenant, if it has one, and the labels of its pod, if it's
+// one. Connections wait for their pod to be looked up; datagrams don't, and
+// go without until it has been.
+func (i *ingester) newClient(rc io.ReadCloser, addr string) *client {
+	c := &client{rc: rc, addr: addr, key: clientHost(addr), logger: i.logger}
+	if i.tenant != nil {
+		c.setTenant(i.tenant)
+	}
+	if pod := i.pods.labels(c.key, rc != nil); pod != nil {
+		if c.labels == nil {
+			c.labels = pod // never modified, so it can be shared
+		} else {
+			for k, v := range pod {
+				c.setLabel(k, v)
+			}
+		}
 	}
+	return c
 }
 
-func handleLine(line []byte, o observer) (string, error) {
-	obs, err := parseLine(line)
+// setTenant makes the client's lines the tenant's.
+func (c *client) setTenant(t *tenant) {
+	c.prefix, c.labels, c.tenant, c.quota = t.prefix, t.labels, "", t.name
+	if t.universe {
+		c.tenant = t.name
+	}
+}
+
+// setLabel sets a label on every one of the client's lines.
+func (c *client) setLabel(name, value string) {
+	labels := map[string]string{name: value}
+	for k, v := range c.labels {
+		if k != name {
+			labels[k] = v
+		}
+	}
+	c.labels = labels
+}
+
+// handleBatch handles lines from clients, and records the result of each.
+// In strict mode, the first bad line closes the connection, and any lines
+// which were queued after it are discarded.
+func (i *ingester) handleBatch(jobs []lineJob) {
+	results := i.handleLines(jobs)
+	for n, job := range jobs {
+		i.record(job, results[n])
+	}
+}
+
+// record records the result of handling a line from a client.
+func (i *ingester) record(job lineJob, r lineResult) {
+	c, line, lineno, name, err := job.client, job.line, job.lineno, r.name, r.err
+	if c.failed() {
+		return
+	}
+	if c.echo {
+		replyEcho(c.rc, lineno, r)
+	}
 	if err != nil {
-		return "", errors.Wrap(err, "parse error")
+		if i.errlog.allow(clientHost(c.addr)) {
+			level.Error(c.logger).Log("line", "rejected", "err", err)
+		}
+		i.activity.reject(c.addr, c.conn, line, err)
+		if c.rc != nil && (i.strict || i.reply) && !c.echo {
+			replyError(c.rc, lineno, err)
+		}
+		if c.rc != nil && i.strict {
+			atomic.StoreUint32(&c.fail, 1)
+			c.rc.Close() // interrupt the reader
+		}
+		return
+	}
+	i.activity.accept(c.addr, c.conn, line)
+	if i.recorder != nil {
+		i.recorder.record(line, time.Now())
+	}
+	level.Debug(c.logger).Log("line", "accepted", "name", name)
+}
+
+// replyError writes a JSON error line describing a rejected line back to
+// the client, if the connection is writable. Failures are ignored, as the
+// client may not be reading.
+func replyError(rc io.ReadCloser, lineno int, err error) {
+	reply(rc, struct {
+		Error string `json:"error"`
+		Line  int    `json:"line"`
+	}{
+		Error: err.Error(),
+		Line:  lineno,
+	})
+}
+
+// replyEcho writes a JSON line describing how a line was handled back to a
+// client in echo mode: the observation, as it was observed, or the error, or
+// that relabeling dropped it.
+func replyEcho(rc io.ReadCloser, lineno int, r lineResult) {
+	e := struct {
+		Line        int             `json:"line"`
+		Observation json.RawMessage `json:"observation,omitempty"`
+		Dropped     bool            `json:"dropped,omitempty"`
+		Error       string          `json:"error,omitempty"`
+	}{
+		Line:        lineno,
+		Observation: r.echo,
+		Dropped:     r.err == nil && r.echo == nil,
+	}
+	if r.err != nil {
+		e.Error = r.err.Error()
+	}
+	reply(rc, e)
+}
+
+// reply writes v back to the client as a JSON line, if the connection is
+// writable.
+func reply(rc io.ReadCloser, v interface{}) {
+	w, ok := rc.(io.Writer)
+	if !ok {
+		return
+	}
+	if conn, ok := rc.(net.Conn); ok {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+	}
+	buf, _ := json.Marshal(v)
+	w.Write(append(buf, '\n'))
+}
+
+// handleLine handles a single line, and returns its metric name.
+func (i *ingester) handleLine(line []byte, addr string) (name string, err error) {
+	r := i.handleLines([]lineJob{{client: &client{addr: addr}, line: line}})
+	return r[0].name, r[0].err
+}
+
+// lineResult is the outcome of handling a line.
+type lineResult struct {
+	name string
+	err  error
+	echo []byte // the observation, as JSON, if the client is in echo mode
+}
+
+// handleLines parses each line, and observes the ones that parsed as a
+// single batch. Lines with read errors, or from failed clients, are skipped.
+func (i *ingester) handleLines(jobs []lineJob) []lineResult {
+	var (
+		results = make([]lineResult, len(jobs))
+		spans   = make([]*span, len(jobs))
+		parses  = make([]*parsed, 0, len(jobs))
+		obs     = make([]observation, 0, len(jobs))
+		index   = make([]int, 0, len(jobs)) // of each observation in jobs
+	)
+	for n, job := range jobs {
+		if job.err != nil || job.client.failed() {
+			results[n].err = job.err
+			continue
+		}
+		span := i.tracer.startRoot("line", spanKindServer)
+		span.set("remote_addr", job.client.addr)
+
+		p := getParsed()
+		begin := time.Now()
+		parse := span.child("parse")
+		err := i.rules.parseLine(job.line, &p.obs)
+		parse.finish(err)
+		i.stats.observe("parse", time.Since(begin))
+		if err != nil {
+			putParsed(p)
+			results[n].err = errors.Wrap(err, "parse error")
+			span.finish(results[n].err)
+			continue
+		}
+		if c := job.client; c.prefix != "" || c.defaults != nil || c.labels != nil || i.labels != nil {
+			p.relabel(c.prefix, c.defaults, c.labels, i.labels)
+		}
+		if !i.rules.relabel(p) {
+			results[n].name = p.obs.Name
+			putParsed(p)
+			span.finish(nil)
+			continue
+		}
+		p.obs.Tenant = job.client.tenant
+		results[n].name = p.obs.Name
+		spans[n] = span
+		parses = append(parses, p)
+		obs = append(obs, p.obs)
+		index = append(index, n)
+	}
+	if len(obs) == 0 {
+		return results
+	}
+
+	// The observe stage is timed for the whole batch, and attributed
+	// equally to each line.
+	observes := make([]*span, len(obs))
+	for k, n := range index {
+		observes[k] = spans[n].child("observe")
+	}
+	begin := time.Now()
+	err := i.observer.observeBatch(obs)
+	each := time.Since(begin) / time.Duration(len(obs))
+	for k, n := range index {
+		i.stats.observe("observe", each)
+		oerr := errorAt(err, k)
+		observes[k].finish(oerr)
+		if oerr != nil {
+			if _, ok := errors.Cause(oerr).(seriesLimitError); ok {
+				i.quotas.reject(jobs[n].client.quota, quotaSeries)
+			}
+			results[n].err = errors.Wrap(oerr, "observation error")
+		} else if obs[k].Op == "delete" {
+			i.auditDelete(jobs[n].client.addr, obs[k])
+		}
+		if jobs[n].client.echo && results[n].err == nil {
+			results[n].echo, _ = json.Marshal(obs[k]) // before the labels are reused
+		}
+		spans[n].set("name", results[n].name)
+		spans[n].finish(results[n].err)
+		putParsed(parses[k])
 	}
-	if err := o.observe(obs); err != nil {
-		return obs.Name, errors.Wrap(err, "observation error")
+	return results
+}
+
+func (i *ingester) auditDelete(addr string, o observation) {
+	what := map[string]string{"name": o.Name}
+	if o.Labels != nil {
+		what["labels"] = renderLabels(o.Labels)
+	}
+	if o.Match {
+		what["match"] = "true"
+	}
+	if err := i.audit.record(addr, "delete", what); err != nil {
+		level.Error(i.logger).Log("during", "audit", "err", err)
 	}
-	return obs.Name, nil
 }
 
 func parseLine(p []byte) (o observation, err error) {
+	err = parseLineInto(p, &o)
+	return o, err
+}
+
+// parseLineInto parses a line into o, and computes its timeseries key. If o
+// has non-nil labels and value, the parsers may reuse them.
+func parseLineInto(p []byte, o *observation) error {
+	return parseLineRenamed(p, o, nil)
+}
+
+// parseLineRenamed is parseLineInto, except that a metric name in renames is
+// replaced by its new name before it's validated, so that names which aren't
+// valid can still be renamed to ones which are.
+func parseLineRenamed(p []byte, o *observation, renames map[string]string) (err error) {
 	if len(p) <= 0 {
-		err = errors.New("invalid (empty) line")
+		return errors.New("invalid (empty) line")
 	} else if p[0] == '{' {
-		err = json.Unmarshal(p, &o)
+		err = jsonUnmarshal(p, o)
 	} else {
-		err = prometheusUnmarshal(p, &o)
+		err = prometheusUnmarshal(p, o)
 	}
-	return o, err
+	if err != nil {
+		return err
+	}
+	if name, ok := renames[o.Name]; ok {
+		o.Name = name
+	}
+	if err := validateNames(o); err != nil {
+		return err
+	}
+	o.Key = makeTimeseriesKey(o.Name, o.Labels)
+	return nil
 }
 
+// prometheusUnmarshal parses a line in the Prometheus text format. It
+// doesn't allocate in the common case: the names, label keys, and label
+// values of existing series are interned, so they're looked up, and if o has
+// non-nil labels and value, they're reused.
 func prometheusUnmarshal(p []byte, o *observation) error {
 	p = bytes.TrimSpace(p)
 	x := bytes.LastIndexByte(p, ' ')
@@ -89,8 +655,10 @@ func prometheusUnmarshal(p []byte, o *observation) error {
 
 	id, val := bytes.TrimSpace(p[:x]), bytes.TrimSpace(p[x+1:])
 
-	value, err := strconv.ParseFloat(string(val), 64)
+	value, err := strconv.ParseFloat(unsafeString(val), 64)
 	if err != nil {
+		// The error refers to val, which the caller may reuse; start over.
+		_, err = strconv.ParseFloat(string(val), 64)
 		return errors.Wrapf(err, "bad value (%s)", string(val))
 	}
 
@@ -103,28 +671,59 @@ func prometheusUnmarshal(p []byte, o *observation) error {
 	}
 
 	name, labels := id[:y], id[y+1:len(id)-1]
-	if bytes.ContainsRune(labels, ' ') {
+	if bytes.IndexByte(labels, ' ') >= 0 {
 		return fmt.Errorf("bad format: labels section may not contain spaces")
 	}
 
-	labelmap := map[string]string{}
-	for _, pair := range bytes.Split(labels, []byte(",")) {
+	labelmap := o.Labels
+	if labelmap == nil {
+		labelmap = map[string]string{}
+	}
+	if err := parseLabels(labels, labelmap); err != nil {
+		return err
+	}
+
+	o.Name = labelStrings.lookupBytes(name)
+	o.Labels = labelmap
+	if o.Value == nil {
+		o.Value = new(float64)
+	}
+	(*o.Value) = value
+
+	return nil
+}
+
+// parseLabels parses comma-separated name="value" pairs into labelmap.
+func parseLabels(labels []byte, labelmap map[string]string) error {
+	for len(labels) > 0 {
+		var pair []byte
+		if c := bytes.IndexByte(labels, ','); c >= 0 {
+			pair, labels = labels[:c], labels[c+1:]
+		} else {
+			pair, labels = labels, nil
+		}
 		z := bytes.IndexByte(pair, '=')
 		if z < 0 {
 			continue
 		}
 		k, v := pair[:z], pair[z+1:]
-		if v[0] != '"' || v[len(v)-1] != '"' {
+		if _, ok := labelmap[unsafeString(k)]; ok {
+			return fmt.Errorf("bad format: duplicate label %q", k)
+		}
+		if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
 			return fmt.Errorf("bad format: label value must be wrapped in quotes")
 		}
-		v = v[1 : len(v)-1]
-		labelmap[string(k)] = string(v)
+		v, err := unescapeLabelValue(v[1 : len(v)-1])
+		if err != nil {
+			return errors.Wrap(err, "bad format")
+		}
+		labelmap[labelStrings.lookupBytes(k)] = labelStrings.lookupBytes(v)
 	}
-
-	o.Name = string(name)
-	o.Labels = labelmap
-	o.Value = new(float64)
-	(*o.Value) = value
-
 	return nil
 }
+
+// unsafeString returns a string sharing memory with b, which must not be
+// modified while the string is in use.
+func unsafeString(b []byte) string {
+	return *(*string)(unsafe.Pointer(&b))
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// handoffTimeout is how long a new aggregator waits for the old one to send
+// its listeners. The state comes later, once the old one has drained, so
+// there's no limit on that.
+const handoffTimeout = 10 * time.Second
+
+// maxHandoffFiles is the most listeners which can be handed off.
+const maxHandoffFiles = 64
+
+// errHandedOff is returned by handoff.await, once the listeners are handed
+// off, so the old aggregator shuts down.
+var errHandedOff = errors.New("handed off to a new aggregator")
+
+// handoff hands an aggregator's listeners, and the state of every series, to
+// its replacement, over a unix socket, so a restart, e.g. to upgrade the
+// binary, doesn't refuse connections, drop datagrams, or reset counters. The
+// aggregator listens on the socket. A new one, started with the same socket,
+// connects to it, and is sent the file descriptors of the listeners. Then
+// the old one shuts down, as usual, and sends the state, and the new one
+// restores it, and starts serving. Meanwhile, connections wait in the
+// listeners' backlogs, and datagrams in the sockets' buffers.
+type handoff struct {
+	path   string
+	logger log.Logger
+
+	inherited map[string]*os.File // from the old aggregator, by address
+	state     *savedState         // from the old aggregator, if there was one
+
+	mtx       sync.Mutex
+	listeners map[string]interface{} // to hand off, by address
+	ln        *net.UnixListener
+	conn      *net.UnixConn // to the new aggregator, once it connects
+}
+
+// handoffHeader is sent with the file descriptors, one for each listener.
+type handoffHeader struct {
+	Listeners []string `json:"listeners"` // addresses, in the order of the descriptors
+}
+
+// newHandoff takes over from the aggregator listening on the socket, if
+// there is one, which means waiting for it to shut down. Then it listens on
+// the socket, for the aggregator which takes over from this one.
+func newHandoff(path string, logger log.Logger) (*handoff, error) {
+	h := &handoff{
+		path:      path,
+		logger:    logger,
+		inherited: map[string]*os.File{},
+		listeners: map[string]interface{}{},
+	}
+	conn, err := net.DialTimeout("unix", path, handoffTimeout)
+	switch {
+	case err == nil:
+		err = h.takeOver(conn.(*net.UnixConn))
+		conn.Close()
+		if err != nil {
+			for _, f := range h.inherited {
+				f.Close()
+			}
+			return nil, err
+		}
+	case errors.Is(err, syscall.ECONNREFUSED):
+		os.Remove(path) // left behind by an aggregator which didn't shut down cleanly
+	case errors.Is(err, os.ErrNotExist):
+		// nothing to take over
+	default:
+		return nil, err
+	}
+	if h.ln, err = net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"}); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// takeOver receives the listeners, and then the state, once the old
+// aggregator has shut down.
+func (h *handoff) takeOver(conn *net.UnixConn) error {
+	conn.SetReadDeadline(time.Now().Add(handoffTimeout))
+	buf := make([]byte, 64*1024)
+	n, files, err := receiveFiles(conn, buf)
+	if err != nil {
+		return fmt.Errorf("receiving listeners: %v", err)
+	}
+	r := bufio.NewReader(io.MultiReader(bytes.NewReader(buf[:n]), conn))
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("receiving listeners: %v", err)
+	}
+	var hdr handoffHeader
+	if err := json.Unmarshal(line, &hdr); err != nil {
+		return fmt.Errorf("receiving listeners: %v", err)
+	}
+	if len(hdr.Listeners) != len(files) {
+		for _, f := range files {
+			f.Close()
+		}
+		return fmt.Errorf("receiving listeners: %d addresses, but %d descriptors", len(hdr.Listeners), len(files))
+	}
+	for i, addr := range hdr.Listeners {
+		h.inherited[addr] = files[i]
+	}
+	level.Info(h.logger).Log("handoff", h.path, "listeners", len(files), "awaiting", "state")
+
+	conn.SetReadDeadline(time.Time{})
+	var st savedState
+	if err := json.NewDecoder(r).Decode(&st); err != nil {
+		return fmt.Errorf("receiving state: %v", err)
+	}
+	h.state = &st
+	return nil
+}
+
+// listen returns the listener for the address handed off by the old
+// aggregator, if there is one, or listens on it, and hands it off in turn.
+// A nil handoff just listens.
+func (h *handoff) listen(network, address string) (net.Listener, error) {
+	if h == nil {
+		return net.Listen(network, address)
+	}
+	key := network + "://" + address
+	if f, ok := h.claim(key); ok {
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(true) // it's this aggregator's now
+		}
+		h.register(key, ln)
+		return ln, nil
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	h.register(key, ln)
+	return ln, nil
+}
+
+// listenUDP is listen, for datagrams.
+func (h *handoff) listenUDP(network, address string) (*net.UDPConn, error) {
+	if h != nil {
+		if f, ok := h.claim(network + "://" + address); ok {
+			pc, err := net.FilePacketConn(f)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			conn, ok := pc.(*net.UDPConn)
+			if !ok {
+				pc.Close()
+				return nil, fmt.Errorf("handed off %s isn't a UDP socket", address)
+			}
+			h.register(network+"://"+address, conn)
+			return conn, nil
+		}
+	}
+	laddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	if h != nil {
+		h.register(network+"://"+address, conn)
+	}
+	return conn, nil
+}
+
+func (h *handoff) claim(key string) (*os.File, bool) {
+	f, ok := h.inherited[key]
+	delete(h.inherited, key)
+	return f, ok
+}
+
+func (h *handoff) register(key string, l interface{}) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.listeners[key] = l
+}
+
+// closeUnclaimed closes the listeners handed off by the old aggregator which
+// this one doesn't listen on, e.g. because its flags changed.
+func (h *handoff) closeUnclaimed() {
+	if h == nil {
+		return
+	}
+	for key, f := range h.inherited {
+		level.Warn(h.logger).Log("handoff", h.path, "listener", key, "err", "handed off, but not listened on; closed")
+		f.Close()
+		delete(h.inherited, key)
+	}
+}
+
+// await waits for a new aggregator to connect, and sends it the listeners.
+// Then it returns errHandedOff, so this one shuts down, and finish sends the
+// state. It returns any other error when the socket is closed.
+func (h *handoff) await() error {
+	for {
+		conn, err := h.ln.AcceptUnix()
+		if err != nil {
+			return err
+		}
+		if err := h.send(conn); err != nil {
+			level.Error(h.logger).Log("handoff", h.path, "err", err)
+			conn.Close()
+			continue
+		}
+		h.mtx.Lock()
+		h.conn = conn
+		h.mtx.Unlock()
+		return errHandedOff
+	}
+}
+
+func (h *handoff) send(conn *net.UnixConn) error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	var (
+		hdr   handoffHeader
+		files []*os.File
+	)
+	for key := range h.listeners {
+		hdr.Listeners = append(hdr.Listeners, key)
+	}
+	sort.Strings(hdr.Listeners)
+	if len(hdr.Listeners) > maxHandoffFiles {
+		return fmt.Errorf("can't hand off more than %d listeners", maxHandoffFiles)
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close() // the duplicates; the new aggregator has its own
+		}
+	}()
+	for _, key := range hdr.Listeners {
+		l := h.listeners[key]
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false) // it's the new aggregator's now
+		}
+		filer, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("%s: can't be handed off", key)
+		}
+		f, err := filer.File()
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		files = append(files, f)
+	}
+	buf, err := json.Marshal(hdr)
+	if err != nil {
+		return err
+	}
+	return sendFiles(conn, append(buf, '\n'), files)
+}
+
+// close stops listening for a new aggregator. The socket is removed, so the
+// new one, which may already be connected, can listen on it.
+func (h *handoff) close() {
+	h.ln.Close()
+}
+
+// finish sends the state to the new aggregator, if the listeners were handed
+// off to one. A nil handoff does nothing.
+func (h *handoff) finish(st savedState) error {
+	if h == nil {
+		return nil
+	}
+	h.mtx.Lock()
+	conn := h.conn
+	h.mtx.Unlock()
+	if conn == nil {
+		return nil
+	}
+	defer conn.Close()
+	return json.NewEncoder(conn).Encode(st)
+}
+
+// handedOff returns true if the listeners were handed off to a new
+// aggregator.
+func (h *handoff) handedOff() bool {
+	if h == nil {
+		return false
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.conn != nil
+}
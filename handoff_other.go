@@ -0,0 +1,21 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// Passing descriptors is only implemented on Unix.
+var errHandoffUnsupported = errors.New("handoff isn't supported on this platform")
+
+func sendFiles(conn *net.UnixConn, msg []byte, files []*os.File) error {
+	return errHandoffUnsupported
+}
+
+func receiveFiles(conn *net.UnixConn, buf []byte) (int, []*os.File, error) {
+	return 0, nil, errHandoffUnsupported
+}
@@ -0,0 +1,132 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestHandoff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "handoff.sock")
+
+	old, err := newHandoff(path, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.state != nil {
+		t.Fatalf("with nothing to take over, want no state, have %+v", old.state)
+	}
+	ln, err := old.listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := old.listenUDP("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := newUniverse(makeObservations(t, []string{`{"name":"foo_total","type":"counter","help":"Foo."}`})...)
+	o, _ := parseLine([]byte(`foo_total{} 3`))
+	if err := u.observe(o); err != nil {
+		t.Fatal(err)
+	}
+
+	awaited := make(chan error, 1)
+	go func() { awaited <- old.await() }()
+	took := make(chan *handoff, 1)
+	go func() {
+		h, err := newHandoff(path, log.NewNopLogger())
+		if err != nil {
+			t.Error(err)
+		}
+		took <- h
+	}()
+	if want, have := errHandedOff, <-awaited; want != have {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+
+	// The old aggregator shuts down. Meanwhile, what's sent waits for the
+	// new one.
+	ln.Close()
+	pc.Close()
+	old.close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sender, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	if _, err := sender.Write([]byte("foo_total{} 1\n")); err != nil {
+		t.Fatal(err)
+	}
+	st, err := (&stateFile{u: u}).checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := old.finish(st); err != nil {
+		t.Fatal(err)
+	}
+
+	h := <-took
+	if h == nil {
+		t.FailNow()
+	}
+	defer h.close()
+	if h.state == nil {
+		t.Fatal("want the old aggregator's state, have none")
+	}
+	u2, _ := newUniverse()
+	if _, _, err := (&stateFile{u: u2, logger: log.NewNopLogger()}).restoreState(*h.state); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := `foo_total{} 3`, scrape(t, u2); !strings.Contains(have, want) {
+		t.Errorf("want %s, have\n%s", want, have)
+	}
+
+	ln2, err := h.listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln2.Close()
+	if want, have := ln.Addr().String(), ln2.Addr().String(); want != have {
+		t.Errorf("listener: want %s, have %s", want, have)
+	}
+	ln2.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	c, err := ln2.Accept()
+	if err != nil {
+		t.Fatalf("the connection made during the handoff: %v", err)
+	}
+	c.Close()
+
+	pc2, err := h.listenUDP("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc2.Close()
+	pc2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, _, err := pc2.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("the datagram sent during the handoff: %v", err)
+	}
+	if want, have := "foo_total{} 1\n", string(buf[:n]); want != have {
+		t.Errorf("datagram: want %q, have %q", want, have)
+	}
+}
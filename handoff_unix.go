@@ -0,0 +1,52 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// sendFiles writes msg to the connection, with the files' descriptors.
+func sendFiles(conn *net.UnixConn, msg []byte, files []*os.File) error {
+	fds := make([]int, len(files))
+	for i, f := range files {
+		fds[i] = int(f.Fd())
+	}
+	_, _, err := conn.WriteMsgUnix(msg, syscall.UnixRights(fds...), nil)
+	return err
+}
+
+// receiveFiles reads the start of a message written by sendFiles into buf,
+// and returns how much it read, and the files.
+func receiveFiles(conn *net.UnixConn, buf []byte) (int, []*os.File, error) {
+	oob := make([]byte, syscall.CmsgSpace(maxHandoffFiles*4))
+	n, oobn, flags, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return 0, nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, nil, err
+	}
+	var files []*os.File
+	for i := range msgs {
+		fds, err := syscall.ParseUnixRights(&msgs[i])
+		if err != nil {
+			continue // not rights
+		}
+		for _, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), "handoff"))
+		}
+	}
+	if flags&syscall.MSG_CTRUNC != 0 {
+		for _, f := range files {
+			f.Close()
+		}
+		return 0, nil, fmt.Errorf("more than %d descriptors", maxHandoffFiles)
+	}
+	return n, files, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sort"
+)
+
+// seriesIndex is the timeseries of a collection, ordered by key, maintained
+// as they're created and deleted, so scrapes don't sort. It's kept in chunks
+// of at most maxIndexChunk timeseries, so an insert or removal only shifts
+// the rest of its chunk, rather than the rest of the index. It isn't safe
+// for concurrent use.
+type seriesIndex struct {
+	chunks [][]timeseriesValue
+	n      int
+}
+
+const maxIndexChunk = 256
+
+// chunk returns the index of the chunk where k belongs.
+func (x *seriesIndex) chunk(k timeseriesKey) int {
+	i := sort.Search(len(x.chunks), func(i int) bool {
+		c := x.chunks[i]
+		return c[len(c)-1].timeseriesKey() >= k
+	})
+	if i == len(x.chunks) && i > 0 {
+		i-- // after everything, so at the end of the last chunk
+	}
+	return i
+}
+
+// insert adds v, which must not already be in the index.
+func (x *seriesIndex) insert(v timeseriesValue) {
+	x.n++
+	if len(x.chunks) == 0 {
+		x.chunks = [][]timeseriesValue{{v}}
+		return
+	}
+	k := v.timeseriesKey()
+	i := x.chunk(k)
+	c := x.chunks[i]
+	j := sort.Search(len(c), func(j int) bool { return c[j].timeseriesKey() >= k })
+	c = append(c, nil)
+	copy(c[j+1:], c[j:])
+	c[j] = v
+	x.chunks[i] = c
+	if len(c) <= maxIndexChunk {
+		return
+	}
+	half := len(c) / 2
+	tail := append(make([]timeseriesValue, 0, maxIndexChunk), c[half:]...)
+	for j := half; j < len(c); j++ {
+		c[j] = nil // so the head chunk doesn't keep them alive
+	}
+	x.chunks[i] = c[:half]
+	x.chunks = append(x.chunks, nil)
+	copy(x.chunks[i+2:], x.chunks[i+1:])
+	x.chunks[i+1] = tail
+}
+
+// remove removes the timeseries with key k, if it's in the index.
+func (x *seriesIndex) remove(k timeseriesKey) {
+	i := x.chunk(k)
+	if i == len(x.chunks) {
+		return
+	}
+	c := x.chunks[i]
+	j := sort.Search(len(c), func(j int) bool { return c[j].timeseriesKey() >= k })
+	if j == len(c) || c[j].timeseriesKey() != k {
+		return
+	}
+	x.n--
+	copy(c[j:], c[j+1:])
+	c[len(c)-1] = nil
+	c = c[:len(c)-1]
+	if len(c) > 0 {
+		x.chunks[i] = c
+		return
+	}
+	copy(x.chunks[i:], x.chunks[i+1:])
+	x.chunks[len(x.chunks)-1] = nil
+	x.chunks = x.chunks[:len(x.chunks)-1]
+}
+
+// reset removes every timeseries.
+func (x *seriesIndex) reset() {
+	x.chunks, x.n = nil, 0
+}
+
+// appendTo appends every timeseries to s, in order.
+func (x *seriesIndex) appendTo(s []timeseriesValue) []timeseriesValue {
+	for _, c := range x.chunks {
+		s = append(s, c...)
+	}
+	return s
+}
+
+func (x *seriesIndex) len() int { return x.n }
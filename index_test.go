@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestSeriesIndex(t *testing.T) {
+	var (
+		x    seriesIndex
+		want = map[timeseriesKey]bool{}
+		rng  = rand.New(rand.NewSource(1))
+	)
+	check := func() {
+		t.Helper()
+		var keys []timeseriesKey
+		for k := range want {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+		values := x.appendTo(nil)
+		if want, have := len(keys), x.len(); want != have {
+			t.Fatalf("len: want %d, have %d", want, have)
+		}
+		if want, have := len(keys), len(values); want != have {
+			t.Fatalf("values: want %d, have %d", want, have)
+		}
+		for i, v := range values {
+			if want, have := keys[i], v.timeseriesKey(); want != have {
+				t.Fatalf("%d: want %s, have %s", i, want, have)
+			}
+		}
+		for _, c := range x.chunks {
+			if len(c) == 0 || len(c) > maxIndexChunk {
+				t.Fatalf("chunk of %d", len(c))
+			}
+		}
+	}
+
+	for i := 0; i < 10*maxIndexChunk; i++ {
+		o := observation{Name: "foo", Labels: map[string]string{"n": fmt.Sprint(rng.Intn(1e6))}}
+		k := o.timeseriesKey()
+		if want[k] {
+			continue
+		}
+		v, _ := newCounter(o)
+		x.insert(v)
+		want[k] = true
+	}
+	check()
+
+	for k := range want {
+		if rng.Intn(3) > 0 {
+			x.remove(k)
+			delete(want, k)
+		}
+	}
+	x.remove("foo{n=\"nonexistent\"}")
+	check()
+
+	x.reset()
+	want = map[timeseriesKey]bool{}
+	check()
+}
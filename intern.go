@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// interner deduplicates strings, so that the many series which share label
+// keys and values, like method="GET", share storage for them too. Only what
+// series are created with is interned, so rejected lines can't fill it, and
+// strings longer than maxInternedLen, which are rarely shared, aren't
+// interned at all. It's generational, so unbounded label values can't grow
+// it forever: once the current generation holds half of max strings, it
+// becomes the previous one, and the strings in the old previous one which
+// nothing looked up since are dropped. Series which have them keep their
+// copies; they're just not shared with new ones.
+type interner struct {
+	keep map[string]string // never dropped
+	max  int
+
+	mtx  sync.RWMutex
+	cur  map[string]string
+	prev map[string]string
+
+	generations uint64 // atomic
+}
+
+// maxInternedStrings bounds the size of the label string interner, and
+// maxInternedLen the strings it interns.
+const (
+	maxInternedStrings = 1 << 16
+	maxInternedLen     = 256
+)
+
+// labelStrings interns the names, label keys, and label values of series,
+// and always has the types and ops, which every line's parse looks up.
+var labelStrings = newInterner(maxInternedStrings, "counter", "gauge", "histogram", "summary", "add", "merge", "delete")
+
+func newInterner(max int, keep ...string) *interner {
+	i := &interner{keep: map[string]string{}, max: max, cur: map[string]string{}, prev: map[string]string{}}
+	for _, s := range keep {
+		i.keep[s] = s
+	}
+	return i
+}
+
+// intern returns the canonical copy of s, interning it if it isn't already.
+func (i *interner) intern(s string) string {
+	if interned, ok := i.keep[s]; ok {
+		return interned
+	}
+	if len(s) > maxInternedLen {
+		return s
+	}
+	i.mtx.RLock()
+	interned, ok := i.cur[s]
+	i.mtx.RUnlock()
+	if ok {
+		return interned
+	}
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	return i.promote(s)
+}
+
+// lookupBytes returns the canonical copy of string(b), without allocating,
+// if it's interned, and otherwise string(b), without interning it, since
+// what's parsed may yet be rejected. It only takes the write lock to bring
+// a string from the previous generation into the current one, at most once
+// per string per generation.
+func (i *interner) lookupBytes(b []byte) string {
+	if interned, ok := i.keep[string(b)]; ok {
+		return interned
+	}
+	i.mtx.RLock()
+	interned, ok := i.cur[string(b)]
+	_, old := i.prev[string(b)]
+	i.mtx.RUnlock()
+	switch {
+	case ok:
+		return interned
+	case !old:
+		return string(b)
+	}
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	if interned, ok := i.cur[string(b)]; ok {
+		return interned
+	}
+	if interned, ok := i.prev[string(b)]; ok {
+		return i.promote(interned)
+	}
+	return string(b) // dropped in the meantime
+}
+
+// promote adds s to the current generation, as the copy in the previous one
+// if there is one, and starts a new generation if the current one is full.
+// The caller must hold the write lock.
+func (i *interner) promote(s string) string {
+	if interned, ok := i.cur[s]; ok {
+		return interned
+	}
+	if interned, ok := i.prev[s]; ok {
+		s = interned
+	}
+	i.cur[s] = s
+	if len(i.cur) >= i.max/2 {
+		i.prev, i.cur = i.cur, make(map[string]string, len(i.cur))
+		atomic.AddUint64(&i.generations, 1)
+	}
+	return s
+}
+
+func (i *interner) len() int {
+	i.mtx.RLock()
+	defer i.mtx.RUnlock()
+	return len(i.keep) + len(i.cur) + len(i.prev)
+}
+
+// renderTelemetry writes how many strings are interned, out of the most
+// there can be, and how many generations have been dropped, which, if it
+// keeps going up, means there are more distinct label values than fit.
+func (i *interner) renderTelemetry(w io.Writer) {
+	fmt.Fprintf(w, "# HELP prometheus_aggregator_interned_strings Label strings shared between series.\n")
+	fmt.Fprintf(w, "# TYPE prometheus_aggregator_interned_strings gauge\n")
+	fmt.Fprintf(w, "prometheus_aggregator_interned_strings %d\n\n", i.len())
+	fmt.Fprintf(w, "# HELP prometheus_aggregator_interned_strings_max The most label strings which can be shared.\n")
+	fmt.Fprintf(w, "# TYPE prometheus_aggregator_interned_strings_max gauge\n")
+	fmt.Fprintf(w, "prometheus_aggregator_interned_strings_max %d\n\n", len(i.keep)+i.max)
+	fmt.Fprintf(w, "# HELP prometheus_aggregator_interned_generations_total Generations of label strings dropped, to make room for new ones.\n")
+	fmt.Fprintf(w, "# TYPE prometheus_aggregator_interned_generations_total counter\n")
+	fmt.Fprintf(w, "prometheus_aggregator_interned_generations_total %d\n\n", atomic.LoadUint64(&i.generations))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestInterner(t *testing.T) {
+	i := newInterner(4, "GET")
+	a := i.intern(string([]byte("POST")))
+	b := i.intern(string([]byte("POST")))
+	if stringData(a) != stringData(b) {
+		t.Errorf("POST: not interned")
+	}
+	if want, have := stringData(a), stringData(i.lookupBytes([]byte("POST"))); want != have {
+		t.Errorf("POST: lookup didn't find it")
+	}
+	i.lookupBytes([]byte("PUT"))
+	i.intern(strings.Repeat("x", maxInternedLen+1))
+	if want, have := 2, i.len(); want != have {
+		t.Errorf("lookups and long strings aren't interned: want len %d, have %d", want, have)
+	}
+
+	// Once a generation holds half the strings, it's the previous one, and
+	// what isn't looked up before the next is dropped.
+	i.intern("PATCH") // POST and PATCH are the previous generation
+	i.lookupBytes([]byte("POST"))
+	i.intern("HEAD") // POST and HEAD are the previous generation
+	if want, have := 3, i.len(); want != have {
+		t.Errorf("after two generations: want len %d, have %d", want, have)
+	}
+	if want, have := stringData(a), stringData(i.lookupBytes([]byte("POST"))); want != have {
+		t.Errorf("POST: dropped, though it was looked up")
+	}
+	if want, have := uint64(2), i.generations; want != have {
+		t.Errorf("generations: want %d, have %d", want, have)
+	}
+
+	// A lookup of what isn't interned doesn't take the write lock, so it
+	// doesn't wait for readers.
+	i.mtx.RLock()
+	done := make(chan struct{})
+	go func() {
+		i.lookupBytes([]byte("DELETE"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("lookup waited for the write lock")
+	}
+	i.mtx.RUnlock()
+	<-done
+}
+
+func stringData(s string) uintptr {
+	return (*[2]uintptr)(unsafe.Pointer(&s))[0]
+}
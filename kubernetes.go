@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// The labels set on lines from pods.
+const (
+	podLabel       = "pod"
+	namespaceLabel = "namespace"
+	nodeLabel      = "node"
+)
+
+// Where a pod finds its credentials for the Kubernetes API, and how long its
+// answers are kept.
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	podCacheTTL       = time.Minute      // how long a pod is remembered
+	podMissTTL        = 10 * time.Second // how long an IP without a pod is remembered
+	podLookupTimeout  = 5 * time.Second
+	podLookupQueue    = 1024 // IPs waiting to be looked up
+	podLookupWorkers  = 4
+	podSweepInterval  = time.Minute
+)
+
+// podResolver finds the pod which has an IP address, with the Kubernetes
+// API, so lines can be labeled with the pod, namespace, and node they came
+// from. Lookups are made by run, in the background, and answers, including
+// no answer, are cached, so each IP is looked up about once a minute. A nil
+// podResolver finds nothing.
+type podResolver struct {
+	api    string // e.g. https://10.96.0.1:443
+	client *http.Client
+	logger log.Logger
+	now    func() time.Time
+
+	tokens *watchedFiles
+	tmtx   sync.Mutex
+	token  string
+
+	queue chan string // IPs to look up
+	mtx   sync.Mutex
+	pods  map[string]*podEntry
+}
+
+type podEntry struct {
+	ready   chan struct{} // closed once labels and expires are first set
+	queued  bool          // waiting for a lookup
+	labels  map[string]string
+	expires time.Time
+}
+
+// newPodResolver returns a resolver which uses the API at the URL, with the
+// bearer token in tokenFile, which is reloaded when it changes. If tokenFile
+// is empty, requests aren't authenticated.
+func newPodResolver(api, tokenFile string, client *http.Client, logger log.Logger) (*podResolver, error) {
+	r := &podResolver{
+		api:    strings.TrimSuffix(api, "/"),
+		client: client,
+		logger: logger,
+		now:    time.Now,
+		queue:  make(chan string, podLookupQueue),
+		pods:   map[string]*podEntry{},
+	}
+	if tokenFile != "" {
+		tokens, err := watchFiles(func() error {
+			buf, err := ioutil.ReadFile(tokenFile)
+			if err != nil {
+				return err
+			}
+			r.tmtx.Lock()
+			defer r.tmtx.Unlock()
+			r.token = strings.TrimSpace(string(buf))
+			return nil
+		}, tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		r.tokens = tokens
+	}
+	return r, nil
+}
+
+// inClusterPodResolver returns a resolver which uses the API of the cluster
+// the aggregator is running in, with its service account, which must be
+// allowed to list pods.
+func inClusterPodResolver(logger log.Logger) (*podResolver, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in Kubernetes: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT aren't set")
+	}
+	cas, err := loadCertPool(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Timeout: podLookupTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				MinVersion: tls.VersionTLS12,
+				RootCAs:    cas,
+			},
+		},
+	}
+	return newPodResolver("https://"+net.JoinHostPort(host, port), serviceAccountDir+"/token", client, logger)
+}
+
+// labels returns the pod, namespace, and node labels for the IP, or nil if
+// no running pod has it. If more than one does, e.g. pods on the host
+// network, it's only labeled with the node. An IP which hasn't been looked
+// up yet is queued, and gets nil, unless wait is set, in which case labels
+// waits for the answer, for up to podLookupTimeout. Expired answers are
+// returned until they're refreshed.
+func (r *podResolver) labels(ip string, wait bool) map[string]string {
+	if r == nil || net.ParseIP(ip) == nil {
+		return nil
+	}
+	now := r.now()
+	r.mtx.Lock()
+	e, ok := r.pods[ip]
+	if !ok {
+		e = &podEntry{ready: make(chan struct{})}
+		r.pods[ip] = e
+		r.enqueue(ip, e, now)
+	} else if !e.queued && !now.Before(e.expires) {
+		r.enqueue(ip, e, now)
+	}
+	r.mtx.Unlock()
+
+	if wait {
+		timer := time.NewTimer(podLookupTimeout)
+		defer timer.Stop()
+		select {
+		case <-e.ready:
+		case <-timer.C:
+			return nil
+		}
+	} else {
+		select {
+		case <-e.ready:
+		default:
+			return nil
+		}
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return e.labels
+}
+
+// enqueue asks run to look the IP up. If too many IPs are waiting already,
+// an IP which has never been looked up is taken to have no pod, for now. It's
+// called with the mutex held.
+func (r *podResolver) enqueue(ip string, e *podEntry, now time.Time) {
+	select {
+	case r.queue <- ip:
+		e.queued = true
+	default:
+		select {
+		case <-e.ready:
+		default:
+			e.expires = now
+			close(e.ready)
+		}
+	}
+}
+
+// run looks up queued IPs, and forgets expired answers every interval, until
+// the context is canceled.
+func (r *podResolver) run(ctx context.Context, interval time.Duration) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for n := 0; n < podLookupWorkers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case ip := <-r.queue:
+					r.resolve(ip)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.mtx.Lock()
+			r.sweep(r.now())
+			r.mtx.Unlock()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// resolve looks up the IP, and records the answer.
+func (r *podResolver) resolve(ip string) {
+	labels, err := r.lookup(ip)
+	if err != nil {
+		level.Warn(r.logger).Log("during", "pod lookup", "ip", ip, "err", err)
+	}
+	now := r.now()
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	e, ok := r.pods[ip]
+	if !ok {
+		return
+	}
+	e.queued, e.labels, e.expires = false, labels, now.Add(podMissTTL)
+	if labels != nil {
+		e.expires = now.Add(podCacheTTL)
+	}
+	select {
+	case <-e.ready:
+	default:
+		close(e.ready)
+	}
+}
+
+// sweep forgets expired entries which aren't waiting for a lookup. It's
+// called with the mutex held.
+func (r *podResolver) sweep(now time.Time) {
+	for ip, e := range r.pods {
+		if !e.queued && !now.Before(e.expires) {
+			delete(r.pods, ip)
+		}
+	}
+}
+
+// lookup asks the API for the pods with the IP.
+func (r *podResolver) lookup(ip string) (map[string]string, error) {
+	req, err := http.NewRequest("GET", r.api+"/api/v1/pods?fieldSelector="+url.QueryEscape("status.podIP="+ip), nil)
+	if err != nil {
+		return nil, err
+	}
+	r.tokens.check()
+	r.tmtx.Lock()
+	token := r.token
+	r.tmtx.Unlock()
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Kubernetes API: %s", resp.Status)
+	}
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+			} `json:"metadata"`
+			Spec struct {
+				NodeName string `json:"nodeName"`
+			} `json:"spec"`
+			Status struct {
+				Phase string `json:"phase"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("Kubernetes API: %v", err)
+	}
+
+	var labels map[string]string
+	for _, pod := range list.Items {
+		if pod.Status.Phase != "Running" && pod.Status.Phase != "Pending" {
+			continue // finished, and its IP may have moved on
+		}
+		if labels != nil {
+			return map[string]string{nodeLabel: pod.Spec.NodeName}, nil
+		}
+		labels = map[string]string{
+			podLabel:       pod.Metadata.Name,
+			namespaceLabel: pod.Metadata.Namespace,
+			nodeLabel:      pod.Spec.NodeName,
+		}
+	}
+	return labels, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestPodResolver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	writeFile(t, tokenFile, "s3cr3t\n")
+
+	pods := map[string]string{
+		"10.1.0.5": `{"metadata":{"name":"web-1","namespace":"shop"},"spec":{"nodeName":"node-a"},"status":{"phase":"Running"}}`,
+		"10.1.0.6": `{"metadata":{"name":"old-1","namespace":"shop"},"spec":{"nodeName":"node-a"},"status":{"phase":"Succeeded"}}`,
+		"10.0.0.2": `{"metadata":{"name":"agent-1","namespace":"ops"},"spec":{"nodeName":"node-b"},"status":{"phase":"Running"}},` +
+			`{"metadata":{"name":"proxy-1","namespace":"ops"},"spec":{"nodeName":"node-b"},"status":{"phase":"Running"}}`,
+	}
+	var lookups uint64
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&lookups, 1)
+		if want, have := "Bearer s3cr3t", r.Header.Get("Authorization"); want != have {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		ip := strings.TrimPrefix(r.URL.Query().Get("fieldSelector"), "status.podIP=")
+		fmt.Fprintf(w, `{"items":[%s]}`, pods[ip])
+	}))
+	defer api.Close()
+
+	r, err := newPodResolver(api.URL, tokenFile, api.Client(), log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mtx sync.Mutex
+	now := time.Unix(1000, 0)
+	r.now = func() time.Time { mtx.Lock(); defer mtx.Unlock(); return now }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.run(ctx, time.Hour)
+
+	// Datagrams don't wait for the lookup.
+	if have := r.labels("10.1.0.5", false); have != nil {
+		t.Errorf("before the lookup: want no labels, have %s", renderLabels(have))
+	}
+
+	for ip, want := range map[string]string{
+		"10.1.0.5": `{namespace="shop",node="node-a",pod="web-1"}`,
+		"10.1.0.6": `{}`,
+		"10.0.0.2": `{node="node-b"}`,
+		"10.9.9.9": `{}`,
+		"@":        `{}`,
+	} {
+		if have := renderLabels(r.labels(ip, true)); want != have {
+			t.Errorf("%s: want %s, have %s", ip, want, have)
+		}
+	}
+	if want, have := uint64(4), atomic.LoadUint64(&lookups); want != have {
+		t.Errorf("lookups: want %d, have %d", want, have)
+	}
+
+	// Answers are cached, for a while.
+	r.labels("10.1.0.5", true)
+	r.labels("10.9.9.9", true)
+	if want, have := uint64(4), atomic.LoadUint64(&lookups); want != have {
+		t.Errorf("cached lookups: want %d, have %d", want, have)
+	}
+
+	// Misses are forgotten sooner, and until it's refreshed, an expired
+	// answer is still given.
+	mtx.Lock()
+	now = now.Add(podMissTTL)
+	mtx.Unlock()
+	r.mtx.Lock()
+	r.sweep(now)
+	r.mtx.Unlock()
+	r.labels("10.9.9.9", true)
+	if want, have := uint64(5), atomic.LoadUint64(&lookups); want != have {
+		t.Errorf("after %s: want %d lookups, have %d", podMissTTL, want, have)
+	}
+	mtx.Lock()
+	now = now.Add(podCacheTTL)
+	mtx.Unlock()
+	if want, have := `{namespace="shop",node="node-a",pod="web-1"}`, renderLabels(r.labels("10.1.0.5", false)); want != have {
+		t.Errorf("expired: want %s, have %s", want, have)
+	}
+	for deadline := time.Now().Add(time.Second); atomic.LoadUint64(&lookups) < 6; {
+		if time.Now().After(deadline) {
+			t.Fatal("expired answer wasn't refreshed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Foo."}`,
+	})...)
+	i := &ingester{observer: u, activity: newActivity(0), logger: log.NewNopLogger(), pods: r}
+	i.handleConn(ioutil.NopCloser(strings.NewReader("foo_total{pod=\"lies\"} 1\n")), "10.1.0.5:40000")
+	if want, have := `foo_total{namespace="shop",node="node-a",pod="web-1"} 1`, scrape(t, u); !strings.Contains(have, want) {
+		t.Errorf("want %s, have\n%s", want, have)
+	}
+}
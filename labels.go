@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// labelPairs is the labels of a timeseries, as name/value pairs ordered by
+// name. It's much smaller than a map, e.g. 24 bytes plus 32 per label, and
+// the strings are interned, so it's what timeseries keep. It's immutable.
+type labelPairs []labelPair
+
+type labelPair struct {
+	name, value string
+}
+
+// makeLabelPairs returns the labels as pairs, with interned names and values.
+// It returns nil if there aren't any.
+func makeLabelPairs(labels map[string]string) labelPairs {
+	if len(labels) == 0 {
+		return nil
+	}
+	pairs := make(labelPairs, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, labelPair{labelStrings.intern(k), labelStrings.intern(v)})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].name < pairs[j].name })
+	return pairs
+}
+
+// toMap returns the labels as a map, or nil if there aren't any.
+func (l labelPairs) toMap() map[string]string {
+	if len(l) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(l))
+	for _, p := range l {
+		m[p.name] = p.value
+	}
+	return m
+}
+
+// include returns true if the pairs have every one of the labels.
+func (l labelPairs) include(labels map[string]string) bool {
+	n := 0
+	for _, p := range l {
+		if v, ok := labels[p.name]; ok {
+			if v != p.value {
+				return false
+			}
+			n++
+		}
+	}
+	return n == len(labels)
+}
+
+// render is like renderLabels.
+func (l labelPairs) render() string {
+	return string(l.appendText(nil))
+}
+
+// appendText appends the labels in the text format, e.g. {code="200"}.
+func (l labelPairs) appendText(b []byte) []byte {
+	b = append(b, '{')
+	for i, p := range l {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendLabel(b, p.name, p.value)
+	}
+	return append(b, '}')
+}
+
+// appendTextWithLE is like appendText, with an extra le label, for the
+// buckets of histograms.
+func (l labelPairs) appendTextWithLE(b, le []byte) []byte {
+	return l.appendTextWith(b, "le", le)
+}
+
+// appendTextWith is like appendText, with an extra label in its place, whose
+// value needs no escaping, e.g. the le of a bucket, or a quantile.
+func (l labelPairs) appendTextWith(b []byte, name string, value []byte) []byte {
+	b = append(b, '{')
+	i := sort.Search(len(l), func(i int) bool { return l[i].name >= name })
+	for _, p := range l[:i] {
+		b = appendLabel(b, p.name, p.value)
+		b = append(b, ',')
+	}
+	b = append(b, name...)
+	b = append(b, `="`...)
+	b = append(b, value...)
+	b = append(b, '"')
+	for _, p := range l[i:] {
+		b = append(b, ',')
+		b = appendLabel(b, p.name, p.value)
+	}
+	return append(b, '}')
+}
+
+// appendLabel appends name="value", with the value escaped as the text
+// format requires.
+func appendLabel(b []byte, name, value string) []byte {
+	b = append(b, name...)
+	b = append(b, `="`...)
+	b = appendEscaped(b, value, true)
+	return append(b, '"')
+}
+
+// appendEscaped appends s with its backslashes and newlines escaped, and if
+// quotes is true, its double quotes, too. That's what the text format
+// requires of label values, and HELP text, respectively.
+func appendEscaped(b []byte, s string, quotes bool) []byte {
+	if !needsEscaping(s, quotes) {
+		return append(b, s...)
+	}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			b = append(b, `\\`...)
+		case c == '\n':
+			b = append(b, `\n`...)
+		case c == '"' && quotes:
+			b = append(b, `\"`...)
+		default:
+			b = append(b, c)
+		}
+	}
+	return b
+}
+
+// writeEscaped is appendEscaped for label values, for a strings.Builder.
+func writeEscaped(sb *strings.Builder, s string) {
+	if !needsEscaping(s, true) {
+		sb.WriteString(s)
+		return
+	}
+	var buf [64]byte
+	sb.Write(appendEscaped(buf[:0], s, true))
+}
+
+func needsEscaping(s string, quotes bool) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '\\' || c == '\n' || (c == '"' && quotes) {
+			return true
+		}
+	}
+	return false
+}
+
+// unescapeLabelValue reverses appendEscaped for a label value. It returns an
+// error for unknown escapes, and double quotes which aren't escaped.
+func unescapeLabelValue(v []byte) ([]byte, error) {
+	if bytes.IndexByte(v, '\\') < 0 && bytes.IndexByte(v, '"') < 0 {
+		return v, nil
+	}
+	out := make([]byte, 0, len(v))
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; c {
+		case '"':
+			return nil, fmt.Errorf("label value has an unescaped double quote")
+		case '\\':
+			if i+1 == len(v) {
+				return nil, fmt.Errorf("label value ends with a backslash")
+			}
+			i++
+			switch v[i] {
+			case '\\':
+				out = append(out, '\\')
+			case '"':
+				out = append(out, '"')
+			case 'n':
+				out = append(out, '\n')
+			default:
+				return nil, fmt.Errorf("label value has an invalid escape \\%c", v[i])
+			}
+		default:
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// constLabels is a flag of labels set on every series, like region and
+// cluster, given as name=value, either by repeating the flag, or separated by
+// commas.
+type constLabels map[string]string
+
+func (l constLabels) String() string {
+	fields := make([]string, 0, len(l))
+	for _, k := range sortLabelKeys(l) {
+		fields = append(fields, k+"="+l[k])
+	}
+	return strings.Join(fields, ",")
+}
+
+func (l constLabels) repeatable() {}
+
+func (l constLabels) Set(s string) error {
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		x := strings.IndexByte(field, '=')
+		if x < 0 {
+			return fmt.Errorf("%q: want name=value", field)
+		}
+		name, value := field[:x], field[x+1:]
+		if !validLabelName(name) || reservedLabelName(name) {
+			return fmt.Errorf("%q: invalid label name", name)
+		}
+		l[name] = value
+	}
+	return nil
+}
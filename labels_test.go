@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLabelPairs(t *testing.T) {
+	labels := map[string]string{"method": "GET", "code": "200", "path": "/"}
+	pairs := makeLabelPairs(labels)
+	if want, have := renderLabels(labels), pairs.render(); want != have {
+		t.Errorf("render: want %s, have %s", want, have)
+	}
+	if want, have := labels, pairs.toMap(); !cmp.Equal(want, have) {
+		t.Error(cmp.Diff(want, have))
+	}
+	if want, have := `{code="200",le="0.5",method="GET",path="/"}`, string(pairs.appendTextWithLE(nil, []byte("0.5"))); want != have {
+		t.Errorf("with le: want %s, have %s", want, have)
+	}
+	if want, have := `{code="200",method="GET",path="/"}`, pairs.render(); want != have {
+		t.Errorf("render: want %s, have %s", want, have)
+	}
+	if want, have := `{a="1",le="0.5",z="2"}`, string(makeLabelPairs(map[string]string{"a": "1", "z": "2"}).appendTextWithLE(nil, []byte("0.5"))); want != have {
+		t.Errorf("with le: want %s, have %s", want, have)
+	}
+
+	for _, empty := range []map[string]string{nil, {}} {
+		pairs := makeLabelPairs(empty)
+		if pairs != nil {
+			t.Errorf("%v: want nil, have %v", empty, pairs)
+		}
+		if want, have := "{}", pairs.render(); want != have {
+			t.Errorf("%v: want %s, have %s", empty, want, have)
+		}
+		if want, have := `{le="+Inf"}`, string(pairs.appendTextWithLE(nil, infLE)); want != have {
+			t.Errorf("%v: want %s, have %s", empty, want, have)
+		}
+	}
+}
+
+func TestEscapedLabelValues(t *testing.T) {
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total foos,\nby path, with \\ and \"quotes\"."}`,
+	})...)
+	loadObservations(t, u, makeObservations(t, []string{
+		`foo_total{path="/a\"b"} 1`,
+		`{"name":"foo_total","labels":{"path":"back\\slash\nnewline"},"value":2}`,
+		`{"name":"foo_total","labels":{"a":"x\",b=\"y"},"value":3}`,
+		`{"name":"foo_total","labels":{"a":"x","b":"y"},"value":4}`,
+	}))
+	have := scrape(t, u)
+	if want := normalizeResponse(`
+		# HELP foo_total Total foos,\nby path, with \\ and "quotes".
+		# TYPE foo_total counter
+		foo_total{a="x",b="y"} 4
+		foo_total{a="x\",b=\"y"} 3
+		foo_total{path="/a\"b"} 1
+		foo_total{path="back\\slash\nnewline"} 2
+	`); want != normalizeResponse(have) {
+		t.Errorf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, normalizeResponse(have))
+	}
+	if errs := validateExposition([]byte(have)); len(errs) > 0 {
+		t.Errorf("invalid exposition: %v", errs)
+	}
+}
+
+func TestConstLabelsFlag(t *testing.T) {
+	l := constLabels{}
+	for _, s := range []string{"region=eu-west-1", "cluster=blue, env=prod", "env=staging"} {
+		if err := l.Set(s); err != nil {
+			t.Fatalf("%q: %v", s, err)
+		}
+	}
+	if want, have := "cluster=blue,env=staging,region=eu-west-1", l.String(); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+	for _, s := range []string{"region", "1region=eu", "le=1", "__name__=foo"} {
+		if err := (constLabels{}).Set(s); err == nil {
+			t.Errorf("%q: want error, have none", s)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// logLimiter allows at most max log events per key in each window, and
+// counts the rest, so that a single broken client can't flood the logs.
+// A nil logLimiter allows everything.
+type logLimiter struct {
+	max    int
+	window time.Duration
+	now    func() time.Time
+	logger log.Logger
+
+	mtx        sync.Mutex
+	keys       map[string]*logWindow
+	suppressed uint64 // total, for telemetry
+}
+
+type logWindow struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+func newLogLimiter(max int, window time.Duration, logger log.Logger) *logLimiter {
+	return &logLimiter{
+		max:    max,
+		window: window,
+		now:    time.Now,
+		logger: logger,
+		keys:   map[string]*logWindow{},
+	}
+}
+
+// allow reports whether a log event for key should be emitted. When a key's
+// window expires, the number of events suppressed in it is logged.
+func (l *logLimiter) allow(key string) bool {
+	if l == nil {
+		return true
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := l.now()
+	w, ok := l.keys[key]
+	if !ok || now.Sub(w.start) >= l.window {
+		l.expire(now)
+		w = &logWindow{start: now}
+		l.keys[key] = w
+	}
+	if w.count < l.max {
+		w.count++
+		return true
+	}
+	w.suppressed++
+	l.suppressed++
+	return false
+}
+
+// expire forgets about keys whose windows have expired, so that the map
+// doesn't grow without bound. The caller must hold the mutex.
+func (l *logLimiter) expire(now time.Time) {
+	for k, w := range l.keys {
+		if now.Sub(w.start) < l.window {
+			continue
+		}
+		if w.suppressed > 0 {
+			level.Warn(l.logger).Log("key", k, "suppressed", w.suppressed, "window", l.window)
+		}
+		delete(l.keys, k)
+	}
+}
+
+func (l *logLimiter) renderTelemetry(w io.Writer) {
+	if l == nil {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	fmt.Fprintf(w, "# HELP prometheus_aggregator_suppressed_logs_total Log events suppressed by rate limiting.\n")
+	fmt.Fprintf(w, "# TYPE prometheus_aggregator_suppressed_logs_total counter\n")
+	fmt.Fprintf(w, "prometheus_aggregator_suppressed_logs_total{} %d\n", l.suppressed)
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestLogLimiter(t *testing.T) {
+	var buf bytes.Buffer
+	now := time.Now()
+	l := newLogLimiter(2, time.Minute, log.NewLogfmtLogger(&buf))
+	l.now = func() time.Time { return now }
+
+	var allowed int
+	for i := 0; i < 5; i++ {
+		if l.allow("10.0.0.1") {
+			allowed++
+		}
+	}
+	if l.allow("10.0.0.2") {
+		allowed++
+	}
+	if want, have := 3, allowed; want != have {
+		t.Errorf("allowed: want %d, have %d", want, have)
+	}
+	if buf.Len() > 0 {
+		t.Errorf("unexpected log output before window expiry: %q", buf.String())
+	}
+
+	now = now.Add(time.Minute)
+	if !l.allow("10.0.0.1") {
+		t.Errorf("want allowed after window expiry, have suppressed")
+	}
+	if want, have := `key=10.0.0.1 suppressed=3`, buf.String(); !strings.Contains(have, want) {
+		t.Errorf("want log containing %q, have %q", want, have)
+	}
+	if want, have := 1, len(l.keys); want != have {
+		t.Errorf("keys: want %d, have %d", want, have)
+	}
+
+	var telemetry bytes.Buffer
+	l.renderTelemetry(&telemetry)
+	if want, have := `prometheus_aggregator_suppressed_logs_total{} 3`, telemetry.String(); !strings.Contains(have, want) {
+		t.Errorf("want telemetry containing %q, have %q", want, have)
+	}
+
+	var nilLimiter *logLimiter
+	if !nilLimiter.allow("x") {
+		t.Errorf("nil limiter should allow everything")
+	}
+}
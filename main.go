@@ -1,16 +1,20 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"text/tabwriter"
@@ -23,20 +27,145 @@ import (
 
 var version = "HEAD (dev/unreleased)"
 
+// subcommands are run instead of the aggregator, by their name as the first
+// argument.
+var subcommands = map[string]func(args []string) error{
+	"send":    func(args []string) error { return runSend(args, os.Stdin) },
+	"check":   func(args []string) error { return runCheck(args, os.Stdout) },
+	"example": func(args []string) error { return runExample(args, os.Stdout) },
+	"replay":  func(args []string) error { return runReplay(args, os.Stdin, os.Stderr) },
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	fs := flag.NewFlagSet("prometheus-aggregator", flag.ExitOnError)
 	var (
 		sockAddr = fs.String("socket", "tcp://127.0.0.1:8191", "address for direct socket metric writes")
+		sockCert = fs.String("socket-tls-cert", "", "TLS certificate file for a tls:// socket")
+		sockKey  = fs.String("socket-tls-key", "", "TLS key file for a tls:// socket")
+		sockCA   = fs.String("socket-tls-ca", "", "CA certificates file; if set, tls:// socket clients must present a certificate signed by one")
+		sockAlow = fs.String("socket-allow", "", "comma-separated CIDRs which may write to the socket (empty allows all)")
+		sockDeny = fs.String("socket-deny", "", "comma-separated CIDRs which may not write to the socket")
+		sockTok  = fs.String("socket-token", "", "token stream clients must send as AUTH <token>, in their first line")
+		sockToks = fs.String("socket-tokens-file", "", "file of tokens, one per line, any of which stream clients may send as AUTH <token>")
+		sockIdnt = fs.String("socket-tls-identity-label", "", "label set to the client certificate's identity on every line (requires -socket-tls-ca)")
+		tenSocks = fs.String("tenant-sockets", "", "comma-separated tenant=address pairs of additional sockets, one per tenant, e.g. team_a=tcp://0.0.0.0:8201")
+		tenLabel = fs.String("tenant-label", "", "label set to the tenant on lines from its socket (empty prefixes metric names with the tenant instead)")
+		tenUnivs = fs.Bool("tenant-universes", false, "give each tenant a universe of its own, scraped at the Prometheus path followed by /<tenant>, instead of a prefix or label")
+		tenIdnt  = fs.Bool("tenant-identity", false, "make TLS clients the tenants named by their certificate identities (requires -socket-tls-ca)")
+		tenMaxS  = fs.Int("tenant-max-series", 0, "maximum number of series in each tenant's universe (0 is unlimited)")
+		tenRateL = fs.Float64("tenant-rate-lines", 0, "lines per second each tenant may send, across all of its clients (0 is unlimited)")
+		tenRateB = fs.Float64("tenant-rate-bytes", 0, "bytes per second each tenant may send, across all of its clients (0 is unlimited)")
+		k8sPods  = fs.Bool("kubernetes-pods", false, "label lines from pods with their pod, namespace, and node, found by IP with the Kubernetes API (in-cluster only)")
+		k8sSide  = fs.Bool("kubernetes-sidecar", false, "run as a sidecar: label every series with the pod, namespace, and node from the downward API, and listen on a -socket shared with the pod's other containers, by default "+defaultSidecarSocket)
+		k8sInfo  = fs.String("kubernetes-podinfo", "/etc/podinfo", "directory of a downward API volume with the files name and namespace, read by -kubernetes-sidecar instead of POD_NAME and POD_NAMESPACE")
 		promAddr = fs.String("prometheus", "tcp://127.0.0.1:8192/metrics", "address for Prometheus scrapes")
+		promAlow = fs.String("prometheus-allow", "", "comma-separated CIDRs which may connect to the Prometheus listener (empty allows all)")
+		promDeny = fs.String("prometheus-deny", "", "comma-separated CIDRs which may not connect to the Prometheus listener")
+		promCert = fs.String("prometheus-tls-cert", "", "TLS certificate file for an https:// Prometheus address, reloaded when it changes")
+		promKey  = fs.String("prometheus-tls-key", "", "TLS key file for an https:// Prometheus address, reloaded when it changes")
+		cfgfile  = fs.String("config", "", "YAML file containing settings and metric declarations")
 		declfile = fs.String("declfile", "", "file containing JSON metric declarations")
 		declpath = fs.String("declpath", "", "sibling path to /metrics serving declfile contents")
-		example  = fs.Bool("example", false, "print example declfile to stdout and return")
+		sdpath   = fs.String("sd-path", "", "sibling path to /metrics serving a Prometheus HTTP service discovery document listing this aggregator, e.g. /sd")
+		sdTarget = fs.String("sd-target", "", "host:port listed in the -sd-path document, which Prometheus scrapes (empty is the hostname, at the -prometheus port)")
+		example  = fs.Bool("example", false, "print example declfile to stdout and return (see the example subcommand for more)")
 		debug    = fs.Bool("debug", false, "log debug information")
+		logFmt   = fs.String("log-format", "logfmt", "log format: logfmt, json")
+		logScrap = fs.Bool("log-scrapes", false, "log every Prometheus scrape")
+		logErrs  = fs.Int("log-errors", 10, "maximum rejected lines logged per client per minute (0 is unlimited)")
 		strict   = fs.Bool("strict", false, "disconnect clients when they send bad data")
+		replyErr = fs.Bool("reply-errors", false, "write errors back to clients when they send bad data")
+		maxLine  = fs.Int("max-line", bufio.MaxScanTokenSize, "maximum length of a line in bytes; longer lines are rejected")
+		negative = fs.String("negative-counters", "reject", "what to do with negative values observed by counters: reject, clamp")
+		nonFinit = fs.String("non-finite", "pass-gauges", "what to do with NaN and ±Inf values: reject, clamp, pass-gauges")
+		decimals = fs.Int("precision", -1, "decimal places of rendered values (-1 is the shortest exact representation)")
+		workerN  = fs.Int("ingest-workers", -1, "number of workers parsing and observing lines (-1 is one per CPU, 0 handles lines in socket readers)")
+		queueLen = fs.Int("ingest-queue", 1024, "number of lines each ingest worker may have waiting")
+		rateLine = fs.Float64("rate-lines", 0, "lines per second each client may send (0 is unlimited)")
+		rateByte = fs.Float64("rate-bytes", 0, "bytes per second each client may send (0 is unlimited)")
+		rateActn = fs.String("rate-action", "throttle", "when a client exceeds its rate: throttle, drop, disconnect")
+		overflow = fs.String("ingest-overflow", "block", "when an ingest queue is full: block, drop-newest, drop-oldest")
+		churnInt = fs.Duration("churn-interval", time.Minute, "interval for computing series churn statistics")
+		churnMax = fs.Uint64("churn-warn", 0, "warn when a metric creates more than this many series per churn interval")
+		statePth = fs.String("state-file", "", "file the state of every series is saved to, periodically and on shutdown, and restored from at startup")
+		stateInt = fs.Duration("state-interval", time.Minute, "interval for saving the state file (0 only saves on shutdown)")
+		backupTo = fs.String("backup", "", "object store snapshots of the state are uploaded to, and restored from by an aggregator without a state file, e.g. s3://bucket/prefix, gs://bucket/prefix, azblob://account/container/prefix")
+		backupIn = fs.Duration("backup-interval", time.Hour, "interval for uploading snapshots to the -backup object store")
+		backupN  = fs.Int("backup-retention", 24, "number of snapshots kept in the -backup object store")
+		handPath = fs.String("handoff-socket", "", "unix socket a new aggregator takes over this one's listeners and state through, for restarts without downtime")
+		walDir   = fs.String("wal-dir", "", "directory for a log of accepted observations, written as they're observed, and replayed at startup (requires -state-file)")
+		peerAddr = fs.String("peer", "", "address of the peer aggregator, which accepted observations are streamed to, e.g. tcp://10.0.0.2:8194")
+		peerLstn = fs.String("peer-listen", "", "address for observations streamed from the peer aggregator, e.g. tcp://0.0.0.0:8194")
+		peerTok  = fs.String("peer-token", "", "token sent to, and required of, the peer aggregator")
+		peerBuf  = fs.Int("peer-buffer", 4096, "number of batches of observations buffered while the peer, or a cluster node, is unreachable")
+		mirrorOn = fs.Bool("mirror", false, "serve scrapes of another aggregator's series, streamed to -peer-listen, or followed with -mirror-wal-dir, without accepting writes")
+		mirrorW  = fs.String("mirror-wal-dir", "", "another aggregator's -wal-dir, which a -mirror follows, never writing it (requires -mirror-state-file)")
+		mirrorS  = fs.String("mirror-state-file", "", "another aggregator's -state-file, which a -mirror restores, never writing it")
+		clusterN = fs.String("cluster", "", "comma-separated addresses of every node in the cluster, which share the series between them, e.g. tcp://10.0.0.1:8195,tcp://10.0.0.2:8195")
+		clusterS = fs.String("cluster-self", "", "address of this node, as it is in -cluster, which it listens on for observations from the others")
+		consulTo = fs.String("consul", "", "Consul HTTP API address, e.g. http://127.0.0.1:8500, for electing which of a pair is the leader, which alone serves scrapes (requires -peer), and registering -consul-service")
+		consulK  = fs.String("consul-key", "prometheus-aggregator/leader", "Consul key locked by the leader")
+		consulT  = fs.String("consul-token", "", "Consul ACL token")
+		consulSv = fs.String("consul-service", "", "name of the Consul service this aggregator registers as, with a check of /-/ready, and deregisters on shutdown (requires -consul)")
+		consulTg = fs.String("consul-service-tags", "", "comma-separated tags of the -consul-service")
+		consulAd = fs.String("consul-service-address", "", "host:port of the -consul-service, which Prometheus scrapes (empty is the Consul agent's address, at the -prometheus port)")
+		leaderID = fs.String("leader-id", "", "name of this aggregator in the leader election, and the suffix of its -consul-service ID (empty is the hostname)")
+		relayTo  = fs.String("relay", "", "address of an upstream aggregator, which the changes to every series are forwarded to, e.g. tcp://10.0.0.9:8191")
+		relayInt = fs.Duration("relay-interval", 10*time.Second, "interval for forwarding changes to the upstream aggregator")
+		relayTok = fs.String("relay-token", "", "token sent to the upstream aggregator as AUTH <token>")
+		clusterT = fs.String("cluster-token", "", "token sent to, and required of, the other nodes in the cluster")
+		shutTime = fs.Duration("shutdown-timeout", 10*time.Second, "on shutdown, how long to wait for lines already read to be observed")
+		shutScrp = fs.Duration("shutdown-scrape-wait", 0, "on shutdown, how long to wait for a final scrape of everything observed (0 doesn't wait)")
+		walSize  = fs.Int64("wal-segment-size", 64<<20, "size in bytes of a -wal-dir log segment; a full segment saves the state file")
+		auditPth = fs.String("audit-log", "", "file to append a log of runtime changes to")
+		recDir   = fs.String("record-dir", "", "directory every accepted line is recorded to, raw, with the time it was received, for the replay subcommand")
+		recSize  = fs.Int64("record-file-size", 64<<20, "size in bytes at which a -record-dir file is rotated")
+		recAge   = fs.Duration("record-file-age", time.Hour, "age at which a -record-dir file is rotated (0 only rotates full files)")
+		recKeep  = fs.Int("record-retention", 24, "number of -record-dir files kept (0 keeps every one)")
+		adminTok = fs.String("admin-token", "", "bearer token with the admin role, required for /admin, /debug, and /-/reload")
+		httpTok  = fs.String("http-token", "", "bearer token required for every request to the Prometheus listener")
+		authFile = fs.String("http-auth-file", "", "file of bearer tokens and basic auth users accepted by the Prometheus listener")
+		recentN  = fs.Int("recent-lines", 0, "number of recently received lines to serve at /debug/recent (0 disables)")
+		otlpAddr = fs.String("otlp-endpoint", "", "OpenTelemetry collector OTLP/HTTP endpoint for traces, e.g. http://127.0.0.1:4318")
+		otlpRate = fs.Float64("trace-sample", 0.001, "fraction of lines and connections to trace")
+		checkInt = fs.Duration("self-check", 0, "interval for validating the metrics exposition with the Prometheus text parser (0 disables)")
+		pprofOn  = fs.Bool("pprof", false, "serve profiling endpoints at /debug/pprof/ on the Prometheus listener")
+		pprofAdr = fs.String("pprof-addr", "", "serve profiling endpoints on this separate address instead, e.g. tcp://127.0.0.1:8193")
 	)
-	fs.Usage = usageFor(fs, "prometheus-aggregator [flags]")
+	constLbl := constLabels{}
+	fs.Var(constLbl, "label", "name=value label set on every series, e.g. region=eu-west-1 (repeatable)")
+	sdLabels := constLabels{}
+	fs.Var(sdLabels, "sd-label", "name=value label of the target in the -sd-path document, e.g. team=payments (repeatable)")
+	fs.Usage = usageFor(fs, "prometheus-aggregator [flags]\n  prometheus-aggregator send [flags] [line ...]\n  prometheus-aggregator replay [flags] [recording ...]\n  prometheus-aggregator check -declfile <file>\n  prometheus-aggregator example [flags]")
 	fs.Parse(os.Args[1:])
 
+	if err := applyEnv(fs, os.LookupEnv); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	if *cfgfile != "" {
+		c, err := readConfig(*cfgfile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		if err := c.apply(fs); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *cfgfile, err)
+			os.Exit(1)
+		}
+	}
+
 	if *example {
 		buf, _ := json.MarshalIndent(exampleDecls, "", "    ")
 		fmt.Fprintf(os.Stdout, "%s\n", buf)
@@ -45,7 +174,16 @@ func main() {
 
 	var logger log.Logger
 	{
-		logger = log.NewLogfmtLogger(os.Stdout)
+		switch strings.ToLower(*logFmt) {
+		case "logfmt":
+			logger = log.NewLogfmtLogger(os.Stdout)
+		case "json":
+			logger = log.NewJSONLogger(os.Stdout)
+		default:
+			fmt.Fprintf(os.Stderr, "unsupported log format %q\n", *logFmt)
+			os.Exit(1)
+		}
+		logger = log.NewSyncLogger(logger)
 		loglevel := level.AllowInfo()
 		if *debug {
 			loglevel = level.AllowDebug()
@@ -53,76 +191,683 @@ func main() {
 		logger = level.NewFilter(logger, loglevel)
 	}
 
-	var initial []observation
-	{
-		if *declfile != "" {
-			buf, err := ioutil.ReadFile(*declfile)
-			if err != nil {
-				level.Error(logger).Log("err", err)
+	if *k8sSide {
+		if *k8sPods {
+			level.Error(logger).Log("kubernetes-sidecar", *k8sSide, "err", "-kubernetes-sidecar and -kubernetes-pods both set the pod labels")
+			os.Exit(1)
+		}
+		explicit := false
+		fs.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "socket" })
+		if !explicit {
+			*sockAddr = defaultSidecarSocket
+		}
+		labels, err := downwardAPILabels(*k8sInfo, os.LookupEnv)
+		if err != nil {
+			level.Error(logger).Log("kubernetes-sidecar", *k8sSide, "err", err)
+			os.Exit(1)
+		}
+		for name, value := range labels {
+			if _, ok := constLbl[name]; ok {
+				level.Error(logger).Log("label", constLbl, "err", fmt.Sprintf("%s is already set on every line by -kubernetes-sidecar", name))
 				os.Exit(1)
 			}
-			if err := json.Unmarshal(buf, &initial); err != nil {
-				level.Error(logger).Log("err", err)
-				os.Exit(1)
+			constLbl[name] = value
+		}
+		level.Info(logger).Log("kubernetes-sidecar", *k8sSide, "labels", constLabels(labels))
+	}
+
+	decls := &declarations{declfile: *declfile, config: *cfgfile}
+	{
+		initial, err := decls.read()
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+		decls.decls = initial
+		if errs := lintDeclarations(initial); len(errs) > 0 {
+			for _, err := range errs {
+				level.Error(logger).Log("self_check", "declarations", "err", err)
 			}
+			os.Exit(1)
 		}
 	}
 
+	rollups, err := newRollupRules(*cfgfile)
+	if err != nil {
+		level.Error(logger).Log("config", *cfgfile, "err", err)
+		os.Exit(1)
+	}
+
 	var u *universe
 	{
 		var err error
-		u, err = newUniverse(initial...)
+		u, err = newUniverse(decls.decls...)
 		if err != nil {
 			level.Error(logger).Log("err", err)
 			os.Exit(1)
 		}
+		if !validNonFinitePolicy(*nonFinit) {
+			level.Error(logger).Log("non-finite", *nonFinit, "err", "must be reject, clamp, or pass-gauges")
+			os.Exit(1)
+		}
+		u.nonfinite = *nonFinit
+		if !validNegativePolicy(*negative) {
+			level.Error(logger).Log("negative-counters", *negative, "err", "must be reject or clamp")
+			os.Exit(1)
+		}
+		u.negative = *negative
+		if *decimals < shortestPrecision {
+			level.Error(logger).Log("precision", *decimals, "err", "must be -1 or more")
+			os.Exit(1)
+		}
+		u.precision = *decimals
+		u.rollups = rollups.newRollups()
+	}
+
+	var tenantsU *tenantUniverses
+	{
+		if *tenUnivs && *tenLabel != "" {
+			level.Error(logger).Log("tenant-universes", *tenUnivs, "tenant-label", *tenLabel, "err", "tenants can have universes or labels, not both")
+			os.Exit(1)
+		}
+		if *tenMaxS != 0 && (!*tenUnivs || *tenMaxS < 0) {
+			level.Error(logger).Log("tenant-max-series", *tenMaxS, "err", "must not be negative, and requires -tenant-universes")
+			os.Exit(1)
+		}
+		if *tenUnivs {
+			tenantsU = newTenantUniverses(u, func() *universe {
+				tu, _ := newUniverse()
+				tu.nonfinite, tu.negative, tu.precision = u.nonfinite, u.negative, u.precision
+				tu.limit = newSeriesLimit(*tenMaxS)
+				tu.rollups = rollups.newRollups()
+				for _, o := range decls.current() {
+					tu.declare(o) // already declared in the default universe
+				}
+				return tu
+			})
+		}
+	}
+
+	var ho *handoff
+	{
+		if *handPath != "" {
+			var err error
+			if ho, err = newHandoff(*handPath, logger); err != nil {
+				level.Error(logger).Log("handoff-socket", *handPath, "err", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	var bkup *backup
+	{
+		if *backupTo != "" {
+			if *backupIn <= 0 || *backupN < 1 {
+				level.Error(logger).Log("backup-interval", *backupIn, "backup-retention", *backupN, "err", "must be positive")
+				os.Exit(1)
+			}
+			store, prefix, err := parseObjectStore(*backupTo, os.Getenv)
+			if err != nil {
+				level.Error(logger).Log("backup", *backupTo, "err", err)
+				os.Exit(1)
+			}
+			snapshotter := &stateFile{u: u, tenants: tenantsU, logger: logger}
+			bkup = newBackup(store, prefix, *backupN, snapshotter.snapshot, logger)
+		}
+	}
+
+	var walLog *wal
+	{
+		if *walDir != "" {
+			if *statePth == "" {
+				level.Error(logger).Log("wal-dir", *walDir, "err", "requires -state-file")
+				os.Exit(1)
+			}
+			if *walSize <= 0 {
+				level.Error(logger).Log("wal-segment-size", *walSize, "err", "must be positive")
+				os.Exit(1)
+			}
+			var next observer = u
+			if tenantsU != nil {
+				next = tenantsU
+			}
+			var err error
+			if walLog, err = openWAL(*walDir, *walSize, next, logger); err != nil {
+				level.Error(logger).Log("wal-dir", *walDir, "err", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	var state *stateFile
+	{
+		if *stateInt < 0 {
+			level.Error(logger).Log("state-interval", *stateInt, "err", "must not be negative")
+			os.Exit(1)
+		}
+		stateless := true
+		if *statePth != "" {
+			state = &stateFile{filename: *statePth, u: u, tenants: tenantsU, wal: walLog, logger: logger}
+			_, err := os.Stat(*statePth)
+			stateless = os.IsNotExist(err)
+		}
+		restorer := state
+		if restorer == nil {
+			restorer = &stateFile{u: u, tenants: tenantsU, logger: logger}
+		}
+		switch {
+		case ho != nil && ho.state != nil:
+			// The old aggregator's state is at least as new as the state file.
+			restored, replayed, err := restorer.restoreState(*ho.state)
+			if err != nil {
+				level.Error(logger).Log("handoff-socket", *handPath, "err", err)
+				os.Exit(1)
+			}
+			level.Info(logger).Log("handoff-socket", *handPath, "restored", restored, "replayed", replayed)
+		case bkup != nil && stateless:
+			// A new host, most likely, so start from the last backup.
+			ctx, cancel := context.WithTimeout(context.Background(), backupTimeout)
+			st, key, err := bkup.latest(ctx)
+			cancel()
+			if err != nil {
+				level.Error(logger).Log("backup", *backupTo, "err", err)
+				os.Exit(1)
+			}
+			restored, replayed, err := restorer.restoreState(st)
+			if err != nil {
+				level.Error(logger).Log("backup", *backupTo, "err", err)
+				os.Exit(1)
+			}
+			level.Info(logger).Log("backup", *backupTo, "snapshot", key, "restored", restored, "replayed", replayed)
+		case state != nil:
+			restored, replayed, err := state.restore()
+			if err != nil {
+				level.Error(logger).Log("state-file", *statePth, "err", err)
+				os.Exit(1)
+			}
+			level.Info(logger).Log("state-file", *statePth, "restored", restored, "replayed", replayed)
+		}
 	}
 
-	var socketNetwork, socketAddress string
-	var forwardFunc func() error
-	var forwardClose func() error
+	var audit *auditLog
 	{
-		sockURL, err := url.Parse(*sockAddr)
+		if *auditPth != "" {
+			f, err := os.OpenFile(*auditPth, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				level.Error(logger).Log("audit-log", *auditPth, "err", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			audit = newAuditLog(f)
+		}
+	}
+
+	rules, err := newRelabeler(*cfgfile)
+	if err != nil {
+		level.Error(logger).Log("config", *cfgfile, "err", err)
+		os.Exit(1)
+	}
+	derived, err := newDeriver(u, *cfgfile)
+	if err != nil {
+		level.Error(logger).Log("config", *cfgfile, "err", err)
+		os.Exit(1)
+	}
+
+	// Files of certificates, keys, and tokens, which are watched for changes,
+	// are also reloaded along with the declfile, as are the relabel rules,
+	// derived metrics, and rollups.
+	var secrets []func() error
+
+	reload := func(who string) error {
+		var secretsErr error
+		for _, reload := range secrets {
+			if err := reload(); err != nil {
+				level.Error(logger).Log("reload", "failed", "err", err) // and carry on with the rest
+				secretsErr = err
+			}
+		}
+		if err := rules.reload(); err != nil {
+			level.Error(logger).Log("reload", "failed", "config", *cfgfile, "err", err) // the previous rules are kept
+			secretsErr = err
+		}
+		if err := derived.reload(); err != nil {
+			level.Error(logger).Log("reload", "failed", "config", *cfgfile, "err", err) // the previous derived metrics are kept
+			secretsErr = err
+		}
+		if err := rollups.reload(); err != nil {
+			level.Error(logger).Log("reload", "failed", "config", *cfgfile, "err", err) // the previous rollups are kept
+			secretsErr = err
+		}
+		added, rebucketed, err := decls.reload(u)
 		if err != nil {
-			level.Error(logger).Log("socket", *sockAddr, "err", err)
+			level.Error(logger).Log("reload", "failed", "err", err)
+			return err
+		}
+		for _, name := range rebucketed {
+			level.Warn(logger).Log("reload", "rebucketed", "name", name, "msg", "all series reset")
+		}
+		if tenantsU != nil {
+			tenantsU.declare(decls.current())
+		}
+		level.Info(logger).Log("reload", "success", "config", *cfgfile, "declfile", *declfile, "added", added, "rebucketed", len(rebucketed))
+		if err := audit.record(who, "reload", map[string]string{"config": *cfgfile, "declfile": *declfile, "added": strconv.Itoa(added)}); err != nil {
+			level.Error(logger).Log("during", "audit", "err", err)
+		}
+		return secretsErr
+	}
+
+	churn := newChurnTracker(u, *churnMax, logger)
+	act := newActivity(*recentN)
+
+	var rec *recorder
+	{
+		if *recDir != "" {
+			if *recSize <= 0 || *recAge < 0 || *recKeep < 0 {
+				level.Error(logger).Log("record-file-size", *recSize, "record-file-age", *recAge, "record-retention", *recKeep, "err", "size must be positive, and age and retention not negative")
+				os.Exit(1)
+			}
+			var err error
+			if rec, err = openRecorder(*recDir, *recSize, *recAge, *recKeep, logger); err != nil {
+				level.Error(logger).Log("record-dir", *recDir, "err", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	var trc *tracer
+	{
+		if *otlpAddr != "" {
+			if *otlpRate < 0 || *otlpRate > 1 {
+				level.Error(logger).Log("trace-sample", *otlpRate, "err", "must be between 0 and 1")
+				os.Exit(1)
+			}
+			trc = newTracer(*otlpAddr, *otlpRate, logger)
+		}
+	}
+
+	var errlog *logLimiter
+	if *logErrs > 0 {
+		errlog = newLogLimiter(*logErrs, time.Minute, logger)
+	}
+
+	stats := newPipelineStats()
+
+	var limiter *rateLimiter
+	{
+		if *rateLine < 0 || *rateByte < 0 {
+			level.Error(logger).Log("rate-lines", *rateLine, "rate-bytes", *rateByte, "err", "must not be negative")
 			os.Exit(1)
 		}
+		if !validLimitAction(*rateActn) {
+			level.Error(logger).Log("rate-action", *rateActn, "err", "must be throttle, drop, or disconnect")
+			os.Exit(1)
+		}
+		if *rateLine > 0 || *rateByte > 0 {
+			limiter = newRateLimiter(*rateLine, *rateByte, *rateActn)
+		}
+	}
 
-		socketNetwork = strings.ToLower(sockURL.Scheme)
+	tokens, err := newSocketTokens(*sockToks, *sockTok)
+	if err != nil {
+		level.Error(logger).Log("socket-tokens-file", *sockToks, "err", err)
+		os.Exit(1)
+	}
+	secrets = append(secrets, tokens.reload)
+
+	ing := &ingester{
+		observer: u,
+		activity: act,
+		tracer:   trc,
+		errlog:   errlog,
+		stats:    stats,
+		audit:    audit,
+		recorder: rec,
+		strict:   *strict,
+		reply:    *replyErr,
+		logger:   logger,
+		maxLine:  *maxLine,
+		overflow: *overflow,
+		identity: *sockIdnt,
+		tokens:   tokens,
+		limiter:  limiter,
+		rules:    rules,
+		drainer:  newDrainer(),
+	}
+	if len(constLbl) > 0 {
+		for _, name := range []string{*sockIdnt, *tenLabel} {
+			if _, ok := constLbl[name]; ok {
+				level.Error(logger).Log("label", constLbl, "err", fmt.Sprintf("%s is already set on every line by another flag", name))
+				os.Exit(1)
+			}
+		}
+		ing.labels = constLbl
+	}
+	if *k8sPods {
+		for _, name := range []string{*sockIdnt, *tenLabel} {
+			if name == podLabel || name == namespaceLabel || name == nodeLabel {
+				level.Error(logger).Log("kubernetes-pods", *k8sPods, "err", fmt.Sprintf("%s is already set on every line by another flag", name))
+				os.Exit(1)
+			}
+		}
+		pods, err := inClusterPodResolver(logger)
+		if err != nil {
+			level.Error(logger).Log("kubernetes-pods", *k8sPods, "err", err)
+			os.Exit(1)
+		}
+		ing.pods = pods
+	}
+	if tenantsU != nil {
+		ing.observer = tenantsU
+	}
+	if walLog != nil {
+		ing.observer = walLog
+	}
+	var repl *replicator
+	var peerLn net.Listener
+	{
+		if *peerAddr != "" || *peerLstn != "" {
+			if *peerBuf < 1 {
+				level.Error(logger).Log("peer-buffer", *peerBuf, "err", "must be at least 1")
+				os.Exit(1)
+			}
+			repl = &replicator{next: ing.observer}
+			if *peerAddr != "" {
+				pu, err := url.Parse(*peerAddr)
+				if err != nil || pu.Host == "" {
+					level.Error(logger).Log("peer", *peerAddr, "err", "must be an address like tcp://host:port")
+					os.Exit(1)
+				}
+				repl.stream = newPeerStream(pu.Scheme, pu.Host, *peerTok, *peerBuf, logger)
+			}
+			if *peerLstn != "" {
+				pu, err := url.Parse(*peerLstn)
+				if err != nil {
+					level.Error(logger).Log("peer-listen", *peerLstn, "err", err)
+					os.Exit(1)
+				}
+				if peerLn, err = ho.listen(pu.Scheme, pu.Host); err != nil {
+					level.Error(logger).Log("peer-listen", *peerLstn, "err", err)
+					os.Exit(1)
+				}
+				repl.listener = newPeerListener(*peerTok, ing.observer, logger)
+			}
+			ing.observer = repl
+		}
+	}
+	var clust *cluster
+	var clusterLn net.Listener
+	{
+		if *clusterN != "" || *clusterS != "" {
+			if repl != nil {
+				level.Error(logger).Log("cluster", *clusterN, "err", "a cluster node can't have a peer, too")
+				os.Exit(1)
+			}
+			network, nodes, err := parseClusterNodes(*clusterN)
+			if err != nil {
+				level.Error(logger).Log("cluster", *clusterN, "err", err)
+				os.Exit(1)
+			}
+			_, self, err := parseClusterNodes(*clusterS)
+			if err != nil || len(self) != 1 {
+				level.Error(logger).Log("cluster-self", *clusterS, "err", "must be one of the -cluster addresses")
+				os.Exit(1)
+			}
+			if *peerBuf < 1 {
+				level.Error(logger).Log("peer-buffer", *peerBuf, "err", "must be at least 1")
+				os.Exit(1)
+			}
+			if clust, err = newCluster(self[0], nodes, network, *clusterT, *peerBuf, ing.observer, logger); err != nil {
+				level.Error(logger).Log("cluster", *clusterN, "err", err)
+				os.Exit(1)
+			}
+			if clusterLn, err = ho.listen(network, self[0]); err != nil {
+				level.Error(logger).Log("cluster-self", *clusterS, "err", err)
+				os.Exit(1)
+			}
+			ing.observer = clust
+		}
+	}
+	var follower *walFollower
+	{
+		switch {
+		case *mirrorOn:
+			if *peerAddr != "" || *clusterN != "" || *tenSocks != "" {
+				level.Error(logger).Log("mirror", *mirrorOn, "err", "a mirror accepts no writes, so it can't have a -peer, -cluster, or -tenant-sockets")
+				os.Exit(1)
+			}
+			if *peerLstn == "" && *mirrorW == "" {
+				level.Error(logger).Log("mirror", *mirrorOn, "err", "requires -peer-listen, or -mirror-wal-dir")
+				os.Exit(1)
+			}
+			if *mirrorW != "" {
+				if *mirrorS == "" || *statePth != "" {
+					level.Error(logger).Log("mirror-wal-dir", *mirrorW, "err", "requires -mirror-state-file, and no -state-file of its own")
+					os.Exit(1)
+				}
+				followed := &stateFile{filename: *mirrorS, u: u, tenants: tenantsU, logger: logger}
+				follower = newWALFollower(*mirrorW, followed, ing.observer, logger)
+				restored, err := follower.resync()
+				if err != nil {
+					level.Error(logger).Log("mirror-state-file", *mirrorS, "err", err)
+					os.Exit(1)
+				}
+				level.Info(logger).Log("mirror-state-file", *mirrorS, "restored", restored)
+			}
+		case *mirrorW != "" || *mirrorS != "":
+			level.Error(logger).Log("mirror-wal-dir", *mirrorW, "mirror-state-file", *mirrorS, "err", "requires -mirror")
+			os.Exit(1)
+		}
+	}
+	var elect *election
+	{
+		if *consulSv != "" && *consulTo == "" {
+			level.Error(logger).Log("consul-service", *consulSv, "err", "requires -consul")
+			os.Exit(1)
+		}
+		if *consulTo != "" && *leaderID == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				level.Error(logger).Log("leader-id", *leaderID, "err", err)
+				os.Exit(1)
+			}
+			*leaderID = hostname
+		}
+		// With a -consul-service, and without a -peer, Consul is only for
+		// registering the service.
+		if *consulTo != "" && (*consulSv == "" || repl != nil && repl.stream != nil) {
+			if repl == nil || repl.stream == nil {
+				level.Error(logger).Log("consul", *consulTo, "err", "requires -peer, so the standby has the leader's state")
+				os.Exit(1)
+			}
+			elect = newElection(*consulTo, *consulK, *leaderID, *consulT, logger)
+		}
+	}
+	var upstream *relay
+	{
+		if *relayTo != "" {
+			if tenantsU != nil {
+				level.Error(logger).Log("relay", *relayTo, "err", "tenants' universes can't be relayed, only the default one")
+				os.Exit(1)
+			}
+			if *relayInt <= 0 {
+				level.Error(logger).Log("relay-interval", *relayInt, "err", "must be positive")
+				os.Exit(1)
+			}
+			ru, err := url.Parse(*relayTo)
+			if err != nil || ru.Host == "" {
+				level.Error(logger).Log("relay", *relayTo, "err", "must be an address like tcp://host:port")
+				os.Exit(1)
+			}
+			upstream = newRelay(u, ru.Scheme, ru.Host, *relayTok, logger)
+		}
+	}
+	if *tenIdnt {
+		if *sockCA == "" {
+			level.Error(logger).Log("tenant-identity", *tenIdnt, "err", "requires -socket-tls-ca")
+			os.Exit(1)
+		}
+		ing.tenants = &tenancy{label: *tenLabel, universes: *tenUnivs}
+	}
+	{
+		var err error
+		if ing.filter, err = parseAddrFilter(*sockAlow, *sockDeny); err != nil {
+			level.Error(logger).Log("socket-allow", *sockAlow, "socket-deny", *sockDeny, "err", err)
+			os.Exit(1)
+		}
+	}
+	if *queueLen < 0 {
+		level.Error(logger).Log("ingest-queue", *queueLen, "err", "must not be negative")
+		os.Exit(1)
+	}
+	if !validOverflowPolicy(*overflow) {
+		level.Error(logger).Log("ingest-overflow", *overflow, "err", "must be block, drop-newest, or drop-oldest")
+		os.Exit(1)
+	}
+	if *workerN < -1 {
+		level.Error(logger).Log("ingest-workers", *workerN, "err", "must be -1 or more")
+		os.Exit(1)
+	}
+	if *workerN < 0 {
+		*workerN = runtime.NumCPU()
+	}
+	if *workerN > 0 {
+		ing.queues = newLineQueues(*workerN, *queueLen)
+	}
+	if *shutTime < 0 || *shutScrp < 0 {
+		level.Error(logger).Log("shutdown-timeout", *shutTime, "shutdown-scrape-wait", *shutScrp, "err", "must not be negative")
+		os.Exit(1)
+	}
+
+	tenants, err := parseTenants(*tenSocks, tenancy{label: *tenLabel, universes: *tenUnivs})
+	if err != nil {
+		level.Error(logger).Log("tenant-sockets", *tenSocks, "err", err)
+		os.Exit(1)
+	}
+	if *tenLabel != "" && (!validLabelName(*tenLabel) || reservedLabelName(*tenLabel) || *tenLabel == *sockIdnt) {
+		level.Error(logger).Log("tenant-label", *tenLabel, "err", "must be a valid label name, other than the -socket-tls-identity-label")
+		os.Exit(1)
+	}
+	if *tenRateL < 0 || *tenRateB < 0 {
+		level.Error(logger).Log("tenant-rate-lines", *tenRateL, "tenant-rate-bytes", *tenRateB, "err", "must not be negative")
+		os.Exit(1)
+	}
+	if len(tenants) > 0 || *tenIdnt {
+		var rates *rateLimiter
+		if *tenRateL > 0 || *tenRateB > 0 {
+			rates = newRateLimiter(*tenRateL, *tenRateB, *rateActn)
+		}
+		ing.quotas = newTenantQuotas(rates)
+	} else if *tenRateL > 0 || *tenRateB > 0 {
+		level.Error(logger).Log("tenant-rate-lines", *tenRateL, "tenant-rate-bytes", *tenRateB, "err", "requires -tenant-sockets or -tenant-identity")
+		os.Exit(1)
+	}
+
+	var checker *selfChecker
+	{
+		if *checkInt > 0 {
+			checker = newSelfChecker(func() []byte {
+				var buf bytes.Buffer
+				renderMetrics(&buf, u, derived, act, errlog, stats, u.violations, limiter, rules, ing.quotas, repl, clust, upstream, bkup, follower)
+				return buf.Bytes()
+			}, logger)
+			checker.check()
+		}
+	}
+
+	// The -socket, and each tenant's socket, has an ingester of its own,
+	// which shares everything but the tenant with the others.
+	var sockets []socketListener
+	var tlsSocket bool
+	socketTenants := append([]*tenant{nil}, tenants...)
+	if *mirrorOn {
+		socketTenants = nil // a mirror accepts no writes
+	}
+	for _, t := range socketTenants {
+		addr, ingest := *sockAddr, ing
+		if t != nil {
+			addr, ingest = t.socket, ing.forTenant(t)
+		}
+		var socketAddress string
+		var forwardFunc, forwardClose func() error
+		sockURL, err := url.Parse(addr)
+		if err != nil {
+			level.Error(logger).Log("socket", addr, "err", err)
+			os.Exit(1)
+		}
+
+		socketNetwork := strings.ToLower(sockURL.Scheme)
 		switch socketNetwork {
-		case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+		case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6", "tls":
 			socketAddress = sockURL.Host
 		case "unix", "unixgram", "unipacket":
 			socketAddress = sockURL.Path
 		default:
-			level.Error(logger).Log("socket", *sockAddr, "err", "unsupported network", "network", sockURL.Scheme)
+			level.Error(logger).Log("socket", addr, "err", "unsupported network", "network", sockURL.Scheme)
 			os.Exit(1)
 		}
 
 		switch socketNetwork {
 		case "udp", "udp4", "udp6", "unixgram":
-			laddr, err := net.ResolveUDPAddr(sockURL.Scheme, socketAddress)
-			if err != nil {
-				level.Error(logger).Log("socket", *sockAddr, "err", err)
+			if tokens != nil {
+				level.Error(logger).Log("socket", addr, "err", "datagrams can't authenticate; tokens require a stream socket")
 				os.Exit(1)
 			}
-			conn, err := net.ListenUDP(sockURL.Scheme, laddr)
+			conn, err := ho.listenUDP(sockURL.Scheme, socketAddress)
 			if err != nil {
-				level.Error(logger).Log("socket", *sockAddr, "err", err)
+				level.Error(logger).Log("socket", addr, "err", err)
 				os.Exit(1)
 			}
-			forwardFunc = func() error { return forwardPacketConn(conn, u, logger) }
+			forwardFunc = func() error { return ingest.forwardPacketConn(conn) }
 			forwardClose = conn.Close
 
 		case "tcp", "tcp4", "tcp6", "unix", "unixpacket":
-			ln, err := net.Listen(sockURL.Scheme, socketAddress)
+			if *k8sSide && socketNetwork == "unix" {
+				if err := removeStaleSocket(socketAddress); err != nil {
+					level.Error(logger).Log("socket", addr, "err", err)
+					os.Exit(1)
+				}
+			}
+			ln, err := ho.listen(sockURL.Scheme, socketAddress)
+			if err != nil {
+				level.Error(logger).Log("socket", addr, "err", err)
+				os.Exit(1)
+			}
+			if *k8sSide && socketNetwork == "unix" {
+				if err := shareSocket(socketAddress); err != nil {
+					level.Error(logger).Log("socket", addr, "err", err)
+					os.Exit(1)
+				}
+			}
+			ln = ingest.filter.listener(ln, ingest.denied)
+			forwardFunc = func() error { return ingest.forwardListener(ln) }
+			forwardClose = ln.Close
+
+		case "tls":
+			config, reload, err := serverTLSConfig(*sockCert, *sockKey, *sockCA)
 			if err != nil {
-				level.Error(logger).Log("socket", *sockAddr, "err", err)
+				level.Error(logger).Log("socket", addr, "err", err)
 				os.Exit(1)
 			}
-			forwardFunc = func() error { return forwardListener(ln, u, *strict, logger) }
+			secrets = append(secrets, reload)
+			ln, err := ho.listen("tcp", socketAddress)
+			if err != nil {
+				level.Error(logger).Log("socket", addr, "err", err)
+				os.Exit(1)
+			}
+			ln = tls.NewListener(ingest.filter.listener(ln, ingest.denied), config)
+			forwardFunc = func() error { return ingest.forwardListener(ln) }
 			forwardClose = ln.Close
 		}
+		tlsSocket = tlsSocket || socketNetwork == "tls"
+		sockets = append(sockets, socketListener{network: socketNetwork, address: socketAddress, tenant: t, forward: forwardFunc, close: forwardClose})
+	}
+	if *sockIdnt != "" && (*sockCA == "" || !validLabelName(*sockIdnt) || reservedLabelName(*sockIdnt)) {
+		level.Error(logger).Log("socket-tls-identity-label", *sockIdnt, "err", "must be a valid label name, and requires -socket-tls-ca")
+		os.Exit(1)
+	}
+	if !tlsSocket && (*sockCert != "" || *sockKey != "" || *sockCA != "") {
+		level.Error(logger).Log("socket", *sockAddr, "err", "TLS flags require a tls:// socket")
+		os.Exit(1)
 	}
 
 	var metricsLn net.Listener
@@ -133,19 +878,79 @@ func main() {
 			level.Error(logger).Log("prometheus", *promAddr, "err", err)
 			os.Exit(1)
 		}
-		metricsLn, err = net.Listen(u.Scheme, u.Host)
+		network := u.Scheme
+		var config *tls.Config
+		if u.Scheme == "https" {
+			network = "tcp"
+			var reload func() error
+			if config, reload, err = serverTLSConfig(*promCert, *promKey, ""); err != nil {
+				level.Error(logger).Log("prometheus", *promAddr, "err", err)
+				os.Exit(1)
+			}
+			secrets = append(secrets, reload)
+		} else if *promCert != "" || *promKey != "" {
+			level.Error(logger).Log("prometheus", *promAddr, "err", "TLS flags require an https:// address")
+			os.Exit(1)
+		}
+		filter, err := parseAddrFilter(*promAlow, *promDeny)
+		if err != nil {
+			level.Error(logger).Log("prometheus-allow", *promAlow, "prometheus-deny", *promDeny, "err", err)
+			os.Exit(1)
+		}
+		metricsLn, err = ho.listen(network, u.Host)
 		if err != nil {
 			level.Error(logger).Log("prometheus", *promAddr, "err", err)
 			os.Exit(1)
 		}
+		metricsLn = filter.listener(metricsLn, func(addr string) {
+			if errlog.allow(clientHost(addr)) {
+				level.Warn(logger).Log("listener", "prometheus_scrapes", "remote_addr", addr, "err", "address not allowed")
+			}
+		})
+		if config != nil {
+			metricsLn = tls.NewListener(metricsLn, config)
+		}
 		metricsPath = u.Path
 		if metricsPath == "" {
 			metricsPath = "/"
 		}
+		if tenantsU != nil && metricsPath == "/" {
+			level.Error(logger).Log("prometheus", *promAddr, "err", "-tenant-universes requires a path, which tenants' paths are under")
+			os.Exit(1)
+		}
+	}
+
+	var reg *registration
+	{
+		if *consulSv != "" {
+			pu, _ := url.Parse(*promAddr) // parsed above
+			var err error
+			reg, err = newRegistration(*consulTo, *consulT, *consulSv, *leaderID, parseServiceTags(*consulTg), *consulAd, pu, metricsLn.Addr(), logger)
+			if err != nil {
+				level.Error(logger).Log("consul-service", *consulSv, "err", err)
+				os.Exit(1)
+			}
+		}
 	}
 
+	var pprofLn net.Listener
+	{
+		if *pprofAdr != "" {
+			u, err := url.Parse(*pprofAdr)
+			if err != nil {
+				level.Error(logger).Log("pprof", *pprofAdr, "err", err)
+				os.Exit(1)
+			}
+			pprofLn, err = ho.listen(u.Scheme, u.Host)
+			if err != nil {
+				level.Error(logger).Log("pprof", *pprofAdr, "err", err)
+				os.Exit(1)
+			}
+		}
+	}
+	ho.closeUnclaimed()
+
 	var declPath string
-	var declHandler http.Handler
 	{
 		if *declpath != "" {
 			*declpath = "/" + strings.Trim(*declpath, "/ ")
@@ -157,39 +962,152 @@ func main() {
 				os.Exit(1)
 			}
 			declPath = u.Path
-			response, err := json.MarshalIndent(initial, "", "    ")
+		}
+	}
+
+	var sd http.Handler
+	var sdPath string
+	{
+		if *sdpath != "" {
+			sdPath = "/" + strings.Trim(*sdpath, "/ ")
+			if sdPath == metricsPath || sdPath == declPath {
+				level.Error(logger).Log("sd-path", *sdpath, "err", "must be a path of its own")
+				os.Exit(1)
+			}
+			target, err := resolveSDTarget(*sdTarget, metricsLn.Addr())
 			if err != nil {
-				level.Error(logger).Log("declpath", *declpath, "during", "marshal of initial declarations", "err", err)
+				level.Error(logger).Log("sd-target", *sdTarget, "err", err)
 				os.Exit(1)
 			}
-			declHandler = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
-				w.Header().Set("content-type", "application/json; charset=utf-8")
-				w.Write(response)
-			})
+			pu, _ := url.Parse(*promAddr) // parsed above
+			sd = sdHandler(target, pu, metricsPath, sdLabels)
+		} else if *sdTarget != "" || len(sdLabels) > 0 {
+			level.Error(logger).Log("sd-target", *sdTarget, "sd-label", sdLabels, "err", "requires -sd-path")
+			os.Exit(1)
+		}
+	}
+
+	var auth *httpAuth
+	{
+		if *authFile != "" {
+			var err error
+			if auth, err = readHTTPAuth(*authFile); err != nil {
+				level.Error(logger).Log("http-auth-file", *authFile, "err", err)
+				os.Exit(1)
+			}
+			secrets = append(secrets, auth.reload)
+		}
+		if *httpTok != "" {
+			if auth == nil {
+				auth = &httpAuth{}
+			}
+			auth.addToken(*httpTok, roleScrape)
 		}
+		if auth != nil {
+			auth.addToken(*adminTok, roleAdmin)
+		}
+	}
+
+	// Admin endpoints need admin credentials even if nothing else needs any.
+	admin := auth
+	if admin == nil && *adminTok != "" {
+		admin = &httpAuth{}
+		admin.addToken(*adminTok, roleAdmin)
 	}
 
 	var g run.Group
+	for _, s := range sockets {
+		s := s
+		g.Add(func() error {
+			keyvals := []interface{}{"listener", "socket_writes", "network", s.network, "address", s.address}
+			if s.tenant != nil {
+				keyvals = append(keyvals, "tenant", s.tenant.name)
+			}
+			level.Info(logger).Log(keyvals...)
+			return s.forward()
+		}, func(error) {
+			s.close()
+		})
+	}
+	if clusterLn != nil {
+		g.Add(func() error {
+			level.Info(logger).Log("listener", "cluster", "network", clusterLn.Addr().Network(), "address", clusterLn.Addr().String(), "nodes", len(clust.nodes))
+			return clust.listener.serve(clusterLn)
+		}, func(error) {
+			clusterLn.Close()
+		})
+	}
+	if peerLn != nil {
+		g.Add(func() error {
+			level.Info(logger).Log("listener", "peer", "network", peerLn.Addr().Network(), "address", peerLn.Addr().String())
+			return repl.listener.serve(peerLn)
+		}, func(error) {
+			peerLn.Close()
+		})
+	}
 	{
+		// Interrupts run in order, so by now the sockets are closed, and
+		// the Prometheus listener and the workers are still running.
+		ctx, cancel := context.WithCancel(context.Background())
 		g.Add(func() error {
-			level.Info(logger).Log("listener", "socket_writes", "network", socketNetwork, "address", socketAddress)
-			return forwardFunc()
+			<-ctx.Done()
+			return ctx.Err()
 		}, func(error) {
-			forwardClose()
+			defer cancel()
+			if !ing.drainer.close(*shutTime) {
+				level.Warn(logger).Log("shutdown", "drain", "err", fmt.Sprintf("lines still in flight after %s", *shutTime))
+			}
+			if *shutScrp > 0 {
+				level.Info(logger).Log("shutdown", "awaiting final scrape", "wait", *shutScrp)
+				if !ing.drainer.awaitScrape(*shutScrp) {
+					level.Warn(logger).Log("shutdown", "final scrape", "err", fmt.Sprintf("not scraped within %s", *shutScrp))
+				}
+			}
 		})
 	}
 	{
 		mux := http.NewServeMux()
-		mux.Handle(metricsPath, u)
+		scrapeLogger := log.NewNopLogger()
+		if *logScrap {
+			scrapeLogger = log.With(logger, "listener", "prometheus_scrapes")
+		}
+		mux.Handle(metricsPath, elect.wrapLeader(ing.drainer.wrapScrapes(metricsHandler(u, scrapeLogger, derived, act, errlog, stats, u.violations, limiter, rules, ing.quotas, repl, clust, upstream, bkup, follower, labelStrings))))
 		if declPath != "" {
-			mux.Handle(declPath, declHandler)
+			mux.Handle(declPath, decls)
+		}
+		if sd != nil {
+			mux.Handle(sdPath, sd)
+		}
+		if tenantsU != nil {
+			prefix := strings.TrimSuffix(metricsPath, "/") + "/"
+			mux.Handle(prefix, elect.wrapLeader(tenantMetricsHandler(tenantsU, prefix, scrapeLogger)))
 		}
-		server := http.Server{Handler: mux}
+		if admin != nil {
+			mux.Handle("/-/reload", reloadHandler(admin, reload))
+		}
+		mux.Handle("/admin/audit", auditHandler(audit))
+		mux.Handle("/admin/churn", churn)
+		mux.Handle("/admin/declarations", declarationsHandler(u, admin, audit, logger))
+		mux.Handle("/admin/dump", dumpHandler(u))
+		mux.Handle("/admin/stats", statsHandler(u))
+		if *recentN > 0 {
+			mux.Handle("/debug/recent", recentHandler(act))
+		}
+		if metricsPath != "/" {
+			mux.Handle("/", uiHandler(u, act))
+		}
+		if *pprofOn && pprofLn == nil {
+			mux.Handle("/debug/pprof/", pprofHandler())
+		}
+		server := http.Server{Handler: authorize(mux, readyHandler(checker, ing.drainer), auth, admin)}
 		g.Add(func() error {
 			keyvals := []interface{}{"listener", "prometheus_scrapes", "network", metricsLn.Addr().Network(), "address", metricsLn.Addr().String(), "path", metricsPath}
 			if declPath != "" {
 				keyvals = append(keyvals, "declarations", declPath)
 			}
+			if sd != nil {
+				keyvals = append(keyvals, "sd", sdPath)
+			}
 			level.Info(logger).Log(keyvals...)
 			return server.Serve(metricsLn)
 		}, func(error) {
@@ -200,6 +1118,165 @@ func main() {
 			}
 		})
 	}
+	if ing.queues != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			level.Info(logger).Log("ingest_workers", len(ing.queues), "queue", *queueLen)
+			return ing.work(ctx)
+		}, func(error) {
+			cancel()
+		})
+	}
+	if elect != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			level.Info(logger).Log("consul", elect.api, "key", elect.key, "leader_id", elect.id)
+			return elect.run(ctx)
+		}, func(error) {
+			cancel()
+		})
+	}
+	if reg != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			level.Info(logger).Log("consul", reg.api, "consul_service", reg.service.Name, "tags", strings.Join(reg.service.Tags, ","))
+			return reg.run(ctx)
+		}, func(error) {
+			cancel()
+		})
+	}
+	if upstream != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			level.Info(logger).Log("relay", upstream.addr, "network", upstream.network, "interval", *relayInt)
+			return upstream.run(ctx, *relayInt)
+		}, func(error) {
+			cancel()
+		})
+	}
+	if follower != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			level.Info(logger).Log("mirror-wal-dir", *mirrorW, "mirror-state-file", *mirrorS)
+			return follower.run(ctx)
+		}, func(error) {
+			cancel()
+		})
+	}
+	if bkup != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			level.Info(logger).Log("backup", *backupTo, "interval", *backupIn, "retention", *backupN)
+			return bkup.run(ctx, *backupIn)
+		}, func(error) {
+			cancel()
+		})
+	}
+	if clust != nil {
+		for _, s := range clust.streams {
+			s := s
+			ctx, cancel := context.WithCancel(context.Background())
+			g.Add(func() error {
+				return s.run(ctx)
+			}, func(error) {
+				cancel()
+			})
+		}
+	}
+	if repl != nil && repl.stream != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			level.Info(logger).Log("peer", repl.stream.addr, "network", repl.stream.network, "buffer", *peerBuf)
+			return repl.stream.run(ctx)
+		}, func(error) {
+			cancel()
+		})
+	}
+	if checker != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return checker.run(ctx, *checkInt)
+		}, func(error) {
+			cancel()
+		})
+	}
+	if trc != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			level.Info(logger).Log("tracing", trc.endpoint, "sample", trc.sample)
+			return trc.run(ctx, 5*time.Second)
+		}, func(error) {
+			cancel()
+		})
+	}
+	if pprofLn != nil {
+		server := http.Server{Handler: pprofHandler()}
+		g.Add(func() error {
+			level.Info(logger).Log("listener", "pprof", "network", pprofLn.Addr().Network(), "address", pprofLn.Addr().String(), "path", "/debug/pprof/")
+			return server.Serve(pprofLn)
+		}, func(error) {
+			server.Close()
+		})
+	}
+	if state != nil && (*stateInt > 0 || walLog != nil) {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return state.run(ctx, *stateInt)
+		}, func(error) {
+			cancel()
+		})
+	}
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return churn.run(ctx, *churnInt)
+		}, func(error) {
+			cancel()
+		})
+	}
+	if ing.pods != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return ing.pods.run(ctx, podSweepInterval)
+		}, func(error) {
+			cancel()
+		})
+	}
+	if rec != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			level.Info(logger).Log("record-dir", *recDir, "file-size", *recSize, "file-age", *recAge, "retention", *recKeep)
+			return rec.run(ctx, time.Second)
+		}, func(error) {
+			cancel()
+		})
+	}
+	if ho != nil {
+		g.Add(func() error {
+			level.Info(logger).Log("handoff-socket", *handPath)
+			return ho.await()
+		}, func(error) {
+			ho.close()
+		})
+	}
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			c := make(chan os.Signal, 1)
+			signal.Notify(c, syscall.SIGHUP)
+			defer signal.Stop(c)
+			for {
+				select {
+				case <-c:
+					reload("SIGHUP") // errors are logged
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}, func(error) {
+			cancel()
+		})
+	}
 	{
 		ctx, cancel := context.WithCancel(context.Background())
 		g.Add(func() error {
@@ -216,6 +1293,37 @@ func main() {
 		})
 	}
 	level.Info(logger).Log("exit", g.Run())
+
+	var failed bool
+	if state != nil {
+		if err := state.save(); err != nil {
+			level.Error(logger).Log("state-file", *statePth, "err", err)
+			failed = true
+		} else {
+			level.Info(logger).Log("state-file", *statePth, "saved", true)
+		}
+	}
+	if ho.handedOff() {
+		// Even if the state file wasn't saved, the new aggregator needs the
+		// state, or it won't start.
+		snapshotter := state
+		if snapshotter == nil {
+			snapshotter = &stateFile{u: u, tenants: tenantsU, logger: logger}
+		}
+		st, err := snapshotter.checkpoint()
+		if err == nil {
+			err = ho.finish(st)
+		}
+		if err != nil {
+			level.Error(logger).Log("handoff-socket", *handPath, "err", err)
+			failed = true
+		} else {
+			level.Info(logger).Log("handoff-socket", *handPath, "handed_off", true)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
 }
 
 func usageFor(fs *flag.FlagSet, short string) func() {
@@ -254,7 +1362,22 @@ var exampleDecls = []observation{
 	{
 		Name:    "myservice_http_request_duration_seconds",
 		Type:    "histogram",
-		Help:    "HTTP request duraton in seconds.",
+		Help:    "HTTP request duration in seconds.",
 		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
 	},
+	{
+		Name:      "myservice_db_query_duration_seconds",
+		Type:      "summary",
+		Help:      "Database query duration in seconds, over the last 10 minutes.",
+		Window:    "10m",
+		Quantiles: []float64{0.5, 0.9, 0.99},
+	},
+}
+
+// socketListener is a socket for metric writes, ready to be run.
+type socketListener struct {
+	network, address string
+	tenant           *tenant // may be nil
+	forward          func() error
+	close            func() error
 }
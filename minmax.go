@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// modeMinMax is the mode of a gauge which also exposes the minimum, maximum,
+// and mean of the values observed since the last scrape, as the companion
+// metrics <name>_min, <name>_max, and <name>_avg. A plain gauge is
+// last-write-wins, so a spike between two scrapes is never seen.
+const modeMinMax = "minmax"
+
+// validateMode returns an error if the mode isn't one a metric of the type
+// can have.
+func validateMode(typ, mode string) error {
+	switch {
+	case mode == "":
+		return nil
+	case (mode == modeMinMax || mode == modeEWMA) && typ == "gauge":
+		return nil
+	case mode == modeMinMax || mode == modeEWMA:
+		return fmt.Errorf("mode %s is only for gauges, not %ss", mode, typ)
+	case mode == modePerSecond && typ == "counter":
+		return nil
+	case mode == modePerSecond:
+		return fmt.Errorf("mode %s is only for counters, not %ss", mode, typ)
+	default:
+		return fmt.Errorf("invalid mode %q", mode)
+	}
+}
+
+// scrapeCount counts the scrapes of a universe, so the values which are
+// aggregated between scrapes know when to start again. A nil scrapeCount is
+// always at zero.
+type scrapeCount struct {
+	n uint64 // atomic
+}
+
+// begin starts a scrape.
+func (s *scrapeCount) begin() {
+	if s != nil {
+		atomic.AddUint64(&s.n, 1)
+	}
+}
+
+func (s *scrapeCount) load() uint64 {
+	if s == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&s.n)
+}
+
+// window is the values observed during one scrape interval.
+type window struct {
+	min, max, sum float64
+	n             uint64
+}
+
+func (w *window) add(v float64) {
+	if w.n == 0 || v < w.min {
+		w.min = v
+	}
+	if w.n == 0 || v > w.max {
+		w.max = v
+	}
+	w.sum += v
+	w.n++
+}
+
+// minMaxGauge is a gauge which keeps a window of the values observed since
+// the last scrape began, and the window before it, which is what's rendered.
+type minMaxGauge struct {
+	*gauge
+	scrapes *scrapeCount
+
+	mtx  sync.Mutex
+	gen  uint64 // the scrape count when cur was started
+	cur  window
+	prev window
+}
+
+func newMinMaxGauge(o observation, scrapes *scrapeCount) (*minMaxGauge, error) {
+	g, err := newGauge(o)
+	if err != nil {
+		return nil, err
+	}
+	return &minMaxGauge{gauge: g, scrapes: scrapes}, nil
+}
+
+func (g *minMaxGauge) observe(o observation) error {
+	if o.Value == nil {
+		return nil // declaration
+	}
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if err := g.gauge.observe(o); err != nil {
+		return err
+	}
+	g.roll(g.scrapes.load())
+	g.cur.add(g.value.load())
+	return nil
+}
+
+// roll moves on to the window of the scrape count. The caller must hold the
+// mutex.
+func (g *minMaxGauge) roll(gen uint64) {
+	switch gen {
+	case g.gen:
+		return
+	case g.gen + 1:
+		g.prev = g.cur
+	default:
+		g.prev = window{} // nothing was observed in between
+	}
+	g.cur, g.gen = window{}, gen
+}
+
+// stats returns the minimum, maximum, and mean of the values observed
+// before the current scrape began, and after the one before it. If there
+// weren't any, the gauge didn't change, and they're all its value.
+func (g *minMaxGauge) stats() (min, max, avg float64) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.roll(g.scrapes.load())
+	if g.prev.n == 0 {
+		v := g.value.load()
+		return v, v, v
+	}
+	return g.prev.min, g.prev.max, g.prev.sum / float64(g.prev.n)
+}
+
+// writeMinMax writes the companion metrics of a collection of minMaxGauges,
+// and returns the number of series written.
+func writeMinMax(buf *bytes.Buffer, n metricName, help string, values []timeseriesValue, precision int) (series int) {
+	type stats struct {
+		labels labelPairs
+		v      [3]float64
+	}
+	all := make([]stats, 0, len(values))
+	for _, v := range values {
+		g, ok := v.(*minMaxGauge)
+		if !ok || !g.touched() {
+			continue
+		}
+		min, max, avg := g.stats()
+		all = append(all, stats{g.labels, [3]float64{min, max, avg}})
+	}
+	for i, suffix := range []string{"_min", "_max", "_avg"} {
+		what := [...]string{"minimum", "maximum", "mean"}[i]
+		writeHeader(buf, string(n)+suffix, fmt.Sprintf("%s (%s since the last scrape)", help, what), "gauge")
+		var b []byte
+		for _, s := range all {
+			b = appendSample(b[:0], string(n), suffix, s.labels, s.v[i], precision)
+			buf.Write(b)
+			series++
+		}
+		buf.WriteByte('\n')
+	}
+	return series
+}
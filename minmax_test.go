@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestMinMaxGauge(t *testing.T) {
+	u, err := newUniverse(makeObservations(t, []string{
+		`{"name":"queue_depth","type":"gauge","help":"Depth of the queue.","mode":"minmax"}`,
+	})...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadObservations(t, u, makeObservations(t, []string{
+		`queue_depth{} 3`,
+		`queue_depth{} 11`,
+		`queue_depth{} 1`,
+		`{"name":"queue_depth","op":"add","value":4}`,
+	}))
+
+	want := normalizeResponse(`
+		# HELP queue_depth Depth of the queue.
+		# TYPE queue_depth gauge
+		queue_depth{} 5
+
+		# HELP queue_depth_min Depth of the queue. (minimum since the last scrape)
+		# TYPE queue_depth_min gauge
+		queue_depth_min{} 1
+
+		# HELP queue_depth_max Depth of the queue. (maximum since the last scrape)
+		# TYPE queue_depth_max gauge
+		queue_depth_max{} 11
+
+		# HELP queue_depth_avg Depth of the queue. (mean since the last scrape)
+		# TYPE queue_depth_avg gauge
+		queue_depth_avg{} 5
+	`)
+	if have := normalizeResponse(scrape(t, u)); want != have {
+		t.Errorf("first scrape: want\n%s\nhave\n%s", want, have)
+	}
+
+	// Nothing observed since: all of them are the value.
+	want = normalizeResponse(`
+		# HELP queue_depth Depth of the queue.
+		# TYPE queue_depth gauge
+		queue_depth{} 5
+
+		# HELP queue_depth_min Depth of the queue. (minimum since the last scrape)
+		# TYPE queue_depth_min gauge
+		queue_depth_min{} 5
+
+		# HELP queue_depth_max Depth of the queue. (maximum since the last scrape)
+		# TYPE queue_depth_max gauge
+		queue_depth_max{} 5
+
+		# HELP queue_depth_avg Depth of the queue. (mean since the last scrape)
+		# TYPE queue_depth_avg gauge
+		queue_depth_avg{} 5
+	`)
+	if have := normalizeResponse(scrape(t, u)); want != have {
+		t.Errorf("idle scrape: want\n%s\nhave\n%s", want, have)
+	}
+
+	loadObservations(t, u, makeObservations(t, []string{
+		`queue_depth{} 7`,
+		`queue_depth{} 2`,
+	}))
+	have := normalizeResponse(scrape(t, u))
+	for _, line := range []string{"queue_depth{} 2", "queue_depth_min{} 2", "queue_depth_max{} 7", "queue_depth_avg{} 4.5"} {
+		if !strings.Contains("\n"+have+"\n", "\n"+line+"\n") {
+			t.Errorf("third scrape: want %q, have\n%s", line, have)
+		}
+	}
+}
+
+func TestMinMaxGaugeMode(t *testing.T) {
+	for _, testcase := range []struct {
+		typ, mode string
+		valid     bool
+	}{
+		{"gauge", "", true},
+		{"gauge", "minmax", true},
+		{"counter", "", true},
+		{"counter", "minmax", false},
+		{"histogram", "minmax", false},
+		{"counter", "per_second", true},
+		{"gauge", "per_second", false},
+		{"gauge", "maxmin", false},
+	} {
+		if want, have := testcase.valid, validateMode(testcase.typ, testcase.mode) == nil; want != have {
+			t.Errorf("%s %q: want valid %v, have %v", testcase.typ, testcase.mode, want, have)
+		}
+	}
+
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"queue_depth","type":"gauge","help":"Depth of the queue.","mode":"minmax"}`,
+	})...)
+	if err := u.observe(observation{Name: "queue_depth", Type: "gauge", Help: "Depth of the queue."}); err != nil {
+		t.Errorf("declaration without a mode: want no error, have %v", err)
+	}
+	if err := u.observe(observation{Name: "queue_depth", Type: "gauge", Help: "Depth of the queue.", Mode: "other"}); err == nil {
+		t.Errorf("declaration with another mode: want error, have none")
+	}
+}
+
+func TestMinMaxGaugeRestore(t *testing.T) {
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"queue_depth","type":"gauge","help":"Depth of the queue.","mode":"minmax"}`,
+		`queue_depth{} 3`,
+	})...)
+	d := u.dump()
+	if want, have := modeMinMax, d.Metrics[0].Mode; want != have {
+		t.Fatalf("dumped mode: want %q, have %q", want, have)
+	}
+
+	restored, _ := newUniverse()
+	if want, have := 1, restored.restore(d, log.NewNopLogger()); want != have {
+		t.Fatalf("restored: want %d, have %d", want, have)
+	}
+	if !strings.Contains(scrape(t, restored), "\nqueue_depth_max{} 3\n") {
+		t.Errorf("restored universe has no companion series")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// mirrorPollInterval is how often a mirror reads what's been appended to the
+// observation log it follows.
+const mirrorPollInterval = time.Second
+
+// walFollower follows another aggregator's state file and observation log,
+// for a mirror, which serves scrapes of the same series, but accepts no
+// writes. It restores the state file, and then observes the records in each
+// segment of the log, from where the state file left off, as they're
+// appended. It never writes either. If it falls so far behind that the
+// segments it needs are removed, it restores the state file again.
+type walFollower struct {
+	followed uint64 // atomic; first, for alignment; records
+	resyncs  uint64 // atomic
+
+	log    *wal       // only for its directory
+	state  *stateFile // only for restoring
+	next   observer
+	logger log.Logger
+
+	seq     int      // of the segment being followed; only used by poll
+	f       *os.File // may be nil
+	partial []byte   // the start of a record, not yet fully appended
+}
+
+func newWALFollower(dir string, state *stateFile, next observer, logger log.Logger) *walFollower {
+	return &walFollower{
+		log:    &wal{dir: dir},
+		state:  state,
+		next:   next,
+		logger: log.With(logger, "mirror", dir),
+	}
+}
+
+// resync restores the state file, and follows the log from where it left
+// off.
+func (w *walFollower) resync() (restored int, err error) {
+	var st savedState
+	buf, err := ioutil.ReadFile(w.state.filename)
+	switch {
+	case os.IsNotExist(err):
+		// not saved yet, so everything's in the log
+	case err != nil:
+		return 0, err
+	default:
+		if err := json.Unmarshal(buf, &st); err != nil {
+			return 0, errors.Wrapf(err, "error parsing %s", w.state.filename)
+		}
+	}
+	if restored, _, err = w.state.restoreState(st); err != nil { // it has no log to replay
+		return restored, err
+	}
+	if w.f != nil {
+		w.f.Close()
+		w.f = nil
+	}
+	w.seq, w.partial = st.WALSegment, nil
+	return restored, nil
+}
+
+// run polls the log until the context is canceled.
+func (w *walFollower) run(ctx context.Context) error {
+	ticker := time.NewTicker(mirrorPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.poll(); err != nil {
+				level.Warn(w.logger).Log("during", "follow", "err", err)
+			}
+		case <-ctx.Done():
+			if w.f != nil {
+				w.f.Close()
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// poll observes what's been appended to the log since the last poll. A
+// segment is finished once there's a newer one, since the log is only
+// rotated between appends.
+func (w *walFollower) poll() error {
+	for {
+		segs, err := w.log.segments()
+		if err != nil {
+			return err
+		}
+		if len(segs) == 0 {
+			return nil
+		}
+		if w.seq == 0 {
+			w.seq = segs[0] // the state file doesn't say; start at the beginning
+		}
+		if w.f == nil {
+			if segs[len(segs)-1] < w.seq {
+				return nil // not started yet
+			}
+			f, err := os.Open(w.log.segmentName(w.seq))
+			if os.IsNotExist(err) {
+				missing := w.seq
+				restored, err := w.resync()
+				atomic.AddUint64(&w.resyncs, 1)
+				level.Warn(w.logger).Log("during", "follow", "err", fmt.Sprintf("segment %d was removed before it was read", missing), "resynced", restored)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			w.f = f
+		}
+		if err := w.read(); err != nil {
+			return err
+		}
+		if segs[len(segs)-1] <= w.seq {
+			return nil // the current segment; there may be more later
+		}
+		if err := w.read(); err != nil { // anything appended before the rotation
+			return err
+		}
+		w.f.Close()
+		w.f, w.seq, w.partial = nil, w.seq+1, nil
+	}
+}
+
+// read observes every complete record appended to the segment since the last
+// read.
+func (w *walFollower) read() error {
+	buf, err := ioutil.ReadAll(w.f)
+	if err != nil {
+		return err
+	}
+	buf = append(w.partial, buf...)
+	var obs []observation
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		o, err := decodeRecord(buf[:i])
+		if err != nil {
+			level.Warn(w.logger).Log("during", "follow", "segment", w.seq, "err", err)
+		} else {
+			obs = append(obs, o)
+		}
+		buf = buf[i+1:]
+	}
+	w.partial = append([]byte(nil), buf...)
+	if len(obs) == 0 {
+		return nil
+	}
+	err = w.next.observeBatch(obs)
+	var accepted uint64
+	for j := range obs {
+		if errorAt(err, j) == nil {
+			accepted++
+		}
+	}
+	atomic.AddUint64(&w.followed, accepted)
+	return nil // rejected records are skipped, as in a replay
+}
+
+// renderTelemetry writes the follower's counters, in the Prometheus text
+// format.
+func (w *walFollower) renderTelemetry(out io.Writer) {
+	if w == nil {
+		return
+	}
+	fmt.Fprintf(out, "# HELP prometheus_aggregator_mirror_followed_records_total Records observed from the followed observation log.\n")
+	fmt.Fprintf(out, "# TYPE prometheus_aggregator_mirror_followed_records_total counter\n")
+	fmt.Fprintf(out, "prometheus_aggregator_mirror_followed_records_total %d\n\n", atomic.LoadUint64(&w.followed))
+	fmt.Fprintf(out, "# HELP prometheus_aggregator_mirror_resyncs_total Times the followed state file was restored again, because the mirror fell behind the log.\n")
+	fmt.Fprintf(out, "# TYPE prometheus_aggregator_mirror_resyncs_total counter\n")
+	fmt.Fprintf(out, "prometheus_aggregator_mirror_resyncs_total %d\n\n", atomic.LoadUint64(&w.resyncs))
+}
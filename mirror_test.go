@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestWALFollower(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename, walDir := filepath.Join(dir, "state.json"), filepath.Join(dir, "wal")
+
+	decls := []string{
+		`{"name":"foo_total","type":"counter","help":"Foo."}`,
+		`{"name":"bar","type":"gauge","help":"Bar."}`,
+	}
+	primary, _ := newUniverse(makeObservations(t, decls)...)
+	w, err := openWAL(walDir, 1<<20, primary, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &stateFile{filename: filename, u: primary, wal: w, logger: log.NewNopLogger()}
+	observe := func(lines ...string) {
+		for _, line := range lines {
+			o, err := parseLine([]byte(line))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.observe(o); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	mirror, _ := newUniverse(makeObservations(t, decls)...)
+	f := newWALFollower(walDir, &stateFile{filename: filename, u: mirror, logger: log.NewNopLogger()}, mirror, log.NewNopLogger())
+	follow := func(what string) {
+		t.Helper()
+		if err := f.poll(); err != nil {
+			t.Fatal(err)
+		}
+		if want, have := scrape(t, primary), scrape(t, mirror); want != have {
+			t.Errorf("%s:\n---WANT---\n%s\n\n---HAVE---\n%s\n", what, want, have)
+		}
+	}
+
+	// Before the state is saved, everything's in the log.
+	observe(`foo_total{code="200"} 3`, `bar{} 5`)
+	if _, err := f.resync(); err != nil {
+		t.Fatal(err)
+	}
+	follow("from the log")
+
+	// Saving the state rotates the log, which the mirror follows.
+	if err := state.save(); err != nil {
+		t.Fatal(err)
+	}
+	observe(`foo_total{code="200"} 2`, `{"name":"bar","labels":{},"op":"delete"}`)
+	follow("after a rotation")
+	observe(`foo_total{code="500"} 1`)
+	follow("appended to")
+
+	// A mirror which falls behind, so the segments it needs are removed,
+	// restores the state file again.
+	observe(`foo_total{code="200"} 10`)
+	for i := 0; i < 2; i++ {
+		if err := state.save(); err != nil {
+			t.Fatal(err)
+		}
+		observe(`bar{} 1`)
+	}
+	follow("after falling behind")
+	if want, have := uint64(1), atomic.LoadUint64(&f.resyncs); want != have {
+		t.Errorf("resyncs: want %d, have %d", want, have)
+	}
+
+	// A new mirror starts from the state file.
+	mirror2, _ := newUniverse(makeObservations(t, decls)...)
+	f2 := newWALFollower(walDir, &stateFile{filename: filename, u: mirror2, logger: log.NewNopLogger()}, mirror2, log.NewNopLogger())
+	if _, err := f2.resync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f2.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := scrape(t, primary), scrape(t, mirror2); want != have {
+		t.Errorf("a new mirror:\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// objectStore is a bucket, or container, of objects, e.g. in S3.
+type objectStore interface {
+	put(ctx context.Context, key string, body []byte) error
+	get(ctx context.Context, key string) ([]byte, error)
+	list(ctx context.Context, prefix string) ([]string, error) // keys, in any order
+	delete(ctx context.Context, key string) error
+}
+
+// parseObjectStore returns the store, and the prefix of the keys in it, for
+// a URL like s3://bucket/prefix, gs://bucket/prefix, for Google Cloud
+// Storage's S3-compatible API, or azblob://account/container/prefix.
+// Credentials come from the environment, as they do for the providers' own
+// tools.
+func parseObjectStore(raw string, getenv func(string) string) (objectStore, string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, "", err
+	}
+	prefix := strings.TrimPrefix(u.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	client := &http.Client{Timeout: time.Minute}
+	switch u.Scheme {
+	case "s3", "gs":
+		s := &s3Store{
+			client:       client,
+			bucket:       u.Host,
+			region:       u.Query().Get("region"),
+			accessKey:    getenv("AWS_ACCESS_KEY_ID"),
+			secretKey:    getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: getenv("AWS_SESSION_TOKEN"),
+			now:          time.Now,
+		}
+		if s.region == "" {
+			s.region = getenv("AWS_REGION")
+		}
+		if s.region == "" {
+			s.region = "us-east-1"
+		}
+		endpoint := u.Query().Get("endpoint")
+		switch {
+		case endpoint != "":
+			s.pathStyle = true
+		case u.Scheme == "gs":
+			endpoint, s.region, s.pathStyle = "https://storage.googleapis.com", "auto", true
+		default:
+			endpoint = "https://s3." + s.region + ".amazonaws.com"
+		}
+		if s.endpoint, err = url.Parse(endpoint); err != nil || s.endpoint.Host == "" {
+			return nil, "", fmt.Errorf("bad endpoint %q", endpoint)
+		}
+		if s.bucket == "" || s.accessKey == "" || s.secretKey == "" {
+			return nil, "", fmt.Errorf("%s:// requires a bucket, and AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY", u.Scheme)
+		}
+		return s, prefix, nil
+	case "azblob":
+		container := prefix
+		if i := strings.Index(prefix, "/"); i >= 0 {
+			container, prefix = prefix[:i], prefix[i+1:]
+		}
+		sas := strings.TrimPrefix(getenv("AZURE_STORAGE_SAS_TOKEN"), "?")
+		if u.Host == "" || container == "" || sas == "" {
+			return nil, "", fmt.Errorf("azblob:// requires an account and a container, and AZURE_STORAGE_SAS_TOKEN")
+		}
+		endpoint := u.Query().Get("endpoint")
+		if endpoint == "" {
+			endpoint = "https://" + u.Host + ".blob.core.windows.net"
+		}
+		return &azureStore{client: client, base: strings.TrimSuffix(endpoint, "/") + "/" + container, sas: sas}, prefix, nil
+	default:
+		return nil, "", fmt.Errorf("unsupported scheme %q; must be s3, gs, or azblob", u.Scheme)
+	}
+}
+
+// s3Store is a bucket in S3, or anything with an S3-compatible API, whose
+// requests are signed with AWS Signature Version 4.
+type s3Store struct {
+	client       *http.Client
+	endpoint     *url.URL
+	pathStyle    bool // bucket in the path, not the host
+	bucket       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string // may be empty
+	now          func() time.Time
+}
+
+func (s *s3Store) url(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = "/" + s.bucket + "/" + key
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = awsURIEncode(u.Path, false) // as it's signed
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+func (s *s3Store) put(ctx context.Context, key string, body []byte) error {
+	_, err := s.do(ctx, "PUT", s.url(key, nil), body)
+	return err
+}
+
+func (s *s3Store) get(ctx context.Context, key string) ([]byte, error) {
+	return s.do(ctx, "GET", s.url(key, nil), nil)
+}
+
+func (s *s3Store) delete(ctx context.Context, key string) error {
+	_, err := s.do(ctx, "DELETE", s.url(key, nil), nil)
+	return err
+}
+
+func (s *s3Store) list(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		buf, err := s.do(ctx, "GET", s.url("", query), nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err := xml.Unmarshal(buf, &result); err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (s *s3Store) do(ctx context.Context, method string, u *url.URL, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	s.sign(req, body)
+	return doObjectRequest(s.client, req)
+}
+
+// sign signs the request, and every header already set on it, per AWS
+// Signature Version 4.
+func (s *s3Store) sign(req *http.Request, body []byte) {
+	now := s.now().UTC()
+	stamp, day := now.Format("20060102T150405Z"), now.Format("20060102")
+	payload := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payload[:]))
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, awsURIEncode(name, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsURIEncode(req.URL.Path, false),
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payload[:]),
+	}, "\n")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{day, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s", s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsURIEncode percent-encodes everything but unreserved characters, and,
+// unless encodeSlash, slashes, as AWS Signature Version 4 requires.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// azureStore is a container in Azure Blob Storage, whose requests are
+// authorized by a shared access signature.
+type azureStore struct {
+	client *http.Client
+	base   string // e.g. https://account.blob.core.windows.net/container
+	sas    string // query string
+}
+
+func (s *azureStore) url(key string, query url.Values) string {
+	u := s.base
+	if key != "" {
+		u += "/" + (&url.URL{Path: key}).EscapedPath()
+	}
+	u += "?" + s.sas
+	if len(query) > 0 {
+		u += "&" + query.Encode()
+	}
+	return u
+}
+
+func (s *azureStore) put(ctx context.Context, key string, body []byte) error {
+	req, err := http.NewRequest("PUT", s.url(key, nil), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Ms-Blob-Type", "BlockBlob")
+	_, err = s.do(ctx, req)
+	return err
+}
+
+func (s *azureStore) get(ctx context.Context, key string) ([]byte, error) {
+	req, err := http.NewRequest("GET", s.url(key, nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.do(ctx, req)
+}
+
+func (s *azureStore) delete(ctx context.Context, key string) error {
+	req, err := http.NewRequest("DELETE", s.url(key, nil), nil)
+	if err != nil {
+		return err
+	}
+	_, err = s.do(ctx, req)
+	return err
+}
+
+func (s *azureStore) list(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {prefix}}
+	for {
+		req, err := http.NewRequest("GET", s.url("", query), nil)
+		if err != nil {
+			return nil, err
+		}
+		buf, err := s.do(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Blobs struct {
+				Blob []struct {
+					Name string
+				}
+			}
+			NextMarker string
+		}
+		if err := xml.Unmarshal(buf, &result); err != nil {
+			return nil, err
+		}
+		for _, b := range result.Blobs.Blob {
+			keys = append(keys, b.Name)
+		}
+		if result.NextMarker == "" {
+			return keys, nil
+		}
+		query.Set("marker", result.NextMarker)
+	}
+}
+
+func (s *azureStore) do(ctx context.Context, req *http.Request) ([]byte, error) {
+	req = req.WithContext(ctx)
+	req.Header.Set("X-Ms-Version", "2020-04-08")
+	return doObjectRequest(s.client, req)
+}
+
+// doObjectRequest returns the body of the response to the request, or an
+// error, with the start of the body, if it wasn't successful.
+func doObjectRequest(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,112 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// batchReader reads datagrams in batches with recvmmsg(2), which costs one
+// syscall per batch, rather than one per datagram.
+type batchReader struct {
+	rc    syscall.RawConn
+	bufs  [][]byte
+	names []syscall.RawSockaddrAny
+	iovs  []syscall.Iovec
+	msgs  []mmsghdr
+}
+
+// mmsghdr is struct mmsghdr from <sys/socket.h>.
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// newBatchReader returns a batchReader for conn, if it's a socket.
+func newBatchReader(conn net.PacketConn, n, size int) (*batchReader, bool) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, false
+	}
+	r := &batchReader{
+		rc:    rc,
+		bufs:  make([][]byte, n),
+		names: make([]syscall.RawSockaddrAny, n),
+		iovs:  make([]syscall.Iovec, n),
+		msgs:  make([]mmsghdr, n),
+	}
+	for i := range r.bufs {
+		r.bufs[i] = make([]byte, size)
+		r.iovs[i].Base = &r.bufs[i][0]
+		r.msgs[i].hdr.Name = (*byte)(unsafe.Pointer(&r.names[i]))
+		r.msgs[i].hdr.Iov = &r.iovs[i]
+		r.msgs[i].hdr.Iovlen = 1
+	}
+	return r, true
+}
+
+// read blocks until at least one datagram is available, and returns the
+// number of datagrams read. They're valid until the next read.
+func (r *batchReader) read() (int, error) {
+	for i := range r.msgs {
+		r.iovs[i].SetLen(len(r.bufs[i]))
+		r.msgs[i].hdr.Namelen = syscall.SizeofSockaddrAny
+		r.msgs[i].len = 0
+	}
+	var (
+		n     uintptr
+		errno syscall.Errno
+	)
+	err := r.rc.Read(func(fd uintptr) bool {
+		n, _, errno = syscall.Syscall6(syscall.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&r.msgs[0])), uintptr(len(r.msgs)), 0, 0, 0)
+		return errno != syscall.EAGAIN && errno != syscall.EWOULDBLOCK
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+// packet returns the ith datagram of the most recent read, and its sender.
+func (r *batchReader) packet(i int) ([]byte, string) {
+	return r.bufs[i][:r.msgs[i].len], sockaddrString(&r.names[i])
+}
+
+func sockaddrString(sa *syscall.RawSockaddrAny) string {
+	switch sa.Addr.Family {
+	case syscall.AF_INET:
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		return (&net.UDPAddr{IP: net.IP(sa4.Addr[:]), Port: ntohs(sa4.Port)}).String()
+	case syscall.AF_INET6:
+		sa6 := (*syscall.RawSockaddrInet6)(unsafe.Pointer(sa))
+		return (&net.UDPAddr{IP: net.IP(sa6.Addr[:]), Port: ntohs(sa6.Port)}).String()
+	case syscall.AF_UNIX:
+		sun := (*syscall.RawSockaddrUnix)(unsafe.Pointer(sa))
+		var path []byte
+		for _, c := range sun.Path {
+			if c == 0 {
+				break
+			}
+			path = append(path, byte(c))
+		}
+		return string(path)
+	default:
+		return ""
+	}
+}
+
+// ntohs converts a port in network byte order.
+func ntohs(port uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return int(b[0])<<8 | int(b[1])
+}
@@ -0,0 +1,56 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestBatchReader(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r, ok := newBatchReader(conn, 8, 1024)
+	if !ok {
+		t.Fatal("no batch reader for UDP conn")
+	}
+
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(client, "foo{} %d", i)
+	}
+
+	var have []string
+	for len(have) < 3 {
+		n, err := r.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			data, from := r.packet(i)
+			if want := client.LocalAddr().String(); want != from {
+				t.Errorf("from: want %s, have %s", want, from)
+			}
+			have = append(have, string(data))
+		}
+	}
+	for i, line := range have {
+		if want := fmt.Sprintf("foo{} %d", i); want != line {
+			t.Errorf("packet %d: want %q, have %q", i, want, line)
+		}
+	}
+
+	conn.Close()
+	if _, err := r.read(); err == nil {
+		t.Errorf("read after close: want error, have none")
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"net"
+)
+
+// batchReader is only implemented on Linux.
+type batchReader struct{}
+
+func newBatchReader(conn net.PacketConn, n, size int) (*batchReader, bool) {
+	return nil, false
+}
+
+func (r *batchReader) read() (int, error) { panic("unreachable") }
+
+func (r *batchReader) packet(i int) ([]byte, string) { panic("unreachable") }
@@ -70,6 +70,26 @@ func TestParsePrometheus(t *testing.T) {
 			input: `foo{code="200", err="false"} 7`,
 			err:   true,
 		},
+		"escaped label value": {
+			input: `foo{path="/a\"b\\c\nd"} 1`,
+			obs:   observation{Name: "foo", Value: fp(1.00), Labels: map[string]string{"path": "/a\"b\\c\nd"}},
+		},
+		"unescaped quote in label value": {
+			input: `foo{path="/a"b"} 1`,
+			err:   true,
+		},
+		"invalid escape in label value": {
+			input: `foo{path="/a\tb"} 1`,
+			err:   true,
+		},
+		"duplicate label": {
+			input: `foo{a="1",a="2"} 7`,
+			err:   true,
+		},
+		"duplicate label with the same value": {
+			input: `foo{code="200",err="false",code="200"} 7`,
+			err:   true,
+		},
 		"space instead of comma": {
 			input: `foo{code="200" err="false"} 7`,
 			err:   true,
@@ -87,3 +107,16 @@ func TestParsePrometheus(t *testing.T) {
 		})
 	}
 }
+
+func TestMakeTimeseriesKey(t *testing.T) {
+	for _, labels := range []map[string]string{
+		nil,
+		{},
+		{"code": "200"},
+		{"method": "GET", "code": "200", "err": "false"},
+	} {
+		if want, have := timeseriesKey("foo "+renderLabels(labels)), makeTimeseriesKey("foo", labels); want != have {
+			t.Errorf("%v: want %q, have %q", labels, want, have)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// modePerSecond is the mode of a counter which also exposes how fast it went
+// up between the last two scrapes, as the companion gauge
+// <name>_per_second, for status pages, load balancers, and anything else
+// which reads the output directly, and can't take a rate of its own.
+const modePerSecond = "per_second"
+
+// perSecondCounter is a counter which remembers its value when each scrape
+// began, so it can say how fast it went up since the scrape before.
+type perSecondCounter struct {
+	*counter
+	scrapes *scrapeCount
+	now     func() time.Time
+
+	mtx  sync.Mutex
+	gen  uint64    // the scrape count when base was read
+	at   time.Time // when base was read
+	base float64
+	rate float64
+}
+
+func newPerSecondCounter(o observation, scrapes *scrapeCount, now func() time.Time) (*perSecondCounter, error) {
+	c, err := newCounter(o)
+	if err != nil {
+		return nil, err
+	}
+	// A new counter went up from zero since it was created.
+	return &perSecondCounter{counter: c, scrapes: scrapes, now: now, gen: scrapes.load(), at: now()}, nil
+}
+
+// perSecond returns the rate at which the counter went up between the
+// beginning of the current scrape and the one before it, or its creation.
+func (c *perSecondCounter) perSecond() float64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if gen := c.scrapes.load(); gen != c.gen {
+		now, v := c.now(), c.value.load()
+		if d := now.Sub(c.at).Seconds(); d > 0 {
+			c.rate = (v - c.base) / d
+		}
+		c.gen, c.at, c.base = gen, now, v
+	}
+	return c.rate
+}
+
+// restore sets the counter to the dumped value, which it didn't go up by
+// since the last scrape.
+func (c *perSecondCounter) restore(sd seriesDump) error {
+	if err := c.counter.restore(sd); err != nil {
+		return err
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.at, c.base = c.now(), c.value.load()
+	return nil
+}
+
+// writePerSecond writes the companion metric of a collection of
+// perSecondCounters, and returns the number of series written.
+func writePerSecond(buf *bytes.Buffer, n metricName, help string, values []timeseriesValue, precision int) (series int) {
+	writeHeader(buf, string(n)+"_per_second", help+" (per second since the last scrape)", "gauge")
+	var b []byte
+	for _, v := range values {
+		c, ok := v.(*perSecondCounter)
+		if !ok || !c.touched() {
+			continue
+		}
+		b = appendSample(b[:0], string(n), "_per_second", c.labels, c.perSecond(), precision)
+		buf.Write(b)
+		series++
+	}
+	buf.WriteByte('\n')
+	return series
+}
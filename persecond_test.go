@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPerSecondCounter(t *testing.T) {
+	u, err := newUniverse(makeObservations(t, []string{
+		`{"name":"req_total","type":"counter","help":"Requests.","mode":"per_second"}`,
+	})...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	u.now = func() time.Time { return now }
+
+	loadObservations(t, u, makeObservations(t, []string{`req_total{route="/a"} 10`}))
+	now = now.Add(5 * time.Second)
+	have := scrape(t, u)
+	for _, want := range []string{
+		"# HELP req_total_per_second Requests. (per second since the last scrape)\n# TYPE req_total_per_second gauge\n",
+		"req_total{route=\"/a\"} 10\n",
+		"req_total_per_second{route=\"/a\"} 2\n",
+	} {
+		if !strings.Contains(have, want) {
+			t.Errorf("first scrape: want %q, have\n%s", strings.TrimSpace(want), have)
+		}
+	}
+
+	loadObservations(t, u, makeObservations(t, []string{`req_total{route="/a"} 30`}))
+	now = now.Add(10 * time.Second)
+	if want, have := "req_total_per_second{route=\"/a\"} 3\n", scrape(t, u); !strings.Contains(have, want) {
+		t.Errorf("second scrape: want %q, have\n%s", strings.TrimSpace(want), have)
+	}
+
+	now = now.Add(10 * time.Second)
+	if want, have := "req_total_per_second{route=\"/a\"} 0\n", scrape(t, u); !strings.Contains(have, want) {
+		t.Errorf("idle scrape: want %q, have\n%s", strings.TrimSpace(want), have)
+	}
+}
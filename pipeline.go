@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// pipelineStats measures the stages of the ingestion pipeline, so capacity
+// planning isn't guesswork. It's safe for concurrent use without locking.
+// A nil pipelineStats records nothing.
+type pipelineStats struct {
+	queued  int64                        // atomic; first, for alignment
+	dropped uint64                       // atomic
+	stages  map[string]*latencyHistogram // fixed at construction
+}
+
+// pipelineStages are the measured stages of the ingestion pipeline.
+var pipelineStages = []string{"queue", "parse", "observe"}
+
+// latencyBuckets are the upper bounds of the stage latency histograms, in
+// seconds.
+var latencyBuckets = []float64{1e-6, 5e-6, 1e-5, 5e-5, 1e-4, 5e-4, 1e-3, 5e-3, 1e-2, 5e-2, 0.1, 0.5, 1}
+
+type latencyHistogram struct {
+	count    uint64   // atomic; first, for alignment
+	sumNanos uint64   // atomic
+	counts   []uint64 // per bucket, non-cumulative, plus +Inf; atomic
+}
+
+func newPipelineStats() *pipelineStats {
+	p := &pipelineStats{stages: map[string]*latencyHistogram{}}
+	for _, stage := range pipelineStages {
+		p.stages[stage] = &latencyHistogram{counts: make([]uint64, len(latencyBuckets)+1)}
+	}
+	return p
+}
+
+// observe records that the stage took d.
+func (p *pipelineStats) observe(stage string, d time.Duration) {
+	if p == nil {
+		return
+	}
+	h, ok := p.stages[stage]
+	if !ok {
+		return
+	}
+	i := sort.SearchFloat64s(latencyBuckets, d.Seconds())
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sumNanos, uint64(d.Nanoseconds()))
+}
+
+// enqueue records that a line was queued for a worker.
+func (p *pipelineStats) enqueue() {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.queued, 1)
+}
+
+// dequeue records that a line left a queue, because a worker took it, or
+// because it was dropped.
+func (p *pipelineStats) dequeue(dropped bool) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.queued, -1)
+	if dropped {
+		atomic.AddUint64(&p.dropped, 1)
+	}
+}
+
+func (p *pipelineStats) renderTelemetry(w io.Writer) {
+	if p == nil {
+		return
+	}
+	fmt.Fprintf(w, "# HELP prometheus_aggregator_ingest_queue_lines Lines waiting for ingest workers.\n")
+	fmt.Fprintf(w, "# TYPE prometheus_aggregator_ingest_queue_lines gauge\n")
+	fmt.Fprintf(w, "prometheus_aggregator_ingest_queue_lines %d\n\n", atomic.LoadInt64(&p.queued))
+	fmt.Fprintf(w, "# HELP prometheus_aggregator_ingest_dropped_lines_total Lines dropped because an ingest worker's queue was full.\n")
+	fmt.Fprintf(w, "# TYPE prometheus_aggregator_ingest_dropped_lines_total counter\n")
+	fmt.Fprintf(w, "prometheus_aggregator_ingest_dropped_lines_total %d\n\n", atomic.LoadUint64(&p.dropped))
+
+	const name = "prometheus_aggregator_stage_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Time spent in each stage of the ingestion pipeline.\n", name)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	for _, stage := range pipelineStages {
+		h := p.stages[stage]
+		var cumulative uint64
+		for i, max := range latencyBuckets {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, renderLabels(map[string]string{"stage": stage, "le": strconv.FormatFloat(max, 'g', -1, 64)}), cumulative)
+		}
+		count := atomic.LoadUint64(&h.count)
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, renderLabels(map[string]string{"stage": stage, "le": "+Inf"}), count)
+		fmt.Fprintf(w, "%s_sum%s %f\n", name, renderLabels(map[string]string{"stage": stage}), time.Duration(atomic.LoadUint64(&h.sumNanos)).Seconds())
+		fmt.Fprintf(w, "%s_count%s %d\n", name, renderLabels(map[string]string{"stage": stage}), count)
+	}
+	fmt.Fprintln(w)
+}
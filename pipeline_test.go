@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPipelineStats(t *testing.T) {
+	p := newPipelineStats()
+	p.observe("parse", 3*time.Microsecond)
+	p.observe("parse", 2*time.Millisecond)
+	p.observe("observe", 2*time.Second)
+	p.observe("unknown", time.Second)
+
+	var buf bytes.Buffer
+	p.renderTelemetry(&buf)
+	if errs := validateExposition(buf.Bytes()); len(errs) > 0 {
+		t.Fatalf("%v\n%s", errs, buf.String())
+	}
+	for _, want := range []string{
+		`prometheus_aggregator_stage_duration_seconds_bucket{le="1e-06",stage="parse"} 0`,
+		`prometheus_aggregator_stage_duration_seconds_bucket{le="5e-06",stage="parse"} 1`,
+		`prometheus_aggregator_stage_duration_seconds_bucket{le="0.005",stage="parse"} 2`,
+		`prometheus_aggregator_stage_duration_seconds_count{stage="parse"} 2`,
+		`prometheus_aggregator_stage_duration_seconds_bucket{le="1",stage="observe"} 0`,
+		`prometheus_aggregator_stage_duration_seconds_bucket{le="+Inf",stage="observe"} 1`,
+		`prometheus_aggregator_stage_duration_seconds_sum{stage="observe"} 2.000000`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("output doesn't contain %q", want)
+		}
+	}
+}
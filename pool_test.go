@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPooledLabelsAreNotRetained(t *testing.T) {
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo","type":"gauge","help":"Current foo."}`,
+	})...)
+	i := &ingester{observer: u, activity: newActivity(0), logger: log.NewNopLogger()}
+	for _, line := range []string{
+		`foo{a="1"} 1`,
+		`foo{b="2"} 2`,
+		`foo{a="1"} 3`,
+	} {
+		if _, err := i.handleLine([]byte(line), "test"); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+	}
+
+	var labels []map[string]string
+	for _, s := range u.dump().Metrics[0].Series {
+		labels = append(labels, s.Labels)
+	}
+	if want, have := []map[string]string{{"a": "1"}, {"b": "2"}}, labels; !cmp.Equal(want, have) {
+		t.Fatal(cmp.Diff(want, have))
+	}
+}
+
+func BenchmarkHandleLine(b *testing.B) {
+	u, _ := newUniverse(observation{Name: "foo", Type: "counter", Help: "Total foos."})
+	i := &ingester{observer: u, activity: newActivity(0), logger: log.NewNopLogger()}
+	line := []byte(`foo{code="200",method="GET"} 1`)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		i.handleLine(line, "bench")
+	}
+}
@@ -0,0 +1,453 @@
+// Package promaggclient writes metrics to a prometheus-aggregator.
+//
+// A Client buffers lines, and writes them every flush interval, over one
+// connection, which it redials when it breaks. It declares each metric at
+// the start of every connection, so the aggregator doesn't need a declfile.
+//
+//	c, err := promaggclient.New(promaggclient.Config{Address: "tcp://127.0.0.1:8191"})
+//	if err != nil {
+//		...
+//	}
+//	defer c.Close()
+//	requests := c.Counter("myapp_requests_total", "Requests handled.")
+//	requests.With("code", "200").Add(1)
+package promaggclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config configures a Client. Only the Address is required.
+type Config struct {
+	// Address of the aggregator's -socket, e.g. tcp://127.0.0.1:8191,
+	// udp://127.0.0.1:8191, unix:///run/prometheus-aggregator.sock, or
+	// unixgram:///run/prometheus-aggregator.sock.
+	Address string
+
+	// Token is sent as AUTH <token> at the start of every connection, for
+	// an aggregator with a -socket-token. Datagrams can't authenticate.
+	Token string
+
+	// FlushInterval is how often buffered lines are written. The default is
+	// one second.
+	FlushInterval time.Duration
+
+	// BufferSize is the most bytes of lines buffered between flushes, or
+	// while the aggregator is unreachable; lines beyond it are dropped. The
+	// default is 1MiB.
+	BufferSize int
+
+	// DialTimeout is how long to wait to connect. The default is 5 seconds.
+	DialTimeout time.Duration
+
+	// ErrorHandler, if set, is called with every error writing to the
+	// aggregator, from the flushing goroutine.
+	ErrorHandler func(error)
+}
+
+// Client writes metrics to an aggregator. It's safe for concurrent use.
+type Client struct {
+	dropped uint64 // atomic; first, for alignment; lines
+
+	network  string
+	address  string
+	token    string
+	interval time.Duration
+	size     int
+	timeout  time.Duration
+	onError  func(error)
+
+	mtx    sync.Mutex
+	buf    bytes.Buffer
+	lines  int
+	decls  [][]byte // every declaration, in order
+	redecl int      // decls not yet written on the current connection
+
+	wmtx     sync.Mutex // held while writing
+	conn     net.Conn
+	auth     bool // the connection is new, and needs a token
+	nextDial time.Time
+	backoff  time.Duration
+
+	declaredAt time.Time // for datagrams, which redeclare every minute; under mtx
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+const (
+	maxBackoff        = 10 * time.Second
+	redeclareInterval = time.Minute
+)
+
+// New returns a Client for the aggregator at the address in the config, and
+// starts flushing lines to it. It doesn't connect until the first flush.
+func New(cfg Config) (*Client, error) {
+	u, err := url.Parse(cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		network:  strings.ToLower(u.Scheme),
+		token:    cfg.Token,
+		interval: cfg.FlushInterval,
+		size:     cfg.BufferSize,
+		timeout:  cfg.DialTimeout,
+		onError:  cfg.ErrorHandler,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	switch c.network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+		c.address = u.Host
+	case "unix", "unixgram":
+		c.address = u.Path
+	default:
+		return nil, fmt.Errorf("unsupported network %q", u.Scheme)
+	}
+	if c.address == "" {
+		return nil, fmt.Errorf("%s: no address", cfg.Address)
+	}
+	if c.token != "" && c.datagrams() {
+		return nil, errors.New("datagrams can't authenticate; a token requires a stream socket")
+	}
+	if c.interval <= 0 {
+		c.interval = time.Second
+	}
+	if c.size <= 0 {
+		c.size = 1 << 20
+	}
+	if c.timeout <= 0 {
+		c.timeout = 5 * time.Second
+	}
+	if c.onError == nil {
+		c.onError = func(error) {}
+	}
+	go c.run()
+	return c, nil
+}
+
+func (c *Client) datagrams() bool {
+	return strings.HasPrefix(c.network, "udp") || c.network == "unixgram"
+}
+
+func (c *Client) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.Flush(); err != nil {
+				c.onError(err)
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Close flushes what's buffered, and closes the connection. The Client
+// mustn't be used after.
+func (c *Client) Close() error {
+	close(c.stop)
+	<-c.done
+	err := c.Flush()
+	c.wmtx.Lock()
+	defer c.wmtx.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return err
+}
+
+// Dropped returns the number of lines dropped, because the buffer was full,
+// or they couldn't be written.
+func (c *Client) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// Counter declares a counter, and returns it.
+func (c *Client) Counter(name, help string) *Counter {
+	c.declare(declaration{Name: name, Type: "counter", Help: help})
+	return &Counter{c: c, name: name}
+}
+
+// Gauge declares a gauge, and returns it.
+func (c *Client) Gauge(name, help string) *Gauge {
+	c.declare(declaration{Name: name, Type: "gauge", Help: help})
+	return &Gauge{c: c, name: name}
+}
+
+// Histogram declares a histogram, with the buckets, and returns it.
+func (c *Client) Histogram(name, help string, buckets []float64) *Histogram {
+	c.declare(declaration{Name: name, Type: "histogram", Help: help, Buckets: buckets})
+	return &Histogram{c: c, name: name}
+}
+
+type declaration struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Help    string    `json:"help"`
+	Buckets []float64 `json:"buckets,omitempty"`
+}
+
+func (c *Client) declare(d declaration) {
+	line, _ := json.Marshal(d)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.decls = append(c.decls, line)
+	c.redecl++ // the current connection hasn't seen it
+}
+
+// line buffers a line, unless the buffer is full, or there's no line,
+// because its value couldn't be encoded.
+func (c *Client) line(b []byte) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if len(b) == 0 || c.buf.Len()+len(b)+1 > c.size {
+		atomic.AddUint64(&c.dropped, 1)
+		return
+	}
+	c.buf.Write(b)
+	c.buf.WriteByte('\n')
+	c.lines++
+}
+
+// Flush writes what's buffered now, rather than waiting for the next flush.
+// While the aggregator can't be reached, lines stay buffered.
+func (c *Client) Flush() error {
+	c.wmtx.Lock()
+	defer c.wmtx.Unlock()
+
+	c.mtx.Lock()
+	if c.buf.Len() == 0 && c.redecl == 0 && !c.datagramsRedeclare() {
+		c.mtx.Unlock()
+		return nil
+	}
+	buf := append([]byte(nil), c.buf.Bytes()...)
+	lines := c.lines
+	c.buf.Reset()
+	c.lines = 0
+	c.mtx.Unlock()
+
+	if c.conn == nil {
+		if err := c.dial(); err != nil {
+			c.requeue(buf, lines)
+			return err
+		}
+	}
+	if err := c.write(buf); err != nil {
+		atomic.AddUint64(&c.dropped, uint64(lines)) // some may have been written
+		c.conn.Close()
+		c.conn = nil
+		return err
+	}
+	return nil
+}
+
+// dial connects, unless it's backing off after failing to. It's called with
+// the write lock held.
+func (c *Client) dial() error {
+	if time.Now().Before(c.nextDial) {
+		return fmt.Errorf("%s: not redialing for %s", c.address, time.Until(c.nextDial).Round(time.Millisecond))
+	}
+	conn, err := net.DialTimeout(c.network, c.address, c.timeout)
+	if err != nil {
+		c.backoff = 2 * c.backoff
+		if c.backoff < 100*time.Millisecond {
+			c.backoff = 100 * time.Millisecond
+		}
+		if c.backoff > maxBackoff {
+			c.backoff = maxBackoff
+		}
+		c.nextDial = time.Now().Add(c.backoff)
+		return err
+	}
+	c.conn, c.backoff = conn, 0
+	c.mtx.Lock()
+	c.redecl = len(c.decls)
+	c.mtx.Unlock()
+	if c.token != "" {
+		c.auth = true
+	}
+	return nil
+}
+
+// requeue puts lines which couldn't be written back in front of the buffer,
+// if they fit.
+func (c *Client) requeue(buf []byte, lines int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if len(buf)+c.buf.Len() > c.size {
+		atomic.AddUint64(&c.dropped, uint64(lines))
+		return
+	}
+	rest := append(buf, c.buf.Bytes()...)
+	c.buf.Reset()
+	c.buf.Write(rest)
+	c.lines += lines
+}
+
+// datagramsRedeclare returns true if it's time to declare every metric
+// again, over datagrams, since some may have been lost, or the aggregator
+// restarted. It's called with the mutex held.
+func (c *Client) datagramsRedeclare() bool {
+	return c.datagrams() && len(c.decls) > 0 && time.Since(c.declaredAt) > redeclareInterval
+}
+
+// write writes the lines, after AUTH, on a new connection, and declarations
+// the connection hasn't seen. It's called with the write lock held.
+func (c *Client) write(buf []byte) error {
+	var prefix []byte
+	if c.auth {
+		prefix = append(prefix, "AUTH "+c.token+"\n"...)
+		c.auth = false
+	}
+	c.mtx.Lock()
+	if c.datagramsRedeclare() {
+		c.redecl = len(c.decls)
+	}
+	for _, d := range c.decls[len(c.decls)-c.redecl:] {
+		prefix = append(append(prefix, d...), '\n')
+	}
+	if c.redecl > 0 && c.datagrams() {
+		c.declaredAt = time.Now()
+	}
+	c.redecl = 0
+	c.mtx.Unlock()
+	buf = append(prefix, buf...)
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	if !c.datagrams() {
+		_, err := c.conn.Write(buf)
+		return err
+	}
+	for len(buf) > 0 { // a line per datagram
+		i := bytes.IndexByte(buf, '\n')
+		if _, err := c.conn.Write(buf[:i]); err != nil {
+			return err
+		}
+		buf = buf[i+1:]
+	}
+	return nil
+}
+
+// Counter is a counter, with labels, which may be empty.
+type Counter struct {
+	c      *Client
+	name   string
+	labels []string
+}
+
+// With returns the counter, with more labels, given as name, value pairs.
+func (m *Counter) With(labelValues ...string) *Counter {
+	return &Counter{c: m.c, name: m.name, labels: with(m.labels, labelValues)}
+}
+
+// Add adds delta, which mustn't be negative, to the counter.
+func (m *Counter) Add(delta float64) {
+	m.c.line(appendLine(nil, m.name, m.labels, "", delta))
+}
+
+// Gauge is a gauge, with labels, which may be empty.
+type Gauge struct {
+	c      *Client
+	name   string
+	labels []string
+}
+
+// With returns the gauge, with more labels, given as name, value pairs.
+func (m *Gauge) With(labelValues ...string) *Gauge {
+	return &Gauge{c: m.c, name: m.name, labels: with(m.labels, labelValues)}
+}
+
+// Set sets the gauge to the value.
+func (m *Gauge) Set(value float64) {
+	m.c.line(appendLine(nil, m.name, m.labels, "", value))
+}
+
+// Add adds delta, which may be negative, to the gauge.
+func (m *Gauge) Add(delta float64) {
+	m.c.line(appendLine(nil, m.name, m.labels, "add", delta))
+}
+
+// Histogram is a histogram, with labels, which may be empty.
+type Histogram struct {
+	c      *Client
+	name   string
+	labels []string
+}
+
+// With returns the histogram, with more labels, given as name, value pairs.
+func (m *Histogram) With(labelValues ...string) *Histogram {
+	return &Histogram{c: m.c, name: m.name, labels: with(m.labels, labelValues)}
+}
+
+// Observe observes the value.
+func (m *Histogram) Observe(value float64) {
+	m.c.line(appendLine(nil, m.name, m.labels, "", value))
+}
+
+func with(labels, labelValues []string) []string {
+	if len(labelValues)%2 != 0 {
+		labelValues = append(labelValues, "unknown")
+	}
+	return append(append([]string(nil), labels...), labelValues...)
+}
+
+// appendLine appends the line, in the text format, if it can be, and
+// otherwise as JSON.
+func appendLine(b []byte, name string, labels []string, op string, value float64) []byte {
+	if op != "" || !textSafe(labels) {
+		m := make(map[string]string, len(labels)/2)
+		for i := 0; i < len(labels); i += 2 {
+			m[labels[i]] = labels[i+1]
+		}
+		line, err := json.Marshal(struct {
+			Name   string            `json:"name"`
+			Labels map[string]string `json:"labels"`
+			Op     string            `json:"op,omitempty"`
+			Value  float64           `json:"value"`
+		}{name, m, op, value})
+		if err != nil {
+			return b // NaN, or ±Inf, which JSON can't represent
+		}
+		return append(b, line...)
+	}
+	b = append(b, name...)
+	b = append(b, '{') // required, even if there are no labels
+	for i := 0; i < len(labels); i += 2 {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, labels[i]...)
+		b = append(b, `="`...)
+		b = append(b, labels[i+1]...)
+		b = append(b, '"')
+	}
+	b = append(b, "} "...)
+	return strconv.AppendFloat(b, value, 'g', -1, 64)
+}
+
+// textSafe returns true if the label values can be written in the text
+// format without escaping.
+func textSafe(labels []string) bool {
+	for i := 1; i < len(labels); i += 2 {
+		if strings.ContainsAny(labels[i], " ,=\"\\\n{}") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,212 @@
+package promaggclient
+
+import (
+	"bufio"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	c, err := New(Config{Address: "tcp://" + ln.Addr().String(), Token: "s3cr3t", FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	requests := c.Counter("myapp_requests_total", "Requests handled.")
+	inflight := c.Gauge("myapp_inflight", "Requests in flight.")
+	duration := c.Histogram("myapp_request_duration_seconds", "Request duration.", []float64{0.1, 1})
+
+	requests.With("code", "200").Add(1)
+	requests.With("path", "/a b").Add(2)
+	inflight.Set(3)
+	inflight.With("pool", "x").Add(-1)
+	duration.With("code").Observe(0.5)
+	inflight.Set(math.NaN()) // fine as text, but not as JSON, so the next is dropped
+	inflight.With("path", "a b").Set(math.NaN())
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for _, want := range []string{
+		`AUTH s3cr3t`,
+		`{"name":"myapp_requests_total","type":"counter","help":"Requests handled."}`,
+		`{"name":"myapp_inflight","type":"gauge","help":"Requests in flight."}`,
+		`{"name":"myapp_request_duration_seconds","type":"histogram","help":"Request duration.","buckets":[0.1,1]}`,
+		`myapp_requests_total{code="200"} 1`,
+		`{"name":"myapp_requests_total","labels":{"path":"/a b"},"value":2}`,
+		`myapp_inflight{} 3`,
+		`{"name":"myapp_inflight","labels":{"pool":"x"},"op":"add","value":-1}`,
+		`myapp_request_duration_seconds{code="unknown"} 0.5`,
+		`myapp_inflight{} NaN`,
+	} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		have, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("want %s: %v", want, err)
+		}
+		if have = strings.TrimSuffix(have, "\n"); want != have {
+			t.Errorf("want %s, have %s", want, have)
+		}
+	}
+	if want, have := uint64(1), c.Dropped(); want != have {
+		t.Errorf("dropped: want %d, have %d", want, have)
+	}
+
+	// A new connection starts with AUTH, and every declaration, again.
+	conn.Close()
+	for i := 0; ; i++ { // until a write fails
+		if i == 100 {
+			t.Fatal("writes didn't fail")
+		}
+		requests.Add(1)
+		if err := c.Flush(); err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	requests.Add(5)
+	c.Flush()
+	conn, err = ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	r = bufio.NewReader(conn)
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+		if line == "myapp_requests_total{} 5\n" {
+			break
+		}
+	}
+	if want, have := 5, len(lines); want != have {
+		t.Fatalf("want %d lines, have %d: %q", want, have, lines)
+	}
+	if want, have := "AUTH s3cr3t", lines[0]; want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+}
+
+func TestClientUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	c, err := New(Config{Address: "tcp://" + addr, FlushInterval: time.Hour, BufferSize: 70})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	foo := c.Counter("foo_total", "")
+	foo.Add(1)
+	if err := c.Flush(); err == nil {
+		t.Fatal("want error, have none")
+	}
+	foo.Add(2)
+	if err := c.Flush(); err == nil {
+		t.Fatal("want error, have none")
+	}
+	for i := 0; i < 10; i++ {
+		foo.Add(3) // until the buffer is full
+	}
+
+	// The lines stay buffered, in order, until it's reachable.
+	if ln, err = net.Listen("tcp", addr); err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+	time.Sleep(200 * time.Millisecond) // past the backoff
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	r := bufio.NewReader(conn)
+	for _, want := range []string{
+		`{"name":"foo_total","type":"counter","help":""}`,
+		`foo_total{} 1`,
+		`foo_total{} 2`,
+		`foo_total{} 3`,
+		`foo_total{} 3`,
+		`foo_total{} 3`,
+	} {
+		have, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("want %s: %v", want, err)
+		}
+		if have = strings.TrimSuffix(have, "\n"); want != have {
+			t.Errorf("want %s, have %s", want, have)
+		}
+	}
+	if want, have := uint64(7), c.Dropped(); want != have {
+		t.Errorf("dropped: want %d, have %d", want, have)
+	}
+}
+
+func TestClientDatagrams(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	if _, err := New(Config{Address: "udp://" + pc.LocalAddr().String(), Token: "s3cr3t"}); err == nil {
+		t.Error("want error for a token with datagrams, have none")
+	}
+
+	c, err := New(Config{Address: "udp://" + pc.LocalAddr().String(), FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	foo := c.Gauge("foo", "")
+	foo.With("a", "1").Set(1)
+	foo.Set(2)
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	for _, want := range []string{
+		`{"name":"foo","type":"gauge","help":""}`,
+		`foo{a="1"} 1`,
+		`foo{} 2`,
+	} {
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("want %s: %v", want, err)
+		}
+		if have := string(buf[:n]); want != have {
+			t.Errorf("want %s, have %s", want, have)
+		}
+	}
+}
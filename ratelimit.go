@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Actions for lines over a client's rate limit.
+const (
+	limitThrottle   = "throttle"   // wait, which pushes back on the client
+	limitDrop       = "drop"       // drop the line
+	limitDisconnect = "disconnect" // close the connection
+)
+
+func validLimitAction(action string) bool {
+	switch action {
+	case limitThrottle, limitDrop, limitDisconnect:
+		return true
+	default:
+		return false
+	}
+}
+
+// rateLimiter limits the lines and bytes per second each client may send,
+// with a token bucket for each, which holds up to one second's worth, so
+// that short bursts are fine. Clients are identified by host, or by
+// authenticated identity. A nil rateLimiter allows everything.
+type rateLimiter struct {
+	lines  float64 // per second; 0 is unlimited
+	bytes  float64 // per second; 0 is unlimited
+	action string
+	now    func() time.Time
+
+	mtx     sync.Mutex
+	clients map[string]*clientBuckets
+	limited map[limitedKey]uint64
+	swept   time.Time
+}
+
+type clientBuckets struct {
+	lines, bytes float64 // tokens
+	last         time.Time
+}
+
+type limitedKey struct {
+	client string
+	action string
+}
+
+func newRateLimiter(lines, bytes float64, action string) *rateLimiter {
+	return &rateLimiter{
+		lines:   lines,
+		bytes:   bytes,
+		action:  action,
+		now:     time.Now,
+		clients: map[string]*clientBuckets{},
+		limited: map[limitedKey]uint64{},
+	}
+}
+
+// limit takes a line of size bytes from the client's buckets. If the client
+// is within its limits, it returns an empty action. Otherwise, it returns
+// the action to take, and for throttling, how long to wait before the client
+// is within them again. Clients which aren't streams, i.e. packet senders,
+// can't be throttled or disconnected, so their lines are dropped. Dropped
+// lines don't count against the limits.
+func (l *rateLimiter) limit(client string, size int, stream bool) (action string, wait time.Duration) {
+	if l == nil {
+		return "", 0
+	}
+	action = l.action
+	if !stream {
+		action = limitDrop
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.clients[client]
+	if !ok {
+		b = &clientBuckets{lines: l.lines, bytes: l.bytes, last: now}
+		l.clients[client] = b
+	}
+	elapsed := now.Sub(b.last).Seconds()
+	b.lines = refill(b.lines, l.lines, elapsed)
+	b.bytes = refill(b.bytes, l.bytes, elapsed)
+	b.last = now
+
+	// A bucket with any tokens at all admits a line, so lines bigger than a
+	// second's worth of bytes aren't refused forever, and the debt is paid
+	// off before the next one.
+	within := (l.lines <= 0 || b.lines > 0) && (l.bytes <= 0 || b.bytes > 0)
+	if within || action == limitThrottle {
+		b.lines--
+		b.bytes -= float64(size)
+	}
+	if within {
+		return "", 0
+	}
+	l.limited[limitedKey{client, action}]++
+	if action == limitThrottle {
+		wait = maxDuration(deficit(b.lines, l.lines), deficit(b.bytes, l.bytes))
+	}
+	return action, wait
+}
+
+// refill adds the tokens accrued over the elapsed seconds, up to a second's
+// worth.
+func refill(tokens, rate, elapsed float64) float64 {
+	if rate <= 0 {
+		return 0
+	}
+	tokens += rate * elapsed
+	if tokens > rate {
+		tokens = rate
+	}
+	return tokens
+}
+
+// deficit returns how long it'll take for a bucket with the tokens to have
+// any tokens again.
+func deficit(tokens, rate float64) time.Duration {
+	if rate <= 0 || tokens > 0 {
+		return 0
+	}
+	return time.Duration((-tokens/rate)*float64(time.Second)) + time.Millisecond
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// sweep forgets clients which haven't sent anything for a minute, once a
+// minute. Their buckets would be full again anyway.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	for client, b := range l.clients {
+		if now.Sub(b.last) >= time.Minute {
+			delete(l.clients, client)
+		}
+	}
+	l.swept = now
+}
+
+// renderTelemetry writes the number of lines limited, by client and action,
+// in the Prometheus text format.
+func (l *rateLimiter) renderTelemetry(w io.Writer) {
+	if l == nil {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	keys := make([]limitedKey, 0, len(l.limited))
+	for k := range l.limited {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].client != keys[j].client {
+			return keys[i].client < keys[j].client
+		}
+		return keys[i].action < keys[j].action
+	})
+	fmt.Fprintf(w, "# HELP prometheus_aggregator_rate_limited_lines_total Lines over a client's rate limit, by client and action taken.\n")
+	fmt.Fprintf(w, "# TYPE prometheus_aggregator_rate_limited_lines_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(w, "prometheus_aggregator_rate_limited_lines_total%s %d\n", renderLabels(map[string]string{"client": k.client, "action": k.action}), l.limited[k])
+	}
+	fmt.Fprintln(w)
+}
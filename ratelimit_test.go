@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	advance := func(d time.Duration) { now = now.Add(d) }
+
+	for _, testcase := range []struct {
+		action string
+		stream bool
+		steps  []string // "ok", an action, or an action and its wait
+	}{
+		{limitDrop, true, []string{"ok", "ok", "drop", "drop", "ok"}},
+		{limitDisconnect, true, []string{"ok", "ok", "disconnect", "disconnect", "ok"}},
+		{limitThrottle, true, []string{"ok", "ok", "throttle 501ms", "throttle 1.001s", "throttle 1.251s"}},
+		{limitThrottle, false, []string{"ok", "ok", "drop", "drop", "ok"}},
+	} {
+		l := newRateLimiter(2, 0, testcase.action)
+		l.now = func() time.Time { return now }
+		var have []string
+		for step := range testcase.steps {
+			if step == len(testcase.steps)-1 {
+				advance(250 * time.Millisecond)
+			}
+			action, wait := l.limit("10.1.2.3", 10, testcase.stream)
+			switch {
+			case action == "":
+				have = append(have, "ok")
+			case wait > 0:
+				have = append(have, action+" "+wait.String())
+			default:
+				have = append(have, action)
+			}
+		}
+		if want, have := strings.Join(testcase.steps, ", "), strings.Join(have, ", "); want != have {
+			t.Errorf("%s (stream %v): want %s, have %s", testcase.action, testcase.stream, want, have)
+		}
+		if action, _ := l.limit("10.9.9.9", 10, testcase.stream); action != "" {
+			t.Errorf("%s: other clients have their own limits, but have %s", testcase.action, action)
+		}
+	}
+}
+
+func TestRateLimiterBytes(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newRateLimiter(0, 100, limitDrop)
+	l.now = func() time.Time { return now }
+	// A line bigger than the limit gets through once, and then has to be
+	// paid for.
+	for n, want := range []string{"", "drop"} {
+		if have, _ := l.limit("10.1.2.3", 150, true); want != have {
+			t.Errorf("%d: want %q, have %q", n, want, have)
+		}
+	}
+	now = now.Add(time.Second)
+	if have, _ := l.limit("10.1.2.3", 1, true); have != "" {
+		t.Errorf("after a second: want ok, have %q", have)
+	}
+
+	var buf strings.Builder
+	l.renderTelemetry(&buf)
+	if want := `prometheus_aggregator_rate_limited_lines_total{action="drop",client="10.1.2.3"} 1`; !strings.Contains(buf.String(), want) {
+		t.Errorf("want %s, have\n%s", want, buf.String())
+	}
+}
+
+func TestRateLimitedConn(t *testing.T) {
+	for _, action := range []string{limitDrop, limitDisconnect} {
+		u, _ := newUniverse(makeObservations(t, []string{
+			`{"name":"foo_total","type":"counter","help":"Foo."}`,
+		})...)
+		l := newRateLimiter(2, 0, action)
+		l.now = func() time.Time { return time.Unix(1000, 0) }
+		i := &ingester{observer: u, activity: newActivity(0), logger: log.NewNopLogger(), limiter: l}
+		i.handleConn(ioutil.NopCloser(strings.NewReader("foo_total{} 1\nfoo_total{} 2\nfoo_total{} 4\nfoo_total{} 8\n")), "10.1.2.3:1234")
+		if want, have := "foo_total{} 3\n", scrape(t, u); !strings.Contains(have, want) {
+			t.Errorf("%s: want %s, have\n%s", action, want, have)
+		}
+	}
+}
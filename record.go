@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// recorder writes every accepted line, raw, as it was received, to files in
+// a directory, for replaying later, and for finding out where a weird series
+// came from. Each line is prefixed with the time it was received, in Unix
+// seconds, and a space, which is what the replay subcommand expects. A file
+// is rotated once it's full, or old, and only the newest are kept. A nil
+// recorder records nothing.
+type recorder struct {
+	dir     string
+	maxSize int64         // of a file, in bytes
+	maxAge  time.Duration // of a file; 0 means no limit
+	keep    int           // files; 0 means every one
+	now     func() time.Time
+	logger  log.Logger
+
+	mtx    sync.Mutex
+	seq    int // of the current file
+	f      *os.File
+	w      *bufio.Writer
+	size   int64
+	opened time.Time
+	buf    []byte
+}
+
+// openRecorder starts a new file in the directory, creating it if necessary,
+// after any which are already there.
+func openRecorder(dir string, maxSize int64, maxAge time.Duration, keep int, logger log.Logger) (*recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	r := &recorder{dir: dir, maxSize: maxSize, maxAge: maxAge, keep: keep, now: time.Now, logger: logger}
+	files, err := r.files()
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		r.seq = files[len(files)-1]
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if err := r.rotate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *recorder) fileName(seq int) string {
+	return filepath.Join(r.dir, fmt.Sprintf("record-%08d.txt", seq))
+}
+
+// files returns the sequence numbers of the files in the directory, in
+// order.
+func (r *recorder) files() ([]int, error) {
+	entries, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []int
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, "record-") || !strings.HasSuffix(name, ".txt") {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "record-"), ".txt"))
+		if err != nil {
+			continue
+		}
+		files = append(files, seq)
+	}
+	sort.Ints(files)
+	return files, nil
+}
+
+// rotate closes the current file, if any, starts the next one, and removes
+// the oldest, past the number kept. The caller must hold the mutex.
+func (r *recorder) rotate() error {
+	if err := r.closeFile(); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.fileName(r.seq+1), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	r.seq, r.f, r.size, r.opened = r.seq+1, f, 0, r.now()
+	r.w = bufio.NewWriter(f)
+	if r.keep <= 0 {
+		return nil
+	}
+	files, err := r.files()
+	if err != nil {
+		return err
+	}
+	for len(files) > r.keep {
+		if err := os.Remove(r.fileName(files[0])); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// closeFile flushes and closes the current file, if any. The caller must
+// hold the mutex.
+func (r *recorder) closeFile() error {
+	if r.f == nil {
+		return nil
+	}
+	err := r.w.Flush()
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	r.f, r.w = nil, nil
+	return err
+}
+
+// record writes the line, received at the time, rotating first if it
+// doesn't fit in the current file, or the file is too old. Errors are
+// logged, rather than returned, since the line has been accepted anyway.
+func (r *recorder) record(line []byte, at time.Time) {
+	if r == nil {
+		return
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.f == nil {
+		return // closed
+	}
+	r.buf = strconv.AppendFloat(r.buf[:0], float64(at.UnixNano())/1e9, 'f', 3, 64)
+	r.buf = append(r.buf, ' ')
+	r.buf = append(r.buf, line...)
+	r.buf = append(r.buf, '\n')
+	full := r.size > 0 && r.size+int64(len(r.buf)) > r.maxSize
+	old := r.maxAge > 0 && at.Sub(r.opened) >= r.maxAge
+	if full || old {
+		if err := r.rotate(); err != nil {
+			level.Error(r.logger).Log("during", "record", "err", err)
+			return
+		}
+	}
+	n, err := r.w.Write(r.buf)
+	r.size += int64(n)
+	if err != nil {
+		level.Error(r.logger).Log("during", "record", "err", err)
+	}
+}
+
+// flush writes what's buffered to the current file.
+func (r *recorder) flush() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	return r.w.Flush()
+}
+
+// run flushes every interval until the context is canceled, and then closes
+// the current file, after which nothing more is recorded.
+func (r *recorder) run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.flush(); err != nil {
+				level.Error(r.logger).Log("during", "record", "err", err)
+			}
+		case <-ctx.Done():
+			r.mtx.Lock()
+			defer r.mtx.Unlock()
+			if err := r.closeFile(); err != nil {
+				level.Error(r.logger).Log("during", "record", "err", err)
+			}
+			return nil
+		}
+	}
+}
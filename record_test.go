@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "record-00000007.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := openRecorder(dir, 64, time.Minute, 2, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 250000000)
+	r.opened = now
+	for _, line := range []string{
+		`foo_total{} 1`, // 28 bytes, with the time
+		`foo_total{} 2`,
+		`foo_total{} 3`, // full; rotated
+		`foo_total{} 4`,
+	} {
+		r.record([]byte(line), now)
+	}
+	now = now.Add(time.Minute)
+	r.now = func() time.Time { return now }
+	r.record([]byte(`foo_total{} 5`), now) // old; rotated
+	if err := r.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := r.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []int{9, 10}, files; !cmp.Equal(want, have) {
+		t.Fatalf("files: want %v, have %v", want, have)
+	}
+	for seq, want := range map[int]string{
+		9:  "1700000000.250 foo_total{} 3\n1700000000.250 foo_total{} 4\n",
+		10: "1700000060.250 foo_total{} 5\n",
+	} {
+		buf, err := ioutil.ReadFile(r.fileName(seq))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := string(buf); want != have {
+			t.Errorf("%d: want %q, have %q", seq, want, have)
+		}
+		at, line, err := splitReplayTime(strings.SplitN(string(buf), "\n", 2)[0])
+		if err != nil || line == "" || at.IsZero() {
+			t.Errorf("%d: can't be replayed: %v", seq, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := r.run(ctx, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	r.record([]byte(`foo_total{} 6`), now) // closed; not recorded
+	if buf, _ := ioutil.ReadFile(r.fileName(10)); strings.Contains(string(buf), "foo_total{} 6") {
+		t.Errorf("recorded after closing: %q", buf)
+	}
+}
+
+func TestIngesterRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rec, err := openRecorder(dir, 1<<20, 0, 0, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Foo."}`,
+	})...)
+	i := &ingester{observer: u, activity: newActivity(0), recorder: rec, logger: log.NewNopLogger()}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go i.forwardListener(ln)
+	if err := runSend([]string{"-socket", "tcp://" + ln.Addr().String(), `foo_total{code="200"} 1`, `bar_total{} 1`, `foo_total{code="500"} 2`}, strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	for deadline := time.Now().Add(time.Second); len(lines) < 2 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if err := rec.flush(); err != nil {
+			t.Fatal(err)
+		}
+		buf, _ := ioutil.ReadFile(rec.fileName(1))
+		lines = lines[:0]
+		for _, l := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+			if _, line, _ := splitReplayTime(l); line != "" {
+				lines = append(lines, line)
+			}
+		}
+	}
+	if want, have := []string{`foo_total{code="200"} 1`, `foo_total{code="500"} 2`}, lines; !cmp.Equal(want, have) {
+		t.Errorf("want %q, have %q", want, have)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// registration registers this aggregator as a service in the local Consul
+// agent, with a health check of its readiness, so Prometheus finds it with
+// consul_sd_configs, and deregisters it when it shuts down.
+type registration struct {
+	consulAPI
+	service consulService
+	retry   time.Duration // between failed registrations
+	logger  log.Logger
+}
+
+// consulService is a service definition, as the Consul agent API takes it.
+type consulService struct {
+	ID      string            `json:"ID"`
+	Name    string            `json:"Name"`
+	Tags    []string          `json:"Tags,omitempty"`
+	Address string            `json:"Address,omitempty"`
+	Port    int               `json:"Port"`
+	Meta    map[string]string `json:"Meta,omitempty"`
+	Check   consulCheck       `json:"Check"`
+}
+
+type consulCheck struct {
+	HTTP          string `json:"HTTP"`
+	Interval      string `json:"Interval"`
+	Timeout       string `json:"Timeout"`
+	TLSSkipVerify bool   `json:"TLSSkipVerify,omitempty"`
+
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter"`
+}
+
+// newRegistration returns the registration of the service, whose ID is
+// the name and id, scraped at the Prometheus listener, listening at addr,
+// with the scheme and path of the -prometheus address. The address Consul
+// advertises is advertise, if it isn't empty, and otherwise the agent's, at
+// the listener's port. The agent checks the readiness of the aggregator at
+// the listener, or at localhost, if it listens on every address.
+func newRegistration(api, token, name, id string, tags []string, advertise string, scrape *url.URL, addr net.Addr, logger log.Logger) (*registration, error) {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	checkHost := net.JoinHostPort(host, port)
+	var address string
+	if advertise != "" {
+		if address, port, err = net.SplitHostPort(advertise); err != nil {
+			return nil, fmt.Errorf("advertised address %q: %v", advertise, err)
+		}
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	path := scrape.Path
+	if path == "" {
+		path = "/"
+	}
+	return &registration{
+		consulAPI: newConsulAPI(api, token),
+		service: consulService{
+			ID:      name + "-" + id,
+			Name:    name,
+			Tags:    tags,
+			Address: address,
+			Port:    p,
+			Meta:    map[string]string{"metrics_path": path, "scheme": scrapeScheme(scrape)},
+			Check: consulCheck{
+				HTTP:                           scrapeScheme(scrape) + "://" + checkHost + "/-/ready",
+				Interval:                       "10s",
+				Timeout:                        "5s",
+				TLSSkipVerify:                  scrape.Scheme == "https", // it's our own listener
+				DeregisterCriticalServiceAfter: "10m",
+			},
+		},
+		retry:  consulSessionTTL / 3,
+		logger: logger,
+	}, nil
+}
+
+// scrapeScheme returns the scheme Prometheus scrapes the address with.
+func scrapeScheme(u *url.URL) string {
+	if u.Scheme == "https" {
+		return "https"
+	}
+	return "http"
+}
+
+// run registers the service, and keeps trying until it's registered, so a
+// Consul agent which isn't up yet doesn't stop the aggregator from starting,
+// and deregisters it when the context is canceled.
+func (r *registration) run(ctx context.Context) error {
+	ticker := time.NewTicker(r.retry)
+	defer ticker.Stop()
+	for {
+		err := r.register(ctx)
+		if err == nil {
+			break
+		}
+		if ctx.Err() == nil {
+			level.Warn(r.logger).Log("during", "consul registration", "err", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	level.Info(r.logger).Log("consul_service", r.service.Name, "id", r.service.ID, "registered", true)
+	<-ctx.Done()
+	r.deregister()
+	return ctx.Err()
+}
+
+func (r *registration) register(ctx context.Context) error {
+	body, err := json.Marshal(r.service)
+	if err != nil {
+		return err
+	}
+	return r.do(ctx, "PUT", "/v1/agent/service/register", body, nil)
+}
+
+// deregister removes the service, so Prometheus stops scraping it before
+// the listener goes away, rather than waiting for the check to fail.
+func (r *registration) deregister() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.do(ctx, "PUT", "/v1/agent/service/deregister/"+url.PathEscape(r.service.ID), nil, nil); err != nil {
+		level.Warn(r.logger).Log("during", "consul deregistration", "err", err)
+	}
+}
+
+// parseServiceTags parses a comma-separated list of tags.
+func parseServiceTags(s string) []string {
+	var tags []string
+	for _, tag := range strings.Split(s, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
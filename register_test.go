@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestRegistration(t *testing.T) {
+	var (
+		mtx          sync.Mutex
+		registered   []consulService
+		deregistered []string
+		fail         = true // the first registration, as if the agent isn't up yet
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		switch {
+		case r.Method == "PUT" && r.URL.Path == "/v1/agent/service/register":
+			if fail {
+				fail = false
+				http.Error(w, "agent not ready", http.StatusInternalServerError)
+				return
+			}
+			var s consulService
+			if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			registered = append(registered, s)
+		case r.Method == "PUT" && len(r.URL.Path) > len("/v1/agent/service/deregister/"):
+			deregistered = append(deregistered, r.URL.Path[len("/v1/agent/service/deregister/"):])
+		default:
+			http.Error(w, "unexpected "+r.Method+" "+r.URL.String(), http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	scrape, _ := url.Parse("tcp://0.0.0.0:8192/metrics")
+	addr := &net.TCPAddr{IP: net.IPv4zero, Port: 8192}
+	reg, err := newRegistration(server.URL, "", "prometheus-aggregator", "agg-a", parseServiceTags("eu, ,prod"), "", scrape, addr, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := consulService{
+		ID:   "prometheus-aggregator-agg-a",
+		Name: "prometheus-aggregator",
+		Tags: []string{"eu", "prod"},
+		Port: 8192,
+		Meta: map[string]string{"metrics_path": "/metrics", "scheme": "http"},
+		Check: consulCheck{
+			HTTP:                           "http://127.0.0.1:8192/-/ready",
+			Interval:                       "10s",
+			Timeout:                        "5s",
+			DeregisterCriticalServiceAfter: "10m",
+		},
+	}
+	if !reflect.DeepEqual(want, reg.service) {
+		t.Fatalf("want %+v, have %+v", want, reg.service)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	reg.retry = 10 * time.Millisecond
+	go func() { done <- reg.run(ctx) }()
+	deadline := time.Now().Add(time.Second)
+	for {
+		mtx.Lock()
+		n := len(registered)
+		mtx.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("not registered after retrying")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	mtx.Lock()
+	defer mtx.Unlock()
+	if want, have := []string{"prometheus-aggregator-agg-a"}, deregistered; !reflect.DeepEqual(want, have) {
+		t.Errorf("deregistered: want %v, have %v", want, have)
+	}
+
+	advertised, err := newRegistration(server.URL, "", "prometheus-aggregator", "agg-a", nil, "10.0.0.1:9192", scrape, addr, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "10.0.0.1", advertised.service.Address; want != have {
+		t.Errorf("advertised address: want %s, have %s", want, have)
+	}
+	if want, have := 9192, advertised.service.Port; want != have {
+		t.Errorf("advertised port: want %d, have %d", want, have)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Relabel actions, as in Prometheus's relabel_config, plus hash and redact.
+const (
+	relabelReplace   = "replace"   // set the target label to the replacement, if the regex matches
+	relabelKeep      = "keep"      // drop lines which don't match the regex
+	relabelDrop      = "drop"      // drop lines which match the regex
+	relabelLabelMap  = "labelmap"  // copy labels whose names match the regex to the replacement
+	relabelLabelDrop = "labeldrop" // remove labels whose names match the regex
+	relabelLabelKeep = "labelkeep" // remove labels whose names don't match the regex
+	relabelHash      = "hash"      // replace the values of labels whose names match the regex with a hash
+	relabelRedact    = "redact"    // replace the values of labels whose names match the regex with redactedValue
+)
+
+// redactedValue replaces the values of labels redacted by relabel rules.
+const redactedValue = "redacted"
+
+// nameLabel is the metric name, to relabel rules.
+const nameLabel = "__name__"
+
+// relabelRule is one of the relabel rules in the config file, which are
+// applied, in order, to every line as it's ingested. They work like
+// Prometheus's metric_relabel_configs, with the metric name as the __name__
+// label: the values of the source labels are joined with the separator, and
+// matched against the regex, which is anchored at both ends. Labels whose
+// names start with __ are removed once all the rules are applied, so they can
+// be used to hold intermediate values. A rule with metrics only applies to
+// the metrics whose names match it, which is also anchored.
+type relabelRule struct {
+	Metrics      string   `yaml:"metrics"`
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    string   `yaml:"separator"`
+	Regex        string   `yaml:"regex"`
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  string   `yaml:"replacement"`
+	Action       string   `yaml:"action"`
+
+	metrics *regexp.Regexp // nil means every metric
+	re      *regexp.Regexp
+}
+
+// UnmarshalYAML sets the defaults for anything the rule doesn't set.
+func (r *relabelRule) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain relabelRule
+	*r = relabelRule{Separator: ";", Regex: "(.*)", Replacement: "$1", Action: relabelReplace}
+	return unmarshal((*plain)(r))
+}
+
+// compile checks the rule, and compiles its regex.
+func (r *relabelRule) compile() error {
+	switch r.Action {
+	case relabelReplace:
+		if r.TargetLabel == "" {
+			return fmt.Errorf("%s requires a target_label", r.Action)
+		}
+		if !strings.Contains(r.TargetLabel, "$") && r.TargetLabel != nameLabel && !validLabelName(r.TargetLabel) {
+			return fmt.Errorf("invalid target_label %q", r.TargetLabel)
+		}
+	case relabelKeep, relabelDrop:
+		if len(r.SourceLabels) == 0 {
+			return fmt.Errorf("%s requires source_labels", r.Action)
+		}
+	case relabelLabelMap:
+	case relabelLabelDrop, relabelLabelKeep, relabelHash, relabelRedact:
+		if len(r.SourceLabels) > 0 || r.TargetLabel != "" {
+			return fmt.Errorf("%s takes no source_labels or target_label, just a regex of label names", r.Action)
+		}
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	re, err := regexp.Compile("^(?:" + r.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid regex %q: %v", r.Regex, err)
+	}
+	r.re = re
+	if r.Metrics != "" {
+		if r.metrics, err = regexp.Compile("^(?:" + r.Metrics + ")$"); err != nil {
+			return fmt.Errorf("invalid metrics regex %q: %v", r.Metrics, err)
+		}
+	}
+	return nil
+}
+
+// apply applies the rule to the metric name and labels. It returns false if
+// the line should be dropped.
+func (r *relabelRule) apply(name *string, labels map[string]string) bool {
+	if r.metrics != nil && !r.metrics.MatchString(*name) {
+		return true
+	}
+	values := make([]string, len(r.SourceLabels))
+	for i, l := range r.SourceLabels {
+		if l == nameLabel {
+			values[i] = *name
+		} else {
+			values[i] = labels[l]
+		}
+	}
+	src := strings.Join(values, r.Separator)
+
+	switch r.Action {
+	case relabelKeep:
+		return r.re.MatchString(src)
+	case relabelDrop:
+		return !r.re.MatchString(src)
+	case relabelLabelMap:
+		var matched []string
+		for k := range labels {
+			if r.re.MatchString(k) {
+				matched = append(matched, k)
+			}
+		}
+		for _, k := range matched {
+			labels[r.re.ReplaceAllString(k, r.Replacement)] = labels[k]
+		}
+	case relabelLabelDrop, relabelLabelKeep:
+		for k := range labels {
+			if r.re.MatchString(k) == (r.Action == relabelLabelDrop) {
+				delete(labels, k)
+			}
+		}
+	case relabelHash, relabelRedact:
+		for k, v := range labels {
+			if v == "" || !r.re.MatchString(k) {
+				continue
+			}
+			if r.Action == relabelHash {
+				labels[k] = hashLabelValue(v)
+			} else {
+				labels[k] = redactedValue
+			}
+		}
+	case relabelReplace:
+		m := r.re.FindStringSubmatchIndex(src)
+		if m == nil {
+			return true
+		}
+		target := string(r.re.ExpandString(nil, r.TargetLabel, src, m))
+		value := string(r.re.ExpandString(nil, r.Replacement, src, m))
+		switch {
+		case target == nameLabel:
+			*name = value
+		case !validLabelName(target):
+		case value == "":
+			delete(labels, target)
+		default:
+			labels[target] = value
+		}
+	}
+	return true
+}
+
+// hashLabelValue returns the first 16 hex digits of the SHA-256 of the
+// value: still distinct, so series stay apart, but not the value.
+func hashLabelValue(v string) string {
+	sum := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(sum[:8])
+}
+
+// relabeler applies the renames, relabel rules, and top-k rules in the
+// config file to every line, and reads them again on reload. A nil relabeler
+// leaves lines alone.
+type relabeler struct {
+	dropped uint64 // atomic; first, for alignment
+	others  uint64 // atomic; lines with a value replaced by a top-k rule
+
+	config string
+
+	mtx     sync.RWMutex
+	rules   []relabelRule
+	renames map[string]string      // replaced, never modified
+	topK    map[string][]labelTopK // by metric; replaced, never modified
+}
+
+// labelTopK is a top-k rule, and the values it's counted.
+type labelTopK struct {
+	rule topKRule
+	t    *topK
+}
+
+// newRelabeler reads the rules in the config file. If there's no config
+// file, it returns nil.
+func newRelabeler(config string) (*relabeler, error) {
+	if config == "" {
+		return nil, nil
+	}
+	r := &relabeler{config: config}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload reads the rules again. If that fails, the previous rules are kept.
+func (r *relabeler) reload() error {
+	if r == nil {
+		return nil
+	}
+	c, err := readConfig(r.config)
+	if err != nil {
+		return err
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	// Rules which haven't changed keep the values they've counted.
+	topK := map[string][]labelTopK{}
+	for _, rule := range c.TopK {
+		l := labelTopK{rule: rule, t: newTopK(rule.K)}
+		for _, prev := range r.topK[rule.Metric] {
+			if prev.rule == rule {
+				l.t = prev.t
+			}
+		}
+		topK[rule.Metric] = append(topK[rule.Metric], l)
+	}
+	r.rules, r.renames, r.topK = c.Relabel, c.Rename, topK
+	return nil
+}
+
+// parseLine parses the line, with parseLineRenamed, so its metric name is
+// renamed before anything else happens to it.
+func (r *relabeler) parseLine(line []byte, o *observation) error {
+	if r == nil {
+		return parseLineInto(line, o)
+	}
+	r.mtx.RLock()
+	renames := r.renames
+	r.mtx.RUnlock()
+	return parseLineRenamed(line, o, renames)
+}
+
+// relabel applies the rules, and then the top-k rules of its metric, to the
+// parsed observation, and recomputes its timeseries key. It returns false if
+// the line should be dropped. Deletes without labels only have their names
+// relabeled, so they still delete every series.
+func (r *relabeler) relabel(p *parsed) bool {
+	if r == nil {
+		return true
+	}
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	if len(r.rules) == 0 {
+		r.applyTopK(p)
+		return true
+	}
+	labels, deleteAll := p.obs.Labels, p.obs.Labels == nil && p.obs.Op == "delete"
+	if labels == nil {
+		labels = p.labels // empty
+		if !deleteAll {
+			p.obs.Labels = labels
+		}
+	}
+	for i := range r.rules {
+		if !r.rules[i].apply(&p.obs.Name, labels) {
+			atomic.AddUint64(&r.dropped, 1)
+			return false
+		}
+	}
+	for k := range labels {
+		if strings.HasPrefix(k, "__") {
+			delete(labels, k)
+		}
+	}
+	if deleteAll {
+		for k := range labels {
+			delete(labels, k)
+		}
+	}
+	p.obs.Key = makeTimeseriesKey(p.obs.Name, p.obs.Labels)
+	r.applyTopK(p)
+	return true
+}
+
+// applyTopK counts the values of the labels of the top-k rules of the
+// observation's metric, replaces those which aren't in the top k with
+// otherValue, and recomputes its timeseries key if it did. Declarations and
+// deletes are left alone, so a series of a value which has dropped out of
+// the top k can still be deleted. The caller must hold the read lock.
+func (r *relabeler) applyTopK(p *parsed) {
+	rules := r.topK[p.obs.Name]
+	if len(rules) == 0 || p.obs.Labels == nil || p.obs.Value == nil || p.obs.Op == "delete" {
+		return
+	}
+	var replaced bool
+	for _, l := range rules {
+		v, ok := p.obs.Labels[l.rule.Label]
+		if ok && v != otherValue && !l.t.observe(v) {
+			p.obs.Labels[l.rule.Label] = otherValue
+			replaced = true
+		}
+	}
+	if replaced {
+		atomic.AddUint64(&r.others, 1)
+		p.obs.Key = makeTimeseriesKey(p.obs.Name, p.obs.Labels)
+	}
+}
+
+// renderTelemetry writes the number of lines dropped by relabel rules, and
+// with values replaced by top-k rules, in the Prometheus text format.
+func (r *relabeler) renderTelemetry(w io.Writer) {
+	if r == nil {
+		return
+	}
+	fmt.Fprintf(w, "# HELP prometheus_aggregator_relabel_dropped_lines_total Lines dropped by relabel rules.\n")
+	fmt.Fprintf(w, "# TYPE prometheus_aggregator_relabel_dropped_lines_total counter\n")
+	fmt.Fprintf(w, "prometheus_aggregator_relabel_dropped_lines_total %d\n", atomic.LoadUint64(&r.dropped))
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "# HELP prometheus_aggregator_topk_other_lines_total Lines with a label value replaced by %s, by top-k rules.\n", otherValue)
+	fmt.Fprintf(w, "# TYPE prometheus_aggregator_topk_other_lines_total counter\n")
+	fmt.Fprintf(w, "prometheus_aggregator_topk_other_lines_total %d\n", atomic.LoadUint64(&r.others))
+	fmt.Fprintln(w)
+}
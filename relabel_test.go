@@ -0,0 +1,289 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestRelabel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "config.yaml")
+	writeFile(t, filename, `
+relabel:
+  - source_labels: [__name__]
+    regex: debug_.*
+    action: drop
+  - source_labels: [code]
+    regex: (\d)\d\d
+    target_label: class
+    replacement: ${1}xx
+  - source_labels: [__name__, env]
+    regex: (.+)_total;staging
+    target_label: __name__
+    replacement: staging_${1}_total
+  - regex: k8s_(.+)
+    action: labelmap
+  - source_labels: [__name__]
+    regex: (.*)
+    target_label: __tmp
+`)
+	rules, err := newRelabeler(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Foo."}`,
+		`{"name":"staging_foo_total","type":"counter","help":"Foo, in staging."}`,
+		`{"name":"debug_total","type":"counter","help":"Debugging."}`,
+	})...)
+	i := &ingester{observer: u, activity: newActivity(0), logger: log.NewNopLogger(), rules: rules}
+	i.handleConn(ioutil.NopCloser(strings.NewReader(strings.Join([]string{
+		`foo_total{code="200"} 1`,
+		`foo_total{code="404",env="staging"} 2`,
+		`foo_total{k8s_namespace="web",k8s_pod="web-1"} 4`,
+		`{"name":"foo_total","value":8}`,
+		`debug_total{} 16`,
+	}, "\n")+"\n")), "test")
+	if want, have := normalizeResponse(`
+		# HELP foo_total Foo.
+		# TYPE foo_total counter
+		foo_total{class="2xx",code="200"} 1
+		foo_total{k8s_namespace="web",k8s_pod="web-1",namespace="web",pod="web-1"} 4
+		foo_total{} 8
+
+		# HELP staging_foo_total Foo, in staging.
+		# TYPE staging_foo_total counter
+		staging_foo_total{class="4xx",code="404",env="staging"} 2
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Errorf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+
+	var buf strings.Builder
+	rules.renderTelemetry(&buf)
+	if want := "prometheus_aggregator_relabel_dropped_lines_total 1\n"; !strings.Contains(buf.String(), want) {
+		t.Errorf("want %s, have\n%s", want, buf.String())
+	}
+
+	// Deletes are relabeled, too, and deletes without labels still delete
+	// every series.
+	i.handleConn(ioutil.NopCloser(strings.NewReader(`{"name":"foo_total","op":"delete"}`+"\n"+`{"name":"foo_total","op":"delete","labels":{"code":"404","env":"staging"}}`+"\n")), "test")
+	if have := scrape(t, u); strings.Contains(have, "foo_total{") {
+		t.Errorf("after deletes: have\n%s", have)
+	}
+}
+
+func TestRelabelLabelDrop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "config.yaml")
+	writeFile(t, filename, `
+relabel:
+  - regex: request_id|trace_id
+    action: labeldrop
+  - metrics: bar_.*
+    regex: code
+    action: labelkeep
+`)
+	rules, err := newRelabeler(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Foo."}`,
+		`{"name":"bar_total","type":"counter","help":"Bar."}`,
+	})...)
+	i := &ingester{observer: u, activity: newActivity(0), logger: log.NewNopLogger(), rules: rules}
+	i.handleConn(ioutil.NopCloser(strings.NewReader(strings.Join([]string{
+		`foo_total{code="200",request_id="a1"} 1`,
+		`foo_total{code="200",request_id="b2",trace_id="c3"} 2`,
+		`bar_total{code="200",path="/a"} 4`,
+		`bar_total{code="200",path="/b"} 8`,
+	}, "\n")+"\n")), "test")
+	if want, have := normalizeResponse(`
+		# HELP bar_total Bar.
+		# TYPE bar_total counter
+		bar_total{code="200"} 12
+
+		# HELP foo_total Foo.
+		# TYPE foo_total counter
+		foo_total{code="200"} 3
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Errorf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+
+	for _, bad := range []string{
+		"relabel:\n  - {action: labeldrop, regex: a, source_labels: [a]}\n",
+		"relabel:\n  - {action: labelkeep, regex: a, target_label: b}\n",
+		"relabel:\n  - {action: labeldrop, regex: a, metrics: \"(\"}\n",
+	} {
+		writeFile(t, filename, bad)
+		if err := rules.reload(); err == nil {
+			t.Errorf("%q: want error, have none", bad)
+		}
+	}
+}
+
+func TestRelabelHashRedact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "config.yaml")
+	writeFile(t, filename, `
+relabel:
+  - regex: email
+    action: redact
+  - regex: account_id|user_.*
+    action: hash
+`)
+	rules, err := newRelabeler(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"logins_total","type":"counter","help":"Logins."}`,
+	})...)
+	i := &ingester{observer: u, activity: newActivity(0), logger: log.NewNopLogger(), rules: rules}
+	i.handleConn(ioutil.NopCloser(strings.NewReader(strings.Join([]string{
+		`logins_total{account_id="12345",email="alice@example.com"} 1`,
+		`logins_total{account_id="12345",email="bob@example.com"} 2`,
+		`logins_total{account_id="67890",user_name=""} 4`,
+	}, "\n")+"\n")), "test")
+	if want, have := normalizeResponse(`
+		# HELP logins_total Logins.
+		# TYPE logins_total counter
+		logins_total{account_id="`+hashLabelValue("12345")+`",email="redacted"} 3
+		logins_total{account_id="`+hashLabelValue("67890")+`",user_name=""} 4
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Errorf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+	if have := scrape(t, u); strings.Contains(have, "12345") || strings.Contains(have, "@") {
+		t.Errorf("values leaked:\n%s", have)
+	}
+}
+
+func TestRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "config.yaml")
+	writeFile(t, filename, `
+rename:
+  api.requests: api_requests_total
+  api_errors: api_requests_total
+relabel:
+  - source_labels: [__name__]
+    regex: api_requests_total
+    target_label: legacy
+    replacement: "yes"
+`)
+	rules, err := newRelabeler(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"api_requests_total","type":"counter","help":"API requests."}`,
+	})...)
+	i := &ingester{observer: u, activity: newActivity(0), logger: log.NewNopLogger(), rules: rules}
+	i.handleConn(ioutil.NopCloser(strings.NewReader(strings.Join([]string{
+		`api.requests{code="200"} 1`,
+		`{"name":"api.requests","labels":{"code":"200"},"value":2}`,
+		`api_errors{code="500"} 4`,
+		`api.other{} 8`,
+	}, "\n")+"\n")), "test")
+	if want, have := normalizeResponse(`
+		# HELP api_requests_total API requests.
+		# TYPE api_requests_total counter
+		api_requests_total{code="200",legacy="yes"} 3
+		api_requests_total{code="500",legacy="yes"} 4
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Errorf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+
+	for _, bad := range []string{
+		"rename:\n  api.requests: api.requests_total\n",
+		"rename:\n  \"\": api_requests_total\n",
+	} {
+		writeFile(t, filename, bad)
+		if err := rules.reload(); err == nil {
+			t.Errorf("%q: want error, have none", bad)
+		}
+	}
+}
+
+func TestRelabelReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "config.yaml")
+	writeFile(t, filename, "strict: true\n")
+	rules, err := newRelabeler(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relabel := func(line string) string {
+		p := getParsed()
+		defer putParsed(p)
+		if err := parseLineInto([]byte(line), &p.obs); err != nil {
+			t.Fatal(err)
+		}
+		if !rules.relabel(p) {
+			return "dropped"
+		}
+		return string(p.obs.timeseriesKey())
+	}
+	if want, have := `foo_total {a="1"}`, relabel(`foo_total{a="1"} 1`); want != have {
+		t.Errorf("without rules: want %s, have %s", want, have)
+	}
+
+	writeFile(t, filename, "relabel:\n  - {source_labels: [a], regex: \"1\", action: drop}\n")
+	if err := rules.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "dropped", relabel(`foo_total{a="1"} 1`); want != have {
+		t.Errorf("after reload: want %s, have %s", want, have)
+	}
+
+	// Bad rules are errors, and the previous rules are kept.
+	for _, bad := range []string{
+		"relabel:\n  - {action: replace}\n",
+		"relabel:\n  - {action: keep}\n",
+		"relabel:\n  - {action: labelmap, regex: \"(\"}\n",
+		"relabel:\n  - {action: explode, source_labels: [a]}\n",
+		"relabel:\n  - {target_label: 1a}\n",
+	} {
+		writeFile(t, filename, bad)
+		if err := rules.reload(); err == nil {
+			t.Errorf("%q: want error, have none", bad)
+		}
+	}
+	if want, have := "dropped", relabel(`foo_total{a="1"} 1`); want != have {
+		t.Errorf("after bad reloads: want %s, have %s", want, have)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// relayTimeout is how long a relay waits to connect to the upstream
+// aggregator, and for each forward to be written.
+const relayTimeout = 10 * time.Second
+
+// relay forwards what the universe has aggregated, every interval, to an
+// upstream aggregator, as lines, like any other client: so aggregators can
+// be chained, e.g. one per host, forwarding to one per region. Each forward
+// is the change since the last one: the increase of each counter, the value
+// of each gauge which changed, and the counts and sum added to each
+// histogram, as a merge. If a forward fails, the changes are forwarded with
+// the next one. Windowed histograms aren't forwarded: their dumps are of the
+// last complete window, not of everything observed, so there's no change to
+// compute.
+type relay struct {
+	forwarded uint64 // atomic; first, for alignment; lines
+	failures  uint64 // atomic
+
+	u       *universe
+	network string
+	addr    string // host:port
+	token   string
+	logger  log.Logger
+	last    map[timeseriesKey]seriesDump // as of the last successful forward
+}
+
+func newRelay(u *universe, network, addr, token string, logger log.Logger) *relay {
+	return &relay{
+		u:       u,
+		network: network,
+		addr:    addr,
+		token:   token,
+		logger:  log.With(logger, "relay", addr),
+		last:    map[timeseriesKey]seriesDump{},
+	}
+}
+
+// run forwards every interval until the context is canceled, and then
+// forwards one last time.
+func (r *relay) run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.forwardLogged()
+		case <-ctx.Done():
+			r.forwardLogged()
+			return ctx.Err()
+		}
+	}
+}
+
+func (r *relay) forwardLogged() {
+	if err := r.forward(); err != nil {
+		atomic.AddUint64(&r.failures, 1)
+		level.Warn(r.logger).Log("during", "forward", "err", err)
+	}
+}
+
+// forward writes the changes since the last forward, if there are any, to a
+// new connection to the upstream aggregator.
+func (r *relay) forward() error {
+	d := r.u.dump()
+	var buf bytes.Buffer
+	next, n, err := r.changes(&buf, d)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		conn, err := net.DialTimeout(r.network, r.addr, relayTimeout)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetWriteDeadline(time.Now().Add(relayTimeout))
+		if r.token != "" {
+			if _, err := fmt.Fprintf(conn, "AUTH %s\n", r.token); err != nil {
+				return err
+			}
+		}
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		// Once it's written, it's forwarded, even if closing fails: sending
+		// it again would count it twice.
+		atomic.AddUint64(&r.forwarded, uint64(n))
+		r.last = next
+		return conn.Close()
+	}
+	r.last = next
+	return nil
+}
+
+// changes writes a line for each series which changed since the last
+// forward, after a declaration of its metric, and returns the state to
+// compare the next forward to, and the number of lines of changes.
+func (r *relay) changes(w io.Writer, d universeDump) (next map[timeseriesKey]seriesDump, n int, err error) {
+	enc := json.NewEncoder(w)
+	next = map[timeseriesKey]seriesDump{}
+	for _, cd := range d.Metrics {
+		if cd.Window != "" {
+			continue
+		}
+		declared := false
+		for _, sd := range cd.Series {
+			k := makeTimeseriesKey(cd.Name, sd.Labels)
+			next[k] = sd
+			prev, seen := r.last[k]
+			o, ok := seriesChange(cd, sd, prev, seen)
+			if !ok {
+				continue
+			}
+			if !declared {
+				if err := enc.Encode(cd.declaration()); err != nil {
+					return nil, 0, err
+				}
+				declared = true
+			}
+			if err := enc.Encode(o); err != nil {
+				return nil, 0, err
+			}
+			n++
+		}
+	}
+	return next, n, nil
+}
+
+// seriesChange returns the observation of the change in the series since
+// prev, if it's been seen before, and false if there's no change. A counter
+// or histogram which went down was reset, e.g. deleted and observed again,
+// so all of it is the change, and so is all of a histogram whose buckets
+// changed.
+func seriesChange(cd collectionDump, sd, prev seriesDump, seen bool) (observation, bool) {
+	o := observation{Name: cd.Name, Labels: sd.Labels}
+	if o.Labels == nil {
+		o.Labels = map[string]string{} // not a delete
+	}
+	switch cd.Type {
+	case "counter":
+		value := *sd.Value
+		if seen && *prev.Value <= value {
+			value -= *prev.Value
+		}
+		if value == 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+			return o, false // no change, or one JSON can't represent
+		}
+		o.Value = &value
+	case "gauge":
+		if seen && math.Float64bits(*prev.Value) == math.Float64bits(*sd.Value) {
+			return o, false
+		}
+		if math.IsNaN(*sd.Value) || math.IsInf(*sd.Value, 0) {
+			return o, false // a change JSON can't represent
+		}
+		value := *sd.Value
+		o.Value = &value
+	case "histogram":
+		sum, count, cumulative := *sd.Sum, *sd.Count, sd.BucketCounts
+		if seen && *prev.Count <= count && len(prev.BucketCounts) == len(cumulative) {
+			sum, count = sum-*prev.Sum, count-*prev.Count
+			cumulative = make([]uint64, len(sd.BucketCounts))
+			for i := range cumulative {
+				cumulative[i] = sd.BucketCounts[i] - prev.BucketCounts[i]
+			}
+		}
+		if count == 0 || math.IsNaN(sum) || math.IsInf(sum, 0) {
+			return o, false
+		}
+		o.Op, o.Value, o.Counts = "merge", &sum, make([]uint64, len(cumulative)+1)
+		var below uint64
+		for i, c := range cumulative {
+			o.Counts[i], below = c-below, c
+		}
+		o.Counts[len(cumulative)] = count - below
+	default:
+		return o, false
+	}
+	return o, true
+}
+
+// renderTelemetry writes the relay's counters, in the Prometheus text
+// format.
+func (r *relay) renderTelemetry(w io.Writer) {
+	if r == nil {
+		return
+	}
+	fmt.Fprintf(w, "# HELP prometheus_aggregator_relay_forwarded_lines_total Lines of changes forwarded to the upstream aggregator.\n")
+	fmt.Fprintf(w, "# TYPE prometheus_aggregator_relay_forwarded_lines_total counter\n")
+	fmt.Fprintf(w, "prometheus_aggregator_relay_forwarded_lines_total %d\n\n", atomic.LoadUint64(&r.forwarded))
+	fmt.Fprintf(w, "# HELP prometheus_aggregator_relay_failures_total Forwards to the upstream aggregator which failed, and were retried with the next.\n")
+	fmt.Fprintf(w, "# TYPE prometheus_aggregator_relay_failures_total counter\n")
+	fmt.Fprintf(w, "prometheus_aggregator_relay_failures_total %d\n\n", atomic.LoadUint64(&r.failures))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestRelay(t *testing.T) {
+	decls := []string{
+		`{"name":"foo_total","type":"counter","help":"Foo."}`,
+		`{"name":"bar","type":"gauge","help":"Bar."}`,
+		`{"name":"baz_seconds","type":"histogram","help":"Baz.","buckets":[0.1,1]}`,
+		`{"name":"qux_seconds","type":"histogram","help":"Qux.","buckets":[1],"window":"1m"}`,
+	}
+	local, _ := newUniverse(makeObservations(t, decls)...)
+	upstream, _ := newUniverse() // declared by the relay
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	tokens, _ := newSocketTokens("", "s3cr3t")
+	i := &ingester{observer: upstream, activity: newActivity(0), logger: log.NewNopLogger(), tokens: tokens}
+	go i.forwardListener(ln)
+
+	r := newRelay(local, "tcp", ln.Addr().String(), "s3cr3t", log.NewNopLogger())
+	observe := func(lines ...string) {
+		for _, line := range lines {
+			o, err := parseLine([]byte(line))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := local.observe(o); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	forward := func(want string) {
+		t.Helper()
+		if err := r.forward(); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) && !strings.Contains(scrape(t, upstream), want) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if have := scrape(t, upstream); !strings.Contains(have, want) {
+			t.Fatalf("want %s, have\n%s", want, have)
+		}
+	}
+
+	observe(`foo_total{code="200"} 3`, `bar{} 5`, `baz_seconds{} 0.05`, `baz_seconds{} 5`)
+	forward(`baz_seconds_count{} 2`)
+	if want, have := scrape(t, local), scrape(t, upstream); want != have {
+		t.Errorf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+
+	// Only the changes are forwarded.
+	observe(`foo_total{code="200"} 2`, `baz_seconds{} 0.5`)
+	forward(`baz_seconds_count{} 3`)
+	if want, have := uint64(3+2), atomic.LoadUint64(&r.forwarded); want != have {
+		t.Errorf("forwarded: want %d, have %d", want, have) // bar didn't change
+	}
+	if want, have := scrape(t, local), scrape(t, upstream); want != have {
+		t.Errorf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+
+	// A counter which was reset is forwarded in full.
+	local.observe(observation{Name: "foo_total", Labels: map[string]string{"code": "200"}, Op: "delete"})
+	observe(`foo_total{code="200"} 1`)
+	forward(`foo_total{code="200"} 6`)
+
+	// Windowed histograms aren't forwarded.
+	observe(`qux_seconds{} 0.5`, `foo_total{code="200"} 1`)
+	forward(`foo_total{code="200"} 7`)
+	if have := scrape(t, upstream); strings.Contains(have, "qux_seconds") {
+		t.Errorf("windowed histogram was forwarded:\n%s", have)
+	}
+
+	// Nothing changed, so nothing's forwarded, and the upstream isn't dialed.
+	ln.Close()
+	if err := r.forward(); err != nil {
+		t.Errorf("without changes: %v", err)
+	}
+	observe(`foo_total{code="200"} 1`)
+	if err := r.forward(); err == nil {
+		t.Errorf("with the upstream gone, want an error, have none")
+	}
+}
+
+func TestMergeValidation(t *testing.T) {
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Foo."}`,
+		`{"name":"baz_seconds","type":"histogram","help":"Baz.","buckets":[0.1,1]}`,
+		`{"name":"qux_seconds","type":"histogram","help":"Qux.","buckets":[1],"window":"1m"}`,
+	})...)
+	for _, line := range []string{
+		`{"name":"foo_total","op":"merge","value":1,"counts":[1]}`,
+		`{"name":"baz_seconds","op":"merge","value":1,"counts":[1,2]}`,
+		`{"name":"baz_seconds","op":"merge","counts":[1,2,3]}`,
+	} {
+		o, err := parseLine([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := u.observe(o); err == nil {
+			t.Errorf("%s: want an error, have none", line)
+		}
+	}
+	o, _ := parseLine([]byte(`{"name":"baz_seconds","op":"merge","value":7.5,"counts":[1,2,3]}`))
+	if err := u.observe(o); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`baz_seconds_bucket{le="0.1"} 1`,
+		`baz_seconds_bucket{le="1"} 3`,
+		`baz_seconds_bucket{le="+Inf"} 6`,
+		`baz_seconds_sum{} 7.5`,
+	} {
+		if have := scrape(t, u); !strings.Contains(have, want) {
+			t.Errorf("want %s, have\n%s", want, have)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// The outcomes of a declaration.
+const (
+	declCreated    = "created"    // the metric is new
+	declExists     = "exists"     // the metric exists, and keeps its declaration
+	declRebucketed = "rebucketed" // the histogram exists, and has new buckets
+)
+
+// declare registers the metric described by the observation, unless a
+// metric with that name already exists, in which case the existing
+// declaration wins. The exception is a histogram declared with different
+// buckets: buckets can't be split or merged after the fact, so it's replaced
+// by a histogram with the new buckets, which resets all of its series.
+// Values are ignored. It returns the outcome.
+func (u *universe) declare(o observation) (string, error) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	n := o.metricName()
+	if c, ok := u.collections[n]; ok {
+		if c.typ != "histogram" || o.Buckets == nil || c.sameBuckets(o.Buckets) {
+			return declExists, nil
+		}
+		d := c.declaration(n)
+		d.Buckets, d.Coarse = o.Buckets, o.Coarse
+		rebucketed, err := newTimeseriesCollection(d)
+		if err != nil {
+			return "", errors.Wrapf(err, "error redeclaring %s", n)
+		}
+		c.mtx.RLock()
+		rebucketed.created = c.created
+		c.limit.release(len(c.values))
+		c.mtx.RUnlock()
+		rebucketed.limit, rebucketed.scrapes, rebucketed.now = c.limit, c.scrapes, c.now
+		u.collections[n] = rebucketed
+		u.invalidate()
+		return declRebucketed, nil
+	}
+	if n == "" {
+		return "", errors.New("a declaration requires a name")
+	}
+	if !validMetricName(string(n)) {
+		return "", fmt.Errorf("invalid metric name %q", n)
+	}
+	c, err := newTimeseriesCollection(o)
+	if err != nil {
+		return "", errors.Wrapf(err, "error declaring %s", n)
+	}
+	u.insertCollection(n, c)
+	return declCreated, nil
+}
+
+// declarations are the contents of the declfile and the declarations in the
+// config file, which can be reloaded into a running universe.
+type declarations struct {
+	declfile string
+	config   string
+
+	mtx   sync.Mutex
+	decls []observation
+}
+
+// read returns the declarations in the config file, if any, followed by
+// those in the declfile, if any.
+func (d *declarations) read() ([]observation, error) {
+	var decls []observation
+	if d.config != "" {
+		c, err := readConfig(d.config)
+		if err != nil {
+			return nil, err
+		}
+		decls = append(decls, c.Declarations...)
+	}
+	if d.declfile != "" {
+		fromfile, err := readDeclfile(d.declfile)
+		if err != nil {
+			return nil, err
+		}
+		decls = append(decls, fromfile...)
+	}
+	return decls, nil
+}
+
+func readDeclfile(filename string) ([]observation, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var decls []observation
+	if err := json.Unmarshal(buf, &decls); err != nil {
+		return nil, errors.Wrapf(err, "error parsing %s", filename)
+	}
+	return decls, nil
+}
+
+// reload re-reads the declarations and merges any new ones into the
+// universe. Accumulated state is preserved: existing metrics are untouched,
+// and values in the declarations are not observed a second time. Histograms
+// with new buckets are the exception; they're reset, and returned.
+func (d *declarations) reload(u *universe) (added int, rebucketed []string, err error) {
+	decls, err := d.read()
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, o := range decls {
+		status, err := u.declare(o)
+		if err != nil {
+			return added, rebucketed, err
+		}
+		switch status {
+		case declCreated:
+			added++
+		case declRebucketed:
+			rebucketed = append(rebucketed, o.Name)
+		}
+	}
+	d.mtx.Lock()
+	d.decls = decls
+	d.mtx.Unlock()
+	return added, rebucketed, nil
+}
+
+// current returns the declarations as of the most recent read.
+func (d *declarations) current() []observation {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.decls
+}
+
+// ServeHTTP renders the current declarations as JSON.
+func (d *declarations) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, d.current())
+}
+
+// reloadHandler triggers the reload function on a POST with admin
+// credentials.
+// The reload function is told who asked for it, as requester has it.
+func reloadHandler(admin *httpAuth, reload func(who string) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !admin.allow(r, roleAdmin) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err := reload(requester(r, admin)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "decls.json")
+	writeFile(t, filename, `[
+		{"name":"foo_total","type":"counter","help":"Total number of foos."}
+	]`)
+
+	decls := &declarations{declfile: filename}
+	initial, err := decls.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decls.decls = initial
+	u, _ := newUniverse(initial...)
+	loadObservations(t, u, makeObservations(t, []string{
+		`foo_total{} 3`,
+	}))
+
+	writeFile(t, filename, `[
+		{"name":"foo_total","type":"counter","help":"Total number of foos."},
+		{"name":"bar_size","type":"gauge","help":"Current size of bar.","value":100}
+	]`)
+	added, rebucketed, err := decls.reload(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 1, added; want != have {
+		t.Errorf("added: want %d, have %d", want, have)
+	}
+	if want, have := 0, len(rebucketed); want != have {
+		t.Errorf("rebucketed: want %d, have %d", want, have)
+	}
+	loadObservations(t, u, makeObservations(t, []string{
+		`foo_total{} 1`,
+		`bar_size{} 5`,
+	}))
+	if want, have := normalizeResponse(`
+		# HELP bar_size Current size of bar.
+		# TYPE bar_size gauge
+		bar_size{} 5
+
+		# HELP foo_total Total number of foos.
+		# TYPE foo_total counter
+		foo_total{} 4
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestReloadHandler(t *testing.T) {
+	var reloads int
+	admin := &httpAuth{}
+	admin.addToken("s3cr3t", roleAdmin)
+	admin.addToken("prometheus", roleScrape)
+	h := reloadHandler(admin, func(string) error { reloads++; return nil })
+	for _, testcase := range []struct {
+		method string
+		auth   string
+		code   int
+	}{
+		{"GET", "Bearer s3cr3t", http.StatusMethodNotAllowed},
+		{"POST", "", http.StatusUnauthorized},
+		{"POST", "Bearer wrong", http.StatusUnauthorized},
+		{"POST", "Bearer prometheus", http.StatusUnauthorized},
+		{"POST", "s3cr3t", http.StatusUnauthorized},
+		{"POST", "Bearer s3cr3t", http.StatusNoContent},
+	} {
+		req := httptest.NewRequest(testcase.method, "/-/reload", nil)
+		if testcase.auth != "" {
+			req.Header.Set("Authorization", testcase.auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if want, have := testcase.code, rec.Code; want != have {
+			t.Errorf("%s %q: want %d, have %d", testcase.method, testcase.auth, want, have)
+		}
+	}
+	if want, have := 1, reloads; want != have {
+		t.Errorf("reloads: want %d, have %d", want, have)
+	}
+
+	var none *httpAuth
+	rec := httptest.NewRecorder()
+	reloadHandler(none, func(string) error { reloads++; return nil }).ServeHTTP(rec, httptest.NewRequest("POST", "/-/reload", nil))
+	if want, have := http.StatusUnauthorized, rec.Code; want != have {
+		t.Errorf("without admin credentials: want %d, have %d", want, have)
+	}
+}
+
+func writeFile(t *testing.T, filename, contents string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filename, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
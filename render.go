@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"runtime"
+	"strconv"
+)
+
+// renderWorkers returns how many collections to render concurrently.
+func renderWorkers(collections int) int {
+	n := runtime.GOMAXPROCS(0)
+	if n > collections {
+		n = collections
+	}
+	return n
+}
+
+// renderedCollection is a collection rendered by writeTextParallel.
+type renderedCollection struct {
+	buf    *bytes.Buffer
+	series int
+}
+
+// writeTextParallel is writeText with collections rendered by a number of
+// workers. Each collection is rendered into its own buffer, and the buffers
+// are written to w in order. Workers only run a little ahead of the writes,
+// so a slow scraper doesn't cause the whole universe to be buffered.
+func writeTextParallel(w io.Writer, names []metricName, collections []*timeseriesCollection, workers, precision int) (series int, err error) {
+	var (
+		results = make([]chan renderedCollection, len(names))
+		jobs    = make(chan int)
+		window  = make(chan struct{}, 2*workers) // rendered but not yet written
+		done    = make(chan struct{})
+	)
+	defer close(done)
+	for i := range results {
+		results[i] = make(chan renderedCollection, 1)
+	}
+	go func() {
+		defer close(jobs)
+		for i := range names {
+			select {
+			case window <- struct{}{}:
+			case <-done:
+				return
+			}
+			jobs <- i
+		}
+	}()
+	for j := 0; j < workers; j++ {
+		go func() {
+			for i := range jobs {
+				buf := renderBufPool.Get().(*bytes.Buffer)
+				buf.Reset()
+				n := collections[i].writeText(buf, names[i], precision)
+				results[i] <- renderedCollection{buf: buf, series: n}
+			}
+		}()
+	}
+
+	for i := range names {
+		r := <-results[i]
+		<-window
+		series += r.series
+		if r.buf.Len() > 0 {
+			_, err = w.Write(r.buf.Bytes())
+		}
+		renderBufPool.Put(r.buf)
+		if err != nil {
+			return series, err
+		}
+	}
+	return series, nil
+}
+
+// The append functions render samples in the text format, without the
+// overhead of fmt, as formatting dominates the CPU cost of scrapes.
+
+// appendSample appends e.g. `foo_sum{code="200"} 1.5`, with the value
+// formatted by appendValue.
+func appendSample(b []byte, name, suffix string, labels labelPairs, value float64, precision int) []byte {
+	b = append(b, name...)
+	b = append(b, suffix...)
+	b = labels.appendText(b)
+	b = append(b, ' ')
+	b = appendValue(b, value, precision)
+	return append(b, '\n')
+}
+
+// shortestPrecision formats values as client_golang does.
+const shortestPrecision = -1
+
+// appendValue appends a sample value. With shortestPrecision, that's the
+// shortest representation that round-trips, e.g. 5, 0.25, or 1e-09.
+// Otherwise, it's a fixed number of decimal places, like %.6f, which is
+// easier on the eyes, but bigger, and lossy.
+func appendValue(b []byte, value float64, precision int) []byte {
+	if precision < 0 {
+		return strconv.AppendFloat(b, value, 'g', -1, 64)
+	}
+	return strconv.AppendFloat(b, value, 'f', precision, 64)
+}
+
+// appendCount appends e.g. `foo_count{code="200"} 3`.
+func appendCount(b []byte, name, suffix string, labels labelPairs, count uint64) []byte {
+	b = append(b, name...)
+	b = append(b, suffix...)
+	b = labels.appendText(b)
+	b = append(b, ' ')
+	b = strconv.AppendUint(b, count, 10)
+	return append(b, '\n')
+}
+
+// appendBucket appends e.g. `foo_bucket{code="200",le="0.5"} 3`.
+func appendBucket(b []byte, name string, labels labelPairs, le []byte, count uint64) []byte {
+	b = append(b, name...)
+	b = append(b, "_bucket"...)
+	b = labels.appendTextWithLE(b, le)
+	b = append(b, ' ')
+	b = strconv.AppendUint(b, count, 10)
+	return append(b, '\n')
+}
+
+var infLE = []byte("+Inf")
+
+// appendLE appends a bucket bound as the value of an le label, formatted
+// exactly as client_golang does, so that buckets line up with those of
+// histograms instrumented directly: the shortest representation that
+// round-trips, with exponents for very small and very large bounds, e.g.
+// 1e-05, and no trailing zeros, e.g. 1 rather than 1.0.
+func appendLE(b []byte, f float64) []byte {
+	switch {
+	case f == 0:
+		return append(b, '0') // including -0
+	case math.IsInf(f, +1):
+		return append(b, infLE...)
+	case math.IsInf(f, -1):
+		return append(b, "-Inf"...)
+	default:
+		return strconv.AppendFloat(b, f, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"testing"
+)
+
+func TestWriteTextParallel(t *testing.T) {
+	u, _ := newUniverse()
+	for i := 0; i < 100; i++ {
+		loadObservations(t, u, makeObservations(t, []string{
+			fmt.Sprintf(`{"name":"foo_%03d","type":"counter","help":"Foo %d."}`, i, i),
+			fmt.Sprintf(`foo_%03d{code="200"} %d`, i, i),
+			fmt.Sprintf(`foo_%03d{code="404"} %d`, i, i),
+		}))
+	}
+	names, collections := u.sortedCollections()
+
+	var want bytes.Buffer
+	for i, n := range names {
+		collections[i].writeText(&want, n, shortestPrecision)
+	}
+	for _, workers := range []int{2, 4, 16} {
+		var have bytes.Buffer
+		series, err := writeTextParallel(&have, names, collections, workers, shortestPrecision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, have := 200, series; want != have {
+			t.Errorf("%d workers: series: want %d, have %d", workers, want, have)
+		}
+		if want, have := want.String(), have.String(); want != have {
+			t.Errorf("%d workers: output differs\n---WANT---\n%s\n---HAVE---\n%s", workers, want, have)
+		}
+
+		w := &failingWriter{after: 10}
+		if _, err := writeTextParallel(w, names, collections, workers, shortestPrecision); err == nil {
+			t.Errorf("%d workers: want error, have none", workers)
+		}
+		if want, have := 11, w.writes; want != have {
+			t.Errorf("%d workers: writes: want %d, have %d", workers, want, have)
+		}
+	}
+}
+
+func TestAppendSample(t *testing.T) {
+	labels := makeLabelPairs(map[string]string{"code": "200", "method": "GET"})
+	for _, v := range []float64{0, 1, -1.5, 0.1234567, 1e21, 1e-7, math.Inf(+1), math.Inf(-1), math.NaN()} {
+		if want, have := fmt.Sprintf("foo_sum%s %f\n", renderLabels(labels.toMap()), v), string(appendSample(nil, "foo", "_sum", labels, v, 6)); want != have {
+			t.Errorf("%v: want %q, have %q", v, want, have)
+		}
+	}
+	for v, want := range map[float64]string{
+		0:            "0",
+		5:            "5",
+		-1.5:         "-1.5",
+		0.1234567:    "0.1234567",
+		1e-7:         "1e-07",
+		1e21:         "1e+21",
+		math.Inf(+1): "+Inf",
+		math.Inf(-1): "-Inf",
+	} {
+		if have := string(appendValue(nil, v, shortestPrecision)); want != have {
+			t.Errorf("%v: want %q, have %q", v, want, have)
+		}
+	}
+	if want, have := "NaN", string(appendValue(nil, math.NaN(), shortestPrecision)); want != have {
+		t.Errorf("NaN: want %q, have %q", want, have)
+	}
+	for _, max := range []float64{0.005, 1, 2.5, 1e6, 1e21} {
+		le := []byte(fmt.Sprint(max))
+		if want, have := fmt.Sprintf("foo_bucket{code=\"200\",le=\"%v\",method=\"GET\"} 7\n", max), string(appendBucket(nil, "foo", labels, le, 7)); want != have {
+			t.Errorf("%v: want %q, have %q", max, want, have)
+		}
+	}
+}
+
+func BenchmarkWriteText(b *testing.B) {
+	u, _ := newUniverse(
+		observation{Name: "foo_total", Type: "counter", Help: "Total foos."},
+		observation{Name: "bar_seconds", Type: "histogram", Help: "Bar duration.", Buckets: []float64{0.01, 0.1, 1, 10}},
+	)
+	var obs []observation
+	for i := 0; i < 1000; i++ {
+		v := float64(i)
+		labels := map[string]string{"code": fmt.Sprint(200 + i%5), "instance": fmt.Sprint(i)}
+		obs = append(obs, observation{Name: "foo_total", Labels: labels, Value: &v})
+		obs = append(obs, observation{Name: "bar_seconds", Labels: labels, Value: &v})
+	}
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		// Touch every series, so nothing comes from the render cache.
+		b.StopTimer()
+		u.observeBatch(obs)
+		b.StartTimer()
+		u.writeText(ioutil.Discard)
+	}
+}
+
+func TestAppendLE(t *testing.T) {
+	for f, want := range map[float64]string{
+		0:                    "0",
+		math.Copysign(0, -1): "0",
+		1:                    "1",
+		-1:                   "-1",
+		0.5:                  "0.5",
+		0.00001:              "1e-05",
+		0.0001:               "0.0001",
+		100:                  "100",
+		2.5:                  "2.5",
+		1e21:                 "1e+21",
+		123456789:            "1.23456789e+08",
+		math.Inf(+1):         "+Inf",
+		math.Inf(-1):         "-Inf",
+	} {
+		if have := string(appendLE(nil, f)); want != have {
+			t.Errorf("%v: want %s, have %s", f, want, have)
+		}
+	}
+}
+
+func TestHistogramBucketDeclarations(t *testing.T) {
+	u, err := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_seconds","type":"histogram","help":"Foo.","buckets":[1e-5,1.0,100]}`,
+	})...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An explicit +Inf bucket is redundant, and would be rendered twice.
+	if _, err := u.declare(observation{Name: "bar_seconds", Type: "histogram", Help: "Bar.", Buckets: []float64{1, math.Inf(+1)}}); err != nil {
+		t.Fatal(err)
+	}
+	loadObservations(t, u, makeObservations(t, []string{
+		`foo_seconds{} 0.5`,
+		`bar_seconds{} 2`,
+	}))
+	if want, have := normalizeResponse(`
+		# HELP bar_seconds Bar.
+		# TYPE bar_seconds histogram
+		bar_seconds_bucket{le="1"} 0
+		bar_seconds_bucket{le="+Inf"} 1
+		bar_seconds_sum{} 2
+		bar_seconds_count{} 1
+
+		# HELP foo_seconds Foo.
+		# TYPE foo_seconds histogram
+		foo_seconds_bucket{le="1e-05"} 0
+		foo_seconds_bucket{le="1"} 1
+		foo_seconds_bucket{le="100"} 1
+		foo_seconds_bucket{le="+Inf"} 1
+		foo_seconds_sum{} 0.5
+		foo_seconds_count{} 1
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+
+	for _, buckets := range [][]float64{{1, 2, 1}, {math.NaN()}} {
+		if _, err := u.declare(observation{Name: "baz_seconds", Type: "histogram", Help: "Baz.", Buckets: buckets}); err == nil {
+			t.Errorf("%v: want error, have none", buckets)
+		}
+	}
+}
+
+func TestHistogramRenderCache(t *testing.T) {
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_seconds","type":"histogram","help":"Foo.","buckets":[1]}`,
+		`foo_seconds{} 0.5`,
+	})...)
+	scrape(t, u) // fills the cache
+
+	// A merge of no observations doesn't change the count, but still
+	// changes the sum, which must not come from the cache.
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"foo_seconds","op":"merge","value":2,"counts":[0,0]}`,
+	}))
+	if want, have := normalizeResponse(`
+		# HELP foo_seconds Foo.
+		# TYPE foo_seconds histogram
+		foo_seconds_bucket{le="1"} 1
+		foo_seconds_bucket{le="+Inf"} 1
+		foo_seconds_sum{} 2.5
+		foo_seconds_count{} 1
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Errorf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestHistogramRedeclaration(t *testing.T) {
+	u, err := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_seconds","type":"histogram","help":"Foo.","buckets":[1,10]}`,
+	})...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadObservations(t, u, makeObservations(t, []string{
+		`foo_seconds{} 5`,
+	}))
+
+	// Lines can't change the buckets, but can repeat them, in any order.
+	for line, ok := range map[string]bool{
+		`{"name":"foo_seconds","buckets":[10,1],"value":5}`:   true,
+		`{"name":"foo_seconds","buckets":[1,5,10],"value":5}`: false,
+	} {
+		if want, have := ok, u.observe(makeObservations(t, []string{line})[0]) == nil; want != have {
+			t.Errorf("%s: want ok %v, have %v", line, want, have)
+		}
+	}
+
+	for _, testcase := range []struct {
+		buckets string
+		want    string
+	}{
+		{"[1,10]", declExists},
+		{"[1,5,10]", declRebucketed},
+	} {
+		buckets, want := testcase.buckets, testcase.want
+		var o observation
+		if err := json.Unmarshal([]byte(`{"name":"foo_seconds","type":"histogram","buckets":`+buckets+`}`), &o); err != nil {
+			t.Fatal(err)
+		}
+		have, err := u.declare(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want != have {
+			t.Errorf("%s: want %s, have %s", buckets, want, have)
+		}
+	}
+
+	// Rebucketing resets the series, but keeps the declared help.
+	loadObservations(t, u, makeObservations(t, []string{
+		`foo_seconds{} 2`,
+	}))
+	if want, have := normalizeResponse(`
+		# HELP foo_seconds Foo.
+		# TYPE foo_seconds histogram
+		foo_seconds_bucket{le="1"} 0
+		foo_seconds_bucket{le="5"} 1
+		foo_seconds_bucket{le="10"} 1
+		foo_seconds_bucket{le="+Inf"} 1
+		foo_seconds_sum{} 2
+		foo_seconds_count{} 1
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runReplay is the replay subcommand, which writes the lines of a recording
+// to an aggregator's socket, at the pace they were recorded, or faster, to
+// reproduce production's ingest in staging, e.g.
+//
+//	prometheus-aggregator replay -socket tcp://staging:8191 -speed 10 recording.txt
+//
+// Each line of the recording may start with the time it was received, in
+// Unix seconds, or RFC 3339, and a space, as `ts '%.s'` writes them. Lines
+// without a time are written right after the line before them. Unlike send,
+// lines aren't parsed, since the bad ones are part of what's reproduced.
+func runReplay(args []string, stdin io.Reader, stderr io.Writer) error {
+	fs := flag.NewFlagSet("prometheus-aggregator replay", flag.ExitOnError)
+	sock := newSocketFlags(fs)
+	var (
+		speed = fs.Float64("speed", 1, "multiple of the recorded pace to replay at (0 is as fast as possible)")
+		loop  = fs.Bool("loop", false, "replay the recordings over and over, until interrupted")
+	)
+	fs.Usage = usageFor(fs, "prometheus-aggregator replay [flags] [recording ...]")
+	fs.Parse(args)
+	if *speed < 0 {
+		return fmt.Errorf("-speed must not be negative")
+	}
+	files := fs.Args()
+	if len(files) == 0 {
+		if *loop {
+			return fmt.Errorf("-loop requires recording files; stdin can't be replayed again")
+		}
+		files = []string{"-"}
+	}
+
+	w, err := sock.dial()
+	if err != nil {
+		return err
+	}
+	r := &replayer{w: w, speed: *speed, sleep: time.Sleep, now: time.Now}
+	begin := time.Now()
+	for {
+		for _, file := range files {
+			if err := r.replayFile(file, stdin); err != nil {
+				w.close()
+				return err
+			}
+		}
+		if !*loop {
+			break
+		}
+	}
+	if err := w.close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(stderr, "replayed %d lines in %s\n", r.lines, time.Since(begin).Round(time.Millisecond))
+	return nil
+}
+
+// replayer writes lines, sleeping between them, so the gaps between their
+// times are kept, divided by the speed.
+type replayer struct {
+	w     *socketWriter
+	speed float64
+	sleep func(time.Duration)
+	now   func() time.Time
+
+	lines     int
+	first     time.Time // of the recording
+	firstWall time.Time // when it was replayed
+}
+
+func (r *replayer) replayFile(file string, stdin io.Reader) error {
+	in := stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	r.first = time.Time{} // every recording starts now
+	s := bufio.NewScanner(in)
+	s.Buffer(make([]byte, bufio.MaxScanTokenSize), 1<<20)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		at, line, err := splitReplayTime(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+		if line == "" {
+			continue
+		}
+		if !at.IsZero() {
+			if err := r.wait(at); err != nil {
+				return err
+			}
+		}
+		if err := r.w.writeLine(line); err != nil {
+			return err
+		}
+		r.lines++
+	}
+	return s.Err()
+}
+
+// wait flushes what's been written, and sleeps until it's time for a line
+// recorded at the time.
+func (r *replayer) wait(at time.Time) error {
+	if r.first.IsZero() {
+		r.first, r.firstWall = at, r.now()
+		return nil
+	}
+	if r.speed == 0 {
+		return nil
+	}
+	due := r.firstWall.Add(time.Duration(float64(at.Sub(r.first)) / r.speed))
+	d := due.Sub(r.now())
+	if d <= 0 {
+		return nil // behind, or recorded out of order; catch up
+	}
+	if err := r.w.flush(); err != nil {
+		return err
+	}
+	r.sleep(d)
+	return nil
+}
+
+// splitReplayTime splits the time a line was recorded, if it has one, from
+// the line. Neither a metric name nor a JSON line starts with a digit, so if
+// the line does, it's a time.
+func splitReplayTime(line string) (time.Time, string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] < '0' || line[0] > '9' {
+		return time.Time{}, line, nil
+	}
+	i := strings.IndexAny(line, " \t")
+	if i < 0 {
+		return time.Time{}, "", fmt.Errorf("a time, but no line")
+	}
+	field, rest := line[:i], strings.TrimSpace(line[i+1:])
+	if f, err := strconv.ParseFloat(field, 64); err == nil {
+		sec := int64(f)
+		return time.Unix(sec, int64((f-float64(sec))*1e9)), rest, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, field)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("bad time %q: want Unix seconds, or RFC 3339", field)
+	}
+	return t, rest, nil
+}
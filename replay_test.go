@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSplitReplayTime(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		at   time.Time
+		line string
+		err  bool
+	}{
+		{in: `foo_total{} 1`, line: `foo_total{} 1`},
+		{in: `{"name":"foo_total","value":1}`, line: `{"name":"foo_total","value":1}`},
+		{in: `1700000000.25 foo_total{} 1`, at: time.Unix(1700000000, 250000000), line: `foo_total{} 1`},
+		{in: "1700000000\tfoo_total{} 1", at: time.Unix(1700000000, 0), line: `foo_total{} 1`},
+		{in: `2023-11-14T22:13:20.5Z foo_total{} 1`, at: time.Unix(1700000000, 500000000), line: `foo_total{} 1`},
+		{in: `  `, line: ``},
+		{in: `1700000000`, err: true},
+		{in: `17:00 foo_total{} 1`, err: true},
+	} {
+		at, line, err := splitReplayTime(tc.in)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: want error, have none", tc.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.in, err)
+			continue
+		}
+		if !tc.at.Equal(at) {
+			t.Errorf("%q: want %s, have %s", tc.in, tc.at, at)
+		}
+		if want, have := tc.line, line; want != have {
+			t.Errorf("%q: want %q, have %q", tc.in, want, have)
+		}
+	}
+}
+
+func TestReplayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "recording.txt")
+	if err := ioutil.WriteFile(file, []byte(strings.Join([]string{
+		`1700000000.0 foo_total{} 1`,
+		`bar_total{} 1`,
+		`1700000002.0 foo_total{} 2`,
+		`1700000001.0 foo_total{} 3`, // out of order; right away
+		`1700000010.0 not a line`,
+		``,
+	}, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	fs := newSocketFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+	*fs.addr = "tcp://" + ln.Addr().String()
+	*fs.token = "s3cr3t"
+	w, err := fs.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		now    = time.Unix(0, 0)
+		slept  []time.Duration
+		writes []int // lines written when each sleep started
+		r      *replayer
+	)
+	r = &replayer{w: w, speed: 2, now: func() time.Time { return now }}
+	r.sleep = func(d time.Duration) {
+		slept = append(slept, d)
+		writes = append(writes, r.lines)
+		now = now.Add(d)
+	}
+	if err := r.replayFile(file, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []time.Duration{time.Second, 4 * time.Second}, slept; !cmp.Equal(want, have) {
+		t.Errorf("slept: want %v, have %v", want, have)
+	}
+	if want, have := []int{2, 4}, writes; !cmp.Equal(want, have) {
+		t.Errorf("written before sleeping: want %v, have %v", want, have)
+	}
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	s := bufio.NewScanner(conn)
+	var lines []string
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	if want, have := strings.Join([]string{
+		`AUTH s3cr3t`,
+		`foo_total{} 1`,
+		`bar_total{} 1`,
+		`foo_total{} 2`,
+		`foo_total{} 3`,
+		`not a line`,
+	}, "\n"), strings.Join(lines, "\n"); want != have {
+		t.Errorf("want\n%s\nhave\n%s", want, have)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// How long a stream waits, before redialing an unreachable aggregator, and
+// for a write to it to complete.
+const (
+	peerRedialDelay  = time.Second
+	peerWriteTimeout = 10 * time.Second
+	peerReadBuffer   = 1 << 20 // longer than any record from a line
+)
+
+// replicator is an observer which streams the observations the next
+// observer accepts to a peer aggregator, which observes them too, so a pair
+// of aggregators, each streaming to the other, track the same state, and
+// Prometheus can scrape either. The peer's stream is received by a
+// peerListener, which observes it with the next observer, so it's not
+// streamed back.
+type replicator struct {
+	next     observer
+	stream   *peerStream   // nil only receives
+	listener *peerListener // nil only streams
+}
+
+func (r *replicator) observe(o observation) error {
+	return r.observeBatch([]observation{o})
+}
+
+// observeBatch observes the batch with the next observer, and streams the
+// observations it accepted to the peer.
+func (r *replicator) observeBatch(obs []observation) error {
+	err := r.next.observeBatch(obs)
+	r.stream.send(obs, err)
+	return err
+}
+
+// renderTelemetry writes the replication counters, in the Prometheus text
+// format.
+func (r *replicator) renderTelemetry(w io.Writer) {
+	if r == nil {
+		return
+	}
+	if s := r.stream; s != nil {
+		fmt.Fprintf(w, "# HELP prometheus_aggregator_peer_connected Whether observations are being streamed to the peer.\n")
+		fmt.Fprintf(w, "# TYPE prometheus_aggregator_peer_connected gauge\n")
+		fmt.Fprintf(w, "prometheus_aggregator_peer_connected %d\n\n", atomic.LoadInt32(&s.connected))
+		fmt.Fprintf(w, "# HELP prometheus_aggregator_peer_sent_observations_total Observations streamed to the peer.\n")
+		fmt.Fprintf(w, "# TYPE prometheus_aggregator_peer_sent_observations_total counter\n")
+		fmt.Fprintf(w, "prometheus_aggregator_peer_sent_observations_total %d\n\n", atomic.LoadUint64(&s.sent))
+		fmt.Fprintf(w, "# HELP prometheus_aggregator_peer_dropped_observations_total Observations which never made it to the peer.\n")
+		fmt.Fprintf(w, "# TYPE prometheus_aggregator_peer_dropped_observations_total counter\n")
+		fmt.Fprintf(w, "prometheus_aggregator_peer_dropped_observations_total %d\n\n", atomic.LoadUint64(&s.dropped))
+	}
+	if l := r.listener; l != nil {
+		fmt.Fprintf(w, "# HELP prometheus_aggregator_peer_received_observations_total Observations received from the peer.\n")
+		fmt.Fprintf(w, "# TYPE prometheus_aggregator_peer_received_observations_total counter\n")
+		fmt.Fprintf(w, "prometheus_aggregator_peer_received_observations_total %d\n\n", atomic.LoadUint64(&l.received))
+	}
+}
+
+// peerStream streams observations to another aggregator, as records, one
+// per line, after an AUTH line, if there's a token. While the aggregator is
+// unreachable, batches are buffered, up to a point, after which they're
+// dropped, and counted. A nil peerStream streams nothing.
+type peerStream struct {
+	sent      uint64 // atomic; first, for alignment
+	dropped   uint64 // atomic
+	connected int32  // atomic; 1 while connected
+
+	network, addr string
+	token         string
+	logger        log.Logger
+	queue         chan peerBatch
+}
+
+// peerBatch is a batch of encoded records, waiting to be streamed.
+type peerBatch struct {
+	buf []byte
+	n   int
+}
+
+// newPeerStream returns a stream to the address, which buffers up to buffer
+// batches.
+func newPeerStream(network, addr, token string, buffer int, logger log.Logger) *peerStream {
+	return &peerStream{
+		network: network,
+		addr:    addr,
+		token:   token,
+		logger:  log.With(logger, "peer", addr),
+		queue:   make(chan peerBatch, buffer),
+	}
+}
+
+// send queues the observations in the batch which weren't rejected, per
+// err, to be streamed.
+func (s *peerStream) send(obs []observation, err error) {
+	if s == nil {
+		return
+	}
+	var buf bytes.Buffer
+	n, eerr := encodeRecords(&buf, obs, err)
+	if eerr != nil {
+		level.Warn(s.logger).Log("during", "stream", "err", eerr)
+	}
+	if n == 0 {
+		return
+	}
+	select {
+	case s.queue <- peerBatch{buf: buf.Bytes(), n: n}:
+	default:
+		atomic.AddUint64(&s.dropped, uint64(n))
+	}
+}
+
+// run streams queued batches, redialing whenever the connection fails, until
+// the context is canceled. A batch which fails to be written is dropped,
+// since the other end may have received part of it. Batches queued when the
+// context is canceled are written, if they can be, quickly.
+func (s *peerStream) run(ctx context.Context) error {
+	var (
+		dialer net.Dialer
+		failed bool // log the other end going away, and coming back, but not every redial
+	)
+	for {
+		conn, err := dialer.DialContext(ctx, s.network, s.addr)
+		if err == nil {
+			if failed {
+				level.Info(s.logger).Log("connected", true)
+			}
+			failed = false
+			atomic.StoreInt32(&s.connected, 1)
+			err = s.stream(ctx, conn)
+			atomic.StoreInt32(&s.connected, 0)
+			conn.Close()
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !failed {
+			level.Warn(s.logger).Log("err", err)
+			failed = true
+		}
+		select {
+		case <-time.After(peerRedialDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *peerStream) stream(ctx context.Context, conn net.Conn) error {
+	if s.token != "" {
+		conn.SetWriteDeadline(time.Now().Add(peerWriteTimeout))
+		if _, err := fmt.Fprintf(conn, "AUTH %s\n", s.token); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case b := <-s.queue:
+			if err := s.write(conn, b, time.Now().Add(peerWriteTimeout)); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			deadline := time.Now().Add(time.Second)
+			for {
+				select {
+				case b := <-s.queue:
+					if err := s.write(conn, b, deadline); err != nil {
+						return err
+					}
+				default:
+					return ctx.Err()
+				}
+			}
+		}
+	}
+}
+
+func (s *peerStream) write(conn net.Conn, b peerBatch, deadline time.Time) error {
+	conn.SetWriteDeadline(deadline)
+	if _, err := conn.Write(b.buf); err != nil {
+		atomic.AddUint64(&s.dropped, uint64(b.n))
+		return err
+	}
+	atomic.AddUint64(&s.sent, uint64(b.n))
+	return nil
+}
+
+// peerListener accepts streams from other aggregators, and observes their
+// records with the next observer.
+type peerListener struct {
+	received uint64 // atomic; first, for alignment
+
+	next   observer
+	tokens *socketTokens // nil doesn't authenticate
+	logger log.Logger
+}
+
+// newPeerListener returns a listener which requires the token, if it isn't
+// empty.
+func newPeerListener(token string, next observer, logger log.Logger) *peerListener {
+	tokens, _ := newSocketTokens("", token) // without a file, there's no error
+	return &peerListener{next: next, tokens: tokens, logger: logger}
+}
+
+// serve accepts streams on the listener, until it's closed.
+func (l *peerListener) serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go l.receive(conn, conn.RemoteAddr().String())
+	}
+}
+
+// receive observes the records in the stream. Records which can't be
+// parsed, or are rejected, e.g. because the other end's declarations differ,
+// are logged, and skipped.
+func (l *peerListener) receive(rc io.ReadCloser, addr string) {
+	defer rc.Close()
+	logger := log.With(l.logger, "peer", addr)
+	br := bufio.NewReaderSize(rc, peerReadBuffer)
+	if l.tokens != nil {
+		if err := authenticate(br, l.tokens); err != nil {
+			level.Warn(logger).Log("auth", "failed", "err", err)
+			return
+		}
+	}
+	for {
+		line, err := readLine(br)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			level.Warn(logger).Log("during", "receive", "err", err)
+			return
+		}
+		o, err := decodeRecord(line)
+		if err == nil {
+			err = l.next.observe(o)
+		}
+		if err != nil {
+			level.Warn(logger).Log("during", "receive", "name", o.Name, "err", err)
+			continue
+		}
+		atomic.AddUint64(&l.received, 1)
+	}
+}
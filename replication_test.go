@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestReplication(t *testing.T) {
+	decls := []string{
+		`{"name":"foo_total","type":"counter","help":"Foo."}`,
+		`{"name":"bar_seconds","type":"histogram","help":"Bar.","buckets":[0.1,1]}`,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	newPeer := func(token string) (*universe, *replicator, net.Listener) {
+		u, _ := newUniverse(makeObservations(t, decls)...)
+		r := &replicator{next: u, listener: newPeerListener(token, u, log.NewNopLogger())}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go r.listener.serve(ln)
+		return u, r, ln
+	}
+	streamTo := func(r *replicator, ln net.Listener, token string) {
+		r.stream = newPeerStream("tcp", ln.Addr().String(), token, 16, log.NewNopLogger())
+		go r.stream.run(ctx)
+	}
+
+	// Each of the pair streams to the other.
+	ua, ra, lna := newPeer("s3cr3t")
+	defer lna.Close()
+	ub, rb, lnb := newPeer("s3cr3t")
+	defer lnb.Close()
+	streamTo(ra, lnb, "s3cr3t")
+	streamTo(rb, lna, "s3cr3t")
+
+	for _, line := range []string{
+		`foo_total{code="200"} 1`,
+		`bar_seconds{} 0.5`,
+		`nope_total{} 1`, // rejected, so not streamed
+	} {
+		o, _ := parseLine([]byte(line))
+		ra.observe(o)
+	}
+	o, _ := parseLine([]byte(`foo_total{code="200"} 2`))
+	rb.observe(o)
+
+	want := `foo_total{code="200"} 3`
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if strings.Contains(scrape(t, ua), want) && strings.Contains(scrape(t, ub), want) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if want, have := scrape(t, ua), scrape(t, ub); want != have {
+		t.Errorf("\n---A---\n%s\n\n---B---\n%s\n", want, have)
+	}
+	if have := scrape(t, ua); !strings.Contains(have, want) {
+		t.Errorf("want %s, have\n%s", want, have)
+	}
+	if have := scrape(t, ua); !strings.Contains(have, `bar_seconds_count{} 1`) {
+		t.Errorf("want bar_seconds_count{} 1, have\n%s", have)
+	}
+
+	// A peer without the token is ignored.
+	uc, rc, lnc := newPeer("wrong")
+	defer lnc.Close()
+	streamTo(rc, lna, "wrong")
+	o, _ = parseLine([]byte(`foo_total{code="500"} 1`))
+	rc.observe(o)
+	time.Sleep(100 * time.Millisecond)
+	if have := scrape(t, ua); strings.Contains(have, `code="500"`) {
+		t.Errorf("without the token, want nothing replicated, have\n%s", have)
+	}
+	if have := scrape(t, uc); !strings.Contains(have, `foo_total{code="500"} 1`) {
+		t.Errorf("want the peer's own observation, have\n%s", have)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Rollup ops.
+const (
+	rollupSum = "sum" // the default
+	rollupAvg = "avg" // only for gauges
+)
+
+// rollupRule is one of the rollups in the config file, which are metrics
+// like PromQL's sum without (...) of another metric, kept up to date as it's
+// observed, rather than computed at scrape time. A rollup of a counter or
+// histogram is the same type, and every observation of the metric is also
+// observed into the series of the rollup with the same labels, once those
+// in without are dropped. A rollup of a gauge is a gauge, which is set to
+// the sum, or the mean, of the gauges with those labels. Rollups of rollups
+// aren't kept up to date.
+type rollupRule struct {
+	Metric  string   `yaml:"metric"`
+	Name    string   `yaml:"name"`
+	Without []string `yaml:"without"`
+	Op      string   `yaml:"op"`
+}
+
+// check returns an error if the rule isn't valid.
+func (r rollupRule) check() error {
+	switch {
+	case !validMetricName(r.Metric):
+		return fmt.Errorf("invalid metric %q", r.Metric)
+	case !validMetricName(r.Name) || r.Name == r.Metric:
+		return fmt.Errorf("%s has invalid rollup name %q", r.Metric, r.Name)
+	case len(r.Without) == 0:
+		return fmt.Errorf("%s requires without, the labels to drop", r.Name)
+	case r.Op != "" && r.Op != rollupSum && r.Op != rollupAvg:
+		return fmt.Errorf("%s has invalid op %q, not sum or avg", r.Name, r.Op)
+	}
+	for _, l := range r.Without {
+		if !validLabelName(l) {
+			return fmt.Errorf("%s has invalid without label %q", r.Name, l)
+		}
+	}
+	return nil
+}
+
+// labels returns the labels of the rollup series of the labels.
+func (r rollupRule) labels(labels map[string]string) map[string]string {
+	rolled := make(map[string]string, len(labels))
+	for k, v := range labels {
+		rolled[k] = v
+	}
+	for _, l := range r.Without {
+		delete(rolled, l)
+	}
+	return rolled
+}
+
+// help returns the help of the rollup of a metric with the help.
+func (r rollupRule) help(help string) string {
+	op := r.Op
+	if op == "" {
+		op = rollupSum
+	}
+	return fmt.Sprintf("%s (%s without %s)", help, op, strings.Join(r.Without, ", "))
+}
+
+// rollupRules are the rollups in the config file, by metric, which are read
+// again on reload. They're shared by every universe. A nil rollupRules has
+// no rollups.
+type rollupRules struct {
+	config string
+
+	mtx      sync.RWMutex
+	byMetric map[string][]rollupRule
+	gen      uint64 // incremented on reload
+}
+
+// newRollupRules reads the rollups in the config file. If there's no config
+// file, it returns nil.
+func newRollupRules(config string) (*rollupRules, error) {
+	if config == "" {
+		return nil, nil
+	}
+	r := &rollupRules{config: config}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload reads the rollups again. If that fails, the previous ones are
+// kept.
+func (r *rollupRules) reload() error {
+	if r == nil {
+		return nil
+	}
+	c, err := readConfig(r.config)
+	if err != nil {
+		return err
+	}
+	byMetric := map[string][]rollupRule{}
+	for _, rule := range c.Rollups {
+		byMetric[rule.Metric] = append(byMetric[rule.Metric], rule)
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.byMetric = byMetric
+	r.gen++
+	return nil
+}
+
+// forMetric returns the rollups of the metric, and the generation of the
+// rules.
+func (r *rollupRules) forMetric(name string) ([]rollupRule, uint64) {
+	if r == nil {
+		return nil, 0
+	}
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.byMetric[name], r.gen
+}
+
+// newRollups returns the rollups of a universe. It returns nil if there are
+// no rollup rules.
+func (r *rollupRules) newRollups() *rollups {
+	if r == nil {
+		return nil
+	}
+	return &rollups{rules: r, groups: map[string]*rollupGroup{}}
+}
+
+// rollups keeps the rollups of one universe up to date. Observations of
+// metrics which are rolled up are serialized, so the rollups of gauges can
+// be maintained from what each observation changed. A nil rollups does
+// nothing.
+type rollups struct {
+	rules *rollupRules
+
+	mtx    sync.Mutex
+	gen    uint64                  // of the rules the groups are for
+	groups map[string]*rollupGroup // of rollups of gauges, by rollup series key
+}
+
+// rollupGroup is the gauges of a metric which have the same labels, once
+// those dropped by a rollup are dropped.
+type rollupGroup struct {
+	sum float64
+	n   int
+}
+
+// forMetric returns the rollups of the metric.
+func (r *rollups) forMetric(name string) []rollupRule {
+	if r == nil {
+		return nil
+	}
+	rules, _ := r.rules.forMetric(name)
+	return rules
+}
+
+// observe observes the observation, and then observes its changes into the
+// rollups of its metric. The rollups are observed directly, so they aren't
+// rolled up in turn.
+func (r *rollups) observe(u *universe, o observation) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	rules, gen := r.rules.forMetric(o.Name)
+	if gen != r.gen {
+		r.groups, r.gen = map[string]*rollupGroup{}, gen // seeded again when they're next needed
+	}
+
+	c := u.collection(o.metricName())
+	var (
+		old     float64
+		existed bool
+	)
+	if (c == nil && o.Type == "gauge") || (c != nil && c.typ == "gauge") {
+		for _, rule := range rules {
+			if o.Op != "delete" || o.Labels != nil {
+				r.group(c, rule, rule.labels(o.Labels)) // before the observation changes it
+			}
+		}
+		old, existed = c.valueOf(o.timeseriesKey())
+	}
+	if err := u.observeDirect(o); err != nil {
+		return err
+	}
+	if c = u.collection(o.metricName()); c == nil {
+		return nil // a delete of nothing
+	}
+
+	for _, rule := range rules {
+		var err error
+		switch {
+		case c.typ == "gauge":
+			err = r.observeGauge(u, c, rule, o, old, existed)
+		case rule.Op == rollupAvg:
+			err = fmt.Errorf("only gauges can be averaged, and %s is a %s", o.Name, c.typ)
+		case o.Op == "delete", o.Value == nil:
+			// Rollups of counters and histograms keep their totals.
+		default:
+			rolled := o
+			rolled.Name, rolled.Type, rolled.Help, rolled.Buckets, rolled.Coarse, rolled.Mode, rolled.Alpha, rolled.Window = rule.Name, c.typ, rule.help(c.help), c.buckets, nil, "", 0, ""
+			rolled.Labels, rolled.Key = rule.labels(o.Labels), ""
+			if c.typ == "summary" { // every observation goes into the rollup's quantiles, too
+				d := c.declaration(o.metricName())
+				rolled.Window, rolled.Quantiles, rolled.AgeBuckets = d.Window, d.Quantiles, d.AgeBuckets
+			}
+			err = u.observeDirect(rolled)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "error rolling %s up into %s", o.Name, rule.Name)
+		}
+	}
+	return nil
+}
+
+// observeGauge updates the rollup of the gauge, given its value before the
+// observation, if it had one.
+func (r *rollups) observeGauge(u *universe, c *timeseriesCollection, rule rollupRule, o observation, old float64, existed bool) error {
+	if o.Op == "delete" && o.Labels == nil {
+		for k := range r.groups {
+			if strings.HasPrefix(k, rule.Name+" ") {
+				delete(r.groups, k)
+			}
+		}
+		return u.observeDirect(observation{Name: rule.Name, Op: "delete"})
+	}
+	labels := rule.labels(o.Labels)
+	g := r.group(c, rule, labels)
+	switch {
+	case o.Op == "delete" && existed:
+		g.sum -= old
+		g.n--
+	case o.Op == "delete" || o.Value == nil:
+		return nil
+	case existed:
+		value, _ := c.valueOf(o.timeseriesKey())
+		g.sum += value - old
+	default:
+		value, _ := c.valueOf(o.timeseriesKey())
+		g.sum += value
+		g.n++
+	}
+	if g.n == 0 {
+		delete(r.groups, string(makeTimeseriesKey(rule.Name, labels)))
+		return u.observeDirect(observation{Name: rule.Name, Labels: labels, Op: "delete"})
+	}
+	value := g.sum
+	if rule.Op == rollupAvg {
+		value /= float64(g.n)
+	}
+	return u.observeDirect(observation{Name: rule.Name, Type: "gauge", Help: rule.help(c.help), Labels: labels, Value: &value})
+}
+
+// group returns the group of gauges of the rollup series with the labels,
+// summing them up if it hasn't been needed since the rules were read.
+func (r *rollups) group(c *timeseriesCollection, rule rollupRule, labels map[string]string) *rollupGroup {
+	k := string(makeTimeseriesKey(rule.Name, labels))
+	if g, ok := r.groups[k]; ok {
+		return g
+	}
+	g := &rollupGroup{}
+	r.groups[k] = g
+	if c == nil {
+		return g // nothing to sum
+	}
+	for _, v := range c.series() {
+		value, ok := seriesValue(v)
+		if !ok || !v.touched() || makeTimeseriesKey(rule.Name, rule.labels(v.labelSet().toMap())) != timeseriesKey(k) {
+			continue
+		}
+		g.sum += value
+		g.n++
+	}
+	return g
+}
+
+// valueOf returns the value of the counter or gauge series, and false if it,
+// or the collection, doesn't exist, or it hasn't been observed.
+func (c *timeseriesCollection) valueOf(k timeseriesKey) (float64, bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.mtx.RLock()
+	v := c.values[k]
+	c.mtx.RUnlock()
+	if v == nil || !v.touched() {
+		return 0, false
+	}
+	return seriesValue(v)
+}
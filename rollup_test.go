@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRollups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "config.yaml")
+	writeFile(t, filename, `rollups:
+  - {metric: req_total, name: req_total_all, without: [instance]}
+  - {metric: lat_seconds, name: lat_seconds_all, without: [instance]}
+  - {metric: query_seconds, name: query_seconds_all, without: [instance]}
+  - {metric: depth, name: depth_sum, without: [instance]}
+  - {metric: depth, name: depth_avg, without: [instance], op: avg}
+`)
+	rules, err := newRollupRules(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := newUniverse()
+	u.rollups = rules.newRollups()
+
+	samples := func(prefix string) string {
+		var lines []string
+		for _, line := range strings.Split(scrape(t, u), "\n") {
+			if strings.HasPrefix(line, prefix) {
+				lines = append(lines, line)
+			}
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"req_total","type":"counter","help":"Requests."}`,
+		`{"name":"lat_seconds","type":"histogram","help":"Latency.","buckets":[1]}`,
+		`{"name":"depth","type":"gauge","help":"Queue depth."}`,
+		`{"name":"query_seconds","type":"summary","help":"Query latency.","quantiles":[0.5]}`,
+		`req_total{route="/a",instance="1"} 1`,
+		`req_total{route="/a",instance="2"} 2`,
+		`req_total{route="/b",instance="1"} 4`,
+		`lat_seconds{instance="1"} 0.5`,
+		`lat_seconds{instance="2"} 2`,
+		`depth{queue="q",instance="1"} 10`,
+		`depth{queue="q",instance="2"} 20`,
+		`depth{queue="q",instance="1"} 4`,
+		`query_seconds{instance="1"} 1`,
+		`query_seconds{instance="2"} 2`,
+		`query_seconds{instance="2"} 3`,
+	}))
+	if want, have := "req_total_all{route=\"/a\"} 3\nreq_total_all{route=\"/b\"} 4", samples("req_total_all"); want != have {
+		t.Errorf("counter: want\n%s\nhave\n%s", want, have)
+	}
+	if want, have := "lat_seconds_all_bucket{le=\"1\"} 1\nlat_seconds_all_bucket{le=\"+Inf\"} 2\nlat_seconds_all_sum{} 2.5\nlat_seconds_all_count{} 2", samples("lat_seconds_all"); want != have {
+		t.Errorf("histogram: want\n%s\nhave\n%s", want, have)
+	}
+	if want, have := "query_seconds_all{quantile=\"0.5\"} 2\nquery_seconds_all_sum{} 6\nquery_seconds_all_count{} 3", samples("query_seconds_all"); want != have {
+		t.Errorf("summary: want\n%s\nhave\n%s", want, have)
+	}
+	if want, have := `depth_sum{queue="q"} 24`, samples("depth_sum"); want != have {
+		t.Errorf("gauge sum: want %s, have %s", want, have)
+	}
+	if want, have := `depth_avg{queue="q"} 12`, samples("depth_avg"); want != have {
+		t.Errorf("gauge avg: want %s, have %s", want, have)
+	}
+	if !strings.Contains(scrape(t, u), "# HELP req_total_all Requests. (sum without instance)\n") {
+		t.Errorf("rollup has the wrong help")
+	}
+
+	// Deleting a gauge takes it out of the rollup, and so does deleting
+	// them all; deleting a counter doesn't change its rollup.
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"depth","labels":{"queue":"q","instance":"2"},"op":"delete"}`,
+		`{"name":"req_total","labels":{"route":"/a","instance":"2"},"op":"delete"}`,
+	}))
+	if want, have := `depth_sum{queue="q"} 4`, samples("depth_sum"); want != have {
+		t.Errorf("after delete: want %s, have %s", want, have)
+	}
+	if want, have := "req_total_all{route=\"/a\"} 3\nreq_total_all{route=\"/b\"} 4", samples("req_total_all"); want != have {
+		t.Errorf("counter after delete: want\n%s\nhave\n%s", want, have)
+	}
+	loadObservations(t, u, makeObservations(t, []string{`{"name":"depth","op":"delete"}`}))
+	if want, have := "", samples("depth_"); want != have {
+		t.Errorf("after delete all: want nothing, have %s", have)
+	}
+
+	// After a reload, gauge rollups are summed up again from what's there.
+	loadObservations(t, u, makeObservations(t, []string{
+		`depth{queue="q",instance="1"} 1`,
+		`depth{queue="q",instance="2"} 2`,
+	}))
+	if err := rules.reload(); err != nil {
+		t.Fatal(err)
+	}
+	loadObservations(t, u, makeObservations(t, []string{`{"name":"depth","labels":{"queue":"q","instance":"3"},"op":"add","value":3}`}))
+	if want, have := `depth_sum{queue="q"} 6`, samples("depth_sum"); want != have {
+		t.Errorf("after reload: want %s, have %s", want, have)
+	}
+}
+
+func TestRollupRuleInvalid(t *testing.T) {
+	for _, r := range []rollupRule{
+		{Metric: "a", Name: "a", Without: []string{"x"}},
+		{Metric: "a", Name: "b"},
+		{Metric: "a", Name: "b", Without: []string{"1x"}},
+		{Metric: "a", Name: "b", Without: []string{"x"}, Op: "max"},
+		{Metric: "", Name: "b", Without: []string{"x"}},
+	} {
+		if err := r.check(); err == nil {
+			t.Errorf("%+v: want error, have none", r)
+		}
+	}
+}
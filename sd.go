@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// sdTargetGroup is a group of targets, as Prometheus's HTTP service
+// discovery takes it.
+type sdTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// sdHandler serves a Prometheus HTTP service discovery document listing this
+// aggregator as a target, at the scheme and path of the Prometheus listener,
+// with the labels. Pointing Prometheus at the document of every aggregator
+// in a fleet finds them all, even if their paths differ.
+func sdHandler(target string, scrape *url.URL, metricsPath string, labels constLabels) http.Handler {
+	group := sdTargetGroup{
+		Targets: []string{target},
+		Labels:  map[string]string{"__metrics_path__": metricsPath, "__scheme__": scrapeScheme(scrape)},
+	}
+	for k, v := range labels {
+		group.Labels[k] = v
+	}
+	body, _ := json.Marshal([]sdTargetGroup{group})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+}
+
+// resolveSDTarget returns the target, if it isn't empty, and otherwise the
+// address of the listener, with the hostname in place of an unspecified IP,
+// which Prometheus can't scrape.
+func resolveSDTarget(target string, addr net.Addr) (string, error) {
+	if target != "" {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return "", fmt.Errorf("%q must be host:port", target)
+		}
+		return target, nil
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		if host, err = os.Hostname(); err != nil {
+			return "", err
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestSDHandler(t *testing.T) {
+	scrape, _ := url.Parse("https://0.0.0.0:8192/metrics")
+	h := sdHandler("agg-a:8192", scrape, "/metrics", constLabels{"team": "payments"})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/sd", nil))
+	if want, have := "application/json", rec.Header().Get("Content-Type"); want != have {
+		t.Errorf("Content-Type: want %s, have %s", want, have)
+	}
+	var groups []sdTargetGroup
+	if err := json.Unmarshal(rec.Body.Bytes(), &groups); err != nil {
+		t.Fatal(err)
+	}
+	want := []sdTargetGroup{{
+		Targets: []string{"agg-a:8192"},
+		Labels:  map[string]string{"__metrics_path__": "/metrics", "__scheme__": "https", "team": "payments"},
+	}}
+	if !reflect.DeepEqual(want, groups) {
+		t.Errorf("want %+v, have %+v", want, groups)
+	}
+}
+
+func TestResolveSDTarget(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8192}
+	for _, testcase := range []struct {
+		target string
+		want   string
+		valid  bool
+	}{
+		{"", "10.0.0.1:8192", true},
+		{"agg-a.example.com:9192", "agg-a.example.com:9192", true},
+		{"agg-a.example.com", "", false},
+	} {
+		have, err := resolveSDTarget(testcase.target, addr)
+		if want, have := testcase.valid, err == nil; want != have {
+			t.Errorf("%q: want valid %v, have %v (%v)", testcase.target, want, have, err)
+		}
+		if want := testcase.want; want != have {
+			t.Errorf("%q: want %s, have %s", testcase.target, want, have)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// selfChecker periodically renders the metrics exposition and validates it,
+// so that rendering bugs are caught before Prometheus trips over them. While
+// the most recent check has failed, the aggregator reports itself not ready.
+type selfChecker struct {
+	render func() []byte
+	logger log.Logger
+
+	mtx  sync.Mutex
+	errs []error
+}
+
+func newSelfChecker(render func() []byte, logger log.Logger) *selfChecker {
+	return &selfChecker{render: render, logger: logger}
+}
+
+// check validates the exposition once, and records the result.
+func (c *selfChecker) check() []error {
+	errs := validateExposition(c.render())
+	for _, err := range errs {
+		level.Error(c.logger).Log("self_check", "failed", "err", err)
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if len(errs) == 0 && len(c.errs) > 0 {
+		level.Info(c.logger).Log("self_check", "recovered")
+	}
+	c.errs = errs
+	return errs
+}
+
+// run checks the exposition every interval until the context is canceled.
+func (c *selfChecker) run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.check()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// ready returns an error describing the most recent failed check, if any.
+// A nil selfChecker is always ready.
+func (c *selfChecker) ready() error {
+	if c == nil {
+		return nil
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if len(c.errs) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(c.errs))
+	for i, err := range c.errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Errorf("self-check failed: %s", strings.Join(msgs, "; "))
+}
+
+// lintDeclarations renders every declared metric, whether or not it's been
+// observed, with a zero in a series without labels, and in a series of each
+// label set in the declarations, and validates the exposition, so that a bad
+// declaration fails at startup, rather than once Prometheus scrapes it.
+func lintDeclarations(decls []observation) []error {
+	u, err := newUniverse()
+	if err != nil {
+		return []error{err}
+	}
+	var zero float64
+	for _, o := range decls {
+		if _, err := u.declare(o); err != nil {
+			return []error{err}
+		}
+		for _, labels := range []map[string]string{nil, o.Labels} {
+			if err := u.observe(observation{Name: o.Name, Labels: labels, Value: &zero}); err != nil {
+				return []error{fmt.Errorf("%s: %v", o.Name, err)}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := u.writeText(&buf); err != nil {
+		return []error{err}
+	}
+	return validateExposition(buf.Bytes())
+}
+
+// readyHandler responds 200 when the aggregator is ready, and 503 otherwise,
+// including once it's shutting down, and no longer accepting lines.
+func readyHandler(c *selfChecker, d *drainer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d.closing() {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		if err := c.ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ready")
+	})
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runSend is the send subcommand, which writes lines to an aggregator's
+// socket, so shell scripts and cron jobs needn't use netcat, e.g.
+//
+//	prometheus-aggregator send -socket tcp://127.0.0.1:8191 'foo_total{code="200"} 1'
+//
+// The lines are the arguments, and a JSON line built from the -name flag and
+// its friends, if it's set, or else each line of stdin. Every line is parsed
+// first, so a bad one fails the command, rather than being dropped by the
+// aggregator, which doesn't reply.
+func runSend(args []string, stdin io.Reader) error {
+	fs := flag.NewFlagSet("prometheus-aggregator send", flag.ExitOnError)
+	sock := newSocketFlags(fs)
+	var (
+		name    = fs.String("name", "", "metric name of a JSON line built from the -label, -value, -op, -type, -help, and -buckets flags")
+		typ     = fs.String("type", "", "declares the metric: counter, gauge, histogram, or summary")
+		help    = fs.String("help", "", "help text of a declaration")
+		buckets = fs.String("buckets", "", "comma-separated buckets of a histogram declaration")
+		op      = fs.String("op", "", "op, e.g. add, for a gauge, or delete")
+		value   = fs.String("value", "", "value")
+	)
+	labels := constLabels{}
+	fs.Var(labels, "label", "name=value label (repeatable)")
+	fs.Usage = usageFor(fs, "prometheus-aggregator send [flags] [line ...]")
+	fs.Parse(args)
+
+	lines := fs.Args()
+	if *name != "" {
+		o := observation{Name: *name, Type: *typ, Help: *help, Op: *op}
+		if len(labels) > 0 {
+			o.Labels = labels
+		}
+		if *buckets != "" {
+			for _, s := range strings.Split(*buckets, ",") {
+				f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+				if err != nil {
+					return fmt.Errorf("-buckets: %v", err)
+				}
+				o.Buckets = append(o.Buckets, f)
+			}
+		}
+		if *value != "" {
+			f, err := strconv.ParseFloat(*value, 64)
+			if err != nil {
+				return fmt.Errorf("-value: %v", err)
+			}
+			o.Value = &f
+		}
+		buf, err := json.Marshal(o)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, string(buf))
+	}
+	if len(lines) == 0 {
+		s := bufio.NewScanner(stdin)
+		for s.Scan() {
+			if line := strings.TrimSpace(s.Text()); line != "" {
+				lines = append(lines, line)
+			}
+		}
+		if err := s.Err(); err != nil {
+			return err
+		}
+	}
+	if len(lines) == 0 {
+		return fmt.Errorf("no lines to send")
+	}
+	for i, line := range lines {
+		var err error
+		if strings.HasPrefix(line, labelsDirective) {
+			_, err = parseLabelsDirective([]byte(line))
+		} else {
+			_, err = parseLine([]byte(line))
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %v", i+1, err)
+		}
+	}
+
+	w, err := sock.dial()
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if err := w.writeLine(line); err != nil {
+			w.close()
+			return err
+		}
+	}
+	return w.close()
+}
+
+// socketFlags are the flags of the subcommands which write to an
+// aggregator's socket.
+type socketFlags struct {
+	addr, token   *string
+	ca, cert, key *string
+	timeout       *time.Duration
+}
+
+func newSocketFlags(fs *flag.FlagSet) *socketFlags {
+	return &socketFlags{
+		addr:    fs.String("socket", "tcp://127.0.0.1:8191", "address of the aggregator's socket"),
+		token:   fs.String("token", "", "token to send as AUTH <token>, for a socket with tokens"),
+		ca:      fs.String("tls-ca", "", "CA certificates file, to verify a tls:// socket (empty uses the system's)"),
+		cert:    fs.String("tls-cert", "", "TLS client certificate file, for a tls:// socket which requires one"),
+		key:     fs.String("tls-key", "", "TLS client key file"),
+		timeout: fs.Duration("timeout", 5*time.Second, "timeout for connecting, and for each write"),
+	}
+}
+
+// dial connects to the socket, and sends AUTH, if there's a token.
+func (f *socketFlags) dial() (*socketWriter, error) {
+	u, err := url.Parse(*f.addr)
+	if err != nil {
+		return nil, err
+	}
+	w := &socketWriter{timeout: *f.timeout}
+	network := strings.ToLower(u.Scheme)
+	switch network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+		w.datagrams = strings.HasPrefix(network, "udp")
+		w.conn, err = net.DialTimeout(network, u.Host, w.timeout)
+	case "unix", "unixgram":
+		w.datagrams = network == "unixgram"
+		w.conn, err = net.DialTimeout(network, u.Path, w.timeout)
+	case "tls":
+		config := &tls.Config{}
+		if *f.ca != "" {
+			if config.RootCAs, err = loadCertPool(*f.ca); err != nil {
+				return nil, err
+			}
+		}
+		if *f.cert != "" || *f.key != "" {
+			cert, err := tls.LoadX509KeyPair(*f.cert, *f.key)
+			if err != nil {
+				return nil, err
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		w.conn, err = tls.DialWithDialer(&net.Dialer{Timeout: w.timeout}, "tcp", u.Host, config)
+	default:
+		return nil, fmt.Errorf("unsupported network %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	w.bw = bufio.NewWriter(w.conn)
+	if *f.token != "" {
+		if w.datagrams {
+			w.conn.Close()
+			return nil, fmt.Errorf("datagrams can't authenticate; a token requires a stream socket")
+		}
+		if err := w.writeLine("AUTH " + *f.token); err != nil {
+			w.conn.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// socketWriter writes lines to an aggregator's socket: buffered, over a
+// stream, and each its own datagram, otherwise.
+type socketWriter struct {
+	conn      net.Conn
+	bw        *bufio.Writer
+	datagrams bool
+	timeout   time.Duration
+}
+
+func (w *socketWriter) writeLine(line string) error {
+	if w.datagrams {
+		w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+		_, err := io.WriteString(w.conn, line)
+		return err
+	}
+	if w.bw.Available() < len(line)+1 {
+		w.conn.SetWriteDeadline(time.Now().Add(w.timeout)) // it may flush
+	}
+	w.bw.WriteString(line)
+	return w.bw.WriteByte('\n')
+}
+
+// flush writes what's buffered.
+func (w *socketWriter) flush() error {
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	return w.bw.Flush()
+}
+
+// close flushes, and closes the connection.
+func (w *socketWriter) close() error {
+	err := w.flush()
+	if cerr := w.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
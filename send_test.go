@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestSend(t *testing.T) {
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Foo."}`,
+		`{"name":"bar","type":"gauge","help":"Bar."}`,
+	})...)
+	i := &ingester{observer: u, activity: newActivity(0), logger: log.NewNopLogger(), tokens: &socketTokens{added: []string{"s3cr3t"}}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go i.forwardListener(ln)
+	socket := "tcp://" + ln.Addr().String()
+
+	for _, args := range [][]string{
+		{"-socket", socket, "-token", "s3cr3t", `foo_total{code="200"} 1`, `foo_total{code="500"} 1`},
+		{"-socket", socket, "-token", "s3cr3t", "-name", "foo_total", "-label", "code=200", "-value", "2"},
+		{"-socket", socket, "-token", "s3cr3t", "-name", "bar", "-value", "-5", "-op", "add"},
+	} {
+		if err := runSend(args, strings.NewReader("")); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+	}
+	stdin := strings.NewReader("foo_total{code=\"500\"} 3\n\nfoo_total{code=\"200\"} 1\n")
+	if err := runSend([]string{"-socket", socket, "-token", "s3cr3t"}, stdin); err != nil {
+		t.Fatal(err)
+	}
+
+	want := normalizeResponse(`
+		# HELP bar Bar.
+		# TYPE bar gauge
+		bar{} -5
+
+		# HELP foo_total Foo.
+		# TYPE foo_total counter
+		foo_total{code="200"} 4
+		foo_total{code="500"} 4
+	`)
+	deadline := time.Now().Add(5 * time.Second)
+	for normalizeResponse(scrape(t, u)) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, normalizeResponse(scrape(t, u)))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSendErrors(t *testing.T) {
+	for name, args := range map[string][]string{
+		"bad line":    {"foo_total 1"},
+		"bad value":   {"-name", "foo_total", "-value", "x"},
+		"bad buckets": {"-name", "foo", "-type", "histogram", "-buckets", "1,x"},
+		"bad name":    {"-name", "foo-total", "-value", "1"},
+		"bad labels":  {`LABELS a="1`},
+		"no lines":    {},
+		"network":     {"-socket", "sctp://127.0.0.1:8191", "foo_total{} 1"},
+		"udp token":   {"-socket", "udp://127.0.0.1:8191", "-token", "s3cr3t", "foo_total{} 1"},
+	} {
+		if err := runSend(args, strings.NewReader("")); err == nil {
+			t.Errorf("%s: want error, have none", name)
+		}
+	}
+}
+
+func TestSendTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certs := writeTestCerts(t, dir)
+
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Foo."}`,
+	})...)
+	i := &ingester{observer: u, activity: newActivity(0), logger: log.NewNopLogger()}
+	ln := listenTLS(t, certs, i)
+	defer ln.Close()
+
+	args := []string{"-socket", "tls://" + ln.Addr().String(), "-tls-ca", certs.ca, "-tls-cert", certs.clientCert, "-tls-key", certs.clientKey, "foo_total{} 1"}
+	if err := runSend(args, strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := normalizeResponse(`
+		# HELP foo_total Foo.
+		# TYPE foo_total counter
+		foo_total{} 1
+	`)
+	deadline := time.Now().Add(5 * time.Second)
+	for normalizeResponse(scrape(t, u)) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, normalizeResponse(scrape(t, u)))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
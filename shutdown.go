@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// drainer tracks the connections being read, and the lines read but not yet
+// observed, so that a shutdown can stop input, observe everything already
+// read, and wait for a final scrape, before the state is saved. Otherwise, a
+// rolling deploy would lose whatever was in flight, or observed since the
+// last scrape. A nil drainer tracks nothing.
+type drainer struct {
+	inflight int64 // atomic; first, for alignment; lines queued but not yet handled
+
+	mtx     sync.Mutex
+	conns   map[io.Closer]struct{}
+	closed  bool
+	handled sync.WaitGroup // connection handlers
+	drained time.Time      // when close returned; zero before then
+	scraped chan struct{}  // closed by the first scrape which starts after drained
+}
+
+func newDrainer() *drainer {
+	return &drainer{conns: map[io.Closer]struct{}{}, scraped: make(chan struct{})}
+}
+
+// open starts tracking a connection, and returns true, unless the drainer
+// is closed, in which case the connection should be closed, too.
+func (d *drainer) open(c io.Closer) bool {
+	if d == nil {
+		return true
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.closed {
+		return false
+	}
+	d.conns[c] = struct{}{}
+	d.handled.Add(1)
+	return true
+}
+
+// done stops tracking a connection, once its handler is done with it, and
+// all its lines are observed.
+func (d *drainer) done(c io.Closer) {
+	if d == nil {
+		return
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	delete(d.conns, c)
+	d.handled.Done()
+}
+
+func (d *drainer) queue() {
+	if d != nil {
+		atomic.AddInt64(&d.inflight, 1)
+	}
+}
+
+func (d *drainer) dequeue() {
+	if d != nil {
+		atomic.AddInt64(&d.inflight, -1)
+	}
+}
+
+// closing returns true once close has been called.
+func (d *drainer) closing() bool {
+	if d == nil {
+		return false
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.closed
+}
+
+// close closes every connection, and refuses new ones, and waits until their
+// handlers are done, and every queued line, including datagrams, is handled,
+// or the timeout elapses. It's called once the sockets are closed, and
+// before the workers stop.
+func (d *drainer) close(timeout time.Duration) (drained bool) {
+	if d == nil {
+		return true
+	}
+	d.mtx.Lock()
+	d.closed = true
+	for c := range d.conns {
+		c.Close() // the handler sees an error, and finishes up
+	}
+	d.mtx.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.handled.Wait()
+		for atomic.LoadInt64(&d.inflight) > 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		close(done)
+	}()
+	defer func() {
+		d.mtx.Lock()
+		d.drained = time.Now()
+		d.mtx.Unlock()
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// wrapScrapes notes when a scrape which started after input was drained is
+// complete, since it's the first to include everything.
+func (d *drainer) wrapScrapes(next http.Handler) http.Handler {
+	if d == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		begin := time.Now()
+		next.ServeHTTP(w, r)
+		d.mtx.Lock()
+		defer d.mtx.Unlock()
+		if d.drained.IsZero() || begin.Before(d.drained) {
+			return
+		}
+		select {
+		case <-d.scraped:
+		default:
+			close(d.scraped)
+		}
+	})
+}
+
+// awaitScrape waits for the final scrape, or the timeout, and returns true
+// if there was one.
+func (d *drainer) awaitScrape(timeout time.Duration) bool {
+	if d == nil || timeout <= 0 {
+		return false
+	}
+	select {
+	case <-d.scraped:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestDrainer(t *testing.T) {
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Foo."}`,
+	})...)
+	i := &ingester{
+		observer: u,
+		activity: newActivity(0),
+		logger:   log.NewNopLogger(),
+		queues:   newLineQueues(2, 1024),
+		drainer:  newDrainer(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go i.work(ctx)
+
+	server, client := net.Pipe()
+	handled := make(chan struct{})
+	go func() {
+		i.handleConn(server, "10.1.2.3:40000")
+		close(handled)
+	}()
+	for n := 0; n < 100; n++ {
+		if _, err := client.Write([]byte("foo_total{} 1\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A scrape before the drain isn't the final one.
+	scrapes := i.drainer.wrapScrapes(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	scrapes.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+	if i.drainer.awaitScrape(10 * time.Millisecond) {
+		t.Errorf("before the drain, want no final scrape, have one")
+	}
+
+	// Draining closes the connection, and waits for what was read.
+	if !i.drainer.close(time.Second) {
+		t.Fatal("drain timed out")
+	}
+	select {
+	case <-handled:
+	default:
+		t.Errorf("after the drain, want the connection handled, but it isn't")
+	}
+	if _, err := client.Write([]byte("foo_total{} 1\n")); err == nil {
+		t.Errorf("after the drain, want the connection closed, but it isn't")
+	}
+	if want, have := "foo_total{} 100\n", scrape(t, u); !strings.Contains(have, want) {
+		t.Errorf("want %s, have\n%s", want, have)
+	}
+
+	// New connections are refused.
+	server2, client2 := net.Pipe()
+	defer client2.Close()
+	i.handleConn(server2, "10.1.2.3:40001")
+	if _, err := client2.Write([]byte("foo_total{} 1\n")); err == nil {
+		t.Errorf("after the drain, want new connections closed, but they aren't")
+	}
+
+	// The next scrape is the final one.
+	scrapes.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+	if !i.drainer.awaitScrape(time.Second) {
+		t.Errorf("after the drain, want a final scrape, have none")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultSidecarSocket is the -socket of a sidecar which doesn't set one: a
+// unix socket, in a directory which is meant to be an emptyDir volume,
+// shared with the other containers of the pod.
+const defaultSidecarSocket = "unix:///var/run/prometheus-aggregator/aggregator.sock"
+
+// downwardAPILabels returns the labels of the pod a sidecar is in: the pod
+// and namespace, from the files name and namespace in dir, which a downward
+// API volume writes, or else from the POD_NAME and POD_NAMESPACE environment
+// variables, and the node, from NODE_NAME, since a volume can't have it.
+// The pod and namespace are required; the node isn't.
+func downwardAPILabels(dir string, lookup func(string) (string, bool)) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, l := range []struct {
+		name, file, env string
+		required        bool
+	}{
+		{podLabel, "name", "POD_NAME", true},
+		{namespaceLabel, "namespace", "POD_NAMESPACE", true},
+		{nodeLabel, "", "NODE_NAME", false},
+	} {
+		var value string
+		if dir != "" && l.file != "" {
+			buf, err := ioutil.ReadFile(filepath.Join(dir, l.file))
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			value = strings.TrimSpace(string(buf))
+		}
+		if value == "" {
+			value, _ = lookup(l.env)
+		}
+		switch {
+		case value != "":
+			labels[l.name] = value
+		case l.required:
+			return nil, fmt.Errorf("no %s: set %s with the downward API, or mount a downward API volume with %s", l.name, l.env, filepath.Join(dir, l.file))
+		}
+	}
+	return labels, nil
+}
+
+// removeStaleSocket removes the unix socket at path, if nothing's listening
+// on it, since a sidecar which crashed leaves its socket behind in the
+// volume, and its replacement couldn't listen there. It creates the
+// directory, too, if it doesn't exist yet.
+func removeStaleSocket(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists, and isn't a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return nil // in use, maybe by an aggregator handing off to this one
+	}
+	return os.Remove(path)
+}
+
+// shareSocket lets every user write to the unix socket at path, since the
+// other containers of the pod don't necessarily run as the same user.
+func shareSocket(path string) error {
+	return os.Chmod(path, 0666)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDownwardAPILabels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	env := map[string]string{"POD_NAME": "web-env", "POD_NAMESPACE": "default", "NODE_NAME": "node-1"}
+	lookup := func(k string) (string, bool) { v, ok := env[k]; return v, ok }
+
+	labels, err := downwardAPILabels(dir, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"pod": "web-env", "namespace": "default", "node": "node-1"}; !reflect.DeepEqual(want, labels) {
+		t.Errorf("from the environment: want %v, have %v", want, labels)
+	}
+
+	// The volume's files win.
+	writeFile(t, filepath.Join(dir, "name"), "web-7d4b9\n")
+	labels, err = downwardAPILabels(dir, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"pod": "web-7d4b9", "namespace": "default", "node": "node-1"}; !reflect.DeepEqual(want, labels) {
+		t.Errorf("from the volume: want %v, have %v", want, labels)
+	}
+
+	delete(env, "POD_NAMESPACE")
+	delete(env, "NODE_NAME")
+	if _, err := downwardAPILabels(dir, lookup); err == nil {
+		t.Errorf("without a namespace: want error, have none")
+	}
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A socket nobody's listening on is removed, and the directory created.
+	path := filepath.Join(dir, "run", "aggregator.sock")
+	if err := removeStaleSocket(path); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false) // as if it crashed
+	ln.Close()
+	if err := removeStaleSocket(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("stale socket: want removed, have %v", err)
+	}
+
+	// One that's in use is left alone.
+	ln, err = net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if err := removeStaleSocket(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path); err != nil {
+		t.Errorf("socket in use: want kept, have %v", err)
+	}
+	if err := shareSocket(path); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0666 {
+		t.Errorf("shared socket: want mode 0666, have %v (%v)", fi.Mode().Perm(), err)
+	}
+
+	// Anything else is an error.
+	other := filepath.Join(dir, "file")
+	writeFile(t, other, "")
+	if err := removeStaleSocket(other); err == nil {
+		t.Errorf("not a socket: want error, have none")
+	}
+}
+
+func TestReadyWhileShuttingDown(t *testing.T) {
+	d := newDrainer()
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		readyHandler(nil, d).ServeHTTP(rec, httptest.NewRequest("GET", "/-/ready", nil))
+		return rec.Code
+	}
+	if want, have := 200, ready(); want != have {
+		t.Errorf("running: want %d, have %d", want, have)
+	}
+	d.close(0)
+	if want, have := 503, ready(); want != have {
+		t.Errorf("shutting down: want %d, have %d", want, have)
+	}
+}
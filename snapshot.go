@@ -0,0 +1,60 @@
+package main
+
+// Scrapes render from copy-on-write snapshots of the universe: the sorted
+// collections, and the sorted timeseries of each collection. A snapshot is
+// discarded whenever a collection or timeseries is added or removed, and
+// copied from the sorted indexes by the next scrape, under the read lock.
+// Values are read from the timeseries themselves, which are safe for
+// concurrent use, so rendering takes no locks that writers need.
+
+// universeSnapshot is the collections of the universe, ordered by name.
+type universeSnapshot struct {
+	names       []metricName
+	collections []*timeseriesCollection
+}
+
+// sortedCollections returns every collection in the universe, ordered by
+// name. The slices are shared, and must not be modified.
+func (u *universe) sortedCollections() ([]metricName, []*timeseriesCollection) {
+	if s, _ := u.snap.Load().(*universeSnapshot); s != nil {
+		return s.names, s.collections
+	}
+	u.mtx.RLock()
+	defer u.mtx.RUnlock()
+	if s, _ := u.snap.Load().(*universeSnapshot); s != nil {
+		return s.names, s.collections // another scrape beat us to it
+	}
+	s := &universeSnapshot{names: append([]metricName(nil), u.names...)}
+	s.collections = make([]*timeseriesCollection, len(s.names))
+	for i, n := range s.names {
+		s.collections[i] = u.collections[n]
+	}
+	u.snap.Store(s)
+	return s.names, s.collections
+}
+
+// invalidate discards the snapshot. The caller must hold the write lock.
+func (u *universe) invalidate() {
+	u.snap.Store((*universeSnapshot)(nil))
+}
+
+// series returns every timeseries in the collection, ordered by key. The
+// slice is shared, and must not be modified.
+func (c *timeseriesCollection) series() []timeseriesValue {
+	if s, _ := c.snap.Load().([]timeseriesValue); s != nil {
+		return s
+	}
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	if s, _ := c.snap.Load().([]timeseriesValue); s != nil {
+		return s
+	}
+	s := c.index.appendTo(make([]timeseriesValue, 0, c.index.len()))
+	c.snap.Store(s)
+	return s
+}
+
+// invalidate discards the snapshot. The caller must hold the write lock.
+func (c *timeseriesCollection) invalidate() {
+	c.snap.Store([]timeseriesValue(nil))
+}
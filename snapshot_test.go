@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScrapeSnapshot(t *testing.T) {
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_seconds","type":"histogram","help":"Foo duration.","buckets":[1]}`,
+	})...)
+	loadObservations(t, u, makeObservations(t, []string{
+		`foo_seconds{code="200"} 0.5`,
+	}))
+	scrape(t, u)
+
+	// A scrape of an unchanged universe doesn't need any locks, so it isn't
+	// held up by a writer which is creating a timeseries.
+	c := u.collection("foo_seconds")
+	c.mtx.Lock()
+	done := make(chan string)
+	go func() { done <- scrape(t, u) }()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("scrape blocked by collection lock")
+	}
+	c.mtx.Unlock()
+
+	loadObservations(t, u, makeObservations(t, []string{
+		`foo_seconds{code="404"} 2`,
+		`foo_seconds{code="200"} 0.5`,
+		`{"name":"foo_seconds","op":"delete","labels":{"code":"200"}}`,
+	}))
+	if want, have := normalizeResponse(`
+		# HELP foo_seconds Foo duration.
+		# TYPE foo_seconds histogram
+		foo_seconds_bucket{code="404",le="1"} 0
+		foo_seconds_bucket{code="404",le="+Inf"} 1
+		foo_seconds_sum{code="404"} 2
+		foo_seconds_count{code="404"} 1
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// savedState is what's in the state file: the dump of the universe, and of
+// each tenant's universe, if they have their own, and the first segment of
+// the observation log which isn't in them.
+type savedState struct {
+	universeDump
+	Tenants    map[string]universeDump `json:"tenants,omitempty"`
+	WALSegment int                     `json:"wal_segment,omitempty"`
+}
+
+// stateFile saves the state of the universe, and of each tenant's universe,
+// to a file, so that a restart doesn't reset every counter, which downstream
+// rate() and alerting would take badly. It's saved periodically, and on
+// shutdown, and restored at startup.
+type stateFile struct {
+	filename string
+	u        *universe
+	tenants  *tenantUniverses // may be nil
+	wal      *wal             // may be nil
+	logger   log.Logger
+}
+
+// save writes the state to a temporary file, which then replaces the state
+// file, so a crash mid-save doesn't leave half a state behind. Once it's
+// saved, the observation log segments it includes are removed.
+func (s *stateFile) save() error {
+	st, err := s.checkpoint()
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.filename), filepath.Base(s.filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // after a successful rename, there's nothing to remove
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), s.filename); err != nil {
+		return err
+	}
+	s.wal.truncate(st.WALSegment)
+	return nil
+}
+
+// checkpoint snapshots the state, and checkpoints the observation log, if
+// any, so the state says where to replay it from.
+func (s *stateFile) checkpoint() (savedState, error) {
+	var st savedState
+	next, err := s.wal.checkpoint(func() { st = s.snapshot() })
+	st.WALSegment = next
+	return st, err
+}
+
+// snapshot copies the state of the universe, and of each tenant's universe.
+func (s *stateFile) snapshot() savedState {
+	st := savedState{universeDump: s.u.dump()}
+	if s.tenants != nil {
+		st.Tenants = map[string]universeDump{}
+		for _, name := range s.tenants.names() {
+			st.Tenants[name] = s.tenants.get(name).dump()
+		}
+	}
+	return st
+}
+
+// restore reads the state file, if it exists, and restores its state. It
+// returns the number of series restored. Then it replays the observation log,
+// if any, from where the state left off, and returns the number of records
+// replayed.
+func (s *stateFile) restore() (restored, replayed int, err error) {
+	var st savedState
+	buf, err := ioutil.ReadFile(s.filename)
+	switch {
+	case os.IsNotExist(err):
+		// first run, or the first with a state file
+	case err != nil:
+		return 0, 0, err
+	default:
+		if err := json.Unmarshal(buf, &st); err != nil {
+			return 0, 0, errors.Wrapf(err, "error parsing %s", s.filename)
+		}
+	}
+	return s.restoreState(st)
+}
+
+// restoreState restores the state, e.g. from the state file, and replays the
+// observation log, if any, from where the state left off.
+func (s *stateFile) restoreState(st savedState) (restored, replayed int, err error) {
+	restored = s.u.restore(st.universeDump, s.logger)
+	for name, d := range st.Tenants {
+		if s.tenants == nil {
+			level.Warn(s.logger).Log("restore", "skipped", "tenant", name, "err", "tenants don't have universes of their own")
+			continue
+		}
+		restored += s.tenants.universe(name).restore(d, log.With(s.logger, "tenant", name))
+	}
+	replayed, err = s.wal.replay(st.WALSegment)
+	return restored, replayed, err
+}
+
+// run saves the state every interval, if it's positive, and whenever the
+// observation log's segment fills up, until the context is canceled.
+func (s *stateFile) run(ctx context.Context, interval time.Duration) error {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var full chan struct{}
+	if s.wal != nil {
+		full = s.wal.full
+	}
+	for {
+		select {
+		case <-tick:
+			if err := s.save(); err != nil {
+				level.Error(s.logger).Log("during", "state save", "err", err)
+			}
+		case <-full:
+			if err := s.save(); err != nil {
+				level.Error(s.logger).Log("during", "state save", "err", err)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// restore recreates the metrics and series in the dump, and sets their
+// values. Metrics which have since been declared differently, e.g. with other
+// buckets, are skipped, along with their series, and logged. It returns the
+// number of series restored.
+func (u *universe) restore(d universeDump, logger log.Logger) (restored int) {
+	for _, cd := range d.Metrics {
+		o := cd.declaration()
+		c := u.collection(o.metricName())
+		if c == nil {
+			if _, err := u.declare(o); err != nil {
+				level.Warn(logger).Log("restore", "skipped", "name", cd.Name, "err", err)
+				continue
+			}
+			c = u.collection(o.metricName())
+		}
+		if d := c.declaration(o.metricName()); d.Type != cd.Type || d.Mode != cd.Mode || d.Alpha != cd.Alpha || d.Window != cd.Window || d.AgeBuckets != cd.AgeBuckets || (c.typ == "summary" && !c.sameQuantiles(cd.Quantiles)) || (c.typ == "histogram" && (!c.sameBuckets(cd.Buckets) || !c.sameCoarse(cd.Coarse))) {
+			level.Warn(logger).Log("restore", "skipped", "name", cd.Name, "series", len(cd.Series), "err", "declared differently since it was saved")
+			continue
+		}
+		for _, sd := range cd.Series {
+			if err := c.restore(observation{Name: cd.Name, Labels: sd.Labels}, sd); err != nil {
+				level.Warn(logger).Log("restore", "skipped", "name", cd.Name, "labels", renderLabels(sd.Labels), "err", err)
+				continue
+			}
+			restored++
+		}
+	}
+	return restored
+}
+
+// restore creates the timeseries identified by the observation, if it
+// doesn't exist, and sets its state.
+func (c *timeseriesCollection) restore(o observation, sd seriesDump) error {
+	if o.Labels == nil {
+		o.Labels = map[string]string{} // not a delete
+	}
+	if err := c.observe(o); err != nil { // without a value, only creates it
+		return err
+	}
+	c.mtx.RLock()
+	v := c.values[o.timeseriesKey()]
+	c.mtx.RUnlock()
+	if v == nil {
+		return fmt.Errorf("timeseries was deleted during restore")
+	}
+	return v.restore(sd)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "state.json")
+
+	decls := []string{
+		`{"name":"foo_total","type":"counter","help":"Foo."}`,
+		`{"name":"bar","type":"gauge","help":"Bar."}`,
+		`{"name":"baz_seconds","type":"histogram","help":"Baz.","buckets":[0.1,1]}`,
+	}
+	newUniverses := func() (*universe, *tenantUniverses) {
+		u, _ := newUniverse(makeObservations(t, decls)...)
+		return u, newTenantUniverses(u, func() *universe {
+			tu, _ := newUniverse(makeObservations(t, decls[:1])...)
+			return tu
+		})
+	}
+
+	u, tenants := newUniverses()
+	for _, line := range []string{
+		`foo_total{code="200"} 3`,
+		`foo_total{} 1.5`,
+		`bar{} -2`,
+		`baz_seconds{} 0.05`,
+		`baz_seconds{} 0.5`,
+		`baz_seconds{} 5`,
+	} {
+		o, err := parseLine([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := u.observe(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	value := 7.0
+	if err := tenants.observe(observation{Name: "foo_total", Value: &value, Tenant: "team_a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &stateFile{filename: filename, u: u, tenants: tenants, logger: log.NewNopLogger()}
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new aggregator picks up where the old one left off.
+	u2, tenants2 := newUniverses()
+	s2 := &stateFile{filename: filename, u: u2, tenants: tenants2, logger: log.NewNopLogger()}
+	restored, _, err := s2.restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 5, restored; want != have {
+		t.Errorf("restored: want %d, have %d", want, have)
+	}
+	if want, have := scrape(t, u), scrape(t, u2); want != have {
+		t.Errorf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+	if want, have := scrape(t, tenants.get("team_a")), scrape(t, tenants2.get("team_a")); want != have {
+		t.Errorf("team_a:\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+
+	// And carries on counting.
+	o, _ := parseLine([]byte(`foo_total{} 1`))
+	u2.observe(o)
+	if want, have := "foo_total{} 2.5\n", scrape(t, u2); !strings.Contains(have, want) {
+		t.Errorf("want %s, have\n%s", want, have)
+	}
+
+	// A histogram with new buckets can't be restored.
+	decls[2] = `{"name":"baz_seconds","type":"histogram","help":"Baz.","buckets":[0.5]}`
+	u3, _ := newUniverses()
+	restored, _, err = (&stateFile{filename: filename, u: u3, logger: log.NewNopLogger()}).restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 3, restored; want != have {
+		t.Errorf("with new buckets, restored: want %d, have %d", want, have)
+	}
+	if have := scrape(t, u3); strings.Contains(have, "baz_seconds_count") {
+		t.Errorf("with new buckets, want no baz_seconds, have\n%s", have)
+	}
+
+	// No state file is a fresh start.
+	restored, _, err = (&stateFile{filename: filepath.Join(dir, "nope.json"), u: u3}).restore()
+	if err != nil || restored != 0 {
+		t.Errorf("without a state file: want 0, <nil>, have %d, %v", restored, err)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// universeStats summarizes what the universe is holding.
+type universeStats struct {
+	Metrics int           `json:"metrics"`
+	Series  int           `json:"series"`
+	Bytes   int           `json:"bytes"`
+	PerName []metricStats `json:"per_metric"`
+}
+
+// metricStats summarizes a single collection.
+type metricStats struct {
+	Name           string             `json:"name"`
+	Type           string             `json:"type"`
+	Series         int                `json:"series"`
+	Bytes          int                `json:"bytes"`
+	BytesPerSeries int                `json:"bytes_per_series"`
+	LastObserved   *time.Time         `json:"last_observed,omitempty"`
+	TopLabelKeys   []labelCardinality `json:"top_label_keys"`
+}
+
+// labelCardinality is the number of distinct values of a label key.
+type labelCardinality struct {
+	Key    string `json:"key"`
+	Values int    `json:"values"`
+}
+
+// topLabelKeys is the number of label keys reported per metric.
+const topLabelKeys = 5
+
+// Rough costs, in bytes, of the things holding a timeseries besides its value
+// struct, i.e. its entries in the values map and the index, and the header of
+// its labels; and of each of its labels and buckets, besides their contents.
+// These are estimates, not measurements.
+const (
+	seriesOverheadBytes = 80
+	labelOverheadBytes  = int(unsafe.Sizeof(labelPair{}))
+	bucketOverheadBytes = int(unsafe.Sizeof(bucket{}))
+	streamBytes         = 8 * 1024 // of each of a summary's streams, which are compressed
+)
+
+// valueBytes is the size of the value struct of each type of timeseries.
+var valueBytes = map[string]int{
+	"counter":   int(unsafe.Sizeof(counter{})),
+	"gauge":     int(unsafe.Sizeof(gauge{})),
+	"histogram": int(unsafe.Sizeof(histogram{})),
+	"summary":   int(unsafe.Sizeof(summary{})),
+}
+
+// modeBytes is the size of what each mode adds to the value struct of a
+// timeseries.
+var modeBytes = map[string]int{
+	modeMinMax:    int(unsafe.Sizeof(minMaxGauge{})),
+	modeEWMA:      int(unsafe.Sizeof(ewmaGauge{})),
+	modePerSecond: int(unsafe.Sizeof(perSecondCounter{})),
+}
+
+// seriesBytes estimates the memory held by a timeseries of the collection:
+// the overhead of its type, its key, and its labels and buckets. Label names
+// and values are usually interned, so shared between timeseries, but they're
+// counted in full, since that's what a high cardinality label costs.
+func (c *timeseriesCollection) seriesBytes(v timeseriesValue) int {
+	n := seriesOverheadBytes + valueBytes[c.typ] + modeBytes[c.mode] + len(v.timeseriesKey())
+	if c.typ == "summary" {
+		n += streamBytes * c.ageBuckets
+	}
+	if c.typ == "histogram" && c.window > 0 {
+		n += int(unsafe.Sizeof(windowedHistogram{})) + valueBytes[c.typ] + bucketOverheadBytes*len(c.buckets) // the last window
+	}
+	for _, p := range v.labelSet() {
+		n += labelOverheadBytes + len(p.name) + len(p.value)
+	}
+	return n + bucketOverheadBytes*len(c.buckets)
+}
+
+func (u *universe) stats() universeStats {
+	names, collections := u.sortedCollections()
+	s := universeStats{
+		Metrics: len(names),
+		PerName: make([]metricStats, 0, len(names)),
+	}
+	for i, n := range names {
+		ms := collections[i].stats(n)
+		s.Series += ms.Series
+		s.Bytes += ms.Bytes
+		s.PerName = append(s.PerName, ms)
+	}
+	return s
+}
+
+func (c *timeseriesCollection) stats(n metricName) metricStats {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	ms := metricStats{
+		Name:   string(n),
+		Type:   c.typ,
+		Series: len(c.values),
+		Bytes:  c.bytes,
+	}
+	if ms.Series > 0 {
+		ms.BytesPerSeries = ms.Bytes / ms.Series
+	}
+	if nanos := atomic.LoadInt64(&c.updated); nanos != 0 {
+		updated := time.Unix(0, nanos)
+		ms.LastObserved = &updated
+	}
+	distinct := map[string]map[string]struct{}{}
+	for _, v := range c.values {
+		for _, p := range v.labelSet() {
+			if distinct[p.name] == nil {
+				distinct[p.name] = map[string]struct{}{}
+			}
+			distinct[p.name][p.value] = struct{}{}
+		}
+	}
+	ms.TopLabelKeys = make([]labelCardinality, 0, len(distinct))
+	for k, values := range distinct {
+		ms.TopLabelKeys = append(ms.TopLabelKeys, labelCardinality{Key: k, Values: len(values)})
+	}
+	sort.Slice(ms.TopLabelKeys, func(i, j int) bool {
+		if ms.TopLabelKeys[i].Values != ms.TopLabelKeys[j].Values {
+			return ms.TopLabelKeys[i].Values > ms.TopLabelKeys[j].Values
+		}
+		return ms.TopLabelKeys[i].Key < ms.TopLabelKeys[j].Key
+	})
+	if len(ms.TopLabelKeys) > topLabelKeys {
+		ms.TopLabelKeys = ms.TopLabelKeys[:topLabelKeys]
+	}
+	return ms
+}
+
+// statsHandler serves universe stats as JSON. The per-metric stats are
+// ordered by name, or with ?sort=bytes or ?sort=series, biggest first, and
+// ?limit=n keeps only the first n of them. Totals always cover every metric.
+func statsHandler(u *universe) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := u.stats()
+		switch by := r.URL.Query().Get("sort"); by {
+		case "", "name":
+		case "bytes":
+			sort.SliceStable(s.PerName, func(i, j int) bool { return s.PerName[i].Bytes > s.PerName[j].Bytes })
+		case "series":
+			sort.SliceStable(s.PerName, func(i, j int) bool { return s.PerName[i].Series > s.PerName[j].Series })
+		default:
+			http.Error(w, fmt.Sprintf("invalid sort %q", by), http.StatusBadRequest)
+			return
+		}
+		if limit := r.URL.Query().Get("limit"); limit != "" {
+			n, err := strconv.Atoi(limit)
+			if err != nil || n < 0 {
+				http.Error(w, fmt.Sprintf("invalid limit %q", limit), http.StatusBadRequest)
+				return
+			}
+			if n < len(s.PerName) {
+				s.PerName = s.PerName[:n]
+			}
+		}
+		respondJSON(w, http.StatusOK, s)
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStats(t *testing.T) {
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+		`{"name":"bar_seconds","type":"histogram","help":"Bar duration.","buckets":[0.1,1]}`,
+	})...)
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	u.now = func() time.Time { return now }
+	loadObservations(t, u, makeObservations(t, []string{
+		`foo_total{code="200",method="GET"} 1`,
+		`foo_total{code="404",method="GET"} 1`,
+		`foo_total{code="500",method="GET"} 1`,
+		`foo_total{code="500",method="PUT"} 1`,
+	}))
+
+	s := u.stats()
+	if want, have := 2, s.Metrics; want != have {
+		t.Errorf("metrics: want %d, have %d", want, have)
+	}
+	if want, have := 6, s.Series; want != have {
+		t.Errorf("series: want %d, have %d", want, have)
+	}
+
+	bar, foo := s.PerName[0], s.PerName[1]
+	if bar.LastObserved != nil {
+		t.Errorf("bar_seconds: want no last observed time, have %v", bar.LastObserved)
+	}
+	if want, have := seriesOverheadBytes+valueBytes["histogram"]+len(`bar_seconds {}`)+2*bucketOverheadBytes, bar.Bytes; want != have {
+		t.Errorf("bar_seconds bytes: want %d, have %d", want, have)
+	}
+	if want, have := bar.Bytes, bar.BytesPerSeries; want != have {
+		t.Errorf("bar_seconds bytes per series: want %d, have %d", want, have)
+	}
+	if foo.LastObserved == nil || !foo.LastObserved.Equal(now) {
+		t.Errorf("foo_total: want last observed %v, have %v", now, foo.LastObserved)
+	}
+	if want, have := 5, foo.Series; want != have {
+		t.Errorf("foo_total series: want %d, have %d", want, have)
+	}
+	if want, have := []labelCardinality{
+		{Key: "code", Values: 3},
+		{Key: "method", Values: 2},
+	}, foo.TopLabelKeys; !cmp.Equal(want, have) {
+		t.Error(cmp.Diff(want, have))
+	}
+	if want, have := s.Bytes, bar.Bytes+foo.Bytes; want != have {
+		t.Errorf("total bytes: want %d, have %d", want, have)
+	}
+}
+
+func TestStatsBytesTracksDeletes(t *testing.T) {
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+	})...)
+	loadObservations(t, u, makeObservations(t, []string{
+		`foo_total{code="200"} 1`,
+	}))
+	before := u.stats().Bytes
+	loadObservations(t, u, makeObservations(t, []string{
+		`foo_total{code="404",path="/some/long/path"} 1`,
+		`{"name":"foo_total","op":"delete","labels":{"code":"404","path":"/some/long/path"}}`,
+		`{"name":"foo_total","op":"delete","labels":{"code":"500"}}`,
+	}))
+	if want, have := before, u.stats().Bytes; want != have {
+		t.Errorf("after delete: want %d, have %d", want, have)
+	}
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"foo_total","op":"delete"}`,
+	}))
+	if want, have := 0, u.stats().Bytes; want != have {
+		t.Errorf("after delete all: want %d, have %d", want, have)
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"a_total","type":"counter","help":"A."}`,
+		`{"name":"b_total","type":"counter","help":"B."}`,
+		`{"name":"c_seconds","type":"histogram","help":"C.","buckets":[1,2,3,4,5,6,7,8]}`,
+	})...)
+	loadObservations(t, u, makeObservations(t, []string{
+		`a_total{code="200"} 1`,
+		`b_total{code="200"} 1`,
+		`b_total{code="404"} 1`,
+		`b_total{code="500"} 1`,
+		`c_seconds{} 1`,
+	}))
+	get := func(query string) (int, []string) {
+		rec := httptest.NewRecorder()
+		statsHandler(u).ServeHTTP(rec, httptest.NewRequest("GET", "/admin/stats"+query, nil))
+		var s universeStats
+		json.Unmarshal(rec.Body.Bytes(), &s)
+		var names []string
+		for _, ms := range s.PerName {
+			names = append(names, ms.Name)
+		}
+		return rec.Code, names
+	}
+	for query, want := range map[string][]string{
+		"":                     {"a_total", "b_total", "c_seconds"},
+		"?sort=series":         {"b_total", "a_total", "c_seconds"},
+		"?sort=bytes&limit=1":  {"b_total"},
+		"?sort=name&limit=100": {"a_total", "b_total", "c_seconds"},
+	} {
+		code, have := get(query)
+		if code != http.StatusOK {
+			t.Errorf("%s: want %d, have %d", query, http.StatusOK, code)
+		}
+		if !cmp.Equal(want, have) {
+			t.Errorf("%s: %s", query, cmp.Diff(want, have))
+		}
+	}
+	for _, query := range []string{"?sort=color", "?limit=-1", "?limit=many"} {
+		if code, _ := get(query); code != http.StatusBadRequest {
+			t.Errorf("%s: want %d, have %d", query, http.StatusBadRequest, code)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/beorn7/perks/quantile"
+)
+
+// Defaults for summaries, the same as client_golang's.
+var defaultQuantiles = []float64{0.5, 0.9, 0.99}
+
+const (
+	defaultSummaryWindow = 10 * time.Minute
+	defaultAgeBuckets    = 5
+	maxAgeBuckets        = 60
+)
+
+// normalizeQuantiles returns a sorted copy of the quantiles of a declaration,
+// which only summaries can have, or the default quantiles of a summary.
+func normalizeQuantiles(typ string, quantiles []float64) ([]float64, error) {
+	switch {
+	case typ != "summary" && quantiles != nil:
+		return nil, fmt.Errorf("quantiles are only for summaries, not %ss", typ)
+	case typ != "summary":
+		return nil, nil
+	case quantiles == nil:
+		return defaultQuantiles, nil
+	}
+	quantiles = append([]float64(nil), quantiles...)
+	sort.Float64s(quantiles)
+	for i, q := range quantiles {
+		if !(q > 0 && q < 1) {
+			return nil, fmt.Errorf("quantile %v isn't between 0 and 1", q)
+		}
+		if i > 0 && q == quantiles[i-1] {
+			return nil, fmt.Errorf("duplicate quantile %v", q)
+		}
+	}
+	return quantiles, nil
+}
+
+// sameQuantiles returns true if the quantiles, once normalized, are the
+// collection's quantiles.
+func (c *timeseriesCollection) sameQuantiles(quantiles []float64) bool {
+	normalized, err := normalizeQuantiles(c.typ, quantiles)
+	if err != nil || len(normalized) != len(c.quantiles) {
+		return false
+	}
+	for i := range normalized {
+		if normalized[i] != c.quantiles[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// parseAgeBuckets returns the number of age buckets of a declaration, which
+// only summaries can have, or the default for a summary.
+func parseAgeBuckets(typ string, n int) (int, error) {
+	switch {
+	case typ != "summary" && n != 0:
+		return 0, fmt.Errorf("age buckets are only for summaries, not %ss", typ)
+	case typ != "summary":
+		return 0, nil
+	case n == 0:
+		return defaultAgeBuckets, nil
+	case n < 0 || n > maxAgeBuckets:
+		return 0, fmt.Errorf("age buckets %d isn't between 1 and %d", n, maxAgeBuckets)
+	}
+	return n, nil
+}
+
+// summary keeps quantiles of the observations in a sliding window, as
+// client_golang's summaries do with MaxAge and AgeBuckets: every observation
+// goes into each of the age buckets' streams, which start over in turn, and
+// the quantiles come from the oldest, which has the whole window, give or
+// take one age bucket. The sum and count are of every observation, ever, as
+// Prometheus expects, so they can be rated.
+type summary struct {
+	k         timeseriesKey
+	n         string
+	h         string
+	labels    labelPairs
+	quantiles []float64
+	age       time.Duration // of each age bucket, i.e. how often one starts over
+	now       func() time.Time
+	cache     renderCache
+
+	mtx     sync.Mutex
+	version uint64 // of the render cache, bumped by every change
+	sum     float64
+	count   uint64
+	streams []*quantile.Stream
+	head    int       // the oldest stream, which the quantiles come from
+	expires time.Time // when the head stream starts over
+}
+
+func newSummary(o observation, quantiles []float64, window time.Duration, ageBuckets int, now func() time.Time) (*summary, error) {
+	targets := make(map[float64]float64, len(quantiles))
+	for _, q := range quantiles {
+		targets[q] = quantileError(q)
+	}
+	streams := make([]*quantile.Stream, ageBuckets)
+	for i := range streams {
+		streams[i] = quantile.NewTargeted(targets)
+	}
+	age := window / time.Duration(ageBuckets)
+	return &summary{
+		k:         o.timeseriesKey(),
+		n:         o.Name,
+		h:         o.Help,
+		labels:    makeLabelPairs(o.Labels),
+		quantiles: quantiles,
+		age:       age,
+		now:       now,
+		streams:   streams,
+		expires:   now().Add(age),
+	}, nil
+}
+
+// quantileError is the error allowed in the rank of a quantile: a tenth of
+// the distance to the nearer end, e.g. 0.05 for the median, and 0.001 for
+// the 99th percentile, which are client_golang's usual objectives.
+func quantileError(q float64) float64 {
+	return math.Min(q, 1-q) / 10
+}
+
+func (s *summary) metricName() metricName {
+	return metricName(s.n)
+}
+
+func (s *summary) timeseriesKey() timeseriesKey { return s.k }
+
+func (s *summary) labelSet() labelPairs { return s.labels }
+
+func (s *summary) observe(o observation) error {
+	if o.Value == nil {
+		return nil // declaration
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.rotate()
+	s.version++
+	s.sum += *o.Value
+	s.count++
+	for _, stream := range s.streams {
+		stream.Insert(*o.Value)
+	}
+	return nil
+}
+
+// rotate starts the head stream over, and makes the next one the head, for
+// every age bucket which has passed. The caller must hold the mutex.
+func (s *summary) rotate() {
+	now := s.now()
+	for i := 0; !now.Before(s.expires); i++ {
+		if i == len(s.streams) { // they've all started over
+			s.expires = now.Add(s.age)
+			break
+		}
+		s.streams[s.head].Reset()
+		s.head = (s.head + 1) % len(s.streams)
+		s.expires = s.expires.Add(s.age)
+		s.version++
+	}
+}
+
+func (s *summary) touched() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.count > 0
+}
+
+func (s *summary) renderText(precision int) string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.rotate()
+	if text, ok := s.cache.get(s.version); ok {
+		return text
+	}
+	text := s.render(precision)
+	s.cache.set(s.version, text)
+	return text
+}
+
+// render renders the quantiles of the window, which are NaN if nothing was
+// observed in it, as client_golang has them, and the sum and count. The
+// caller must hold the mutex.
+func (s *summary) render(precision int) string {
+	b := make([]byte, 0, (len(s.quantiles)+2)*(len(s.n)+len(s.k)+24))
+	var q [32]byte
+	head := s.streams[s.head]
+	for _, quantile := range s.quantiles {
+		value := math.NaN()
+		if head.Count() > 0 {
+			value = head.Query(quantile)
+		}
+		b = append(b, s.n...)
+		b = s.labels.appendTextWith(b, "quantile", strconv.AppendFloat(q[:0], quantile, 'g', -1, 64))
+		b = append(b, ' ')
+		b = appendValue(b, value, precision)
+		b = append(b, '\n')
+	}
+	b = appendSample(b, s.n, "_sum", s.labels, s.sum, precision)
+	b = appendCount(b, s.n, "_count", s.labels, s.count)
+	return string(b)
+}
+
+// dump has the sum and count; the quantiles are of a window, which isn't
+// kept.
+func (s *summary) dump() seriesDump {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	sum, count := s.sum, s.count
+	return seriesDump{Labels: s.labels.toMap(), Sum: &sum, Count: &count}
+}
+
+// restore sets the summary to the dumped sum and count. Its quantiles start
+// with an empty window.
+func (s *summary) restore(sd seriesDump) error {
+	if sd.Sum == nil || sd.Count == nil {
+		return fmt.Errorf("summary has no sum or count")
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.sum, s.count = *sd.Sum, *sd.Count
+	s.version++
+	return nil
+}
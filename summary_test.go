@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSummary(t *testing.T) {
+	u, _ := newUniverse()
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	u.now = func() time.Time { return now }
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"req_seconds","type":"summary","help":"Request duration.","quantiles":[0.9,0.5],"window":"1m","age_buckets":2}`,
+		`req_seconds{} 1`,
+		`req_seconds{} 2`,
+		`req_seconds{} 3`,
+		`req_seconds{} 4`,
+	}))
+
+	samples := func() string {
+		var lines []string
+		for _, line := range strings.Split(scrape(t, u), "\n") {
+			if strings.HasPrefix(line, "req_seconds") {
+				lines = append(lines, line)
+			}
+		}
+		return strings.Join(lines, "\n")
+	}
+	start := now
+	for _, testcase := range []struct {
+		name  string
+		at    time.Time
+		lines []string
+		want  string
+	}{
+		{
+			name: "first age bucket",
+			at:   start,
+			want: "req_seconds{quantile=\"0.5\"} 2\nreq_seconds{quantile=\"0.9\"} 4\nreq_seconds_sum{} 10\nreq_seconds_count{} 4",
+		},
+		{
+			name:  "second age bucket",
+			at:    start.Add(30 * time.Second),
+			lines: []string{`req_seconds{} 10`},
+			want:  "req_seconds{quantile=\"0.5\"} 3\nreq_seconds{quantile=\"0.9\"} 10\nreq_seconds_sum{} 20\nreq_seconds_count{} 5",
+		},
+		{
+			name: "first age bucket gone",
+			at:   start.Add(time.Minute),
+			want: "req_seconds{quantile=\"0.5\"} 10\nreq_seconds{quantile=\"0.9\"} 10\nreq_seconds_sum{} 20\nreq_seconds_count{} 5",
+		},
+		{
+			name: "after a quiet window",
+			at:   start.Add(2 * time.Minute),
+			want: "req_seconds{quantile=\"0.5\"} NaN\nreq_seconds{quantile=\"0.9\"} NaN\nreq_seconds_sum{} 20\nreq_seconds_count{} 5",
+		},
+	} {
+		now = testcase.at
+		loadObservations(t, u, makeObservations(t, testcase.lines))
+		if want, have := testcase.want, samples(); want != have {
+			t.Errorf("%s: want\n%s\nhave\n%s", testcase.name, want, have)
+		}
+	}
+	if errs := validateExposition([]byte(scrape(t, u))); len(errs) > 0 {
+		t.Errorf("exposition: %v", errs)
+	}
+}
+
+func TestSummaryDeclarations(t *testing.T) {
+	for _, testcase := range []struct {
+		decl  string
+		valid bool
+	}{
+		{`{"name":"foo","type":"summary","help":"Foo."}`, true},
+		{`{"name":"foo","type":"summary","help":"Foo.","quantiles":[0.25,0.75],"window":"1h","age_buckets":6}`, true},
+		{`{"name":"foo","type":"summary","help":"Foo.","quantiles":[0.5,1]}`, false},
+		{`{"name":"foo","type":"summary","help":"Foo.","quantiles":[0.5,0.5]}`, false},
+		{`{"name":"foo","type":"summary","help":"Foo.","age_buckets":-1}`, false},
+		{`{"name":"foo","type":"summary","help":"Foo.","age_buckets":61}`, false},
+		{`{"name":"foo","type":"histogram","help":"Foo.","quantiles":[0.5]}`, false},
+		{`{"name":"foo","type":"gauge","help":"Foo.","age_buckets":5}`, false},
+	} {
+		u, _ := newUniverse()
+		_, err := u.declare(makeObservations(t, []string{testcase.decl})[0])
+		if want, have := testcase.valid, err == nil; want != have {
+			t.Errorf("%s: want valid %v, have %v (%v)", testcase.decl, want, have, err)
+		}
+	}
+
+	// Redeclaring with other quantiles, or age buckets, is a conflict.
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo","type":"summary","help":"Foo."}`,
+	})...)
+	for _, line := range []string{
+		`{"name":"foo","type":"summary","help":"Foo.","quantiles":[0.99,0.9,0.5],"window":"10m","age_buckets":5,"value":1}`,
+	} {
+		if err := u.observe(makeObservations(t, []string{line})[0]); err != nil {
+			t.Errorf("%s: %v", line, err)
+		}
+	}
+	for _, line := range []string{
+		`{"name":"foo","quantiles":[0.5],"value":1}`,
+		`{"name":"foo","age_buckets":2,"value":1}`,
+		`{"name":"foo","window":"1m","value":1}`,
+	} {
+		if err := u.observe(makeObservations(t, []string{line})[0]); err == nil {
+			t.Errorf("%s: want error, have none", line)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// telemetry is a source of the aggregator's own metrics, which are rendered
+// in the Prometheus text format after the metrics in the universe.
+type telemetry interface {
+	renderTelemetry(w io.Writer)
+}
+
+// renderMetrics writes the universe, followed by each telemetry source, and
+// returns the number of timeseries from the universe. If writing the
+// universe fails, the telemetry isn't written.
+func renderMetrics(w io.Writer, u *universe, sources ...telemetry) (series int, err error) {
+	if series, err = u.writeText(w); err != nil {
+		return series, err
+	}
+	for _, t := range sources {
+		t.renderTelemetry(w)
+	}
+	return series, nil
+}
+
+// metricsHandler streams the universe, followed by each telemetry source.
+// Every scrape is logged to the scrape logger.
+func metricsHandler(u *universe, scrapeLogger log.Logger, sources ...telemetry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		begin := time.Now()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		cw := &countingWriter{w: w}
+		bw := bufio.NewWriterSize(cw, scrapeBufferSize)
+		u.scrapes.begin()
+		series, err := renderMetrics(bw, u, sources...)
+		if err == nil {
+			err = bw.Flush()
+		}
+		keyvals := []interface{}{"scrape", r.URL.Path, "remote_addr", r.RemoteAddr, "user_agent", r.UserAgent(), "bytes", cw.n, "series", series, "took", time.Since(begin)}
+		if err != nil {
+			keyvals = append(keyvals, "err", err)
+		}
+		level.Info(scrapeLogger).Log(keyvals...)
+	})
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+	})...)
+	loadObservations(t, u, makeObservations(t, []string{
+		`foo_total{code="200"} 1`,
+		`foo_total{code="500"} 1`,
+	}))
+	a := newActivity(0)
+	a.accept("10.0.0.1:1234", nil, []byte(`foo_total{code="200"} 1`))
+
+	var logs bytes.Buffer
+	rec := httptest.NewRecorder()
+	metricsHandler(u, log.NewLogfmtLogger(&logs), a).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		`foo_total{code="500"} 1`,
+		`prometheus_aggregator_client_lines_total{client="10.0.0.1",result="accepted"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("response doesn't contain %q", want)
+		}
+	}
+	for _, want := range []string{
+		`scrape=/metrics`,
+		`series=2`,
+		`remote_addr=192.0.2.1:1234`,
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("scrape log %q doesn't contain %q", logs.String(), want)
+		}
+	}
+}
+
+func TestWriteTextStopsOnError(t *testing.T) {
+	u, _ := newUniverse()
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"a_total","type":"counter","help":"A.","value":1}`,
+		`{"name":"b_total","type":"counter","help":"B.","value":1}`,
+		`{"name":"c_total","type":"counter","help":"C.","value":1}`,
+	}))
+	w := &failingWriter{after: 1}
+	series, err := u.writeText(w)
+	if err == nil {
+		t.Fatal("want error, have none")
+	}
+	if want, have := 2, series; want != have {
+		t.Errorf("series: want %d, have %d", want, have)
+	}
+	if want, have := 2, w.writes; want != have {
+		t.Errorf("writes: want %d, have %d", want, have)
+	}
+}
+
+// failingWriter fails every write after the first few.
+type failingWriter struct {
+	after  int
+	writes int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.writes > w.after {
+		return 0, errors.New("broken pipe")
+	}
+	return len(p), nil
+}
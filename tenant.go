@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// tenant is a team, or anyone else, whose metrics are kept apart from
+// everyone else's: by a prefix on their names, by a label, or in a universe
+// of their own. A tenant is whoever writes to its socket, or whoever has a
+// client certificate with its name.
+type tenant struct {
+	name     string
+	socket   string            // address, like -socket; "" for identities
+	prefix   string            // prepended to every metric name; "" means none
+	labels   map[string]string // set on every line, replacing the line's own
+	universe bool              // whether it has a universe of its own
+}
+
+// tenancy is how tenants' metrics are kept apart. If the tenants don't have
+// universes of their own, and there's no label, their metric names are
+// prefixed with their name and an underscore.
+type tenancy struct {
+	label     string // set to the tenant's name on every line
+	universes bool   // each tenant gets a universe of its own
+}
+
+func (y tenancy) tenant(name string) *tenant {
+	t := &tenant{name: name}
+	switch {
+	case y.universes:
+		t.universe = true
+	case y.label != "":
+		t.labels = map[string]string{y.label: name}
+	default:
+		t.prefix = name + "_"
+	}
+	return t
+}
+
+// parseTenants parses a comma-separated list of name=socket pairs.
+func parseTenants(s string, y tenancy) ([]*tenant, error) {
+	var tenants []*tenant
+	seen := map[string]bool{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		x := strings.IndexByte(field, '=')
+		if x < 0 {
+			return nil, fmt.Errorf("%q: want name=socket", field)
+		}
+		name, socket := field[:x], field[x+1:]
+		switch {
+		case !validMetricName(name):
+			return nil, fmt.Errorf("%q: tenant name must be a valid metric name", name)
+		case seen[name]:
+			return nil, fmt.Errorf("%q: duplicate tenant", name)
+		case socket == "":
+			return nil, fmt.Errorf("%q: no socket", name)
+		}
+		seen[name] = true
+		t := y.tenant(name)
+		t.socket = socket
+		tenants = append(tenants, t)
+	}
+	return tenants, nil
+}
+
+// tenantName makes a tenant name out of an identity, like the common name of
+// a client certificate, by replacing everything which can't be in a metric
+// name with an underscore.
+func tenantName(id string) string {
+	b := []byte(id)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// tenantUniverses is an observer which keeps the observations of each tenant
+// with a universe of its own in that universe, which is created the first
+// time the tenant is seen, so tenants can't trample each other's metric
+// names, or run each other into limits. Observations without a tenant go to
+// the default universe.
+type tenantUniverses struct {
+	def         *universe
+	newUniverse func() *universe
+
+	mtx       sync.RWMutex
+	universes map[string]*universe
+}
+
+func newTenantUniverses(def *universe, newUniverse func() *universe) *tenantUniverses {
+	return &tenantUniverses{
+		def:         def,
+		newUniverse: newUniverse,
+		universes:   map[string]*universe{},
+	}
+}
+
+// get returns the tenant's universe, or nil if the tenant hasn't been seen.
+func (t *tenantUniverses) get(name string) *universe {
+	if name == "" {
+		return t.def
+	}
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.universes[name]
+}
+
+// universe returns the tenant's universe, creating it if necessary.
+func (t *tenantUniverses) universe(name string) *universe {
+	if u := t.get(name); u != nil {
+		return u
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	u, ok := t.universes[name]
+	if !ok {
+		u = t.newUniverse()
+		t.universes[name] = u
+	}
+	return u
+}
+
+// names returns the tenants with universes, in order.
+func (t *tenantUniverses) names() []string {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	names := make([]string, 0, len(t.universes))
+	for name := range t.universes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// declare declares the declarations in every tenant's universe, e.g. after
+// they've been reloaded. Only the default universe's declarations are
+// reported, and audited, so errors are ignored here.
+func (t *tenantUniverses) declare(decls []observation) {
+	for _, name := range t.names() {
+		u := t.get(name)
+		for _, o := range decls {
+			u.declare(o)
+		}
+	}
+}
+
+func (t *tenantUniverses) observe(o observation) error {
+	return t.universe(o.Tenant).observe(o)
+}
+
+// observeBatch observes each run of observations from the same tenant as a
+// batch, in its universe. Usually, the whole batch is one run.
+func (t *tenantUniverses) observeBatch(obs []observation) error {
+	var errs batchError
+	for start, end := 0, 0; start < len(obs); start = end {
+		end = start + 1
+		for end < len(obs) && obs[end].Tenant == obs[start].Tenant {
+			end++
+		}
+		err := t.universe(obs[start].Tenant).observeBatch(obs[start:end])
+		if start == 0 && end == len(obs) {
+			return err
+		}
+		if err == nil {
+			continue
+		}
+		if errs == nil {
+			errs = make(batchError, len(obs))
+		}
+		for j := start; j < end; j++ {
+			errs[j] = errorAt(err, j-start)
+		}
+	}
+	if errs == nil {
+		return nil
+	}
+	return errs
+}
+
+// tenantMetricsHandler serves each tenant's universe, with its violations,
+// at prefix followed by the tenant's name.
+func tenantMetricsHandler(t *tenantUniverses, prefix string, scrapeLogger log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, prefix)
+		u := t.get(name)
+		if name == "" || u == nil {
+			http.NotFound(w, r)
+			return
+		}
+		metricsHandler(u, scrapeLogger, u.violations).ServeHTTP(w, r)
+	})
+}
+
+// Reasons for rejecting a tenant's lines.
+const (
+	quotaRate   = "rate"   // over the tenant's rate limit
+	quotaSeries = "series" // would be a new series past the tenant's limit
+)
+
+// tenantQuotas limits the lines and bytes per second of each tenant, across
+// all of its clients, and counts each tenant's lines rejected for being over
+// its quotas, so a noisy tenant can see that it's the noisy one. A nil
+// tenantQuotas limits and counts nothing.
+type tenantQuotas struct {
+	limiter *rateLimiter // keyed by tenant; may be nil
+
+	mtx      sync.Mutex
+	rejected map[quotaKey]uint64
+}
+
+type quotaKey struct {
+	tenant string
+	reason string
+}
+
+func newTenantQuotas(limiter *rateLimiter) *tenantQuotas {
+	return &tenantQuotas{limiter: limiter, rejected: map[quotaKey]uint64{}}
+}
+
+// limit is the rate limiter's limit, for the tenant. Lines without a tenant
+// are within it.
+func (q *tenantQuotas) limit(tenant string, size int, stream bool) (action string, wait time.Duration) {
+	if q == nil || tenant == "" {
+		return "", 0
+	}
+	action, wait = q.limiter.limit(tenant, size, stream)
+	if action != "" {
+		q.reject(tenant, quotaRate)
+	}
+	return action, wait
+}
+
+// reject counts a line of the tenant's rejected for the reason.
+func (q *tenantQuotas) reject(tenant, reason string) {
+	if q == nil || tenant == "" {
+		return
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.rejected[quotaKey{tenant, reason}]++
+}
+
+// renderTelemetry writes the number of lines rejected, by tenant and reason,
+// in the Prometheus text format.
+func (q *tenantQuotas) renderTelemetry(w io.Writer) {
+	if q == nil {
+		return
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	keys := make([]quotaKey, 0, len(q.rejected))
+	for k := range q.rejected {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].tenant != keys[j].tenant {
+			return keys[i].tenant < keys[j].tenant
+		}
+		return keys[i].reason < keys[j].reason
+	})
+	fmt.Fprintf(w, "# HELP prometheus_aggregator_tenant_rejected_lines_total Lines over a tenant's quotas, by tenant and quota.\n")
+	fmt.Fprintf(w, "# TYPE prometheus_aggregator_tenant_rejected_lines_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(w, "prometheus_aggregator_tenant_rejected_lines_total%s %d\n", renderLabels(map[string]string{"tenant": k.tenant, "reason": k.reason}), q.rejected[k])
+	}
+	fmt.Fprintln(w)
+}
+
+// forTenant returns an ingester for a tenant's socket, which shares
+// everything else, including its workers, with i.
+func (i *ingester) forTenant(t *tenant) *ingester {
+	return &ingester{
+		observer: i.observer,
+		activity: i.activity,
+		tracer:   i.tracer,
+		errlog:   i.errlog,
+		stats:    i.stats,
+		audit:    i.audit,
+		strict:   i.strict,
+		reply:    i.reply,
+		logger:   log.With(i.logger, "tenant", t.name),
+		queues:   i.queues,
+		overflow: i.overflow,
+		maxLine:  i.maxLine,
+		identity: i.identity,
+		tokens:   i.tokens,
+		filter:   i.filter,
+		limiter:  i.limiter,
+		tenants:  i.tenants,
+		labels:   i.labels,
+		rules:    i.rules,
+		pods:     i.pods,
+		quotas:   i.quotas,
+		drainer:  i.drainer,
+		tenant:   t,
+	}
+}
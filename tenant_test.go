@@ -0,0 +1,202 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestParseTenants(t *testing.T) {
+	tenants, err := parseTenants("team_a=tcp://0.0.0.0:8201, team_b=udp://0.0.0.0:8202", tenancy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have []string
+	for _, tenant := range tenants {
+		have = append(have, tenant.name+" "+tenant.socket+" "+tenant.prefix)
+	}
+	if want, have := "team_a tcp://0.0.0.0:8201 team_a_, team_b udp://0.0.0.0:8202 team_b_", strings.Join(have, ", "); want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+
+	tenants, err = parseTenants("team_a=tcp://0.0.0.0:8201", tenancy{label: "team"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "", tenants[0].prefix; want != have {
+		t.Errorf("with a label, prefix: want %q, have %q", want, have)
+	}
+	if want, have := "team_a", tenants[0].labels["team"]; want != have {
+		t.Errorf("with a label, label: want %q, have %q", want, have)
+	}
+
+	for _, s := range []string{
+		"team_a",
+		"team-a=tcp://0.0.0.0:8201",
+		"team_a=",
+		"team_a=tcp://0.0.0.0:8201,team_a=tcp://0.0.0.0:8202",
+	} {
+		if _, err := parseTenants(s, tenancy{}); err == nil {
+			t.Errorf("%q: want error, have none", s)
+		}
+	}
+}
+
+func TestTenantIngest(t *testing.T) {
+	for _, testcase := range []struct {
+		label string
+		want  string
+	}{
+		{"", `
+			# HELP foo_total Foo.
+			# TYPE foo_total counter
+			foo_total{} 1
+
+			# HELP team_a_foo_total Foo, for team A.
+			# TYPE team_a_foo_total counter
+			team_a_foo_total{code="500",team="team_b"} 3
+			team_a_foo_total{team="team_b"} 2
+		`},
+		{"team", `
+			# HELP foo_total Foo.
+			# TYPE foo_total counter
+			foo_total{code="500",team="team_a"} 3
+			foo_total{team="team_a"} 2
+			foo_total{} 1
+		`},
+	} {
+		u, _ := newUniverse(makeObservations(t, []string{
+			`{"name":"foo_total","type":"counter","help":"Foo."}`,
+			`{"name":"team_a_foo_total","type":"counter","help":"Foo, for team A."}`,
+		})...)
+		tenants, err := parseTenants("team_a=tcp://127.0.0.1:0", tenancy{label: testcase.label})
+		if err != nil {
+			t.Fatal(err)
+		}
+		i := &ingester{observer: u, activity: newActivity(0), logger: log.NewNopLogger()}
+		i.handleConn(ioutil.NopCloser(strings.NewReader("foo_total{} 1\n")), "test")
+		i.forTenant(tenants[0]).handleConn(ioutil.NopCloser(strings.NewReader(`foo_total{team="team_b"} 2`+"\n"+`foo_total{team="team_b",code="500"} 3`+"\n")), "test")
+		if want, have := normalizeResponse(testcase.want), normalizeResponse(scrape(t, u)); want != have {
+			t.Errorf("label %q:\n---WANT---\n%s\n\n---HAVE---\n%s\n", testcase.label, want, have)
+		}
+
+		// A tenant's deletes only delete its own series, but all of them.
+		i.forTenant(tenants[0]).handleConn(ioutil.NopCloser(strings.NewReader(`{"name":"foo_total","op":"delete"}`+"\n")), "test")
+		if want, have := normalizeResponse(`
+			# HELP foo_total Foo.
+			# TYPE foo_total counter
+			foo_total{} 1
+		`), normalizeResponse(scrape(t, u)); want != have {
+			t.Errorf("label %q: after delete:\n---WANT---\n%s\n\n---HAVE---\n%s\n", testcase.label, want, have)
+		}
+	}
+}
+
+func TestTenantUniverses(t *testing.T) {
+	decl := makeObservations(t, []string{`{"name":"foo_total","type":"counter","help":"Foo."}`})
+	u, _ := newUniverse(decl...)
+	tenants := newTenantUniverses(u, func() *universe {
+		tu, _ := newUniverse()
+		tu.limit = newSeriesLimit(2)
+		tu.declare(decl[0])
+		return tu
+	})
+	teams, err := parseTenants("team_a=tcp://127.0.0.1:0", tenancy{universes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := &ingester{observer: tenants, activity: newActivity(0), logger: log.NewNopLogger()}
+	i.handleConn(ioutil.NopCloser(strings.NewReader("foo_total{} 1\n")), "test")
+	i.forTenant(teams[0]).handleConn(ioutil.NopCloser(strings.NewReader("foo_total{a=\"1\"} 2\nfoo_total{a=\"2\"} 4\nfoo_total{a=\"3\"} 8\n")), "test")
+
+	if want, have := normalizeResponse(`
+		# HELP foo_total Foo.
+		# TYPE foo_total counter
+		foo_total{} 1
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Errorf("default:\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+
+	// Past its limit, a tenant can't create any more series.
+	h := tenantMetricsHandler(tenants, "/metrics/", log.NewNopLogger())
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics/team_a", nil))
+	if want, have := normalizeResponse(`
+		# HELP foo_total Foo.
+		# TYPE foo_total counter
+		foo_total{a="1"} 2
+		foo_total{a="2"} 4
+
+		# HELP prometheus_aggregator_violations_total Observations rejected by validation, by metric and kind of violation.
+		# TYPE prometheus_aggregator_violations_total counter
+	`), normalizeResponse(rec.Body.String()); want != have {
+		t.Errorf("team_a:\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+	for _, path := range []string{"/metrics/team_b", "/metrics/"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if want, have := http.StatusNotFound, rec.Code; want != have {
+			t.Errorf("%s: want %d, have %d", path, want, have)
+		}
+	}
+
+	// Errors in a batch which spans tenants are where they belong.
+	value := 1.0
+	err = tenants.observeBatch([]observation{
+		{Name: "foo_total", Value: &value},
+		{Name: "bar_total", Value: &value, Tenant: "team_b"},
+		{Name: "foo_total", Value: &value, Tenant: "team_b"},
+	})
+	for n, want := range []bool{false, true, false} {
+		if have := errorAt(err, n) != nil; want != have {
+			t.Errorf("batch %d: want error %v, have %v", n, want, errorAt(err, n))
+		}
+	}
+}
+
+func TestTenantQuotas(t *testing.T) {
+	decl := makeObservations(t, []string{`{"name":"foo_total","type":"counter","help":"Foo."}`})
+	u, _ := newUniverse(decl...)
+	tenants := newTenantUniverses(u, func() *universe {
+		tu, _ := newUniverse()
+		tu.limit = newSeriesLimit(2)
+		tu.declare(decl[0])
+		return tu
+	})
+	teams, err := parseTenants("team_a=tcp://127.0.0.1:0", tenancy{universes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rates := newRateLimiter(4, 0, limitDrop)
+	rates.now = func() time.Time { return time.Unix(1000, 0) }
+	quotas := newTenantQuotas(rates)
+	i := &ingester{observer: tenants, activity: newActivity(0), logger: log.NewNopLogger(), quotas: quotas}
+
+	lines := "foo_total{a=\"1\"} 1\nfoo_total{a=\"2\"} 1\nfoo_total{a=\"3\"} 1\nfoo_total{a=\"4\"} 1\nfoo_total{a=\"5\"} 1\n"
+	i.handleConn(ioutil.NopCloser(strings.NewReader(lines)), "test")
+	i.forTenant(teams[0]).handleConn(ioutil.NopCloser(strings.NewReader(lines)), "test")
+
+	// The default universe has no quotas.
+	if want, have := 5, strings.Count(scrape(t, u), "foo_total{a="); want != have {
+		t.Errorf("default: want %d series, have %d", want, have)
+	}
+	if want, have := 2, strings.Count(scrape(t, tenants.get("team_a")), "foo_total{a="); want != have {
+		t.Errorf("team_a: want %d series, have %d", want, have)
+	}
+
+	var buf strings.Builder
+	quotas.renderTelemetry(&buf)
+	for _, want := range []string{
+		`prometheus_aggregator_tenant_rejected_lines_total{reason="rate",tenant="team_a"} 1`,
+		`prometheus_aggregator_tenant_rejected_lines_total{reason="series",tenant="team_a"} 2`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("want %s, have\n%s", want, buf.String())
+		}
+	}
+}
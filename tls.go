@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// serverTLSConfig returns a TLS config for a listener, which presents the
+// certificate in certFile, with the key in keyFile. If caFile isn't empty,
+// clients must present a certificate signed by one of the CAs in it. The
+// files are watched for changes, and reload loads them all again.
+func serverTLSConfig(certFile, keyFile, caFile string) (config *tls.Config, reload func() error, err error) {
+	kp, err := newKeypair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	config = &tls.Config{
+		GetCertificate: kp.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if caFile == "" {
+		return config, kp.files.reload, nil
+	}
+	cas, err := newCertPool(caFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := config.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = cas.get()
+		return c, nil
+	}
+	reload = func() error {
+		if err := kp.files.reload(); err != nil {
+			return err
+		}
+		return cas.files.reload()
+	}
+	return config, reload, nil
+}
+
+// keypair is a certificate and its key, loaded from files, and reloaded when
+// either file changes.
+type keypair struct {
+	files *watchedFiles
+
+	mtx  sync.Mutex
+	cert *tls.Certificate
+}
+
+func newKeypair(certFile, keyFile string) (*keypair, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("TLS requires both a certificate and a key")
+	}
+	kp := &keypair{}
+	files, err := watchFiles(func() error {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		kp.mtx.Lock()
+		defer kp.mtx.Unlock()
+		kp.cert = &cert
+		return nil
+	}, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	kp.files = files
+	return kp, nil
+}
+
+// getCertificate is a tls.Config GetCertificate func.
+func (kp *keypair) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	kp.files.check()
+	kp.mtx.Lock()
+	defer kp.mtx.Unlock()
+	return kp.cert, nil
+}
+
+// certPool is a set of CA certificates, loaded from a file, and reloaded when
+// it changes, so CAs can be added ahead of rotating client certificates.
+type certPool struct {
+	files *watchedFiles
+
+	mtx  sync.Mutex
+	pool *x509.CertPool
+}
+
+func newCertPool(filename string) (*certPool, error) {
+	p := &certPool{}
+	files, err := watchFiles(func() error {
+		pool, err := loadCertPool(filename)
+		if err != nil {
+			return err
+		}
+		p.mtx.Lock()
+		defer p.mtx.Unlock()
+		p.pool = pool
+		return nil
+	}, filename)
+	if err != nil {
+		return nil, err
+	}
+	p.files = files
+	return p, nil
+}
+
+func (p *certPool) get() *x509.CertPool {
+	p.files.check()
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.pool
+}
+
+// peerIdentity completes the handshake of a server connection, and returns
+// the identity in the client's certificate: its common name, or if it
+// doesn't have one, its first DNS name.
+func peerIdentity(conn *tls.Conn) (string, error) {
+	if err := conn.Handshake(); err != nil {
+		return "", err
+	}
+	return certIdentity(conn.ConnectionState().PeerCertificates)
+}
+
+// certIdentity returns the identity in a client's certificates, as
+// peerIdentity does.
+func certIdentity(certs []*x509.Certificate) (string, error) {
+	if len(certs) == 0 {
+		return "", fmt.Errorf("no client certificate")
+	}
+	switch leaf := certs[0]; {
+	case leaf.Subject.CommonName != "":
+		return leaf.Subject.CommonName, nil
+	case len(leaf.DNSNames) > 0:
+		return leaf.DNSNames[0], nil
+	default:
+		return "", fmt.Errorf("client certificate has no common name or DNS name")
+	}
+}
+
+// loadCertPool reads the PEM-encoded certificates in filename.
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("%s: no certificates found", filename)
+	}
+	return pool, nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestTLSSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certs := writeTestCerts(t, dir)
+
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Foo."}`,
+	})...)
+	i := &ingester{observer: u, activity: newActivity(0), logger: log.NewNopLogger()}
+	ln := listenTLS(t, certs, i)
+	defer ln.Close()
+
+	// Without a client certificate, the handshake fails.
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: certs.pool, ServerName: "localhost"})
+	if err == nil {
+		_, err = conn.Write([]byte("foo_total{} 100\n"))
+		if err == nil {
+			_, err = conn.Read(make([]byte, 1))
+		}
+		conn.Close()
+	}
+	if err == nil {
+		t.Errorf("without client certificate: want error, have none")
+	}
+
+	client, err := tls.LoadX509KeyPair(certs.clientCert, certs.clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err = tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: certs.pool, ServerName: "localhost", Certificates: []tls.Certificate{client}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("foo_total{} 1\nfoo_total{} 2\n")); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	want := normalizeResponse(`
+		# HELP foo_total Foo.
+		# TYPE foo_total counter
+		foo_total{} 3
+	`)
+	deadline := time.Now().Add(5 * time.Second)
+	for normalizeResponse(scrape(t, u)) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, normalizeResponse(scrape(t, u)))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTLSIdentityLabel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certs := writeTestCerts(t, dir)
+
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Foo."}`,
+	})...)
+	i := &ingester{observer: u, activity: newActivity(0), logger: log.NewNopLogger(), identity: "sender"}
+	ln := listenTLS(t, certs, i)
+	defer ln.Close()
+
+	client, err := tls.LoadX509KeyPair(certs.clientCert, certs.clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: certs.pool, ServerName: "localhost", Certificates: []tls.Certificate{client}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The identity replaces whatever the client claims to be.
+	if _, err := conn.Write([]byte(`foo_total{sender="someone-else"} 1` + "\n" + `{"name":"foo_total","value":2}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	want := normalizeResponse(`
+		# HELP foo_total Foo.
+		# TYPE foo_total counter
+		foo_total{sender="billing-service"} 3
+	`)
+	deadline := time.Now().Add(5 * time.Second)
+	for normalizeResponse(scrape(t, u)) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, normalizeResponse(scrape(t, u)))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTLSIdentityTenant(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certs := writeTestCerts(t, dir)
+
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"billing_service_foo_total","type":"counter","help":"Foo, for billing."}`,
+	})...)
+	i := &ingester{observer: u, activity: newActivity(0), logger: log.NewNopLogger(), tenants: &tenancy{}}
+	ln := listenTLS(t, certs, i)
+	defer ln.Close()
+
+	client, err := tls.LoadX509KeyPair(certs.clientCert, certs.clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: certs.pool, ServerName: "localhost", Certificates: []tls.Certificate{client}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("foo_total{} 1\n")); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	want := normalizeResponse(`
+		# HELP billing_service_foo_total Foo, for billing.
+		# TYPE billing_service_foo_total counter
+		billing_service_foo_total{} 1
+	`)
+	deadline := time.Now().Add(5 * time.Second)
+	for normalizeResponse(scrape(t, u)) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, normalizeResponse(scrape(t, u)))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerTLSConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certs := writeTestCerts(t, dir)
+
+	for _, testcase := range [][3]string{
+		{certs.serverCert, "", ""},
+		{"", certs.serverKey, ""},
+		{certs.serverCert, certs.clientKey, ""},
+		{certs.serverCert, certs.serverKey, filepath.Join(dir, "nonexistent.pem")},
+		{certs.serverCert, certs.serverKey, certs.serverKey},
+	} {
+		if _, _, err := serverTLSConfig(testcase[0], testcase[1], testcase[2]); err == nil {
+			t.Errorf("%v: want error, have none", testcase)
+		}
+	}
+}
+
+func TestKeypairReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certs := writeTestCerts(t, dir)
+
+	kp, err := newKeypair(certs.serverCert, certs.serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commonName := func() string {
+		cert, err := kp.getCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+	rotate := func(src, dst string, modTime time.Time) {
+		buf, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, dst, string(buf))
+		if err := os.Chtimes(dst, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want, have := "localhost", commonName(); want != have {
+		t.Fatalf("want %s, have %s", want, have)
+	}
+
+	// Halfway through a rotation, the certificate and key don't match, so the
+	// previous certificate is still used.
+	later := time.Now().Add(time.Minute)
+	rotate(certs.clientCert, certs.serverCert, later)
+	if want, have := "localhost", commonName(); want != have {
+		t.Errorf("half rotated: want %s, have %s", want, have)
+	}
+	rotate(certs.clientKey, certs.serverKey, later)
+	if want, have := "billing-service", commonName(); want != have {
+		t.Errorf("rotated: want %s, have %s", want, have)
+	}
+}
+
+// listenTLS starts a mutual TLS listener, whose connections are handled by
+// the ingester.
+func listenTLS(t *testing.T, certs testCerts, i *ingester) net.Listener {
+	t.Helper()
+	config, _, err := serverTLSConfig(certs.serverCert, certs.serverKey, certs.ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = tls.NewListener(ln, config)
+	go i.forwardListener(ln)
+	return ln
+}
+
+// testCerts are the PEM files written by writeTestCerts: a CA, and a server
+// and client certificate signed by it.
+type testCerts struct {
+	ca                    string
+	serverCert, serverKey string
+	clientCert, clientKey string
+	pool                  *x509.CertPool
+}
+
+func writeTestCerts(t *testing.T, dir string) testCerts {
+	t.Helper()
+	caKey, caCert := newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	serverKey, serverCert := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, caKey)
+	clientKey, clientCert := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "billing-service"},
+		DNSNames:    []string{"billing.example.com"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caCert, caKey)
+
+	certs := testCerts{
+		ca:         filepath.Join(dir, "ca.pem"),
+		serverCert: filepath.Join(dir, "server.pem"),
+		serverKey:  filepath.Join(dir, "server-key.pem"),
+		clientCert: filepath.Join(dir, "client.pem"),
+		clientKey:  filepath.Join(dir, "client-key.pem"),
+		pool:       x509.NewCertPool(),
+	}
+	certs.pool.AddCert(caCert)
+	writePEM(t, certs.ca, "CERTIFICATE", caCert.Raw)
+	writePEM(t, certs.serverCert, "CERTIFICATE", serverCert.Raw)
+	writePEM(t, certs.serverKey, "EC PRIVATE KEY", marshalTestKey(t, serverKey))
+	writePEM(t, certs.clientCert, "CERTIFICATE", clientCert.Raw)
+	writePEM(t, certs.clientKey, "EC PRIVATE KEY", marshalTestKey(t, clientKey))
+	return certs
+}
+
+var testSerial int64
+
+// newTestCert creates a certificate from the template, signed by the parent,
+// or self-signed if the parent is nil.
+func newTestCert(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*ecdsa.PrivateKey, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSerial++
+	template.SerialNumber = big.NewInt(testSerial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cert
+}
+
+func marshalTestKey(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	t.Helper()
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func writePEM(t *testing.T, filename, typ string, der []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// otherValue replaces the values of a label which aren't in its top k.
+const otherValue = "_other"
+
+// topKRule is one of the top-k rules in the config file, which keep only
+// the k most frequent values of a label of a metric, and replace the rest
+// with otherValue, so a high cardinality label, like a URL path, can be
+// observed without a series for every value.
+type topKRule struct {
+	Metric string `yaml:"metric"`
+	Label  string `yaml:"label"`
+	K      int    `yaml:"k"`
+}
+
+// check returns an error if the rule isn't valid.
+func (r topKRule) check() error {
+	switch {
+	case !validMetricName(r.Metric):
+		return fmt.Errorf("invalid metric %q", r.Metric)
+	case !validLabelName(r.Label):
+		return fmt.Errorf("%s has invalid label %q", r.Metric, r.Label)
+	case r.K < 1:
+		return fmt.Errorf("%s %s requires a k of at least 1", r.Metric, r.Label)
+	}
+	return nil
+}
+
+// topKCapacity is how many values a topK keeps counts of, per value of k.
+const topKCapacity = 4
+
+// topK finds the most frequent values of a label, approximately, in a fixed
+// amount of memory, with the Space-Saving algorithm: it keeps counts of a
+// few times k values, and when a value it isn't counting turns up, and it's
+// full, it replaces the value with the smallest count, and inherits its
+// count as the new value's possible error. A value is in the top k if the
+// count it's known to have is at least that of the kth value. Once there are
+// more than k values, that's at least 2, so a value seen once, since it was
+// last replaced, never is.
+type topK struct {
+	k int
+
+	mtx       sync.Mutex
+	entries   map[string]*topKEntry
+	heap      topKHeap // of the entries, by count
+	threshold uint64   // the known count of the kth value
+	since     int      // observations since the threshold was computed
+}
+
+type topKEntry struct {
+	value string
+	count uint64 // including the error
+	err   uint64 // the count of the value it replaced
+	index int    // in the heap
+}
+
+func newTopK(k int) *topK {
+	return &topK{k: k, entries: map[string]*topKEntry{}}
+}
+
+// observe counts the value, and returns true if it's in the top k.
+func (t *topK) observe(value string) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	e, ok := t.entries[value]
+	switch {
+	case ok:
+		e.count++
+		heap.Fix(&t.heap, e.index)
+	case len(t.entries) < topKCapacity*t.k:
+		e = &topKEntry{value: value, count: 1}
+		t.entries[value] = e
+		heap.Push(&t.heap, e)
+	default:
+		e = t.heap[0]
+		delete(t.entries, e.value)
+		e.value, e.err = value, e.count
+		e.count++
+		t.entries[value] = e
+		heap.Fix(&t.heap, 0)
+	}
+	if t.since++; t.since >= t.k || (t.threshold == 0 && len(t.entries) > t.k) {
+		t.recompute()
+	}
+	return len(t.entries) <= t.k || e.count-e.err >= t.threshold
+}
+
+// recompute computes the threshold. The caller must hold the mutex.
+func (t *topK) recompute() {
+	t.since = 0
+	if len(t.entries) <= t.k {
+		t.threshold = 0
+		return
+	}
+	known := make([]uint64, 0, len(t.entries))
+	for _, e := range t.entries {
+		known = append(known, e.count-e.err)
+	}
+	sort.Slice(known, func(i, j int) bool { return known[i] > known[j] })
+	t.threshold = known[t.k-1]
+	if t.threshold < 2 {
+		t.threshold = 2
+	}
+}
+
+// topKHeap is a min-heap of entries, by count.
+type topKHeap []*topKEntry
+
+func (h topKHeap) Len() int           { return len(h) }
+func (h topKHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h topKHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *topKHeap) Push(x interface{}) {
+	e := x.(*topKEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *topKHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
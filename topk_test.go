@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTopK(t *testing.T) {
+	tk := newTopK(3)
+
+	// Until there are more than k values, they're all in.
+	for _, v := range []string{"/a", "/b", "/c", "/a", "/b", "/a"} {
+		if !tk.observe(v) {
+			t.Errorf("%s: want in the top k, have out", v)
+		}
+	}
+
+	// A long tail of values seen once never gets in, and never pushes the
+	// frequent ones out, even though there are more of them than it keeps
+	// counts of.
+	for i := 0; i < 100; i++ {
+		if v := fmt.Sprintf("/tail/%d", i); tk.observe(v) {
+			t.Errorf("%s: want out of the top k, have in", v)
+		}
+		if i%10 == 0 {
+			for _, v := range []string{"/a", "/b", "/c"} {
+				if !tk.observe(v) {
+					t.Errorf("%s, after %d of the tail: want in the top k, have out", v, i)
+				}
+			}
+		}
+	}
+	if want, have := topKCapacity*3, len(tk.entries); want != have {
+		t.Errorf("entries: want %d, have %d", want, have)
+	}
+
+	// A value which turns up often enough gets in.
+	var in bool
+	for i := 0; i < 50 && !in; i++ {
+		in = tk.observe("/d")
+	}
+	if !in {
+		t.Errorf("/d: want in the top k eventually, have out")
+	}
+}
+
+func TestRelabelTopK(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "config.yaml")
+	writeFile(t, filename, "topk:\n  - {metric: req_total, label: path, k: 2}\n")
+	rules, err := newRelabeler(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relabel := func(line string) string {
+		p := getParsed()
+		defer putParsed(p)
+		if err := parseLineInto([]byte(line), &p.obs); err != nil {
+			t.Fatal(err)
+		}
+		if !rules.relabel(p) {
+			return "dropped"
+		}
+		return string(p.obs.timeseriesKey())
+	}
+	for _, line := range []string{
+		`req_total{path="/a"} 1`,
+		`req_total{path="/b"} 1`,
+		`req_total{path="/a"} 1`,
+		`req_total{path="/b"} 1`,
+	} {
+		relabel(line)
+	}
+	for line, want := range map[string]string{
+		`req_total{path="/a",code="200"} 1`:                         `req_total {code="200",path="/a"}`,
+		`req_total{path="/x",code="200"} 1`:                         `req_total {code="200",path="_other"}`,
+		`req_total{code="200"} 1`:                                   `req_total {code="200"}`,
+		`other_total{path="/y"} 1`:                                  `other_total {path="/y"}`,
+		`{"name":"req_total","labels":{"path":"/z"},"op":"delete"}`: `req_total {path="/z"}`,
+	} {
+		if have := relabel(line); want != have {
+			t.Errorf("%s: want %s, have %s", line, want, have)
+		}
+	}
+
+	// Reloading the same rule keeps what it's counted.
+	if err := rules.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := `req_total {path="/b"}`, relabel(`req_total{path="/b"} 1`); want != have {
+		t.Errorf("after reload: want %s, have %s", want, have)
+	}
+
+	var buf bytes.Buffer
+	rules.renderTelemetry(&buf)
+	if want := "prometheus_aggregator_topk_other_lines_total 1\n"; !strings.Contains(buf.String(), want) {
+		t.Errorf("want %q in\n%s", want, buf.String())
+	}
+
+	writeFile(t, filename, "topk:\n  - {metric: req_total, label: path, k: 0}\n")
+	if err := rules.reload(); err == nil {
+		t.Errorf("k of 0: want error, have none")
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// tracer records spans of the ingestion pipeline, and exports them to an
+// OpenTelemetry collector via OTLP/HTTP, using the JSON encoding. A nil
+// tracer is valid, and records nothing.
+type tracer struct {
+	endpoint string  // e.g. http://127.0.0.1:4318/v1/traces
+	sample   float64 // fraction of root spans to record
+	client   *http.Client
+	spans    chan *span
+	logger   log.Logger
+
+	mtx sync.Mutex
+	rng *mathrand.Rand
+}
+
+// span is a single timed operation. A nil span is valid, and records nothing.
+type span struct {
+	t        *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      error
+}
+
+// OTLP span kinds.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+// Spans are buffered and exported in batches of at most this many.
+const (
+	traceBufferSize = 4096
+	traceBatchSize  = 512
+)
+
+func newTracer(endpoint string, sample float64, logger log.Logger) *tracer {
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	return &tracer{
+		endpoint: endpoint,
+		sample:   sample,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		spans:    make(chan *span, traceBufferSize),
+		logger:   logger,
+		rng:      mathrand.New(mathrand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// startRoot begins a new trace, subject to sampling.
+func (t *tracer) startRoot(name string, kind int) *span {
+	if t == nil {
+		return nil
+	}
+	t.mtx.Lock()
+	sampled := t.rng.Float64() < t.sample
+	t.mtx.Unlock()
+	if !sampled {
+		return nil
+	}
+	s := &span{t: t, name: name, kind: kind, start: time.Now()}
+	rand.Read(s.traceID[:])
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// child begins a span within the same trace as s.
+func (s *span) child(name string) *span {
+	if s == nil {
+		return nil
+	}
+	c := &span{t: s.t, traceID: s.traceID, parentID: s.spanID, name: name, kind: spanKindInternal, start: time.Now()}
+	rand.Read(c.spanID[:])
+	return c
+}
+
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	if s.attrs == nil {
+		s.attrs = map[string]string{}
+	}
+	s.attrs[key] = fmt.Sprint(value)
+}
+
+// finish ends the span, and queues it for export. If the export buffer is
+// full, the span is dropped rather than blocking ingestion.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end, s.err = time.Now(), err
+	select {
+	case s.t.spans <- s:
+	default:
+	}
+}
+
+// run exports queued spans every interval, or whenever a full batch is
+// ready, until the context is canceled.
+func (t *tracer) run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	batch := make([]*span, 0, traceBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(batch); err != nil {
+			level.Warn(t.logger).Log("during", "trace export", "spans", len(batch), "err", err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) >= traceBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			flush()
+			return ctx.Err()
+		}
+	}
+}
+
+func (t *tracer) export(spans []*span) error {
+	body, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded %s", resp.Status)
+	}
+	return nil
+}
+
+// The following types model the parts of the OTLP JSON encoding we use.
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 0 unset, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+func otlpRequest(spans []*span) otlpTraces {
+	out := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		out[i] = otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			out[i].ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, k := range sortLabelKeys(s.attrs) {
+			out[i].Attributes = append(out[i].Attributes, otlpAttribute{Key: k, Value: otlpValue{StringValue: s.attrs[k]}})
+		}
+		if s.err != nil {
+			out[i].Status = otlpStatus{Code: 2, Message: s.err.Error()}
+		}
+	}
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			{Key: "service.name", Value: otlpValue{StringValue: "prometheus-aggregator"}},
+			{Key: "service.version", Value: otlpValue{StringValue: version}},
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/peterbourgon/prometheus-aggregator", Version: version},
+			Spans: out,
+		}},
+	}}}
+}
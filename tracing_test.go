@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTracing(t *testing.T) {
+	received := make(chan otlpTraces, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if want, have := "/v1/traces", r.URL.Path; want != have {
+			t.Errorf("path: want %q, have %q", want, have)
+		}
+		var req otlpTraces
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		received <- req
+	}))
+	defer collector.Close()
+
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+	})...)
+	trc := newTracer(collector.URL, 1, log.NewNopLogger())
+	ing := &ingester{observer: u, activity: newActivity(0), tracer: trc, logger: log.NewNopLogger()}
+
+	src, w := io.Pipe()
+	done := make(chan struct{})
+	go func() { defer close(done); ing.handleConn(src, "test") }()
+	fmt.Fprintln(w, `foo_total{} 1`)
+	fmt.Fprintln(w, `foo_total 1`)
+	w.Close()
+	<-done
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go trc.run(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	var spans []otlpSpan
+	select {
+	case req := <-received:
+		spans = req.ResourceSpans[0].ScopeSpans[0].Spans
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for export")
+	}
+
+	// 1 conn span, plus 2 line spans, plus 2 parse spans, plus 1 observe span.
+	var names []string
+	for _, s := range spans {
+		names = append(names, s.Name)
+	}
+	sort.Strings(names)
+	if want, have := []string{"conn", "line", "line", "observe", "parse", "parse"}, names; !cmp.Equal(want, have) {
+		t.Fatal(cmp.Diff(want, have))
+	}
+
+	var errored int
+	for _, s := range spans {
+		if s.Status.Code == 2 {
+			errored++
+		}
+		if s.Name == "parse" || s.Name == "observe" {
+			if s.ParentSpanID == "" {
+				t.Errorf("%s span has no parent", s.Name)
+			}
+		}
+	}
+	if want, have := 2, errored; want != have {
+		t.Errorf("errored spans: want %d, have %d", want, have)
+	}
+}
+
+func TestTracingNil(t *testing.T) {
+	var trc *tracer
+	s := trc.startRoot("line", spanKindServer)
+	s.set("k", "v")
+	s.child("parse").finish(nil)
+	s.finish(nil)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// uiHandler serves a small HTML page summarizing the universe, connected
+// clients, and recently rejected lines.
+func uiHandler(u *universe, a *activity) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		var buf bytes.Buffer
+		if err := uiTemplate.Execute(&buf, struct {
+			Version string
+			Now     time.Time
+			Stats   universeStats
+			Clients []clientInfo
+			Errors  []lineRecord
+		}{
+			Version: version,
+			Now:     time.Now(),
+			Stats:   u.stats(),
+			Clients: a.connectedClients(),
+			Errors:  a.recentErrors(),
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(buf.Bytes())
+	})
+}
+
+var uiTemplate = template.Must(template.New("ui").Funcs(template.FuncMap{
+	"ago": func(now time.Time, t *time.Time) string {
+		if t == nil {
+			return "never"
+		}
+		return now.Sub(*t).Truncate(time.Second).String() + " ago"
+	},
+	"since": func(now, t time.Time) string {
+		return now.Sub(t).Truncate(time.Second).String()
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>prometheus-aggregator</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { text-align: left; padding: 0.2em 1em 0.2em 0; }
+th { border-bottom: 1px solid #999; }
+td.num { text-align: right; }
+code { font-size: 12px; }
+</style>
+</head>
+<body>
+<h1>prometheus-aggregator</h1>
+<p>Version {{ .Version }}, {{ .Stats.Metrics }} metrics, {{ .Stats.Series }} series.</p>
+
+<h2>Metrics</h2>
+<table>
+<tr><th>Name</th><th>Type</th><th>Series</th><th>Last observed</th></tr>
+{{ range .Stats.PerName }}<tr><td>{{ .Name }}</td><td>{{ .Type }}</td><td class="num">{{ .Series }}</td><td>{{ ago $.Now .LastObserved }}</td></tr>
+{{ else }}<tr><td colspan="4">No metrics.</td></tr>
+{{ end }}</table>
+
+<h2>Connected clients</h2>
+<table>
+<tr><th>Address</th><th>Connected for</th><th>Accepted</th><th>Rejected</th></tr>
+{{ range .Clients }}<tr><td>{{ .Addr }}</td><td>{{ since $.Now .Connected }}</td><td class="num">{{ .Accepted }}</td><td class="num">{{ .Rejected }}</td></tr>
+{{ else }}<tr><td colspan="4">No connected clients.</td></tr>
+{{ end }}</table>
+
+<h2>Recent errors</h2>
+<table>
+<tr><th>Time</th><th>Address</th><th>Line</th><th>Error</th></tr>
+{{ range .Errors }}<tr><td>{{ .Time.Format "2006-01-02T15:04:05Z07:00" }}</td><td>{{ .Addr }}</td><td><code>{{ .Line }}</code></td><td><code>{{ .Err }}</code></td></tr>
+{{ else }}<tr><td colspan="4">No recent errors.</td></tr>
+{{ end }}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUI(t *testing.T) {
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total number of foos."}`,
+	})...)
+	loadObservations(t, u, makeObservations(t, []string{
+		`foo_total{code="200"} 1`,
+	}))
+	a := newActivity(0)
+	c := a.connect("10.0.0.1:1234")
+	a.accept("10.0.0.1:1234", c, []byte(`foo_total{} 1`))
+	a.reject("10.0.0.1:1234", c, []byte(`<bad>`), errors.New("parse error"))
+
+	rec := httptest.NewRecorder()
+	uiHandler(u, a).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"<td>foo_total</td>",
+		"<td>10.0.0.1:1234</td>",
+		"&lt;bad&gt;",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("response doesn't contain %q", want)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	uiHandler(u, a).ServeHTTP(rec, httptest.NewRequest("GET", "/nope", nil))
+	if want, have := 404, rec.Code; want != have {
+		t.Errorf("GET /nope: want %d, have %d", want, have)
+	}
+}
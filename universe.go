@@ -1,23 +1,40 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
+	"io"
+	"math"
 	"net/http"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
 type (
 	// universe of all received observations by metric name.
-	// Note it has a (very) coarse-grained mutex, therefore
-	// all subtypes (counter, etc.) are NOT goroutine-safe.
+	// Its mutex only guards the collections map; each collection
+	// has its own mutex, which guards its values map, so writers
+	// to different metrics don't contend. Scrapes render from
+	// snapshots, and don't hold either.
 	universe struct {
-		mtx         sync.Mutex
+		mtx         sync.RWMutex
 		collections map[metricName]*timeseriesCollection
+		names       []metricName // of the collections, sorted
+		snap        atomic.Value // *universeSnapshot
+		nonfinite   string       // policy for NaN and ±Inf values
+		negative    string       // policy for negative counter values
+		precision   int          // of rendered values, see appendValue
+		limit       *seriesLimit // may be nil
+		scrapes     *scrapeCount // shared by the universe's collections
+		rollups     *rollups     // may be nil
+		violations  *violations
+		now         func() time.Time
 	}
 
 	// metricName e.g. `http_requests_total`.
@@ -25,11 +42,31 @@ type (
 
 	// timeseriesCollection corresponds to one high order Prometheus metric.
 	// It has multiple timeseriesValues uniquely identified by their labels.
+	// Its declaration never changes after it's created.
 	timeseriesCollection struct {
+		updated int64 // unix nanos of most recent observation with a value, atomic
+
 		typ     string
 		help    string
-		buckets []float64 // only used by histograms
+		buckets []float64     // only used by histograms
+		coarse  []float64     // a subset of the buckets, rendered as another histogram
+		coarseI []int         // of the coarse buckets in the buckets
+		mode    string        // how the values are aggregated; "" is the default
+		alpha   float64       // only used by EWMA gauges
+		window  time.Duration // after which histograms are reset, or of a summary's quantiles; 0 is never
+
+		quantiles  []float64 // only used by summaries
+		ageBuckets int       // only used by summaries
+
+		mtx     sync.RWMutex // write lock to add or remove timeseries
 		values  map[timeseriesKey]timeseriesValue
+		index   seriesIndex  // of the values, ordered by key
+		snap    atomic.Value // []timeseriesValue, ordered by key
+		created uint64       // total number of timeseries ever created
+		bytes   int          // estimated memory held by the values
+		limit   *seriesLimit // shared by the universe's collections; may be nil
+		scrapes *scrapeCount // shared by the universe's collections; may be nil
+		now     func() time.Time
 	}
 
 	// timeseriesKey is universally unique, e.g.
@@ -38,18 +75,28 @@ type (
 
 	// timeseriesValue is a set of observations for
 	// a unique metric name and set of labels.
+	// It's safe for concurrent use.
 	timeseriesValue interface {
 		metricName() metricName
 		timeseriesKey() timeseriesKey
+		labelSet() labelPairs
 		touched() bool
 		observe(observation) error
-		renderText() string
+		renderText(precision int) string
+		dump() seriesDump
+		restore(seriesDump) error
 	}
 )
 
 func newUniverse(initial ...observation) (*universe, error) {
 	u := &universe{
 		collections: map[metricName]*timeseriesCollection{},
+		nonfinite:   nonFinitePassGauges,
+		negative:    negativeReject,
+		precision:   shortestPrecision,
+		scrapes:     &scrapeCount{},
+		violations:  newViolations(),
+		now:         time.Now,
 	}
 	for _, o := range initial {
 		if err := u.observe(o); err != nil {
@@ -60,41 +107,322 @@ func newUniverse(initial ...observation) (*universe, error) {
 }
 
 func (u *universe) observe(o observation) error {
-	u.mtx.Lock()
-	defer u.mtx.Unlock()
+	if o.Op == "delete" && o.Match && o.Labels != nil {
+		return u.deleteMatching(o)
+	}
+	if rules := u.rollups.forMetric(o.Name); rules != nil {
+		return u.rollups.observe(u, o)
+	}
+	return u.observeDirect(o)
+}
+
+// deleteMatching deletes every series of the delete's metric whose labels
+// include the delete's, one at a time, so rollups see each of them go.
+func (u *universe) deleteMatching(o observation) error {
+	c := u.collection(o.metricName())
+	if c == nil {
+		return nil
+	}
+	for _, labels := range c.matching(o.Labels) {
+		if err := u.observe(observation{Name: o.Name, Labels: labels, Op: "delete", Tenant: o.Tenant}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// observeDirect observes the observation, without updating any rollups of
+// its metric.
+func (u *universe) observeDirect(o observation) error {
 	n := o.metricName()
-	if _, ok := u.collections[n]; !ok {
-		c, err := newTimeseriesCollection(o.Type, o.Help, o.Buckets)
+	if o.Op == "delete" {
+		if c := u.collection(n); c != nil {
+			c.delete(o)
+		}
+		return nil // deleting something that doesn't exist is fine
+	}
+	c := u.collection(n)
+	if c == nil {
+		var err error
+		if c, err = u.createCollection(n, o); err != nil {
+			return err
+		}
+	}
+	if err := u.check(c, &o); err != nil {
+		return err
+	}
+	if err := c.observe(o); err != nil {
+		return err
+	}
+	if o.Value != nil {
+		atomic.StoreInt64(&c.updated, u.now().UnixNano())
+	}
+	return nil
+}
+
+// observeBatch observes each observation in order. Consecutive observations
+// of the same metric are a run, which costs one lookup of the collection,
+// and usually one acquisition of its lock, rather than one of each per
+// observation. If any observations fail, it returns a batchError.
+func (u *universe) observeBatch(obs []observation) error {
+	errs := make(batchError, len(obs))
+	for start, end := 0, 0; start < len(obs); start = end {
+		end = start + 1
+		for end < len(obs) && sameRun(obs[start], obs[end]) {
+			end++
+		}
+		run, runErrs := obs[start:end], errs[start:end]
+		c := u.collection(run[0].metricName())
+		if c == nil && len(run) > 1 {
+			c, _ = u.createCollection(run[0].metricName(), run[0])
+		}
+		if c == nil || len(run) == 1 || u.rollups.forMetric(run[0].Name) != nil {
+			// Deletes, runs whose first observation can't create the
+			// collection, and runs of metrics which are rolled up, are
+			// observed one at a time.
+			for j, o := range run {
+				runErrs[j] = u.observe(o)
+			}
+			continue
+		}
+		if u.checkRun(c, run, runErrs) {
+			c.observeRun(run, runErrs)
+		} else {
+			for j, o := range run {
+				if runErrs[j] == nil {
+					runErrs[j] = c.observe(o)
+				}
+			}
+		}
+		for j, o := range run {
+			if o.Value != nil && runErrs[j] == nil {
+				atomic.StoreInt64(&c.updated, u.now().UnixNano())
+				break
+			}
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return errs
+		}
+	}
+	return nil
+}
+
+func sameRun(a, b observation) bool {
+	return a.Name == b.Name && a.Op != "delete" && b.Op != "delete"
+}
+
+// batchError holds the error of each observation in a batch, by index.
+// Observations which succeeded have nil errors.
+type batchError []error
+
+func (e batchError) Error() string {
+	var first error
+	var failed int
+	for _, err := range e {
 		if err != nil {
-			return errors.Wrap(err, "error creating new timeseries collection")
+			if first == nil {
+				first = err
+			}
+			failed++
 		}
-		u.collections[n] = c
 	}
-	return u.collections[n].observe(o)
+	return fmt.Sprintf("%d of %d observations failed, first: %v", failed, len(e), first)
 }
 
-func newTimeseriesCollection(typ, help string, buckets []float64) (*timeseriesCollection, error) {
-	switch typ {
-	case "counter", "gauge", "histogram":
+// errorAt returns the error of the nth observation in a batch, given the
+// error returned by observeBatch.
+func errorAt(err error, n int) error {
+	if e, ok := err.(batchError); ok {
+		return e[n]
+	}
+	return err
+}
+
+// collection returns the named collection, or nil if it doesn't exist.
+func (u *universe) collection(n metricName) *timeseriesCollection {
+	u.mtx.RLock()
+	defer u.mtx.RUnlock()
+	return u.collections[n]
+}
+
+// createCollection returns the named collection, creating it from the
+// observation if another writer hasn't done so in the meantime.
+func (u *universe) createCollection(n metricName, o observation) (*timeseriesCollection, error) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	if c, ok := u.collections[n]; ok {
+		return c, nil
+	}
+	if !validMetricName(string(n)) {
+		return nil, fmt.Errorf("invalid metric name %q", n)
+	}
+	c, err := newTimeseriesCollection(o)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating new timeseries collection")
+	}
+	u.insertCollection(n, c)
+	return c, nil
+}
+
+// insertCollection adds a new collection. The caller must hold the write lock.
+func (u *universe) insertCollection(n metricName, c *timeseriesCollection) {
+	c.limit, c.scrapes = u.limit, u.scrapes
+	c.now = func() time.Time { return u.now() }
+	u.collections[n] = c
+	i := sort.Search(len(u.names), func(i int) bool { return u.names[i] >= n })
+	u.names = append(u.names, "")
+	copy(u.names[i+1:], u.names[i:])
+	u.names[i] = n
+	u.invalidate()
+}
+
+// seriesLimit limits the number of timeseries in a universe, across all of its
+// collections. A nil seriesLimit doesn't.
+type seriesLimit struct {
+	max   int64
+	count int64 // atomic
+}
+
+func newSeriesLimit(max int) *seriesLimit {
+	if max <= 0 {
+		return nil
+	}
+	return &seriesLimit{max: int64(max)}
+}
+
+// seriesLimitError is the error for a new timeseries past the limit.
+type seriesLimitError int64
+
+func (e seriesLimitError) Error() string {
+	return fmt.Sprintf("limit of %d reached", int64(e))
+}
+
+// take counts a new timeseries, if there's room for it.
+func (l *seriesLimit) take() bool {
+	if l == nil {
+		return true
+	}
+	if atomic.AddInt64(&l.count, 1) > l.max {
+		atomic.AddInt64(&l.count, -1)
+		return false
+	}
+	return true
+}
+
+// release uncounts n timeseries which have been removed.
+func (l *seriesLimit) release(n int) {
+	if l != nil {
+		atomic.AddInt64(&l.count, -int64(n))
+	}
+}
+
+// newTimeseriesCollection returns an empty collection with the declaration.
+// Its name, labels, and value, if any, are ignored.
+func newTimeseriesCollection(o observation) (*timeseriesCollection, error) {
+	switch o.Type {
+	case "counter", "gauge", "histogram", "summary":
 	default:
-		return nil, fmt.Errorf("invalid type '%s'", typ)
+		return nil, fmt.Errorf("invalid type '%s'", o.Type)
 	}
-	if help == "" {
+	if o.Help == "" {
 		return nil, fmt.Errorf("help string cannot be empty")
 	}
+	if err := validateMode(o.Type, o.Mode); err != nil {
+		return nil, err
+	}
+	alpha, err := parseAlpha(o.Mode, o.Alpha)
+	if err != nil {
+		return nil, err
+	}
+	window, err := parseWindow(o.Type, o.Window)
+	if err != nil {
+		return nil, err
+	}
+	buckets, err := normalizeBuckets(o.Buckets)
+	if err != nil {
+		return nil, err
+	}
+	coarse, coarseI, err := normalizeCoarse(o.Type, buckets, o.Coarse)
+	if err != nil {
+		return nil, err
+	}
+	quantiles, err := normalizeQuantiles(o.Type, o.Quantiles)
+	if err != nil {
+		return nil, err
+	}
+	ageBuckets, err := parseAgeBuckets(o.Type, o.AgeBuckets)
+	if err != nil {
+		return nil, err
+	}
 	return &timeseriesCollection{
-		typ:     typ,
-		help:    help,
-		buckets: buckets,
-		values:  map[timeseriesKey]timeseriesValue{},
+		typ:        o.Type,
+		help:       o.Help,
+		buckets:    buckets,
+		coarse:     coarse,
+		coarseI:    coarseI,
+		mode:       o.Mode,
+		alpha:      alpha,
+		window:     window,
+		quantiles:  quantiles,
+		ageBuckets: ageBuckets,
+		values:     map[timeseriesKey]timeseriesValue{},
+		now:        time.Now,
 	}, nil
 }
 
+// declaration returns the declaration of the collection, as the metric n.
+func (c *timeseriesCollection) declaration(n metricName) observation {
+	o := observation{Name: string(n), Type: c.typ, Help: c.help, Buckets: c.buckets, Coarse: c.coarse, Mode: c.mode, Alpha: c.alpha, Quantiles: c.quantiles, AgeBuckets: c.ageBuckets}
+	if c.window > 0 {
+		o.Window = c.window.String()
+	}
+	return o
+}
+
+// normalizeBuckets returns a sorted copy of the buckets, without +Inf, which
+// every histogram has anyway. NaN and duplicate buckets are errors.
+func normalizeBuckets(buckets []float64) ([]float64, error) {
+	if buckets == nil {
+		return nil, nil
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets) // histograms search them
+	for i, b := range buckets {
+		if math.IsNaN(b) {
+			return nil, fmt.Errorf("bucket cannot be NaN")
+		}
+		if i > 0 && b == buckets[i-1] {
+			return nil, fmt.Errorf("duplicate bucket %s", appendLE(nil, b))
+		}
+	}
+	if n := len(buckets); n > 0 && math.IsInf(buckets[n-1], +1) {
+		buckets = buckets[:n-1]
+	}
+	return buckets, nil
+}
+
+// sameBuckets returns true if the buckets, once normalized, are the
+// collection's buckets.
+func (c *timeseriesCollection) sameBuckets(buckets []float64) bool {
+	normalized, err := normalizeBuckets(buckets)
+	if err != nil || len(normalized) != len(c.buckets) {
+		return false
+	}
+	for i := range normalized {
+		if normalized[i] != c.buckets[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // touched should return true if any timeseries in the collection
 // has been touched. It's used to determine if we should render
 // the header stanza in the /metrics output.
 func (c *timeseriesCollection) touched() bool {
-	for _, v := range c.values {
+	for _, v := range c.series() {
 		if v.touched() {
 			return true
 		}
@@ -102,30 +430,124 @@ func (c *timeseriesCollection) touched() bool {
 	return false
 }
 
+// observe records the observation in the timeseries identified by its labels.
 func (c *timeseriesCollection) observe(o observation) error {
-	o.Type, o.Help, o.Buckets = c.typ, c.help, c.buckets // first writer wins
+	var errs [1]error
+	c.observeRun([]observation{o}, errs[:])
+	return errs[0]
+}
+
+// observeRun records each observation in order, and writes its error to the
+// same index of errs. Timeseries are safe for concurrent use, so as long as
+// they already exist, only the read lock is taken. Creating them takes the
+// write lock. Either way, it's taken once for the whole run.
+func (c *timeseriesCollection) observeRun(obs []observation, errs []error) {
+	j := 0
+	c.mtx.RLock()
+	for ; j < len(obs); j++ {
+		v, ok := c.values[obs[j].timeseriesKey()]
+		if !ok {
+			break
+		}
+		errs[j] = v.observe(obs[j])
+	}
+	c.mtx.RUnlock()
+	if j == len(obs) {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for ; j < len(obs); j++ {
+		errs[j] = c.observeLocked(obs[j])
+	}
+}
+
+// observeLocked records the observation, creating its timeseries if it
+// doesn't exist. The caller must hold the write lock.
+func (c *timeseriesCollection) observeLocked(o observation) error {
+	o.Type, o.Help, o.Buckets, o.Mode = c.typ, c.help, c.buckets, c.mode // checked by the universe
 	k := o.timeseriesKey()
 	if _, ok := c.values[k]; !ok {
-		v, err := newTimeseriesValue(c.typ, o)
+		if err := validateNames(&o); err != nil {
+			return errors.Wrap(err, "error creating new timeseries")
+		}
+		if !c.limit.take() {
+			return errors.Wrap(seriesLimitError(c.limit.max), "error creating new timeseries")
+		}
+		o.Name = labelStrings.intern(o.Name)
+		v, err := c.newTimeseriesValue(o)
 		if err != nil {
+			c.limit.release(1)
 			return errors.Wrap(err, "error creating new timeseries")
 		}
 		c.values[k] = v
+		c.index.insert(v)
+		c.created++
+		c.bytes += c.seriesBytes(v)
+		c.invalidate()
 	}
 	return c.values[k].observe(o)
 }
 
-func newTimeseriesValue(typ string, o observation) (timeseriesValue, error) {
+// delete removes the timeseries identified by the observation's labels.
+// If the observation has no labels at all, every timeseries is removed.
+// The collection itself, i.e. its type, help, and buckets, is retained,
+// so clients can continue to refer to the metric by name.
+func (c *timeseriesCollection) delete(o observation) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	defer c.invalidate()
+	if o.Labels == nil {
+		c.limit.release(len(c.values))
+		c.values = map[timeseriesKey]timeseriesValue{}
+		c.index.reset()
+		c.bytes = 0
+		return
+	}
+	k := o.timeseriesKey()
+	if v, ok := c.values[k]; ok {
+		c.limit.release(1)
+		delete(c.values, k)
+		c.index.remove(k)
+		c.bytes -= c.seriesBytes(v)
+	}
+}
+
+// matching returns the labels of every timeseries whose labels include all
+// of the given ones, in order.
+func (c *timeseriesCollection) matching(labels map[string]string) []map[string]string {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	var matches []map[string]string
+	for _, v := range c.index.appendTo(nil) {
+		if v.labelSet().include(labels) {
+			matches = append(matches, v.labelSet().toMap())
+		}
+	}
+	return matches
+}
+
+func (c *timeseriesCollection) newTimeseriesValue(o observation) (timeseriesValue, error) {
 	if o.Name == "" {
 		return nil, fmt.Errorf("a new timeseries value requires a name")
 	}
-	switch typ {
-	case "counter":
+	switch typ := c.typ; {
+	case typ == "counter" && c.mode == modePerSecond:
+		return newPerSecondCounter(o, c.scrapes, c.now)
+	case typ == "counter":
 		return newCounter(o)
-	case "gauge":
+	case typ == "gauge" && c.mode == modeMinMax:
+		return newMinMaxGauge(o, c.scrapes)
+	case typ == "gauge" && c.mode == modeEWMA:
+		return newEWMAGauge(o, c.alpha)
+	case typ == "gauge":
 		return newGauge(o)
-	case "histogram":
+	case typ == "histogram" && c.window > 0:
+		return newWindowedHistogram(o, c.window, c.now)
+	case typ == "histogram":
 		return newHistogram(o)
+	case typ == "summary":
+		return newSummary(o, c.quantiles, c.window, c.ageBuckets, c.now)
 	default:
 		return nil, fmt.Errorf("invalid timeseries type '%s' (programmer error)", typ)
 	}
@@ -136,47 +558,90 @@ func newTimeseriesValue(typ string, o observation) (timeseriesValue, error) {
 //
 
 func (u *universe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var buf bytes.Buffer
-	{
-		u.mtx.Lock()
-		for _, n := range sortMetricNames(u.collections) {
-			c := u.collections[n]
-			if !c.touched() {
-				continue
-			}
-			fmt.Fprintf(&buf, "# HELP %s %s\n", n, c.help)
-			fmt.Fprintf(&buf, "# TYPE %s %s\n", n, c.typ)
-			for _, k := range sortTimeseriesKeys(c.values) {
-				v := c.values[k]
-				if !v.touched() {
-					continue
-				}
-				fmt.Fprint(&buf, v.renderText())
-			}
-			fmt.Fprintln(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	u.scrapes.begin()
+	bw := bufio.NewWriterSize(w, scrapeBufferSize)
+	if _, err := u.writeText(bw); err == nil {
+		bw.Flush()
+	}
+}
+
+// scrapeBufferSize is the size of the buffer between rendering and the
+// scraper. Anything bigger is streamed, chunked.
+const scrapeBufferSize = 32 * 1024
+
+// renderBufPool recycles the buffers collections are rendered into.
+var renderBufPool = sync.Pool{
+	New: func() interface{} { return &bytes.Buffer{} },
+}
+
+// writeText renders every touched timeseries in the Prometheus text format,
+// and returns the number of timeseries rendered. Collections are rendered
+// from snapshots, each into a buffer, which is written to w, so a slow
+// scraper never blocks ingestion. On multicore hosts, collections are
+// rendered concurrently, but written in order. It stops at the first write
+// error.
+func (u *universe) writeText(w io.Writer) (series int, err error) {
+	names, collections := u.sortedCollections()
+	if workers := renderWorkers(len(names)); workers > 1 {
+		return writeTextParallel(w, names, collections, workers, u.precision)
+	}
+	buf := renderBufPool.Get().(*bytes.Buffer)
+	defer renderBufPool.Put(buf)
+	for i, n := range names {
+		buf.Reset()
+		series += collections[i].writeText(buf, n, u.precision)
+		if buf.Len() == 0 {
+			continue
+		}
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return series, err
 		}
-		u.mtx.Unlock()
 	}
-	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
-	w.Write(buf.Bytes())
+	return series, nil
 }
 
-func sortMetricNames(collections map[metricName]*timeseriesCollection) (keys []metricName) {
-	keys = make([]metricName, 0, len(collections))
-	for k := range collections {
-		keys = append(keys, k)
+func (c *timeseriesCollection) writeText(buf *bytes.Buffer, n metricName, precision int) (series int) {
+	values := c.series()
+	if !c.touched() {
+		return 0
 	}
-	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
-	return keys
+	writeHeader(buf, string(n), c.help, c.typ)
+	for _, v := range values {
+		if !v.touched() {
+			continue
+		}
+		buf.WriteString(v.renderText(precision))
+		series++
+	}
+	buf.WriteByte('\n')
+	if c.mode == modeMinMax {
+		series += writeMinMax(buf, n, c.help, values, precision)
+	}
+	if c.mode == modePerSecond {
+		series += writePerSecond(buf, n, c.help, values, precision)
+	}
+	if c.coarse != nil {
+		series += writeCoarse(buf, n, c.help, c.coarseI, values, precision)
+	}
+	return series
 }
 
-func sortTimeseriesKeys(values map[timeseriesKey]timeseriesValue) (keys []timeseriesKey) {
-	keys = make([]timeseriesKey, 0, len(values))
-	for k := range values {
-		keys = append(keys, k)
+// writeHeader writes the HELP and TYPE lines of a metric.
+func writeHeader(buf *bytes.Buffer, name, help, typ string) {
+	buf.WriteString("# HELP ")
+	buf.WriteString(name)
+	buf.WriteByte(' ')
+	if needsEscaping(help, false) {
+		buf.Write(appendEscaped(nil, help, false))
+	} else {
+		buf.WriteString(help)
 	}
-	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
-	return keys
+	buf.WriteString("\n# TYPE ")
+	buf.WriteString(name)
+	buf.WriteByte(' ')
+	buf.WriteString(typ)
+	buf.WriteByte('\n')
 }
 
 //
@@ -188,9 +653,37 @@ type observation struct {
 	Type    string            `json:"type"`
 	Help    string            `json:"help"`
 	Buckets []float64         `json:"buckets,omitempty"`
+	Coarse  []float64         `json:"coarse,omitempty"`
+	Mode    string            `json:"mode,omitempty"`
+	Alpha   float64           `json:"alpha,omitempty"`
+	Window  string            `json:"window,omitempty"`
 	Labels  map[string]string `json:"labels,omitempty"`
 	Op      string            `json:"op,omitempty"`
 	Value   *float64          `json:"value,omitempty"`
+
+	// Quantiles and AgeBuckets declare a summary, along with its Window,
+	// which is how far back its quantiles go.
+	Quantiles  []float64 `json:"quantiles,omitempty"`
+	AgeBuckets int       `json:"age_buckets,omitempty" yaml:"age_buckets"`
+
+	// Match makes a delete with labels delete every series whose labels
+	// include them, rather than only the series with exactly them. A delete
+	// without labels gets it along with a tenant's label, or a connection's
+	// LABELS defaults, so it still deletes every series they could have made.
+	Match bool `json:"match,omitempty"`
+
+	// Counts are the counts of each bucket of a histogram, and then of the
+	// +Inf bucket, not cumulative, which a merge adds, along with its value,
+	// which is the sum.
+	Counts []uint64 `json:"counts,omitempty"`
+
+	// Key caches the timeseries key of a parsed line, so it's only
+	// computed once. Anything that changes Name or Labels must clear it.
+	Key timeseriesKey `json:"-" yaml:"-"`
+
+	// Tenant is the tenant whose universe the observation belongs in, if
+	// tenants have universes of their own; "" means the default one.
+	Tenant string `json:"-" yaml:"-"`
 }
 
 func (o observation) metricName() metricName {
@@ -198,6 +691,9 @@ func (o observation) metricName() metricName {
 }
 
 func (o observation) timeseriesKey() timeseriesKey {
+	if o.Key != "" {
+		return o.Key
+	}
 	return makeTimeseriesKey(o.Name, o.Labels)
 }
 
@@ -205,19 +701,24 @@ func (o observation) timeseriesKey() timeseriesKey {
 //
 //
 
+// counter and gauge values are atomicFloats, so they can be observed while
+// holding only the collection's read lock.
 type counter struct {
+	value  atomicFloat
+	touch  uint32 // atomic
+	k      timeseriesKey
 	n      string
 	h      string
-	labels map[string]string
-	touch  bool
-	value  float64
+	labels labelPairs
+	cache  renderCache
 }
 
 func newCounter(o observation) (*counter, error) {
 	return &counter{
+		k:      o.timeseriesKey(),
 		n:      o.Name,
 		h:      o.Help,
-		labels: o.Labels,
+		labels: makeLabelPairs(o.Labels), // the observation's labels may be reused
 	}, nil
 }
 
@@ -225,23 +726,29 @@ func (c *counter) metricName() metricName {
 	return metricName(c.n)
 }
 
-func (c *counter) timeseriesKey() timeseriesKey {
-	return makeTimeseriesKey(c.n, c.labels)
-}
+func (c *counter) timeseriesKey() timeseriesKey { return c.k }
+
+func (c *counter) labelSet() labelPairs { return c.labels }
 
 func (c *counter) observe(o observation) error {
 	if o.Value == nil {
 		return nil // declaration
 	}
-	c.touch = true
-	c.value += *o.Value
+	c.value.add(*o.Value)
+	atomic.StoreUint32(&c.touch, 1)
 	return nil
 }
 
-func (c *counter) touched() bool { return c.touch }
+func (c *counter) touched() bool { return atomic.LoadUint32(&c.touch) == 1 }
 
-func (c *counter) renderText() string {
-	return fmt.Sprintf("%s%s %f\n", c.n, renderLabels(c.labels), c.value)
+func (c *counter) renderText(precision int) string {
+	bits := c.value.loadBits()
+	if text, ok := c.cache.get(bits); ok {
+		return text
+	}
+	text := string(appendSample(nil, c.n, "", c.labels, math.Float64frombits(bits), precision))
+	c.cache.set(bits, text)
+	return text
 }
 
 //
@@ -249,18 +756,21 @@ func (c *counter) renderText() string {
 //
 
 type gauge struct {
+	value  atomicFloat
+	touch  uint32 // atomic
+	k      timeseriesKey
 	n      string
 	h      string
-	labels map[string]string
-	touch  bool
-	value  float64
+	labels labelPairs
+	cache  renderCache
 }
 
 func newGauge(o observation) (*gauge, error) {
 	return &gauge{
+		k:      o.timeseriesKey(),
 		n:      o.Name,
 		h:      o.Help,
-		labels: o.Labels,
+		labels: makeLabelPairs(o.Labels), // the observation's labels may be reused
 	}, nil
 }
 
@@ -268,9 +778,9 @@ func (g *gauge) metricName() metricName {
 	return metricName(g.n)
 }
 
-func (g *gauge) timeseriesKey() timeseriesKey {
-	return makeTimeseriesKey(g.n, g.labels)
-}
+func (g *gauge) timeseriesKey() timeseriesKey { return g.k }
+
+func (g *gauge) labelSet() labelPairs { return g.labels }
 
 func (g *gauge) observe(o observation) error {
 	if o.Value == nil {
@@ -278,33 +788,109 @@ func (g *gauge) observe(o observation) error {
 	}
 	switch o.Op {
 	case "add":
-		g.value += *o.Value
+		g.value.add(*o.Value)
 	default:
-		g.value = *o.Value
+		g.value.store(*o.Value)
 	}
-	g.touch = true
+	atomic.StoreUint32(&g.touch, 1)
 	return nil
 }
 
-func (g *gauge) touched() bool { return g.touch }
+func (g *gauge) touched() bool { return atomic.LoadUint32(&g.touch) == 1 }
+
+func (g *gauge) renderText(precision int) string {
+	bits := g.value.loadBits()
+	if text, ok := g.cache.get(bits); ok {
+		return text
+	}
+	text := string(appendSample(nil, g.n, "", g.labels, math.Float64frombits(bits), precision))
+	g.cache.set(bits, text)
+	return text
+}
+
+//
+//
+//
 
-func (g *gauge) renderText() string {
-	return fmt.Sprintf("%s%s %f\n", g.n, renderLabels(g.labels), g.value)
+// renderCache holds the most recently rendered text of a timeseries, along
+// with a version identifying the state it was rendered from, so idle series
+// aren't re-rendered on every scrape. It's safe for concurrent scrapes.
+type renderCache struct {
+	v atomic.Value // renderedText
+}
+
+type renderedText struct {
+	version uint64
+	text    string
+}
+
+func (c *renderCache) get(version uint64) (string, bool) {
+	r, ok := c.v.Load().(renderedText)
+	if !ok || r.version != version {
+		return "", false
+	}
+	return r.text, true
+}
+
+func (c *renderCache) set(version uint64, text string) {
+	c.v.Store(renderedText{version: version, text: text})
 }
 
 //
 //
 //
 
+// atomicFloat is a float64 stored as its IEEE 754 bits, so that it can be
+// loaded, stored, and added to without a lock.
+type atomicFloat struct {
+	bits uint64
+}
+
+func (f *atomicFloat) load() float64 {
+	return math.Float64frombits(f.loadBits())
+}
+
+func (f *atomicFloat) loadBits() uint64 {
+	return atomic.LoadUint64(&f.bits)
+}
+
+func (f *atomicFloat) store(v float64) {
+	atomic.StoreUint64(&f.bits, math.Float64bits(v))
+}
+
+func (f *atomicFloat) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&f.bits)
+		next := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&f.bits, old, next) {
+			return
+		}
+	}
+}
+
+//
+//
+//
+
+// histogram values are guarded by their own mutex, so they can be observed
+// while holding only the collection's read lock, and rendered without it.
 type histogram struct {
-	n       string
-	h       string
-	labels  map[string]string
+	k      timeseriesKey
+	n      string
+	h      string
+	labels labelPairs
+	cache  renderCache
+
+	mtx     sync.Mutex
+	version uint64 // of the render cache, bumped by every change
 	sum     float64
 	count   uint64
 	buckets []bucket
 }
 
+// bucket counts the observations greater than the max of the previous bucket,
+// and less than or equal to its own max. Cumulative counts, as required by
+// the le semantics of Prometheus, are derived at render time.
 type bucket struct {
 	max   float64
 	count uint64
@@ -316,9 +902,10 @@ func newHistogram(o observation) (*histogram, error) {
 		buckets[i] = bucket{max: v}
 	}
 	return &histogram{
+		k:       o.timeseriesKey(),
 		n:       o.Name,
 		h:       o.Help,
-		labels:  o.Labels,
+		labels:  makeLabelPairs(o.Labels),
 		buckets: buckets,
 	}, nil
 }
@@ -327,64 +914,129 @@ func (h *histogram) metricName() metricName {
 	return metricName(h.n)
 }
 
-func (h *histogram) timeseriesKey() timeseriesKey {
-	return makeTimeseriesKey(h.n, h.labels)
-}
+func (h *histogram) timeseriesKey() timeseriesKey { return h.k }
+
+func (h *histogram) labelSet() labelPairs { return h.labels }
 
 func (h *histogram) observe(o observation) error {
 	if o.Value == nil {
 		return nil // declaration
 	}
-	h.sum += *o.Value
-	h.count++
-	for i := range h.buckets {
-		if *o.Value <= h.buckets[i].max {
-			h.buckets[i].count++
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.version++
+	if o.Op == "merge" { // checked by the universe
+		h.sum += *o.Value
+		for i, n := range o.Counts {
+			if i < len(h.buckets) {
+				h.buckets[i].count += n
+			}
+			h.count += n
 		}
+		return nil
 	}
+	h.sum += *o.Value
+	h.count++
+	i := sort.Search(len(h.buckets), func(i int) bool { return *o.Value <= h.buckets[i].max })
+	if i < len(h.buckets) {
+		h.buckets[i].count++
+	} // else only the +Inf bucket, i.e. h.count
 	return nil
 }
 
-func (h *histogram) touched() bool { return h.count > 0 }
+// cumulativeCounts returns the count of each bucket, including every
+// observation in the buckets before it. The caller must hold the mutex.
+func (h *histogram) cumulativeCounts() []uint64 {
+	counts := make([]uint64, len(h.buckets))
+	var cumulative uint64
+	for i, b := range h.buckets {
+		cumulative += b.count
+		counts[i] = cumulative
+	}
+	return counts
+}
 
-func (h *histogram) renderText() string {
-	var sb strings.Builder
+func (h *histogram) touched() bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.count > 0
+}
+
+func (h *histogram) renderText(precision int) string {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	// A merge can change the sum without the count, so the count doesn't
+	// identify the state, but the version does.
+	if text, ok := h.cache.get(h.version); ok {
+		return text
+	}
+	text := h.render(precision)
+	h.cache.set(h.version, text)
+	return text
+}
+
+func (h *histogram) render(precision int) string {
+	b := make([]byte, 0, (len(h.buckets)+3)*(len(h.n)+len(h.k)+24))
+	var le [32]byte
 	{
 		// Render all of the individual buckets,
 		// including a terminal +Inf bucket.
-		labelscopy := map[string]string{}
-		for k, v := range h.labels {
-			labelscopy[k] = v
+		counts := h.cumulativeCounts()
+		for i, bk := range h.buckets {
+			b = appendBucket(b, h.n, h.labels, appendLE(le[:0], bk.max), counts[i])
 		}
-		for _, b := range h.buckets {
-			labelscopy["le"] = fmt.Sprint(b.max)
-			fmt.Fprintf(&sb, "%s_bucket%s %d\n", h.n, renderLabels(labelscopy), b.count)
-		}
-		labelscopy["le"] = "+Inf"
-		fmt.Fprintf(&sb, "%s_bucket%s %d\n", h.n, renderLabels(labelscopy), h.count)
+		b = appendBucket(b, h.n, h.labels, infLE, h.count)
 	}
 	{
 		// Render the aggregate statistics.
-		fmt.Fprintf(&sb, "%s_sum%s %f\n", h.n, renderLabels(h.labels), h.sum)
-		fmt.Fprintf(&sb, "%s_count%s %d\n", h.n, renderLabels(h.labels), h.count)
+		b = appendSample(b, h.n, "_sum", h.labels, h.sum, precision)
+		b = appendCount(b, h.n, "_count", h.labels, h.count)
 	}
-	return sb.String()
+	return string(b)
 }
 
 //
 //
 //
 
+// makeTimeseriesKey returns name + " " + renderLabels(labels), without the
+// overhead of fmt, as it's on the hot path.
 func makeTimeseriesKey(name string, labels map[string]string) timeseriesKey {
-	return timeseriesKey(name + " " + renderLabels(labels))
+	var keys [16]string
+	sorted := keys[:0]
+	size := len(name) + 3
+	for k, v := range labels {
+		sorted = append(sorted, k)
+		size += len(k) + len(v) + 4
+	}
+	sort.Strings(sorted)
+	var sb strings.Builder
+	sb.Grow(size)
+	sb.WriteString(name)
+	sb.WriteString(" {")
+	for i, k := range sorted {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(k)
+		sb.WriteString(`="`)
+		writeEscaped(&sb, labels[k])
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return timeseriesKey(sb.String())
 }
 
 func renderLabels(labels map[string]string) string {
-	parts := make([]string, len(labels))
+	b := make([]byte, 0, 64)
+	b = append(b, '{')
 	for i, k := range sortLabelKeys(labels) {
-		parts[i] = fmt.Sprintf(`%s="%s"`, k, labels[k])
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendLabel(b, k, labels[k])
 	}
-	return "{" + strings.Join(parts, ",") + "}"
+	return string(append(b, '}'))
 }
 
 func sortLabelKeys(labels map[string]string) (keys []string) {
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// validateNames checks the metric name and label names of an observation
+// against the Prometheus data model, so that nothing which Prometheus would
+// refuse to ingest makes it into the exposition. Reserved label names are
+// refused too.
+func validateNames(o *observation) error {
+	if !validMetricName(o.Name) {
+		return fmt.Errorf("invalid metric name %q", o.Name)
+	}
+	for k := range o.Labels {
+		if !validLabelName(k) {
+			return fmt.Errorf("invalid label name %q", k)
+		}
+		if reservedLabelName(k) {
+			return fmt.Errorf("reserved label name %q", k)
+		}
+	}
+	return nil
+}
+
+// validMetricName returns true if s matches [a-zA-Z_:][a-zA-Z0-9_:]*.
+func validMetricName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validLabelName returns true if s matches [a-zA-Z_][a-zA-Z0-9_]*.
+func validLabelName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// reservedLabelName returns true for the label names histograms and summaries
+// generate, le and quantile, which would collide, and for names starting with
+// __, which Prometheus keeps for itself.
+func reservedLabelName(s string) bool {
+	return s == "le" || s == "quantile" || strings.HasPrefix(s, "__")
+}
+
+// Policies for NaN and ±Inf values. A NaN can't be taken back out of a
+// counter or histogram sum, and neither can an Inf, so they're only ever
+// accepted as is by gauges.
+const (
+	nonFiniteReject     = "reject"      // reject them
+	nonFiniteClamp      = "clamp"       // clamp ±Inf to ±MaxFloat64, and reject NaN
+	nonFinitePassGauges = "pass-gauges" // accept them for gauges, and reject them otherwise
+)
+
+func validNonFinitePolicy(policy string) bool {
+	switch policy {
+	case nonFiniteReject, nonFiniteClamp, nonFinitePassGauges:
+		return true
+	default:
+		return false
+	}
+}
+
+// checkValue applies the policy for non-finite values to an observation of a
+// metric of type typ. Clamping replaces the value.
+func checkValue(policy, typ string, o *observation) error {
+	if o.Value == nil {
+		return nil
+	}
+	v := *o.Value
+	if !math.IsNaN(v) && !math.IsInf(v, 0) {
+		return nil
+	}
+	switch {
+	case policy == nonFinitePassGauges && typ == "gauge":
+		return nil
+	case policy == nonFiniteClamp && math.IsInf(v, 0):
+		clamped := math.Copysign(math.MaxFloat64, v)
+		o.Value = &clamped
+		return nil
+	}
+	return fmt.Errorf("non-finite value %v for %s", v, typ)
+}
+
+// Policies for negative values observed by counters, which would make them
+// go backwards.
+const (
+	negativeReject = "reject" // reject them
+	negativeClamp  = "clamp"  // observe them as zero
+)
+
+func validNegativePolicy(policy string) bool {
+	switch policy {
+	case negativeReject, negativeClamp:
+		return true
+	default:
+		return false
+	}
+}
+
+// checkCounter applies the policy for negative values to an observation of a
+// metric of type typ, and counts them as violations. Clamping replaces the
+// value.
+func (u *universe) checkCounter(typ string, o *observation) error {
+	if typ != "counter" || o.Value == nil || !(*o.Value < 0) {
+		return nil
+	}
+	u.violations.add(o.Name, "negative_counter")
+	if u.negative == negativeClamp {
+		var zero float64
+		o.Value = &zero
+		return nil
+	}
+	return fmt.Errorf("negative value %v for counter %s", *o.Value, o.Name)
+}
+
+// check validates an observation of the collection: any type, help,
+// buckets, coarse buckets, mode, alpha, and window it declares must match the
+// collection's,
+// and its value must be acceptable under the policies for non-finite and
+// negative values, which may replace it.
+func (u *universe) check(c *timeseriesCollection, o *observation) error {
+	switch {
+	case o.Type != "" && o.Type != c.typ:
+		u.violations.add(o.Name, "type_conflict")
+		return fmt.Errorf("conflicting type %s for %s, which is a %s", o.Type, o.Name, c.typ)
+	case o.Help != "" && o.Help != c.help:
+		u.violations.add(o.Name, "help_conflict")
+		return fmt.Errorf("conflicting help for %s, which is %q", o.Name, c.help)
+	case o.Buckets != nil && !c.sameBuckets(o.Buckets):
+		u.violations.add(o.Name, "bucket_conflict")
+		return fmt.Errorf("conflicting buckets for %s, which has %v", o.Name, c.buckets)
+	case o.Coarse != nil && !c.sameCoarse(o.Coarse):
+		u.violations.add(o.Name, "bucket_conflict")
+		return fmt.Errorf("conflicting coarse buckets for %s, which has %v", o.Name, c.coarse)
+	case o.Mode != "" && o.Mode != c.mode:
+		u.violations.add(o.Name, "mode_conflict")
+		return fmt.Errorf("conflicting mode %s for %s, which has mode %q", o.Mode, o.Name, c.mode)
+	case o.Alpha != 0 && o.Alpha != c.alpha:
+		u.violations.add(o.Name, "mode_conflict")
+		return fmt.Errorf("conflicting alpha %v for %s, which has alpha %v", o.Alpha, o.Name, c.alpha)
+	case o.Window != "" && !c.sameWindow(o.Window):
+		u.violations.add(o.Name, "window_conflict")
+		return fmt.Errorf("conflicting window %s for %s, which has window %s", o.Window, o.Name, c.window)
+	case o.Quantiles != nil && !c.sameQuantiles(o.Quantiles):
+		u.violations.add(o.Name, "quantile_conflict")
+		return fmt.Errorf("conflicting quantiles for %s, which has %v", o.Name, c.quantiles)
+	case o.AgeBuckets != 0 && o.AgeBuckets != c.ageBuckets:
+		u.violations.add(o.Name, "window_conflict")
+		return fmt.Errorf("conflicting age buckets %d for %s, which has %d", o.AgeBuckets, o.Name, c.ageBuckets)
+	case o.Op == "add" && c.mode == modeEWMA:
+		u.violations.add(o.Name, "bad_add")
+		return fmt.Errorf("%s is a moving average, which can't be added to", o.Name)
+	case o.Op == "merge" && c.typ != "histogram":
+		u.violations.add(o.Name, "bad_merge")
+		return fmt.Errorf("only histograms can be merged into, and %s is a %s", o.Name, c.typ)
+	case o.Op == "merge" && (o.Value == nil || len(o.Counts) != len(c.buckets)+1):
+		u.violations.add(o.Name, "bad_merge")
+		return fmt.Errorf("a merge into %s needs a value, which is the sum, and %d counts, one per bucket and +Inf", o.Name, len(c.buckets)+1)
+	}
+	if err := checkValue(u.nonfinite, c.typ, o); err != nil {
+		return err
+	}
+	return u.checkCounter(c.typ, o)
+}
+
+// checkRun applies check to each observation, and writes its error to the
+// same index of errs. It returns true if there weren't any.
+func (u *universe) checkRun(c *timeseriesCollection, obs []observation, errs []error) bool {
+	ok := true
+	for i := range obs {
+		if errs[i] = u.check(c, &obs[i]); errs[i] != nil {
+			ok = false
+		}
+	}
+	return ok
+}
+
+// violations counts observations rejected by validation, by metric name and
+// kind of violation, so that the clients responsible can be tracked down.
+type violations struct {
+	mtx    sync.Mutex
+	counts map[violation]uint64
+}
+
+type violation struct {
+	metric string
+	kind   string
+}
+
+func newViolations() *violations {
+	return &violations{counts: map[violation]uint64{}}
+}
+
+func (v *violations) add(metric, kind string) {
+	if v == nil {
+		return
+	}
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	v.counts[violation{metric, kind}]++
+}
+
+func (v *violations) renderTelemetry(w io.Writer) {
+	if v == nil {
+		return
+	}
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	keys := make([]violation, 0, len(v.counts))
+	for k := range v.counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].metric != keys[j].metric {
+			return keys[i].metric < keys[j].metric
+		}
+		return keys[i].kind < keys[j].kind
+	})
+	fmt.Fprintf(w, "# HELP prometheus_aggregator_violations_total Observations rejected by validation, by metric and kind of violation.\n")
+	fmt.Fprintf(w, "# TYPE prometheus_aggregator_violations_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(w, "prometheus_aggregator_violations_total%s %d\n", renderLabels(map[string]string{"metric": k.metric, "kind": k.kind}), v.counts[k])
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateNames(t *testing.T) {
+	for line, valid := range map[string]bool{
+		`foo_total{} 1`:                             true,
+		`foo:bar_total{code="200",_x1="y"} 1`:       true,
+		`_foo{} 1`:                                  true,
+		`{"name":"foo_total","labels":{"a_b":"1"}}`: true,
+		`1foo{} 1`:                                  false,
+		`foo-bar{} 1`:                               false,
+		`foo.bar{} 1`:                               false,
+		`föö{} 1`:                                   false,
+		`foo{code:x="200"} 1`:                       false,
+		`foo{1code="200"} 1`:                        false,
+		`foo{="200"} 1`:                             false,
+		`{"name":"foo bar","value":1}`:              false,
+		`{"name":"","value":1}`:                     false,
+		`{"name":"foo","labels":{"a-b":"1"},"value":1}`:      false,
+		`{"name":"foo","labels":{"a=\"1\",b":"2"}}`:          false,
+		`{"name":"foo","labels":{"ok":"any value, really"}}`: true,
+		`foo_seconds{le="1"} 1`:                              false,
+		`foo{quantile="0.5"} 1`:                              false,
+		`foo{__name__="bar"} 1`:                              false,
+		`{"name":"foo","labels":{"__meta":"x"},"value":1}`:   false,
+		`foo{lease="1",_quantile="2"} 1`:                     true,
+	} {
+		_, err := parseLine([]byte(line))
+		if want, have := valid, err == nil; want != have {
+			t.Errorf("%s: want valid %v, have %v (%v)", line, want, have, err)
+		}
+	}
+}
+
+func TestUniverseValidatesNames(t *testing.T) {
+	u, _ := newUniverse()
+	if _, err := u.declare(observation{Name: "foo-bar", Type: "counter", Help: "Help."}); err == nil {
+		t.Error("declare: want error, have none")
+	}
+	if err := u.observe(observation{Name: "foo.bar", Type: "counter", Help: "Help."}); err == nil {
+		t.Error("observe: want error, have none")
+	}
+	value := 1.0
+	if err := u.observe(observation{Name: "foo", Type: "counter", Help: "Help.", Labels: map[string]string{"a-b": "1"}, Value: &value}); err == nil {
+		t.Error("observe with bad label: want error, have none")
+	}
+	if want, have := 0, u.stats().Series; want != have {
+		t.Errorf("series: want %d, have %d", want, have)
+	}
+}
+
+func TestNonFiniteValues(t *testing.T) {
+	for _, testcase := range []struct {
+		policy string
+		line   string
+		want   string // rendered series, or empty if rejected
+	}{
+		{nonFinitePassGauges, `g{} NaN`, `g{} NaN`},
+		{nonFinitePassGauges, `g{} +Inf`, `g{} +Inf`},
+		{nonFinitePassGauges, `c_total{} NaN`, ``},
+		{nonFinitePassGauges, `c_total{} -Inf`, ``},
+		{nonFinitePassGauges, `c_total{} 1`, `c_total{} 1`},
+		{nonFiniteReject, `g{} NaN`, ``},
+		{nonFiniteReject, `g{} -Inf`, ``},
+		{nonFiniteClamp, `g{} NaN`, ``},
+		{nonFiniteClamp, `c_total{} NaN`, ``},
+		{nonFiniteClamp, `g{} +Inf`, `g{} 1.7976931348623157e+308`},
+		{nonFiniteClamp, `g{} -Inf`, `g{} -1.7976931348623157e+308`},
+	} {
+		// Both single and batched observations apply the policy.
+		for _, batch := range []bool{false, true} {
+			u, _ := newUniverse(makeObservations(t, []string{
+				`{"name":"g","type":"gauge","help":"G."}`,
+				`{"name":"c_total","type":"counter","help":"C."}`,
+			})...)
+			u.nonfinite = testcase.policy
+			o := makeObservations(t, []string{testcase.line})
+			var err error
+			if batch {
+				err = u.observeBatch([]observation{o[0], o[0]})
+				testcase.want = strings.Replace(testcase.want, "c_total{} 1", "c_total{} 2", 1)
+			} else {
+				err = u.observe(o[0])
+			}
+			if want, have := testcase.want == "", err != nil; want != have {
+				t.Errorf("%s %s: want rejected %v, have %v (%v)", testcase.policy, testcase.line, want, have, err)
+			}
+			if have := scrape(t, u); testcase.want != "" && !strings.Contains(have, testcase.want+"\n") {
+				t.Errorf("%s %s: want %s, have\n%s", testcase.policy, testcase.line, testcase.want, have)
+			}
+		}
+	}
+}
+
+func TestDeclarationConflicts(t *testing.T) {
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Total foos."}`,
+	})...)
+	for line, ok := range map[string]bool{
+		`{"name":"foo_total","type":"counter","help":"Total foos.","value":1}`: true,
+		`{"name":"foo_total","value":1}`:                                       true,
+		`{"name":"foo_total","type":"gauge","value":1}`:                        false,
+		`{"name":"foo_total","type":"gauge","help":"Total foos."}`:             false,
+		`{"name":"foo_total","help":"Foos, all of them.","value":1}`:           false,
+	} {
+		o := makeObservations(t, []string{line})
+		for _, err := range []error{u.observe(o[0]), errorAt(u.observeBatch([]observation{o[0], o[0]}), 0)} {
+			if want, have := ok, err == nil; want != have {
+				t.Errorf("%s: want ok %v, have %v (%v)", line, want, have, err)
+			}
+		}
+	}
+	if want, have := normalizeResponse(`
+		# HELP foo_total Total foos.
+		# TYPE foo_total counter
+		foo_total{} 6
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Errorf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+
+	var buf strings.Builder
+	u.violations.renderTelemetry(&buf)
+	if want, have := normalizeResponse(`
+		# HELP prometheus_aggregator_violations_total Observations rejected by validation, by metric and kind of violation.
+		# TYPE prometheus_aggregator_violations_total counter
+		prometheus_aggregator_violations_total{kind="help_conflict",metric="foo_total"} 3
+		prometheus_aggregator_violations_total{kind="type_conflict",metric="foo_total"} 6
+	`), normalizeResponse(buf.String()); want != have {
+		t.Errorf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestNegativeCounters(t *testing.T) {
+	for _, testcase := range []struct {
+		policy string
+		want   string
+		err    bool
+	}{
+		{negativeReject, `c_total{} 3`, true},
+		{negativeClamp, `c_total{} 3`, false},
+	} {
+		u, _ := newUniverse(makeObservations(t, []string{
+			`{"name":"c_total","type":"counter","help":"C."}`,
+			`{"name":"g","type":"gauge","help":"G."}`,
+		})...)
+		u.negative = testcase.policy
+		loadObservations(t, u, makeObservations(t, []string{
+			`c_total{} 3`,
+			`g{} -2`,
+		}))
+		o := makeObservations(t, []string{`c_total{} -1`})
+		if want, have := testcase.err, u.observe(o[0]) != nil; want != have {
+			t.Errorf("%s: want error %v, have %v", testcase.policy, want, have)
+		}
+		if want, have := testcase.err, errorAt(u.observeBatch([]observation{o[0], o[0]}), 1) != nil; want != have {
+			t.Errorf("%s: batch: want error %v, have %v", testcase.policy, want, have)
+		}
+		have := scrape(t, u)
+		for _, want := range []string{testcase.want, `g{} -2`} {
+			if !strings.Contains(have, want+"\n") {
+				t.Errorf("%s: want %s, have\n%s", testcase.policy, want, have)
+			}
+		}
+
+		var buf strings.Builder
+		u.violations.renderTelemetry(&buf)
+		if want := `prometheus_aggregator_violations_total{kind="negative_counter",metric="c_total"} 3`; !strings.Contains(buf.String(), want) {
+			t.Errorf("%s: want %s, have\n%s", testcase.policy, want, buf.String())
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// wal is a log of accepted observations, which is replayed at startup, on
+// top of the state file, so nothing observed since the state was last saved
+// is lost. It's an observer, which records what the next observer accepts,
+// so despite the name, it's written after observing, not ahead of it: only
+// accepted observations are worth replaying. It's synced before the batch is
+// done, though, so anything a client has been told was observed is in it.
+// The log is a directory of segments, each a file of JSON records, one per
+// line. Saving the state checkpoints the log: a new segment is started, and
+// once the state is safely saved, the old ones are removed. Whenever a
+// segment fills up, the state is saved, so the log stays small.
+type wal struct {
+	dir         string
+	segmentSize int64
+	next        observer
+	logger      log.Logger
+	full        chan struct{} // signaled when the current segment is full
+
+	// Observing and appending holds the read lock, and checkpoints take the
+	// write lock, so every observation is either in the saved state, or in
+	// a segment after it, and never both.
+	cmtx sync.RWMutex
+
+	mtx  sync.Mutex
+	seq  int // of the current segment
+	f    *os.File
+	size int64
+}
+
+// walRecord is an observation, as recorded in the log, and as replicated to
+// a peer. Its labels are recorded even if they're empty, since to a delete,
+// no labels and empty labels are different things, and its value is a
+// walValue, so a gauge set to NaN or ±Inf is recorded too.
+type walRecord struct {
+	observation
+	Labels map[string]string `json:"labels"`
+	Tenant string            `json:"tenant,omitempty"`
+	Value  *walValue         `json:"value,omitempty"`
+}
+
+// walValue is a value which JSON can represent, even if it's NaN or ±Inf,
+// as the strings "NaN", "+Inf", and "-Inf", which is how Prometheus writes
+// them, too.
+type walValue float64
+
+func (v walValue) MarshalJSON() ([]byte, error) {
+	switch f := float64(v); {
+	case math.IsNaN(f):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(f, 1):
+		return []byte(`"+Inf"`), nil
+	case math.IsInf(f, -1):
+		return []byte(`"-Inf"`), nil
+	default:
+		return json.Marshal(f)
+	}
+}
+
+func (v *walValue) UnmarshalJSON(p []byte) error {
+	var s string
+	if err := json.Unmarshal(p, &s); err != nil {
+		var f float64
+		if err := json.Unmarshal(p, &f); err != nil {
+			return err
+		}
+		*v = walValue(f)
+		return nil
+	}
+	switch s {
+	case "NaN":
+		*v = walValue(math.NaN())
+	case "+Inf":
+		*v = walValue(math.Inf(1))
+	case "-Inf":
+		*v = walValue(math.Inf(-1))
+	default:
+		return fmt.Errorf("invalid value %q", s)
+	}
+	return nil
+}
+
+// openWAL opens the log in the directory, creating it if necessary, and
+// starts a new segment, after any which are already there.
+func openWAL(dir string, segmentSize int64, next observer, logger log.Logger) (*wal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	w := &wal{dir: dir, segmentSize: segmentSize, next: next, logger: logger, full: make(chan struct{}, 1)}
+	segs, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segs) > 0 {
+		w.seq = segs[len(segs)-1]
+	}
+	if err := w.rotate(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *wal) segmentName(seq int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("wal-%08d.log", seq))
+}
+
+// segments returns the sequence numbers of the segments in the directory,
+// in order.
+func (w *wal) segments() ([]int, error) {
+	entries, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segs []int
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, "wal-") || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "wal-"), ".log"))
+		if err != nil {
+			continue
+		}
+		segs = append(segs, seq)
+	}
+	sort.Ints(segs)
+	return segs, nil
+}
+
+// rotate closes the current segment, if any, and starts the next one.
+func (w *wal) rotate() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	f, err := os.OpenFile(w.segmentName(w.seq+1), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if w.f != nil {
+		w.f.Close()
+	}
+	w.seq, w.f, w.size = w.seq+1, f, 0
+	return nil
+}
+
+func (w *wal) observe(o observation) error {
+	return w.observeBatch([]observation{o})
+}
+
+// observeBatch observes the batch with the next observer, and appends the
+// observations it accepted to the log, and syncs it, before returning.
+func (w *wal) observeBatch(obs []observation) error {
+	w.cmtx.RLock()
+	defer w.cmtx.RUnlock()
+	err := w.next.observeBatch(obs)
+	if aerr := w.append(obs, err); aerr != nil {
+		level.Error(w.logger).Log("during", "wal append", "err", aerr)
+	}
+	return err
+}
+
+// encodeRecords appends a record to buf for each observation in the batch
+// which wasn't rejected, per err, and returns how many. If an observation
+// can't be encoded, it's skipped, and the error is returned, after the rest
+// are encoded.
+func encodeRecords(buf *bytes.Buffer, obs []observation, err error) (n int, eerr error) {
+	enc := json.NewEncoder(buf)
+	for j, o := range obs {
+		if errorAt(err, j) != nil {
+			continue
+		}
+		rec := walRecord{observation: o, Labels: o.Labels, Tenant: o.Tenant}
+		if o.Value != nil {
+			v := walValue(*o.Value)
+			rec.Value = &v
+		}
+		if err := enc.Encode(rec); err != nil {
+			eerr = err
+			continue
+		}
+		n++
+	}
+	return n, eerr
+}
+
+// decodeRecord parses a line written by encodeRecords.
+func decodeRecord(line []byte) (observation, error) {
+	var rec walRecord
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return observation{}, err
+	}
+	rec.observation.Labels, rec.observation.Tenant = rec.Labels, rec.Tenant
+	if rec.Value != nil {
+		v := float64(*rec.Value)
+		rec.observation.Value = &v
+	}
+	return rec.observation, nil
+}
+
+func (w *wal) append(obs []observation, err error) error {
+	var buf bytes.Buffer
+	_, eerr := encodeRecords(&buf, obs, err)
+	if buf.Len() == 0 {
+		return eerr
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if _, err := w.f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	w.size += int64(buf.Len())
+	if w.size >= w.segmentSize {
+		select {
+		case w.full <- struct{}{}:
+		default:
+		}
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	return eerr
+}
+
+// checkpoint starts a new segment, and calls save, which should copy the
+// state, with no observations in flight. It returns the first segment which
+// isn't in the copy. A nil wal just calls save.
+func (w *wal) checkpoint(save func()) (next int, err error) {
+	if w == nil {
+		save()
+		return 0, nil
+	}
+	w.cmtx.Lock()
+	defer w.cmtx.Unlock()
+	if err := w.rotate(); err != nil {
+		return 0, err
+	}
+	save()
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.seq, nil
+}
+
+// truncate removes the segments before next, once they're in the saved
+// state.
+func (w *wal) truncate(next int) {
+	if w == nil {
+		return
+	}
+	segs, err := w.segments()
+	if err != nil {
+		level.Error(w.logger).Log("during", "wal truncate", "err", err)
+		return
+	}
+	for _, seq := range segs {
+		if seq >= next {
+			break
+		}
+		if err := os.Remove(w.segmentName(seq)); err != nil {
+			level.Error(w.logger).Log("during", "wal truncate", "err", err)
+		}
+	}
+}
+
+// replay observes the records in the segments from from up to, but not
+// including, the current one, with the next observer. A record which can't
+// be parsed, e.g. the last one, cut short by a crash, is skipped. Records
+// which are rejected, e.g. because their metric is no longer declared, are
+// skipped, too. It returns the number of records observed.
+func (w *wal) replay(from int) (replayed int, err error) {
+	if w == nil {
+		return 0, nil
+	}
+	segs, err := w.segments()
+	if err != nil {
+		return 0, err
+	}
+	for _, seq := range segs {
+		if seq < from || seq >= w.seq {
+			continue
+		}
+		n, err := w.replaySegment(seq)
+		replayed += n
+		if err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, nil
+}
+
+func (w *wal) replaySegment(seq int) (replayed int, err error) {
+	f, err := os.Open(w.segmentName(seq))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	for lineno := 1; ; lineno++ {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			o, derr := decodeRecord(line)
+			if derr != nil {
+				level.Warn(w.logger).Log("during", "wal replay", "segment", seq, "line", lineno, "err", derr)
+			} else if w.next.observe(o) == nil {
+				replayed++
+			}
+		}
+		if err != nil {
+			break // io.EOF, or a read error, which is as far as we can go
+		}
+	}
+	return replayed, nil
+}
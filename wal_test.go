@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-aggregator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename, walDir := filepath.Join(dir, "state.json"), filepath.Join(dir, "wal")
+
+	decls := []string{
+		`{"name":"foo_total","type":"counter","help":"Foo."}`,
+		`{"name":"bar","type":"gauge","help":"Bar."}`,
+	}
+	start := func() (*universe, *wal, *stateFile) {
+		u, _ := newUniverse(makeObservations(t, decls)...)
+		w, err := openWAL(walDir, 1<<20, u, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u, w, &stateFile{filename: filename, u: u, wal: w, logger: log.NewNopLogger()}
+	}
+	observe := func(w *wal, lines ...string) {
+		for _, line := range lines {
+			o, err := parseLine([]byte(line))
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.observe(o)
+		}
+	}
+
+	// Without a state file, everything is in the log.
+	u, w, _ := start()
+	observe(w,
+		`foo_total{code="200"} 3`,
+		`foo_total{} 1`,
+		`{"name":"foo_total","labels":{},"op":"delete"}`,
+		`bar{} 5`,
+		`nope{} 1`,
+	)
+	u2, w2, s2 := start() // after a crash
+	restored, replayed, err := s2.restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 0, restored; want != have {
+		t.Errorf("restored: want %d, have %d", want, have)
+	}
+	if want, have := 4, replayed; want != have {
+		t.Errorf("replayed: want %d, have %d", want, have) // nope was rejected, and not logged
+	}
+	if want, have := scrape(t, u), scrape(t, u2); want != have {
+		t.Errorf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+
+	// Saving the state removes what it includes from the log, and the rest
+	// is replayed on top of it.
+	if err := s2.save(); err != nil {
+		t.Fatal(err)
+	}
+	if segs, _ := w2.segments(); len(segs) != 1 {
+		t.Errorf("after a save, want 1 segment, have %v", segs)
+	}
+	observe(w2, `foo_total{code="200"} 1`, `foo_total{code="500"} 2`)
+	u3, w3, s3 := start()
+	restored, replayed, err = s3.restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 2, restored; want != have {
+		t.Errorf("after a save, restored: want %d, have %d", want, have)
+	}
+	if want, have := 2, replayed; want != have {
+		t.Errorf("after a save, replayed: want %d, have %d", want, have)
+	}
+	if want, have := scrape(t, u2), scrape(t, u3); want != have {
+		t.Errorf("after a save:\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+	if want, have := `foo_total{code="200"} 4`, scrape(t, u3); !strings.Contains(have, want) {
+		t.Errorf("want %s, have\n%s", want, have)
+	}
+
+	// A record cut short by a crash is skipped.
+	f, err := os.OpenFile(w3.segmentName(w3.seq), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"name":"foo_total","labels":{"code":"2`)
+	f.Close()
+	_, _, s4 := start()
+	if _, replayed, err = s4.restore(); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 2, replayed; want != have {
+		t.Errorf("after a cut short record, replayed: want %d, have %d", want, have)
+	}
+}
+
+func TestWALRecordValues(t *testing.T) {
+	var buf bytes.Buffer
+	var obs []observation
+	for _, f := range []float64{1.5, math.NaN(), math.Inf(1), math.Inf(-1)} {
+		f := f
+		obs = append(obs, observation{Name: "bar", Labels: map[string]string{}, Value: &f})
+	}
+	if n, err := encodeRecords(&buf, obs, nil); err != nil || n != len(obs) {
+		t.Fatalf("encoded %d of %d: %v", n, len(obs), err)
+	}
+	for j, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		o, err := decodeRecord(line)
+		if err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		if want, have := *obs[j].Value, *o.Value; math.Float64bits(want) != math.Float64bits(have) {
+			t.Errorf("%s: want %v, have %v", line, want, have)
+		}
+	}
+}
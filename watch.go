@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// watchedFiles loads something from a set of files, like a certificate and
+// its key, or a list of tokens, and loads it again when any of them changes,
+// so secrets can be rotated without a restart, which would lose every
+// aggregated value. Changes are noticed by modification time, whenever check
+// is called, or forced with reload, e.g. on SIGHUP. A nil watchedFiles
+// watches nothing.
+type watchedFiles struct {
+	filenames []string
+	load      func() error
+
+	mtx     sync.Mutex
+	modTime time.Time // of the most recently modified file, when loaded
+}
+
+// watchFiles loads the files for the first time.
+func watchFiles(load func() error, filenames ...string) (*watchedFiles, error) {
+	w := &watchedFiles{filenames: filenames, load: load}
+	if err := w.reload(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// check loads the files again if they've changed since they were last
+// loaded. If that fails, e.g. because only one of a certificate and its key
+// has been replaced so far, whatever was loaded before is kept, and loading
+// is tried again next time.
+func (w *watchedFiles) check() {
+	if w == nil {
+		return
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if modTime, err := w.stat(); err == nil && !modTime.Equal(w.modTime) {
+		w.loadAt(modTime) // errors keep the previous load
+	}
+}
+
+// reload loads the files again, whether they've changed or not. If that
+// fails, whatever was loaded before is kept.
+func (w *watchedFiles) reload() error {
+	if w == nil {
+		return nil
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	modTime, err := w.stat()
+	if err != nil {
+		return err
+	}
+	return w.loadAt(modTime)
+}
+
+func (w *watchedFiles) loadAt(modTime time.Time) error {
+	if err := w.load(); err != nil {
+		return err
+	}
+	w.modTime = modTime
+	return nil
+}
+
+func (w *watchedFiles) stat() (time.Time, error) {
+	var modTime time.Time
+	for _, filename := range w.filenames {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	return modTime, nil
+}
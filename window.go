@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// parseWindow parses the window of a declaration, which only histograms and
+// summaries can have. An empty window is 0, i.e. the histogram is never
+// reset, or for a summary, the default window.
+func parseWindow(typ, window string) (time.Duration, error) {
+	switch {
+	case window == "" && typ == "summary":
+		return defaultSummaryWindow, nil
+	case window == "":
+		return 0, nil
+	case typ != "histogram" && typ != "summary":
+		return 0, fmt.Errorf("window %s is only for histograms and summaries, not %ss", window, typ)
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil {
+		return 0, fmt.Errorf("invalid window %q", window)
+	}
+	if d < time.Second {
+		return 0, fmt.Errorf("window %s is shorter than a second", window)
+	}
+	return d, nil
+}
+
+// sameWindow returns true if the window is the collection's.
+func (c *timeseriesCollection) sameWindow(window string) bool {
+	d, err := parseWindow(c.typ, window)
+	return err == nil && d == c.window
+}
+
+// windowedHistogram is a histogram which starts again every window, aligned
+// to the clock, e.g. on the minute for a window of 1m. Observations go into
+// the current window, and what's rendered and dumped is the last complete
+// one, so every scrape during a window sees the same counts.
+type windowedHistogram struct {
+	window time.Duration
+	now    func() time.Time
+
+	mtx   sync.Mutex
+	start time.Time  // of the current window
+	cur   *histogram // observed in the current window
+	last  *histogram // observed in the window before it
+	touch bool       // ever observed, so rendered even when last is empty
+}
+
+func newWindowedHistogram(o observation, window time.Duration, now func() time.Time) (*windowedHistogram, error) {
+	h, err := newHistogram(o)
+	if err != nil {
+		return nil, err
+	}
+	w := &windowedHistogram{window: window, now: now, cur: h, last: h.empty()}
+	w.start = now().Truncate(window)
+	return w, nil
+}
+
+// empty returns a histogram of the same series, with nothing observed.
+func (h *histogram) empty() *histogram {
+	buckets := make([]bucket, len(h.buckets))
+	for i, b := range h.buckets {
+		buckets[i] = bucket{max: b.max}
+	}
+	return &histogram{k: h.k, n: h.n, h: h.h, labels: h.labels, buckets: buckets}
+}
+
+// roll moves on to the current window, if it's a new one. The caller must
+// hold the mutex.
+func (w *windowedHistogram) roll() {
+	start := w.now().Truncate(w.window)
+	switch {
+	case !start.After(w.start):
+		return
+	case start.Equal(w.start.Add(w.window)):
+		w.last = w.cur
+	default:
+		w.last = w.cur.empty() // nothing was observed in the window before
+	}
+	w.cur, w.start = w.cur.empty(), start
+}
+
+// histograms returns the current and last histograms, after rolling.
+func (w *windowedHistogram) histograms() (cur, last *histogram) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.roll()
+	return w.cur, w.last
+}
+
+func (w *windowedHistogram) metricName() metricName { return w.cur.metricName() }
+
+func (w *windowedHistogram) timeseriesKey() timeseriesKey { return w.cur.timeseriesKey() }
+
+func (w *windowedHistogram) labelSet() labelPairs { return w.cur.labelSet() }
+
+func (w *windowedHistogram) observe(o observation) error {
+	if o.Value == nil {
+		return nil // declaration
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.roll()
+	w.touch = true
+	return w.cur.observe(o)
+}
+
+func (w *windowedHistogram) touched() bool {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.touch
+}
+
+func (w *windowedHistogram) renderText(precision int) string {
+	_, last := w.histograms()
+	return last.renderText(precision)
+}
+
+func (w *windowedHistogram) dump() seriesDump {
+	_, last := w.histograms()
+	return last.dump()
+}
+
+// restore sets the last complete window to the dumped one.
+func (w *windowedHistogram) restore(sd seriesDump) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.roll()
+	last := w.cur.empty()
+	if err := last.restore(sd); err != nil {
+		return err
+	}
+	w.last, w.touch = last, true
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWindowedHistogram(t *testing.T) {
+	u, _ := newUniverse()
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	u.now = func() time.Time { return now }
+	loadObservations(t, u, makeObservations(t, []string{
+		`{"name":"req_seconds","type":"histogram","help":"Request duration.","buckets":[1],"window":"1m"}`,
+		`req_seconds{} 0.5`,
+		`req_seconds{} 2`,
+	}))
+
+	samples := func() string {
+		var lines []string
+		for _, line := range strings.Split(scrape(t, u), "\n") {
+			if strings.HasPrefix(line, "req_seconds_") {
+				lines = append(lines, line)
+			}
+		}
+		return strings.Join(lines, "\n")
+	}
+	for _, testcase := range []struct {
+		name  string
+		at    time.Time
+		lines []string
+		want  string
+	}{
+		{
+			name: "first window, incomplete",
+			at:   now.Add(30 * time.Second),
+			want: "req_seconds_bucket{le=\"1\"} 0\nreq_seconds_bucket{le=\"+Inf\"} 0\nreq_seconds_sum{} 0\nreq_seconds_count{} 0",
+		},
+		{
+			name:  "second window",
+			at:    time.Date(2020, 1, 2, 3, 5, 0, 0, time.UTC),
+			lines: []string{`req_seconds{} 0.25`},
+			want:  "req_seconds_bucket{le=\"1\"} 1\nreq_seconds_bucket{le=\"+Inf\"} 2\nreq_seconds_sum{} 2.5\nreq_seconds_count{} 2",
+		},
+		{
+			name: "third window",
+			at:   time.Date(2020, 1, 2, 3, 6, 59, 0, time.UTC),
+			want: "req_seconds_bucket{le=\"1\"} 1\nreq_seconds_bucket{le=\"+Inf\"} 1\nreq_seconds_sum{} 0.25\nreq_seconds_count{} 1",
+		},
+		{
+			name: "after a quiet window",
+			at:   time.Date(2020, 1, 2, 3, 8, 0, 0, time.UTC),
+			want: "req_seconds_bucket{le=\"1\"} 0\nreq_seconds_bucket{le=\"+Inf\"} 0\nreq_seconds_sum{} 0\nreq_seconds_count{} 0",
+		},
+	} {
+		now = testcase.at
+		loadObservations(t, u, makeObservations(t, testcase.lines))
+		if want, have := testcase.want, samples(); want != have {
+			t.Errorf("%s: want\n%s\nhave\n%s", testcase.name, want, have)
+		}
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	for _, testcase := range []struct {
+		typ, window string
+		want        time.Duration
+		valid       bool
+	}{
+		{"histogram", "", 0, true},
+		{"histogram", "5m", 5 * time.Minute, true},
+		{"histogram", "10ms", 0, false},
+		{"histogram", "soon", 0, false},
+		{"gauge", "", 0, true},
+		{"gauge", "5m", 0, false},
+		{"summary", "", 10 * time.Minute, true},
+		{"summary", "1m", time.Minute, true},
+	} {
+		have, err := parseWindow(testcase.typ, testcase.window)
+		if want, have := testcase.valid, err == nil; want != have {
+			t.Errorf("%s %q: want valid %v, have %v (%v)", testcase.typ, testcase.window, want, have, err)
+		}
+		if want := testcase.want; want != have {
+			t.Errorf("%s %q: want %s, have %s", testcase.typ, testcase.window, want, have)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// lineJob is a line read from a client, waiting to be handled.
+type lineJob struct {
+	client   *client
+	line     []byte
+	buf      *[]byte // from the linePool, if line is a queued copy
+	lineno   int
+	err      error // from reading the line
+	enqueued time.Time
+}
+
+// newLineQueues returns n bounded queues, each with room for depth lines.
+func newLineQueues(n, depth int) []chan lineJob {
+	queues := make([]chan lineJob, n)
+	for i := range queues {
+		queues[i] = make(chan lineJob, depth)
+	}
+	return queues
+}
+
+// Overflow policies, for when a worker's queue is full.
+const (
+	overflowBlock      = "block"       // wait, which pushes back on the client
+	overflowDropNewest = "drop-newest" // drop the line being queued
+	overflowDropOldest = "drop-oldest" // drop the line at the head of the queue
+)
+
+func validOverflowPolicy(policy string) bool {
+	switch policy {
+	case overflowBlock, overflowDropNewest, overflowDropOldest:
+		return true
+	default:
+		return false
+	}
+}
+
+// dispatch hands each line to the worker responsible for its client, so
+// that socket readers aren't stalled by parsing and observing. Lines are
+// copied, so the caller may reuse them. If a worker's queue is full, the
+// overflow policy decides what happens. Without workers, the lines are
+// handled inline, as a batch.
+func (i *ingester) dispatch(jobs []lineJob) {
+	if len(jobs) == 0 {
+		return
+	}
+	if i.queues == nil {
+		i.handleBatch(jobs)
+		return
+	}
+	for _, job := range jobs {
+		job.buf = copyLine(job.line)
+		job.line = *job.buf
+		job.enqueued = time.Now()
+		i.enqueue(job)
+	}
+}
+
+func (i *ingester) enqueue(job lineJob) {
+	q := i.queues[queueIndex(job.client.addr, len(i.queues))]
+	job.client.pending.Add(1)
+	i.drainer.queue()
+	i.stats.enqueue()
+	switch i.overflow {
+	case overflowDropNewest:
+		select {
+		case q <- job:
+		default:
+			i.drop(job)
+		}
+	case overflowDropOldest:
+		for {
+			select {
+			case q <- job:
+				return
+			default:
+			}
+			select {
+			case old := <-q:
+				i.drop(old)
+			default:
+			}
+		}
+	default:
+		q <- job
+	}
+}
+
+// drop discards a queued line.
+func (i *ingester) drop(job lineJob) {
+	i.stats.dequeue(true)
+	putLine(job.buf)
+	job.client.pending.Done()
+	i.drainer.dequeue()
+	if i.errlog.allow("ingest-queue") {
+		level.Warn(i.logger).Log("line", "dropped", "remote_addr", job.client.addr, "overflow", i.overflow)
+	}
+}
+
+// queueIndex picks the queue for a client address. Each address always maps
+// to the same queue, which keeps its lines in order.
+func queueIndex(addr string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(addr))
+	return int(h.Sum32() % uint32(n))
+}
+
+// work runs a worker for each queue until the context is canceled.
+func (i *ingester) work(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, q := range i.queues {
+		wg.Add(1)
+		go func(q <-chan lineJob) {
+			defer wg.Done()
+			batch := make([]lineJob, 0, i.batchSize())
+			for {
+				select {
+				case job := <-q:
+					batch = append(batch[:0], job)
+				case <-ctx.Done():
+					return
+				}
+				// Whatever else is already queued goes in the same batch.
+			fill:
+				for len(batch) < cap(batch) {
+					select {
+					case job := <-q:
+						batch = append(batch, job)
+					default:
+						break fill
+					}
+				}
+				for _, job := range batch {
+					i.stats.dequeue(false)
+					i.stats.observe("queue", time.Since(job.enqueued))
+				}
+				i.handleBatch(batch)
+				for _, job := range batch {
+					putLine(job.buf)
+					job.client.pending.Done()
+					i.drainer.dequeue()
+				}
+			}
+		}(q)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
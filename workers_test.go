@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestWorkers(t *testing.T) {
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo","type":"gauge","help":"Current foo."}`,
+	})...)
+	i := &ingester{observer: u, activity: newActivity(0), logger: log.NewNopLogger(), queues: newLineQueues(4, 1)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- i.work(ctx) }()
+
+	// Gauges are set, so the final value is only right if each client's
+	// lines are handled in order.
+	var wg sync.WaitGroup
+	for c := 0; c < 8; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			src, w := io.Pipe()
+			go func() {
+				for n := 1; n <= 100; n++ {
+					fmt.Fprintf(w, "foo{client=\"%d\"} %d\n", c, n)
+				}
+				w.Close()
+			}()
+			i.handleConn(src, fmt.Sprintf("client-%d", c))
+		}(c)
+	}
+	wg.Wait()
+	cancel()
+	<-done
+
+	d := u.dump()
+	if want, have := 8, len(d.Metrics[0].Series); want != have {
+		t.Fatalf("series: want %d, have %d", want, have)
+	}
+	for _, s := range d.Metrics[0].Series {
+		if want, have := 100.0, *s.Value; want != have {
+			t.Errorf("%v: want %v, have %v", s.Labels, want, have)
+		}
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	for policy, want := range map[string]string{
+		overflowDropNewest: "line 1",
+		overflowDropOldest: "line 3",
+	} {
+		t.Run(policy, func(t *testing.T) {
+			stats := newPipelineStats()
+			i := &ingester{stats: stats, overflow: policy, logger: log.NewNopLogger(), queues: newLineQueues(1, 1)}
+			c := &client{addr: "test", logger: log.NewNopLogger()}
+			for n := 1; n <= 3; n++ {
+				i.dispatch([]lineJob{{client: c, line: []byte(fmt.Sprintf("line %d", n)), lineno: n}})
+			}
+			if have := string((<-i.queues[0]).line); want != have {
+				t.Errorf("queued: want %q, have %q", want, have)
+			}
+			if want, have := uint64(2), stats.dropped; want != have {
+				t.Errorf("dropped: want %d, have %d", want, have)
+			}
+		})
+	}
+}
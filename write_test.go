@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/go-kit/kit/log"
@@ -23,7 +28,8 @@ func TestHandleConn(t *testing.T) {
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
-		handleConn(src, dst, strict, logger)
+		i := &ingester{observer: dst, activity: newActivity(0), strict: strict, logger: logger}
+		i.handleConn(src, "test")
 	}()
 
 	// Make writes to the input of the pipe.
@@ -41,8 +47,165 @@ func TestHandleConn(t *testing.T) {
 	if want, have := normalizeResponse(`
 		# HELP foo Total foos.
 		# TYPE foo counter
-		foo{code="412"} 7.000000
+		foo{code="412"} 7
 	`), normalizeResponse(rec.Body.String()); want != have {
 		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
 	}
 }
+
+func TestStrictErrorReply(t *testing.T) {
+	dst, _ := newUniverse()
+	server, client := net.Pipe()
+	i := &ingester{observer: dst, activity: newActivity(0), strict: true, logger: log.NewNopLogger()}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		i.handleConn(server, "test")
+	}()
+
+	go func() {
+		fmt.Fprintln(client, `{"name":"foo","type":"counter","help":"Total foos.","value":1}`)
+		fmt.Fprintln(client, `foo 2`)
+	}()
+
+	reply, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response struct {
+		Error string `json:"error"`
+		Line  int    `json:"line"`
+	}
+	if err := json.Unmarshal([]byte(reply), &response); err != nil {
+		t.Fatalf("%q: %v", reply, err)
+	}
+	if want, have := 2, response.Line; want != have {
+		t.Errorf("line: want %d, have %d", want, have)
+	}
+	if want, have := "parse error", response.Error; !strings.HasPrefix(have, want) {
+		t.Errorf("error: want prefix %q, have %q", want, have)
+	}
+	<-done
+}
+
+func TestLongLines(t *testing.T) {
+	dst, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo","type":"counter","help":"Total foos."}`,
+	})...)
+	a := newActivity(0)
+	i := &ingester{observer: dst, activity: a, maxLine: 32, logger: log.NewNopLogger()}
+	i.handleConn(ioutil.NopCloser(strings.NewReader(strings.Join([]string{
+		`foo{code="200"} 1`,
+		`foo{code="` + strings.Repeat("x", 100) + `"} 1`,
+		"foo{code=\"200\"} 2\r",
+		`foo{code="404"} 4`,
+	}, "\n"))), "test")
+
+	if want, have := normalizeResponse(`
+		# HELP foo Total foos.
+		# TYPE foo counter
+		foo{code="200"} 3
+		foo{code="404"} 4
+	`), normalizeResponse(scrape(t, dst)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+	errs := a.recentErrors()
+	if want, have := 1, len(errs); want != have {
+		t.Fatalf("errors: want %d, have %d", want, have)
+	}
+	if want, have := "line too long (over 32 bytes)", errs[0].Err; want != have {
+		t.Errorf("error: want %q, have %q", want, have)
+	}
+}
+
+func TestLabelsDirective(t *testing.T) {
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Foo."}`,
+	})...)
+	i := &ingester{observer: u, activity: newActivity(0), logger: log.NewNopLogger()}
+	for _, conn := range []string{
+		"LABELS instance=\"web-3\",dc=\"ams1\"\nfoo_total{} 1\nfoo_total{dc=\"fra1\"} 2\n{\"name\":\"foo_total\",\"value\":4}\n",
+		"LABELS le=\"1\"\nfoo_total{} 10\n",
+		"LABELS instance=web-3\nfoo_total{} 20\n",
+		"foo_total{} 8\nLABELS instance=\"web-4\"\n",
+	} {
+		i.handleConn(ioutil.NopCloser(strings.NewReader(conn)), "test")
+	}
+	if want, have := normalizeResponse(`
+		# HELP foo_total Foo.
+		# TYPE foo_total counter
+		foo_total{dc="ams1",instance="web-3"} 5
+		foo_total{dc="fra1",instance="web-3"} 2
+		foo_total{} 8
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+
+	// A delete without labels deletes every series with the directive's.
+	i.handleConn(ioutil.NopCloser(strings.NewReader("LABELS instance=\"web-3\"\n{\"name\":\"foo_total\",\"op\":\"delete\"}\n")), "test")
+	if want, have := normalizeResponse(`
+		# HELP foo_total Foo.
+		# TYPE foo_total counter
+		foo_total{} 8
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Errorf("after delete:\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestEchoDirective(t *testing.T) {
+	u, _ := newUniverse()
+	server, client := net.Pipe()
+	i := &ingester{observer: u, activity: newActivity(0), logger: log.NewNopLogger()}
+	go i.handleConn(server, "test")
+	go func() {
+		fmt.Fprint(client, strings.Join([]string{
+			`ECHO`,
+			`LABELS dc="ams1"`,
+			`{"name":"foo_total","type":"counter","help":"Foo."}`,
+			`foo_total{code="200"} 1`,
+			`foo_total 2`,
+		}, "\n")+"\n")
+	}()
+
+	var replies []string
+	s := bufio.NewScanner(client)
+	for len(replies) < 3 && s.Scan() {
+		replies = append(replies, s.Text())
+	}
+	client.Close()
+	if want, have := strings.Join([]string{
+		`{"line":3,"observation":{"name":"foo_total","type":"counter","help":"Foo.","labels":{"dc":"ams1"}}}`,
+		`{"line":4,"observation":{"name":"foo_total","type":"","help":"","labels":{"code":"200","dc":"ams1"},"value":1}}`,
+		`{"line":5,"error":"parse error: bad format: couldn't find opening brace"}`,
+	}, "\n"), strings.Join(replies, "\n"); want != have {
+		t.Errorf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+}
+
+func TestConstLabels(t *testing.T) {
+	u, _ := newUniverse(makeObservations(t, []string{
+		`{"name":"foo_total","type":"counter","help":"Foo."}`,
+	})...)
+	i := &ingester{observer: u, activity: newActivity(0), logger: log.NewNopLogger(), labels: constLabels{"region": "eu"}}
+	i.handleConn(ioutil.NopCloser(strings.NewReader("foo_total{} 1\nfoo_total{code=\"200\",region=\"us\"} 2\n")), "test")
+	if want, have := normalizeResponse(`
+		# HELP foo_total Foo.
+		# TYPE foo_total counter
+		foo_total{code="200",region="eu"} 2
+		foo_total{region="eu"} 1
+	`), normalizeResponse(scrape(t, u)); want != have {
+		t.Fatalf("\n---WANT---\n%s\n\n---HAVE---\n%s\n", want, have)
+	}
+
+	// Deletes with labels get the constant labels, too, and deletes without
+	// any still delete every series.
+	i.handleConn(ioutil.NopCloser(strings.NewReader(`{"name":"foo_total","op":"delete","labels":{"code":"200"}}`+"\n")), "test")
+	if want, have := "foo_total{region=\"eu\"} 1\n", scrape(t, u); !strings.Contains(have, want) || strings.Contains(have, "code=") {
+		t.Errorf("after delete: want %s, have\n%s", want, have)
+	}
+	i.handleConn(ioutil.NopCloser(strings.NewReader(`{"name":"foo_total","op":"delete"}`+"\n")), "test")
+	if have := scrape(t, u); strings.Contains(have, "foo_total{") {
+		t.Errorf("after delete all: have\n%s", have)
+	}
+}